@@ -0,0 +1,71 @@
+// Package auth authenticates the HTTP API requests using static bearer
+// tokens, HMAC-signed requests or JSON Web Tokens.
+//
+// Every authenticator returns a nil principal and a nil error if the
+// request carries no credentials it recognizes, so several authenticators
+// may be tried in turn.
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/evgeny08/collection-key/types"
+)
+
+// Identity is a principal description shared by the credential files.
+type Identity struct {
+	Subject string       `json:"subject"`
+	Tenant  string       `json:"tenant,omitempty"`
+	Roles   []types.Role `json:"roles"`
+}
+
+// principal validates the identity and returns its principal.
+func (id *Identity) principal() (*types.Principal, error) {
+	if id.Subject == "" {
+		return nil, fmt.Errorf("empty subject")
+	}
+	if err := validateRoles(id.Roles); err != nil {
+		return nil, fmt.Errorf("subject %q: %v", id.Subject, err)
+	}
+	return &types.Principal{Subject: id.Subject, Tenant: id.Tenant, Roles: id.Roles}, nil
+}
+
+// validateRoles checks the roles are known and not empty.
+func validateRoles(roles []types.Role) error {
+	if len(roles) == 0 {
+		return fmt.Errorf("no roles")
+	}
+	for _, role := range roles {
+		if !types.ValidRole(role) {
+			return fmt.Errorf("unknown role %q", role)
+		}
+	}
+	return nil
+}
+
+// bearerToken returns the bearer token of the request or an empty string.
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	h := r.Header.Get("Authorization")
+	if len(h) < len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(h[len(prefix):])
+}
+
+// readJSONFile decodes the JSON file into v.
+func readJSONFile(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode %s: %v", path, err)
+	}
+	return nil
+}
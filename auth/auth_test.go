@@ -0,0 +1,447 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evgeny08/collection-key/types"
+)
+
+func TestTokens(t *testing.T) {
+	tokens, err := NewTokens([]Token{
+		{Token: "0123456789abcdef", Identity: Identity{Subject: "ops", Roles: []types.Role{types.RoleAdmin}}},
+		{Token: "fedcba9876543210", Identity: Identity{Subject: "shop", Tenant: "t1", Roles: []types.Role{types.RoleIssuer}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name   string
+		header string
+		want   *types.Principal
+	}{
+		{
+			name:   "admin",
+			header: "Bearer 0123456789abcdef",
+			want:   &types.Principal{Subject: "ops", Roles: []types.Role{types.RoleAdmin}},
+		},
+		{
+			name:   "tenant",
+			header: "bearer fedcba9876543210",
+			want:   &types.Principal{Subject: "shop", Tenant: "t1", Roles: []types.Role{types.RoleIssuer}},
+		},
+		{
+			name:   "unknown token",
+			header: "Bearer 0123456789abcdeX",
+		},
+		{
+			name: "no token",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/v1/keys", nil)
+			if tc.header != "" {
+				r.Header.Set("Authorization", tc.header)
+			}
+			p, err := tokens.Authenticate(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(p, tc.want) {
+				t.Fatalf("got principal %+v want %+v", p, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewTokensInvalid(t *testing.T) {
+	testCases := []struct {
+		name   string
+		tokens []Token
+	}{
+		{
+			name:   "short token",
+			tokens: []Token{{Token: "short", Identity: Identity{Subject: "a", Roles: []types.Role{types.RoleAdmin}}}},
+		},
+		{
+			name:   "no roles",
+			tokens: []Token{{Token: "0123456789abcdef", Identity: Identity{Subject: "a"}}},
+		},
+		{
+			name:   "unknown role",
+			tokens: []Token{{Token: "0123456789abcdef", Identity: Identity{Subject: "a", Roles: []types.Role{"root"}}}},
+		},
+		{
+			name: "duplicate token",
+			tokens: []Token{
+				{Token: "0123456789abcdef", Identity: Identity{Subject: "a", Roles: []types.Role{types.RoleAdmin}}},
+				{Token: "0123456789abcdef", Identity: Identity{Subject: "b", Roles: []types.Role{types.RoleAdmin}}},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewTokens(tc.tokens); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestHMAC(t *testing.T) {
+	const secret = "0123456789abcdef0123456789abcdef"
+	h, err := NewHMAC([]HMACKey{
+		{ID: "k1", Secret: secret, Identity: Identity{Subject: "pos", Tenant: "t1", Roles: []types.Role{types.RoleVerifier}}},
+	}, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+	h.now = func() time.Time { return now }
+
+	newRequest := func() *http.Request {
+		return httptest.NewRequest("POST", "/api/v1/keys/ABC/redeem?x=1", strings.NewReader(`{"note":"x"}`))
+	}
+
+	testCases := []struct {
+		name    string
+		sign    func(r *http.Request)
+		want    *types.Principal
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			sign: func(r *http.Request) { SignRequest(r, "k1", secret, now) },
+			want: &types.Principal{Subject: "pos", Tenant: "t1", Roles: []types.Role{types.RoleVerifier}},
+		},
+		{
+			name: "unsigned",
+			sign: func(r *http.Request) {},
+		},
+		{
+			name:    "unknown key",
+			sign:    func(r *http.Request) { SignRequest(r, "k2", secret, now) },
+			wantErr: true,
+		},
+		{
+			name:    "wrong secret",
+			sign:    func(r *http.Request) { SignRequest(r, "k1", strings.Repeat("x", 32), now) },
+			wantErr: true,
+		},
+		{
+			name:    "stale",
+			sign:    func(r *http.Request) { SignRequest(r, "k1", secret, now.Add(-time.Hour)) },
+			wantErr: true,
+		},
+		{
+			name: "tampered body",
+			sign: func(r *http.Request) {
+				SignRequest(r, "k1", secret, now)
+				r.Body = ioutil.NopCloser(strings.NewReader(`{"note":"y"}`))
+			},
+			wantErr: true,
+		},
+		{
+			name: "tampered path",
+			sign: func(r *http.Request) {
+				SignRequest(r, "k1", secret, now)
+				r.URL.Path = "/api/v1/keys/ABD/redeem"
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newRequest()
+			tc.sign(r)
+			p, err := h.Authenticate(r)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v want error %v", err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(p, tc.want) {
+				t.Fatalf("got principal %+v want %+v", p, tc.want)
+			}
+			if err == nil {
+				body, _ := ioutil.ReadAll(r.Body)
+				if string(body) != `{"note":"x"}` {
+					t.Fatalf("request body was not restored: %q", body)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	const secret = "0123456789abcdef0123456789abcdef"
+	const body = `{"type":"key.issued"}`
+	now := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name    string
+		sign    func(r *http.Request)
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			sign: func(r *http.Request) { SignWebhook(r, secret, []byte(body), now) },
+		},
+		{
+			name:    "unsigned",
+			sign:    func(r *http.Request) {},
+			wantErr: true,
+		},
+		{
+			name:    "wrong secret",
+			sign:    func(r *http.Request) { SignWebhook(r, strings.Repeat("x", 32), []byte(body), now) },
+			wantErr: true,
+		},
+		{
+			name:    "stale",
+			sign:    func(r *http.Request) { SignWebhook(r, secret, []byte(body), now.Add(-time.Hour)) },
+			wantErr: true,
+		},
+		{
+			name:    "tampered body",
+			sign:    func(r *http.Request) { SignWebhook(r, secret, []byte(`{"type":"key.redeemed"}`), now) },
+			wantErr: true,
+		},
+		{
+			name: "tampered timestamp",
+			sign: func(r *http.Request) {
+				SignWebhook(r, secret, []byte(body), now)
+				r.Header.Set(WebhookTimestampHeader, "1546344001")
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/hook", strings.NewReader(body))
+			tc.sign(r)
+			got, err := VerifyWebhook(r, secret, 5*time.Minute, now)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v want error %v", err, tc.wantErr)
+			}
+			if err == nil && string(got) != body {
+				t.Fatalf("got body %q want %q", got, body)
+			}
+		})
+	}
+}
+
+func TestJWT(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks := map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"kid": "rsa",
+				"use": "sig",
+				"n":   b64(rsaKey.N.Bytes()),
+				"e":   b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+			},
+			{
+				"kty": "EC",
+				"kid": "ec",
+				"crv": "P-256",
+				"x":   b64(ecKey.X.Bytes()),
+				"y":   b64(ecKey.Y.Bytes()),
+			},
+		},
+	}
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jwks.json")
+	data, _ := json.Marshal(jwks)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := NewJWT(&JWTConfig{JWKSFile: path, Issuer: "idp", Audience: "collection-key", Leeway: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+	j.now = func() time.Time { return now }
+
+	claims := func(mod func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub":    "app",
+			"iss":    "idp",
+			"aud":    []string{"collection-key"},
+			"exp":    now.Add(time.Hour).Unix(),
+			"tenant": "t1",
+			"roles":  []string{"issuer"},
+		}
+		if mod != nil {
+			mod(c)
+		}
+		return c
+	}
+	want := &types.Principal{Subject: "app", Tenant: "t1", Roles: []types.Role{types.RoleIssuer}}
+
+	testCases := []struct {
+		name    string
+		token   string
+		want    *types.Principal
+		wantErr bool
+	}{
+		{
+			name:  "RS256",
+			token: signJWT(t, "RS256", "rsa", rsaKey, claims(nil)),
+			want:  want,
+		},
+		{
+			name:  "ES256",
+			token: signJWT(t, "ES256", "ec", ecKey, claims(nil)),
+			want:  want,
+		},
+		{
+			name:  "string audience",
+			token: signJWT(t, "RS512", "rsa", rsaKey, claims(func(c map[string]interface{}) { c["aud"] = "collection-key" })),
+			want:  want,
+		},
+		{
+			name:  "not a jwt",
+			token: "0123456789abcdef",
+		},
+		{
+			name:    "unknown kid",
+			token:   signJWT(t, "RS256", "other", otherKey, claims(nil)),
+			wantErr: true,
+		},
+		{
+			name:    "wrong key",
+			token:   signJWT(t, "RS256", "rsa", otherKey, claims(nil)),
+			wantErr: true,
+		},
+		{
+			name:    "algorithm mismatch",
+			token:   signJWT(t, "ES384", "ec", ecKey, claims(nil)),
+			wantErr: true,
+		},
+		{
+			name:    "expired",
+			token:   signJWT(t, "RS256", "rsa", rsaKey, claims(func(c map[string]interface{}) { c["exp"] = now.Add(-2 * time.Minute).Unix() })),
+			wantErr: true,
+		},
+		{
+			name:  "expired within leeway",
+			token: signJWT(t, "RS256", "rsa", rsaKey, claims(func(c map[string]interface{}) { c["exp"] = now.Add(-30 * time.Second).Unix() })),
+			want:  want,
+		},
+		{
+			name:    "not before",
+			token:   signJWT(t, "RS256", "rsa", rsaKey, claims(func(c map[string]interface{}) { c["nbf"] = now.Add(time.Hour).Unix() })),
+			wantErr: true,
+		},
+		{
+			name:    "no expiration",
+			token:   signJWT(t, "RS256", "rsa", rsaKey, claims(func(c map[string]interface{}) { delete(c, "exp") })),
+			wantErr: true,
+		},
+		{
+			name:    "wrong issuer",
+			token:   signJWT(t, "RS256", "rsa", rsaKey, claims(func(c map[string]interface{}) { c["iss"] = "evil" })),
+			wantErr: true,
+		},
+		{
+			name:    "wrong audience",
+			token:   signJWT(t, "RS256", "rsa", rsaKey, claims(func(c map[string]interface{}) { c["aud"] = "other" })),
+			wantErr: true,
+		},
+		{
+			name:    "unknown role",
+			token:   signJWT(t, "RS256", "rsa", rsaKey, claims(func(c map[string]interface{}) { c["roles"] = []string{"root"} })),
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/v1/keys", nil)
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+			p, err := j.Authenticate(r)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v want error %v", err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(p, tc.want) {
+				t.Fatalf("got principal %+v want %+v", p, tc.want)
+			}
+		})
+	}
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+
+	hash := map[string]crypto.Hash{
+		"RS256": crypto.SHA256, "RS512": crypto.SHA512,
+		"ES256": crypto.SHA256, "ES384": crypto.SHA384,
+	}[alg]
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	var sig []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, key, hash, digest); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(sig[size-len(rb):size], rb)
+		copy(sig[2*size-len(sb):], sb)
+	}
+	return signed + "." + b64(sig)
+}
@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/evgeny08/collection-key/types"
+)
+
+const (
+	// hmacScheme is the Authorization scheme of the signed requests.
+	hmacScheme = "HMAC-SHA256"
+	// TimestampHeader carries the signing time in Unix seconds.
+	TimestampHeader = "X-Request-Timestamp"
+)
+
+// HMACKey is an entry of the HMAC keys file.
+type HMACKey struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+	Identity
+}
+
+type hmacKey struct {
+	secret    []byte
+	principal *types.Principal
+}
+
+// HMAC authenticates the requests signed with a shared secret.
+type HMAC struct {
+	keys    map[string]*hmacKey
+	maxSkew time.Duration
+	now     func() time.Time
+}
+
+// NewHMAC creates an HMAC signature authenticator. Requests signed
+// more than maxSkew away from the current time are rejected.
+func NewHMAC(keys []HMACKey, maxSkew time.Duration) (*HMAC, error) {
+	if maxSkew <= 0 {
+		return nil, errors.New("max skew must be positive")
+	}
+	h := &HMAC{keys: make(map[string]*hmacKey), maxSkew: maxSkew, now: time.Now}
+	for i, key := range keys {
+		if key.ID == "" {
+			return nil, fmt.Errorf("hmac key %d: empty id", i)
+		}
+		if len(key.Secret) < 32 {
+			return nil, fmt.Errorf("hmac key %q: secret must be at least 32 characters long", key.ID)
+		}
+		if _, ok := h.keys[key.ID]; ok {
+			return nil, fmt.Errorf("hmac key %q: duplicate id", key.ID)
+		}
+		p, err := key.principal()
+		if err != nil {
+			return nil, fmt.Errorf("hmac key %q: %v", key.ID, err)
+		}
+		h.keys[key.ID] = &hmacKey{secret: []byte(key.Secret), principal: p}
+	}
+	return h, nil
+}
+
+// LoadHMACKeys creates an HMAC signature authenticator
+// from a JSON file holding an array of keys.
+func LoadHMACKeys(path string, maxSkew time.Duration) (*HMAC, error) {
+	var keys []HMACKey
+	if err := readJSONFile(path, &keys); err != nil {
+		return nil, err
+	}
+	return NewHMAC(keys, maxSkew)
+}
+
+// Authenticate verifies the request signature and returns the principal
+// of the signing key. Requests without an HMAC authorization are ignored.
+func (h *HMAC) Authenticate(r *http.Request) (*types.Principal, error) {
+	keyID, signature, ok := parseHMACAuthorization(r.Header.Get("Authorization"))
+	if !ok {
+		return nil, nil
+	}
+	key, ok := h.keys[keyID]
+	if !ok {
+		return nil, errors.New("unknown hmac key")
+	}
+
+	ts, err := strconv.ParseInt(r.Header.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid request timestamp")
+	}
+	skew := h.now().Sub(time.Unix(ts, 0))
+	if skew > h.maxSkew || skew < -h.maxSkew {
+		return nil, errors.New("request timestamp out of range")
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+	expected := sign(key.secret, canonicalRequest(r, ts, body))
+	if !hmac.Equal(expected, signature) {
+		return nil, errors.New("invalid signature")
+	}
+	return key.principal, nil
+}
+
+// SignRequest signs the request with the HMAC key. The request body,
+// if any, is read and replaced so it can still be sent.
+func SignRequest(r *http.Request, keyID, secret string, now time.Time) error {
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	ts := now.Unix()
+	signature := sign([]byte(secret), canonicalRequest(r, ts, body))
+	r.Header.Set(TimestampHeader, strconv.FormatInt(ts, 10))
+	r.Header.Set("Authorization", fmt.Sprintf("%s KeyId=%s,Signature=%s", hmacScheme, keyID, hex.EncodeToString(signature)))
+	return nil
+}
+
+// parseHMACAuthorization parses the "HMAC-SHA256 KeyId=..,Signature=.." header.
+func parseHMACAuthorization(h string) (keyID string, signature []byte, ok bool) {
+	if !strings.HasPrefix(h, hmacScheme+" ") {
+		return "", nil, false
+	}
+	for _, part := range strings.Split(h[len(hmacScheme)+1:], ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return "", nil, false
+		}
+		switch kv[0] {
+		case "KeyId":
+			keyID = kv[1]
+		case "Signature":
+			var err error
+			if signature, err = hex.DecodeString(kv[1]); err != nil {
+				return "", nil, false
+			}
+		}
+	}
+	return keyID, signature, keyID != "" && signature != nil
+}
+
+// canonicalRequest returns the signed representation of the request.
+func canonicalRequest(r *http.Request, ts int64, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	return []byte(strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		r.URL.RawQuery,
+		strconv.FormatInt(ts, 10),
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n"))
+}
+
+func sign(secret, data []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// readBody reads the request body and restores it for the next reader.
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %v", err)
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
@@ -0,0 +1,288 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/evgeny08/collection-key/types"
+)
+
+// JWTConfig is a JWT authenticator configuration.
+type JWTConfig struct {
+	// JWKSFile is a JSON Web Key Set file holding the verification keys.
+	JWKSFile string
+	// Issuer and Audience are the required "iss" and "aud" claims, if set.
+	Issuer   string
+	Audience string
+	// Leeway is the clock skew allowed when checking "exp" and "nbf".
+	Leeway time.Duration
+}
+
+// JWT authenticates the requests carrying bearer JSON Web Tokens
+// signed with RS256, RS384, RS512, ES256, ES384 or ES512.
+type JWT struct {
+	keys     map[string]crypto.PublicKey
+	issuer   string
+	audience string
+	leeway   time.Duration
+	now      func() time.Time
+}
+
+// NewJWT creates a JWT authenticator verifying the tokens against a local JWKS file.
+func NewJWT(cfg *JWTConfig) (*JWT, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := readJSONFile(cfg.JWKSFile, &set); err != nil {
+		return nil, err
+	}
+	j := &JWT{
+		keys:     make(map[string]crypto.PublicKey),
+		issuer:   cfg.Issuer,
+		audience: cfg.Audience,
+		leeway:   cfg.Leeway,
+		now:      time.Now,
+	}
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("jwk %d: %v", i, err)
+		}
+		if _, ok := j.keys[k.Kid]; ok {
+			return nil, fmt.Errorf("jwk %d: duplicate kid %q", i, k.Kid)
+		}
+		j.keys[k.Kid] = key
+	}
+	if len(j.keys) == 0 {
+		return nil, errors.New("no signing keys in the JWKS file")
+	}
+	return j, nil
+}
+
+// Authenticate verifies the bearer JWT and returns the principal described
+// by its "sub", "tenant" and "roles" claims. Bearer tokens that are not
+// JWTs are ignored, as they may be recognized by another authenticator.
+func (j *JWT) Authenticate(r *http.Request) (*types.Principal, error) {
+	token := bearerToken(r)
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, nil
+	}
+	key, ok := j.keys[header.Kid]
+	if !ok {
+		return nil, errors.New("unknown jwt key")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed jwt signature")
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errors.New("malformed jwt claims")
+	}
+	if err := j.validate(&claims); err != nil {
+		return nil, err
+	}
+	return &types.Principal{Subject: claims.Subject, Tenant: claims.Tenant, Roles: claims.Roles}, nil
+}
+
+type jwtClaims struct {
+	Subject   string       `json:"sub"`
+	Issuer    string       `json:"iss"`
+	Audience  audience     `json:"aud"`
+	ExpiresAt *int64       `json:"exp"`
+	NotBefore *int64       `json:"nbf"`
+	Tenant    string       `json:"tenant"`
+	Roles     []types.Role `json:"roles"`
+}
+
+func (j *JWT) validate(c *jwtClaims) error {
+	now := j.now()
+	if c.ExpiresAt == nil {
+		return errors.New("jwt has no expiration")
+	}
+	if now.After(time.Unix(*c.ExpiresAt, 0).Add(j.leeway)) {
+		return errors.New("jwt is expired")
+	}
+	if c.NotBefore != nil && now.Before(time.Unix(*c.NotBefore, 0).Add(-j.leeway)) {
+		return errors.New("jwt is not valid yet")
+	}
+	if j.issuer != "" && c.Issuer != j.issuer {
+		return errors.New("invalid jwt issuer")
+	}
+	if j.audience != "" && !c.Audience.contains(j.audience) {
+		return errors.New("invalid jwt audience")
+	}
+	if c.Subject == "" {
+		return errors.New("jwt has no subject")
+	}
+	if err := validateRoles(c.Roles); err != nil {
+		return fmt.Errorf("invalid jwt roles: %v", err)
+	}
+	return nil
+}
+
+// audience is the "aud" claim, either a string or an array of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var ss []string
+	if err := json.Unmarshal(data, &ss); err != nil {
+		return err
+	}
+	*a = ss
+	return nil
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ecdsaAlgs are the JWT algorithms by the curve size.
+var ecdsaAlgs = map[int]string{256: "ES256", 384: "ES384", 521: "ES512"}
+
+func verifySignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported jwt algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg[0] != 'R' {
+			return errors.New("jwt algorithm does not match the key")
+		}
+		if err := rsa.VerifyPKCS1v15(key, hash, digest, signature); err != nil {
+			return errors.New("invalid jwt signature")
+		}
+	case *ecdsa.PublicKey:
+		bits := key.Curve.Params().BitSize
+		size := (bits + 7) / 8
+		if alg[0] != 'E' || ecdsaAlgs[bits] != alg || len(signature) != 2*size {
+			return errors.New("jwt algorithm does not match the key")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("invalid jwt signature")
+		}
+	}
+	return nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// jwk is a JSON Web Key holding an RSA or EC public key.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %v", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x: %v", err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y: %v", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
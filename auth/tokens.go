@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+
+	"github.com/evgeny08/collection-key/types"
+)
+
+// Token is an entry of the static bearer tokens file.
+type Token struct {
+	Token string `json:"token"`
+	Identity
+}
+
+// Tokens authenticates the requests carrying static bearer tokens.
+type Tokens struct {
+	// Tokens are looked up by hash, so the lookup time
+	// does not depend on the token prefix.
+	principals map[[sha256.Size]byte]*types.Principal
+}
+
+// NewTokens creates a static bearer token authenticator.
+func NewTokens(tokens []Token) (*Tokens, error) {
+	t := &Tokens{principals: make(map[[sha256.Size]byte]*types.Principal)}
+	for i, token := range tokens {
+		if len(token.Token) < 16 {
+			return nil, fmt.Errorf("token %d: must be at least 16 characters long", i)
+		}
+		p, err := token.principal()
+		if err != nil {
+			return nil, fmt.Errorf("token %d: %v", i, err)
+		}
+		hash := sha256.Sum256([]byte(token.Token))
+		if _, ok := t.principals[hash]; ok {
+			return nil, fmt.Errorf("token %d: duplicate token", i)
+		}
+		t.principals[hash] = p
+	}
+	return t, nil
+}
+
+// LoadTokens creates a static bearer token authenticator
+// from a JSON file holding an array of tokens.
+func LoadTokens(path string) (*Tokens, error) {
+	var tokens []Token
+	if err := readJSONFile(path, &tokens); err != nil {
+		return nil, err
+	}
+	return NewTokens(tokens)
+}
+
+// Authenticate returns the principal of the request bearer token. Unknown
+// tokens are not rejected, as they may be recognized by another authenticator.
+func (t *Tokens) Authenticate(r *http.Request) (*types.Principal, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, nil
+	}
+	return t.principals[sha256.Sum256([]byte(token))], nil
+}
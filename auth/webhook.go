@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// WebhookSignatureHeader carries the hex-encoded HMAC-SHA256
+	// signature of the webhook timestamp and body.
+	WebhookSignatureHeader = "X-Webhook-Signature"
+	// WebhookTimestampHeader carries the webhook signing time in Unix seconds.
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+)
+
+// SignWebhook sets the signature headers of the webhook request
+// with the given body signed with the webhook secret.
+func SignWebhook(r *http.Request, secret string, body []byte, now time.Time) {
+	ts := now.Unix()
+	r.Header.Set(WebhookTimestampHeader, strconv.FormatInt(ts, 10))
+	r.Header.Set(WebhookSignatureHeader, hex.EncodeToString(sign([]byte(secret), webhookPayload(ts, body))))
+}
+
+// VerifyWebhook checks the signature of a webhook request sent by the key
+// service and returns its body. Requests signed more than maxSkew away from
+// the given time are rejected, so the captured requests cannot be replayed.
+func VerifyWebhook(r *http.Request, secret string, maxSkew time.Duration, now time.Time) ([]byte, error) {
+	signature, err := hex.DecodeString(r.Header.Get(WebhookSignatureHeader))
+	if err != nil || len(signature) == 0 {
+		return nil, errors.New("invalid webhook signature")
+	}
+	ts, err := strconv.ParseInt(r.Header.Get(WebhookTimestampHeader), 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid webhook timestamp")
+	}
+	skew := now.Sub(time.Unix(ts, 0))
+	if skew > maxSkew || skew < -maxSkew {
+		return nil, errors.New("webhook timestamp out of range")
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(sign([]byte(secret), webhookPayload(ts, body)), signature) {
+		return nil, errors.New("invalid webhook signature")
+	}
+	return body, nil
+}
+
+// webhookPayload returns the signed representation of the webhook.
+func webhookPayload(ts int64, body []byte) []byte {
+	return append([]byte(strconv.FormatInt(ts, 10)+"."), body...)
+}
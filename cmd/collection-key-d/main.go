@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
@@ -12,8 +13,12 @@ import (
 	"github.com/kelseyhightower/envconfig"
 	"golang.org/x/time/rate"
 
+	"github.com/evgeny08/collection-key/auth"
 	"github.com/evgeny08/collection-key/httpserver"
+	"github.com/evgeny08/collection-key/keygen"
 	"github.com/evgeny08/collection-key/storage"
+	"github.com/evgeny08/collection-key/storage/memstore"
+	"github.com/evgeny08/collection-key/types"
 )
 
 type configuration struct {
@@ -21,8 +26,54 @@ type configuration struct {
 	RateLimitEvery time.Duration `envconfig:"KEY_RATE_LIMIT_EVERY" default:"1us"`
 	RateLimitBurst int           `envconfig:"KEY_RATE_LIMIT_BURST" default:"100"`
 
-	MongoURL string `envconfig:"KEY_MONGO_URL" default:"mongodb://127.0.0.1:27017"`
-	DBName   string `envconfig:"KEY_DB_NAME"   default:"collection-key"`
+	// Requests without credentials are rejected unless anonymous roles
+	// are set, then they act as the default tenant with these roles.
+	AnonymousRoles []string `envconfig:"KEY_ANONYMOUS_ROLES"`
+	AdminToken     string   `envconfig:"KEY_ADMIN_TOKEN"`
+
+	AuthTokensFile   string        `envconfig:"KEY_AUTH_TOKENS_FILE"`
+	AuthHMACKeysFile string        `envconfig:"KEY_AUTH_HMAC_KEYS_FILE"`
+	AuthHMACMaxSkew  time.Duration `envconfig:"KEY_AUTH_HMAC_MAX_SKEW" default:"5m"`
+	AuthJWKSFile     string        `envconfig:"KEY_AUTH_JWKS_FILE"`
+	AuthJWTIssuer    string        `envconfig:"KEY_AUTH_JWT_ISSUER"`
+	AuthJWTAudience  string        `envconfig:"KEY_AUTH_JWT_AUDIENCE"`
+	AuthJWTLeeway    time.Duration `envconfig:"KEY_AUTH_JWT_LEEWAY" default:"1m"`
+
+	StorageBackend string `envconfig:"KEY_STORAGE_BACKEND" default:"mongo"`
+	MongoURL       string `envconfig:"KEY_MONGO_URL"       default:"mongodb://127.0.0.1:27017"`
+	DBName         string `envconfig:"KEY_DB_NAME"         default:"collection-key"`
+
+	SweepInterval time.Duration `envconfig:"KEY_SWEEP_INTERVAL" default:"1m"`
+
+	WebhookInterval    time.Duration `envconfig:"KEY_WEBHOOK_INTERVAL"     default:"10s"`
+	WebhookMaxAttempts int           `envconfig:"KEY_WEBHOOK_MAX_ATTEMPTS" default:"10"`
+	WebhookBackoff     time.Duration `envconfig:"KEY_WEBHOOK_BACKOFF"      default:"30s"`
+
+	// The key events are appended to the file as newline-delimited JSON,
+	// "-" writes them to stdout. Empty disables the file sink.
+	EventsFile     string        `envconfig:"KEY_EVENTS_FILE"`
+	OutboxInterval time.Duration `envconfig:"KEY_OUTBOX_INTERVAL" default:"1s"`
+
+	IdempotencyTTL time.Duration `envconfig:"KEY_IDEMPOTENCY_TTL" default:"24h"`
+
+	// The low-water mark of the default tenant keys out of any pool,
+	// zero disables it. Pools have their own replenish policies.
+	ReplenishInterval time.Duration `envconfig:"KEY_REPLENISH_INTERVAL" default:"1m"`
+	LowWater          int           `envconfig:"KEY_LOW_WATER"`
+	HighWater         int           `envconfig:"KEY_HIGH_WATER"`
+	AutoReplenish     bool          `envconfig:"KEY_AUTO_REPLENISH" default:"false"`
+
+	KeyLength         int    `envconfig:"KEY_LENGTH"          default:"12"`
+	KeyAlphabet       string `envconfig:"KEY_ALPHABET"        default:"0123456789ABCDEFGHJKMNPQRSTVWXYZ"`
+	KeyGroupSize      int    `envconfig:"KEY_GROUP_SIZE"      default:"4"`
+	KeyGroupSeparator string `envconfig:"KEY_GROUP_SEPARATOR" default:"-"`
+	KeyCheckDigit     bool   `envconfig:"KEY_CHECK_DIGIT"     default:"false"`
+}
+
+// storageBackend is a key storage that can be shut down.
+type storageBackend interface {
+	httpserver.Storage
+	Shutdown()
 }
 
 func main() {
@@ -43,21 +94,98 @@ func main() {
 		os.Exit(exitCodeFailure)
 	}
 
-	mongoDB, err := storage.New(&storage.Config{
-		URL:    cfg.MongoURL,
-		DBName: cfg.DBName,
-		Logger: logger,
-	})
+	// The verify-audit command checks the audit chains and exits.
+	if len(os.Args) > 1 {
+		if os.Args[1] != "verify-audit" {
+			level.Error(logger).Log("msg", "unknown command", "command", os.Args[1])
+			os.Exit(exitCodeFailure)
+		}
+		os.Exit(verifyAudit(&cfg, logger))
+	}
+
+	var keyStorage storageBackend
+	switch cfg.StorageBackend {
+	case "mongo":
+		mongoDB, err := storage.New(&storage.Config{
+			URL:           cfg.MongoURL,
+			DBName:        cfg.DBName,
+			Logger:        logger,
+			SweepInterval: cfg.SweepInterval,
+		})
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to initialize MongoDB", "err", err)
+			os.Exit(exitCodeFailure)
+		}
+		keyStorage = mongoDB
+	case "memory":
+		level.Warn(logger).Log("msg", "using in-memory storage, keys are lost on exit")
+		keyStorage = memstore.New()
+	default:
+		level.Error(logger).Log("msg", "unknown storage backend", "backend", cfg.StorageBackend)
+		os.Exit(exitCodeFailure)
+	}
+
+	keyGenCfg := &keygen.Config{
+		Length:     cfg.KeyLength,
+		Alphabet:   cfg.KeyAlphabet,
+		GroupSize:  cfg.KeyGroupSize,
+		Separator:  cfg.KeyGroupSeparator,
+		CheckDigit: cfg.KeyCheckDigit,
+	}
+	keyGen, err := keygen.New(keyGenCfg)
+	if err != nil {
+		level.Error(logger).Log("msg", "failed to initialize key generator", "err", err)
+		os.Exit(exitCodeFailure)
+	}
+
+	authenticators, err := newAuthenticators(&cfg)
+	if err != nil {
+		level.Error(logger).Log("msg", "failed to initialize authentication", "err", err)
+		os.Exit(exitCodeFailure)
+	}
+	anonymousRoles, err := newAnonymousRoles(&cfg)
+	if err != nil {
+		level.Error(logger).Log("msg", "failed to initialize anonymous access", "err", err)
+		os.Exit(exitCodeFailure)
+	}
+
+	sinks, eventsFile, err := newEventSinks(&cfg)
 	if err != nil {
-		level.Error(logger).Log("msg", "failed to initialize MongoDB", "err", err)
+		level.Error(logger).Log("msg", "failed to initialize event sinks", "err", err)
 		os.Exit(exitCodeFailure)
 	}
 
+	var replenish *types.ReplenishPolicy
+	if cfg.LowWater > 0 {
+		replenish = &types.ReplenishPolicy{
+			LowWater:  cfg.LowWater,
+			HighWater: cfg.HighWater,
+			Auto:      cfg.AutoReplenish,
+		}
+	}
+
 	serverHTTP, err := httpserver.New(&httpserver.Config{
-		Logger:      logger,
-		Port:        cfg.HTTPPort,
-		Storage:     mongoDB,
-		RateLimiter: rate.NewLimiter(rate.Every(cfg.RateLimitEvery), cfg.RateLimitBurst),
+		Logger:       logger,
+		Port:         cfg.HTTPPort,
+		Storage:      keyStorage,
+		KeyGenerator: keyGen,
+		KeyGeneratorFactory: func(params *types.KeyGenParams) (httpserver.KeyGenerator, error) {
+			return keygen.New(keyGenCfg.Override(params))
+		},
+		RateLimiter:    rate.NewLimiter(rate.Every(cfg.RateLimitEvery), cfg.RateLimitBurst),
+		Authenticators: authenticators,
+		AnonymousRoles: anonymousRoles,
+		IdempotencyTTL: cfg.IdempotencyTTL,
+
+		ReplenishInterval: cfg.ReplenishInterval,
+		Replenish:         replenish,
+
+		WebhookInterval:    cfg.WebhookInterval,
+		WebhookMaxAttempts: cfg.WebhookMaxAttempts,
+		WebhookBackoff:     cfg.WebhookBackoff,
+
+		OutboxInterval: cfg.OutboxInterval,
+		Sinks:          sinks,
 	})
 	if err != nil {
 		level.Error(logger).Log("msg", "failed to initialize HTTP server", "err", err)
@@ -85,7 +213,13 @@ func main() {
 		case sig := <-sigc:
 			level.Info(logger).Log("msg", "received signal, exiting", "signal", sig)
 			serverHTTP.Shutdown() // Shutdown server HTTP
-			mongoDB.Shutdown()    // Shutdown MongoDB
+			keyStorage.Shutdown() // Shutdown storage
+			// The relay has stopped, so no more events are written.
+			if eventsFile != nil {
+				if err := closeEventsFile(eventsFile); err != nil {
+					level.Error(logger).Log("msg", "failed to close events file", "err", err)
+				}
+			}
 			signal.Stop(sigc)
 			close(donec)
 		case <-errc:
@@ -99,3 +233,89 @@ func main() {
 	os.Exit(exitCodeSuccess)
 
 }
+
+// newAuthenticators creates the configured request authenticators.
+func newAuthenticators(cfg *configuration) ([]httpserver.Authenticator, error) {
+	var authenticators []httpserver.Authenticator
+	if cfg.AdminToken != "" {
+		tokens, err := auth.NewTokens([]auth.Token{{
+			Token:    cfg.AdminToken,
+			Identity: auth.Identity{Subject: "admin", Roles: []types.Role{types.RoleAdmin}},
+		}})
+		if err != nil {
+			return nil, fmt.Errorf("admin token: %v", err)
+		}
+		authenticators = append(authenticators, tokens)
+	}
+	if cfg.AuthTokensFile != "" {
+		tokens, err := auth.LoadTokens(cfg.AuthTokensFile)
+		if err != nil {
+			return nil, fmt.Errorf("tokens: %v", err)
+		}
+		authenticators = append(authenticators, tokens)
+	}
+	if cfg.AuthHMACKeysFile != "" {
+		hmac, err := auth.LoadHMACKeys(cfg.AuthHMACKeysFile, cfg.AuthHMACMaxSkew)
+		if err != nil {
+			return nil, fmt.Errorf("hmac keys: %v", err)
+		}
+		authenticators = append(authenticators, hmac)
+	}
+	if cfg.AuthJWKSFile != "" {
+		jwt, err := auth.NewJWT(&auth.JWTConfig{
+			JWKSFile: cfg.AuthJWKSFile,
+			Issuer:   cfg.AuthJWTIssuer,
+			Audience: cfg.AuthJWTAudience,
+			Leeway:   cfg.AuthJWTLeeway,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("jwt: %v", err)
+		}
+		authenticators = append(authenticators, jwt)
+	}
+	return authenticators, nil
+}
+
+// newAnonymousRoles returns the configured roles of the requests
+// without credentials. There are none by default.
+func newAnonymousRoles(cfg *configuration) ([]types.Role, error) {
+	var roles []types.Role
+	for _, role := range cfg.AnonymousRoles {
+		if !types.ValidRole(types.Role(role)) {
+			return nil, fmt.Errorf("unknown anonymous role %q", role)
+		}
+		roles = append(roles, types.Role(role))
+	}
+	return roles, nil
+}
+
+// newEventSinks creates the configured key event sinks. The opened
+// events file is returned to be closed on shutdown.
+func newEventSinks(cfg *configuration) ([]httpserver.Sink, *os.File, error) {
+	var (
+		sinks []httpserver.Sink
+		file  *os.File
+	)
+	switch cfg.EventsFile {
+	case "":
+	case "-":
+		sinks = append(sinks, httpserver.NewNDJSONSink(os.Stdout))
+	default:
+		f, err := os.OpenFile(cfg.EventsFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("events file: %v", err)
+		}
+		sinks = append(sinks, httpserver.NewNDJSONSink(f))
+		file = f
+	}
+	return sinks, file, nil
+}
+
+// closeEventsFile flushes the events file to disk and closes it.
+func closeEventsFile(f *os.File) error {
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/evgeny08/collection-key/types"
+	"github.com/kelseyhightower/envconfig"
+)
+
+func TestDefaultConfigHasNoAnonymousRoles(t *testing.T) {
+	if v, ok := os.LookupEnv("KEY_ANONYMOUS_ROLES"); ok {
+		os.Unsetenv("KEY_ANONYMOUS_ROLES")
+		defer os.Setenv("KEY_ANONYMOUS_ROLES", v)
+	}
+
+	var cfg configuration
+	if err := envconfig.Process("", &cfg); err != nil {
+		t.Fatal(err)
+	}
+	roles, err := newAnonymousRoles(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) != 0 {
+		t.Fatalf("got anonymous roles %v by default want none", roles)
+	}
+}
+
+func TestEventsFileClosed(t *testing.T) {
+	_, file, err := newEventSinks(&configuration{EventsFile: "-"})
+	if err != nil || file != nil {
+		t.Fatalf("got file %v, %v for stdout want nil, nil", file, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+	sinks, file, err := newEventSinks(&configuration{EventsFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := &types.Event{ID: "event-1", Type: types.EventKeyCreated, Key: &types.Key{ID: "key-1"}}
+	if err := sinks[0].Publish(context.Background(), []*types.Event{event}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if err := closeEventsFile(file); err != nil {
+		t.Fatalf("close events file: %v", err)
+	}
+	if _, err := file.Write([]byte("\n")); err == nil {
+		t.Fatal("write after close: got no error")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 1 || !strings.Contains(string(data), `"event-1"`) {
+		t.Fatalf("got events file %q want one event", data)
+	}
+}
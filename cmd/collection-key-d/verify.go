@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/evgeny08/collection-key/storage"
+)
+
+// exitCodeBroken is the exit code of verify-audit if an audit chain is broken.
+const exitCodeBroken = 2
+
+// verifyAudit walks the audit chains of the MongoDB storage and reports
+// the first broken link. It returns zero if all the chains are intact.
+func verifyAudit(cfg *configuration, logger log.Logger) int {
+	if cfg.StorageBackend != "mongo" {
+		level.Error(logger).Log("msg", "audit chains are only stored in mongo", "backend", cfg.StorageBackend)
+		return 1
+	}
+	mongoDB, err := storage.Open(&storage.Config{
+		URL:    cfg.MongoURL,
+		DBName: cfg.DBName,
+		Logger: logger,
+	})
+	if err != nil {
+		level.Error(logger).Log("msg", "failed to initialize MongoDB", "err", err)
+		return 1
+	}
+	defer mongoDB.Shutdown()
+
+	res, err := mongoDB.VerifyAuditChain(context.Background())
+	if err != nil {
+		level.Error(logger).Log("msg", "failed to verify audit chains", "err", err)
+		return 1
+	}
+	if b := res.Break; b != nil {
+		level.Error(logger).Log(
+			"msg", "audit chain is broken",
+			"tenant", b.TenantID,
+			"pool", b.PoolID,
+			"seq", b.Seq,
+			"reason", b.Reason,
+			"records", res.Records,
+		)
+		return exitCodeBroken
+	}
+	level.Info(logger).Log("msg", "audit chains are intact", "chains", res.Chains, "records", res.Records)
+	return 0
+}
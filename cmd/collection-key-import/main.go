@@ -0,0 +1,134 @@
+// Command collection-key-import imports externally generated keys from
+// a CSV or NDJSON file and prints the rows the service rejected.
+//
+// Usage:
+//
+//	collection-key-import [flags] FILE
+//
+// FILE is a CSV file with an id column or an NDJSON file of
+// {"id": ...} objects, or - to read the standard input.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/evgeny08/collection-key/httpserver"
+	"github.com/evgeny08/collection-key/types"
+)
+
+const (
+	exitCodeSuccess  = 0
+	exitCodeFailure  = 1
+	exitCodeRejected = 2
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("collection-key-import", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	serviceURL := flags.String("url", envOr("KEY_URL", "http://127.0.0.1:24020"), "service `URL`")
+	pool := flags.String("pool", "", "import the keys to the `pool`")
+	format := flags.String("format", "", "file `format`, csv or ndjson; guessed from the file extension if empty")
+	apiKey := flags.String("api-key", os.Getenv("KEY_API_KEY"), "tenant API `key`")
+	token := flags.String("token", os.Getenv("KEY_TOKEN"), "bearer `token`")
+	reportFile := flags.String("report", "", "write the JSON report of all rows to the `file`")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: collection-key-import [flags] FILE\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return exitCodeFailure
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return exitCodeFailure
+	}
+	name := flags.Arg(0)
+
+	fileFormat := types.FileFormat(*format)
+	if fileFormat == "" {
+		fileFormat = types.FormatNDJSON
+		if strings.EqualFold(filepath.Ext(name), ".csv") {
+			fileFormat = types.FormatCSV
+		}
+	}
+
+	file := stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintf(stderr, "failed to open import file: %v\n", err)
+			return exitCodeFailure
+		}
+		defer f.Close()
+		file = f
+	}
+
+	var opts []httpserver.ClientOption
+	if *apiKey != "" {
+		opts = append(opts, httpserver.WithAPIKey(*apiKey))
+	}
+	if *token != "" {
+		opts = append(opts, httpserver.WithBearerToken(*token))
+	}
+	client, err := httpserver.NewClient(*serviceURL, opts...)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to create client: %v\n", err)
+		return exitCodeFailure
+	}
+
+	report, err := client.ImportPoolKeys(context.Background(), *pool, fileFormat, file)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to import keys: %v\n", err)
+		return exitCodeFailure
+	}
+
+	if *reportFile != "" {
+		if err := writeReport(*reportFile, report); err != nil {
+			fmt.Fprintf(stderr, "failed to write report: %v\n", err)
+			return exitCodeFailure
+		}
+	}
+	for _, row := range report.Rows {
+		if row.Status == types.ImportRejected {
+			fmt.Fprintf(stdout, "row %d: %s: %s\n", row.Row, row.ID, row.Reason)
+		}
+	}
+	fmt.Fprintf(stdout, "batch %s: %d accepted, %d rejected\n", report.BatchID, report.Accepted, report.Rejected)
+	if report.Rejected > 0 {
+		return exitCodeRejected
+	}
+	return exitCodeSuccess
+}
+
+// writeReport writes the import report to the file as JSON.
+func writeReport(name string, report *types.ImportReport) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func envOr(name, value string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return value
+}
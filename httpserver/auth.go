@@ -0,0 +1,103 @@
+package httpserver
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-kit/kit/endpoint"
+
+	"github.com/evgeny08/collection-key/types"
+)
+
+// apiKeyHeader is a request header carrying the tenant API key.
+const apiKeyHeader = "X-API-Key"
+
+// Authenticator authenticates the HTTP requests. It returns a nil principal
+// and a nil error if the request carries no credentials it recognizes.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*types.Principal, error)
+}
+
+// authMiddleware authenticates the request and puts the principal and its
+// tenant into the request context, so every storage query is scoped to it.
+// The API key is checked first, then the authenticators in order.
+// Requests without credentials get the anonymous roles in the default
+// tenant, or are rejected if there are none.
+func authMiddleware(svc service, authenticators []Authenticator, anonymousRoles []types.Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			p, err := authenticate(svc, authenticators, r)
+			if err != nil {
+				encodeError(w, err, true)
+				return
+			}
+			if p == nil {
+				if r.Header.Get("Authorization") != "" {
+					encodeError(w, errorf(ErrUnauthorized, "invalid credentials"), true)
+					return
+				}
+				if len(anonymousRoles) == 0 {
+					encodeError(w, errorf(ErrUnauthorized, "missing credentials"), true)
+					return
+				}
+				p = &types.Principal{Roles: anonymousRoles}
+			}
+			ctx = types.WithPrincipal(ctx, p)
+			ctx = types.WithTenant(ctx, p.Tenant)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// authenticate returns the principal of the request credentials
+// or nil if the request carries none.
+func authenticate(svc service, authenticators []Authenticator, r *http.Request) (*types.Principal, error) {
+	if apiKey := r.Header.Get(apiKeyHeader); apiKey != "" {
+		return svc.authenticate(r.Context(), apiKey)
+	}
+	for _, a := range authenticators {
+		p, err := a.Authenticate(r)
+		if err != nil {
+			return nil, errorf(ErrUnauthorized, "%v", err)
+		}
+		if p != nil {
+			return p, nil
+		}
+	}
+	return nil, nil
+}
+
+// requireRole returns an endpoint middleware rejecting
+// the principals having none of the roles.
+func requireRole(roles ...types.Role) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			p := types.PrincipalFromContext(ctx)
+			if p == nil {
+				return nil, errorf(ErrUnauthorized, "missing credentials")
+			}
+			for _, role := range roles {
+				if p.HasRole(role) {
+					return next(ctx, request)
+				}
+			}
+			return nil, errorf(ErrForbidden, "permission denied")
+		}
+	}
+}
+
+// requireOperator returns an endpoint middleware rejecting all principals
+// except authenticated admins out of any tenant. It guards the tenant
+// management API, so neither anonymous nor tenant admins may use it.
+func requireOperator() endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return requireRole(types.RoleAdmin)(func(ctx context.Context, request interface{}) (interface{}, error) {
+			p := types.PrincipalFromContext(ctx)
+			if p.Subject == "" || p.Tenant != "" {
+				return nil, errorf(ErrForbidden, "permission denied")
+			}
+			return next(ctx, request)
+		})
+	}
+}
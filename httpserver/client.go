@@ -2,36 +2,161 @@ package httpserver
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/go-kit/kit/endpoint"
 	kithttp "github.com/go-kit/kit/transport/http"
 
+	"github.com/evgeny08/collection-key/auth"
 	"github.com/evgeny08/collection-key/types"
 )
 
 // Client is a client for auth-user service.
 type Client struct {
 	createKey       endpoint.Endpoint
+	createKeys      endpoint.Endpoint
+	importKeys      endpoint.Endpoint
 	getKey          endpoint.Endpoint
+	issueKey        endpoint.Endpoint
+	listKeys        endpoint.Endpoint
+	exportKeys      endpoint.Endpoint
+	keyStats        endpoint.Endpoint
 	canceledKey     endpoint.Endpoint
+	redeemKey       endpoint.Endpoint
+	revokeKey       endpoint.Endpoint
 	verificationKey endpoint.Endpoint
+	keyHistory      endpoint.Endpoint
 	unreleasedKey   endpoint.Endpoint
+	createPool      endpoint.Endpoint
+	getPool         endpoint.Endpoint
+	listPools       endpoint.Endpoint
+	createTenant    endpoint.Endpoint
+	listTenants     endpoint.Endpoint
+	createAPIKey    endpoint.Endpoint
+	revokeAPIKey    endpoint.Endpoint
+	createWebhook   endpoint.Endpoint
+	listWebhooks    endpoint.Endpoint
+	deleteWebhook   endpoint.Endpoint
+	listDeliveries  endpoint.Endpoint
+	retryDelivery   endpoint.Endpoint
+	watchEvents     endpoint.Endpoint
+
+	idempotentRetries int
+}
+
+type clientOptions struct {
+	requestFuncs      []func(r *http.Request)
+	idempotentRetries int
+}
+
+// ClientOption configures a Client.
+type ClientOption func(o *clientOptions)
+
+// WithAPIKey authenticates the client requests as a tenant.
+func WithAPIKey(apiKey string) ClientOption {
+	return withRequestFunc(func(r *http.Request) {
+		r.Header.Set(apiKeyHeader, apiKey)
+	})
+}
+
+// WithBearerToken authenticates the client requests with
+// a static bearer token or a JSON Web Token.
+func WithBearerToken(token string) ClientOption {
+	return withRequestFunc(func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+token)
+	})
+}
+
+// WithHMACKey signs the client requests with the HMAC key.
+func WithHMACKey(keyID, secret string) ClientOption {
+	return withRequestFunc(func(r *http.Request) {
+		// The request is sent unsigned if signing fails
+		// and is rejected by the server.
+		_ = auth.SignRequest(r, keyID, secret, time.Now())
+	})
+}
+
+// WithIdempotentRetries makes the key issuance, creation and cancellation
+// requests idempotent and retries them up to n times on network and internal
+// server errors. Every call sends an idempotency key, generated unless set
+// with WithIdempotencyKey, so a retry gets the response of the original
+// request instead of e.g. consuming another key.
+func WithIdempotentRetries(n int) ClientOption {
+	return func(o *clientOptions) {
+		o.idempotentRetries = n
+	}
+}
+
+func withRequestFunc(f func(r *http.Request)) ClientOption {
+	return func(o *clientOptions) {
+		o.requestFuncs = append(o.requestFuncs, f)
+	}
+}
+
+type idempotencyKeyKey struct{}
+
+// WithIdempotencyKey returns a copy of the context carrying the idempotency
+// key of the key issuance, creation or cancellation request made with it.
+// Retrying a request with the same key returns the original response.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyKey{}, key)
+}
+
+func idempotencyKeyFromContext(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKeyKey{}).(string)
+	return key
 }
 
 // NewClient creates a new service client.
-func NewClient(serviceURL string) (*Client, error) {
+func NewClient(serviceURL string, opts ...ClientOption) (*Client, error) {
 	baseURL, err := url.Parse(serviceURL)
 	if err != nil {
 		return nil, err
 	}
 
+	var o clientOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	applyOptions := kithttp.ClientBefore(func(ctx context.Context, r *http.Request) context.Context {
+		if key := idempotencyKeyFromContext(ctx); key != "" {
+			r.Header.Set(idempotencyKeyHeader, key)
+		}
+		for _, f := range o.requestFuncs {
+			f(r)
+		}
+		return ctx
+	})
+
 	c := &Client{
 		createKey: kithttp.NewClient(
 			"POST",
 			baseURL,
 			encodeCreateKeyRequest,
 			decodeCreateKeyResponse,
+			applyOptions,
+		).Endpoint(),
+
+		createKeys: kithttp.NewClient(
+			"POST",
+			baseURL,
+			encodeCreateKeysRequest,
+			decodeCreateKeysResponse,
+			applyOptions,
+			kithttp.BufferedStream(true),
+		).Endpoint(),
+
+		importKeys: kithttp.NewClient(
+			"POST",
+			baseURL,
+			encodeImportKeysRequest,
+			decodeImportKeysResponse,
+			applyOptions,
 		).Endpoint(),
 
 		getKey: kithttp.NewClient(
@@ -39,6 +164,40 @@ func NewClient(serviceURL string) (*Client, error) {
 			baseURL,
 			encodeGetKeyRequest,
 			decodeGetKeyResponse,
+			applyOptions,
+		).Endpoint(),
+
+		issueKey: kithttp.NewClient(
+			"POST",
+			baseURL,
+			encodeIssueKeyRequest,
+			decodeIssueKeyResponse,
+			applyOptions,
+		).Endpoint(),
+
+		listKeys: kithttp.NewClient(
+			"GET",
+			baseURL,
+			encodeListKeysRequest,
+			decodeListKeysResponse,
+			applyOptions,
+		).Endpoint(),
+
+		keyStats: kithttp.NewClient(
+			"GET",
+			baseURL,
+			encodeKeyStatsRequest,
+			decodeKeyStatsResponse,
+			applyOptions,
+		).Endpoint(),
+
+		exportKeys: kithttp.NewClient(
+			"GET",
+			baseURL,
+			encodeExportKeysRequest,
+			decodeExportKeysResponse,
+			applyOptions,
+			kithttp.BufferedStream(true),
 		).Endpoint(),
 
 		canceledKey: kithttp.NewClient(
@@ -46,6 +205,23 @@ func NewClient(serviceURL string) (*Client, error) {
 			baseURL,
 			encodeCanceledKeyRequest,
 			decodeCanceledKeyResponse,
+			applyOptions,
+		).Endpoint(),
+
+		redeemKey: kithttp.NewClient(
+			"POST",
+			baseURL,
+			encodeRedeemKeyRequest,
+			decodeRedeemKeyResponse,
+			applyOptions,
+		).Endpoint(),
+
+		revokeKey: kithttp.NewClient(
+			"POST",
+			baseURL,
+			encodeRevokeKeyRequest,
+			decodeRevokeKeyResponse,
+			applyOptions,
 		).Endpoint(),
 
 		verificationKey: kithttp.NewClient(
@@ -53,6 +229,15 @@ func NewClient(serviceURL string) (*Client, error) {
 			baseURL,
 			encodeVerificationKeyRequest,
 			decodeVerificationKeyResponse,
+			applyOptions,
+		).Endpoint(),
+
+		keyHistory: kithttp.NewClient(
+			"GET",
+			baseURL,
+			encodeKeyHistoryRequest,
+			decodeKeyHistoryResponse,
+			applyOptions,
 		).Endpoint(),
 
 		unreleasedKey: kithttp.NewClient(
@@ -60,43 +245,409 @@ func NewClient(serviceURL string) (*Client, error) {
 			baseURL,
 			encodeUnreleasedKeyRequest,
 			decodeUnreleasedKeyResponse,
+			applyOptions,
 		).Endpoint(),
+
+		createPool: kithttp.NewClient(
+			"POST",
+			baseURL,
+			encodeCreatePoolRequest,
+			decodeCreatePoolResponse,
+			applyOptions,
+		).Endpoint(),
+
+		getPool: kithttp.NewClient(
+			"GET",
+			baseURL,
+			encodeGetPoolRequest,
+			decodeGetPoolResponse,
+			applyOptions,
+		).Endpoint(),
+
+		listPools: kithttp.NewClient(
+			"GET",
+			baseURL,
+			encodeListPoolsRequest,
+			decodeListPoolsResponse,
+			applyOptions,
+		).Endpoint(),
+
+		createTenant: kithttp.NewClient(
+			"POST",
+			baseURL,
+			encodeCreateTenantRequest,
+			decodeCreateTenantResponse,
+			applyOptions,
+		).Endpoint(),
+
+		listTenants: kithttp.NewClient(
+			"GET",
+			baseURL,
+			encodeListTenantsRequest,
+			decodeListTenantsResponse,
+			applyOptions,
+		).Endpoint(),
+
+		createAPIKey: kithttp.NewClient(
+			"POST",
+			baseURL,
+			encodeCreateAPIKeyRequest,
+			decodeCreateAPIKeyResponse,
+			applyOptions,
+		).Endpoint(),
+
+		revokeAPIKey: kithttp.NewClient(
+			"POST",
+			baseURL,
+			encodeRevokeAPIKeyRequest,
+			decodeRevokeAPIKeyResponse,
+			applyOptions,
+		).Endpoint(),
+
+		createWebhook: kithttp.NewClient(
+			"POST",
+			baseURL,
+			encodeCreateWebhookRequest,
+			decodeCreateWebhookResponse,
+			applyOptions,
+		).Endpoint(),
+
+		listWebhooks: kithttp.NewClient(
+			"GET",
+			baseURL,
+			encodeListWebhooksRequest,
+			decodeListWebhooksResponse,
+			applyOptions,
+		).Endpoint(),
+
+		deleteWebhook: kithttp.NewClient(
+			"DELETE",
+			baseURL,
+			encodeDeleteWebhookRequest,
+			decodeDeleteWebhookResponse,
+			applyOptions,
+		).Endpoint(),
+
+		listDeliveries: kithttp.NewClient(
+			"GET",
+			baseURL,
+			encodeListDeliveriesRequest,
+			decodeListDeliveriesResponse,
+			applyOptions,
+		).Endpoint(),
+
+		retryDelivery: kithttp.NewClient(
+			"POST",
+			baseURL,
+			encodeRetryDeliveryRequest,
+			decodeRetryDeliveryResponse,
+			applyOptions,
+		).Endpoint(),
+
+		watchEvents: kithttp.NewClient(
+			"GET",
+			baseURL,
+			encodeWatchEventsRequest,
+			decodeWatchEventsResponse,
+			applyOptions,
+			kithttp.BufferedStream(true),
+		).Endpoint(),
+
+		idempotentRetries: o.idempotentRetries,
 	}
 
 	return c, nil
 }
 
-// CreateKey creates a new key.
-func (c *Client) CreateKey(ctx context.Context) (*types.Key, error) {
-	var request interface{}
-	response, err := c.createKey(ctx, request)
+// idempotentRetryDelay is the delay before the first retry of an idempotent request.
+const idempotentRetryDelay = 100 * time.Millisecond
+
+// idempotent makes the call with an idempotency key and retries it on network
+// and internal server errors if the client is created with WithIdempotentRetries.
+func (c *Client) idempotent(ctx context.Context, call func(ctx context.Context) error) error {
+	if c.idempotentRetries <= 0 {
+		return call(ctx)
+	}
+	if idempotencyKeyFromContext(ctx) == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		ctx = WithIdempotencyKey(ctx, hex.EncodeToString(b))
+	}
+
+	delay := idempotentRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := call(ctx)
+		if err == nil || attempt == c.idempotentRetries {
+			return err
+		}
+		if e, ok := err.(*Error); ok && e.Kind != ErrInternal {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// CreateKey creates a new key. Validity is an optional key validity window.
+func (c *Client) CreateKey(ctx context.Context, validity *types.KeyValidity) (*types.Key, error) {
+	return c.CreatePoolKey(ctx, "", validity)
+}
+
+// CreatePoolKey creates a new key of the pool using the pool generator settings.
+// Validity is an optional key validity window.
+func (c *Client) CreatePoolKey(ctx context.Context, pool string, validity *types.KeyValidity) (*types.Key, error) {
+	request := createKeyRequest{Pool: pool, Validity: validity}
+	var key *types.Key
+	err := c.idempotent(ctx, func(ctx context.Context) error {
+		response, err := c.createKey(ctx, request)
+		if err != nil {
+			return err
+		}
+		res := response.(createKeyResponse)
+		key = res.Key
+		return res.Err
+	})
+	return key, err
+}
+
+// CreateKeys creates count new keys in a batch and returns the batch ID.
+// Params override the server key generator settings and validity sets
+// the keys validity window, both may be nil.
+// Progress is called on every progress update and may be nil.
+func (c *Client) CreateKeys(ctx context.Context, count int, params *types.KeyGenParams, validity *types.KeyValidity, progress func(*types.BatchProgress)) (string, error) {
+	return c.CreatePoolKeys(ctx, "", count, params, validity, progress)
+}
+
+// CreatePoolKeys creates count new keys of the pool in a batch as CreateKeys
+// does. Params override the pool generator settings.
+func (c *Client) CreatePoolKeys(ctx context.Context, pool string, count int, params *types.KeyGenParams, validity *types.KeyValidity, progress func(*types.BatchProgress)) (string, error) {
+	request := createKeysRequest{Pool: pool, Count: count, Generator: params, Validity: validity}
+	response, err := c.createKeys(ctx, request)
+	if err != nil {
+		return "", err
+	}
+	res := response.(createKeysResponse)
+	if res.Err != nil {
+		return "", res.Err
+	}
+	return readBatchProgress(res.Body, progress)
+}
+
+// ImportKeys creates keys with the IDs read from the CSV or NDJSON import
+// file and reports the outcome of every row. The file is streamed to the server.
+func (c *Client) ImportKeys(ctx context.Context, format types.FileFormat, file io.Reader) (*types.ImportReport, error) {
+	return c.ImportPoolKeys(ctx, "", format, file)
+}
+
+// ImportPoolKeys creates keys of the pool from the import file as ImportKeys does.
+func (c *Client) ImportPoolKeys(ctx context.Context, pool string, format types.FileFormat, file io.Reader) (*types.ImportReport, error) {
+	request := importKeysRequest{Pool: pool, Format: format, File: file}
+	response, err := c.importKeys(ctx, request)
 	if err != nil {
 		return nil, err
 	}
-	res := response.(createKeyResponse)
-	return res.Key, res.Err
+	res := response.(importKeysResponse)
+	return res.Report, res.Err
 }
 
-// GetKey returns an unreleased key
+// GetKey returns an unreleased key out of any pool
 func (c *Client) GetKey(ctx context.Context) (string, error) {
-	var request interface{}
-	response, err := c.getKey(ctx, request)
+	return c.GetPoolKey(ctx, "")
+}
+
+// GetPoolKey returns an unreleased key of the pool
+func (c *Client) GetPoolKey(ctx context.Context, pool string) (string, error) {
+	request := getKeyRequest{Pool: pool}
+	var key string
+	err := c.idempotent(ctx, func(ctx context.Context) error {
+		response, err := c.getKey(ctx, request)
+		if err != nil {
+			return err
+		}
+		res := response.(getKeyResponse)
+		key = res.Key
+		return res.Err
+	})
+	return key, err
+}
+
+// IssueKey issues an unreleased key out of any pool to the recipient
+// and returns it. Issuance may be nil.
+func (c *Client) IssueKey(ctx context.Context, issuance *types.Issuance) (*types.Key, error) {
+	return c.IssuePoolKey(ctx, "", issuance)
+}
+
+// IssuePoolKey issues an unreleased key of the pool to the recipient
+// and returns it. Issuance may be nil.
+func (c *Client) IssuePoolKey(ctx context.Context, pool string, issuance *types.Issuance) (*types.Key, error) {
+	request := issueKeyRequest{Pool: pool, Issuance: issuance}
+	var key *types.Key
+	err := c.idempotent(ctx, func(ctx context.Context) error {
+		response, err := c.issueKey(ctx, request)
+		if err != nil {
+			return err
+		}
+		res := response.(issueKeyResponse)
+		key = res.Key
+		return res.Err
+	})
+	return key, err
+}
+
+// KeysByRecipient returns the keys issued to the recipient ordered by the issue time.
+func (c *Client) KeysByRecipient(ctx context.Context, recipient string) ([]*types.Key, error) {
+	if recipient == "" {
+		return nil, errorf(ErrBadParams, "empty recipient")
+	}
+	params := &types.KeyListParams{Sort: types.SortByIssued}
+	params.Recipient = recipient
+	keys := []*types.Key{}
+	it := c.Keys(ctx, params)
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+	return keys, it.Err()
+}
+
+// ListKeys returns a page of the keys matching the listing parameters.
+// Pass the NextCursor of the page in the parameters to get the next page.
+func (c *Client) ListKeys(ctx context.Context, params *types.KeyListParams) (*types.KeyPage, error) {
+	request := listKeysRequest{Params: params}
+	response, err := c.listKeys(ctx, request)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	res := response.(getKeyResponse)
-	return res.Key, res.Err
+	res := response.(listKeysResponse)
+	return res.Page, res.Err
+}
+
+// ExportKeys writes the keys matching the export parameters to w
+// in the CSV or NDJSON format as the server streams them.
+func (c *Client) ExportKeys(ctx context.Context, params *types.KeyExportParams, w io.Writer) error {
+	request := exportKeysRequest{Params: params}
+	response, err := c.exportKeys(ctx, request)
+	if err != nil {
+		return err
+	}
+	res := response.(exportKeysResponse)
+	if res.Err != nil {
+		return res.Err
+	}
+	defer res.Body.Close()
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+// Stats returns the counts of all keys by status and the recent issuance rates.
+func (c *Client) Stats(ctx context.Context) (*types.KeyStats, error) {
+	return c.keyStatsOf(ctx, nil)
+}
+
+// PoolStats returns the key statistics of the pool as Stats does.
+// An empty pool selects the keys out of any pool.
+func (c *Client) PoolStats(ctx context.Context, pool string) (*types.KeyStats, error) {
+	return c.keyStatsOf(ctx, &pool)
+}
+
+func (c *Client) keyStatsOf(ctx context.Context, pool *string) (*types.KeyStats, error) {
+	request := keyStatsRequest{Pool: pool}
+	response, err := c.keyStats(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	res := response.(keyStatsResponse)
+	return res.Stats, res.Err
+}
+
+// Keys returns an iterator over all the keys matching the listing
+// parameters. The pages of params.Limit keys are fetched as needed.
+func (c *Client) Keys(ctx context.Context, params *types.KeyListParams) *KeyIterator {
+	p := *params
+	p.Cursor = ""
+	return &KeyIterator{ctx: ctx, client: c, params: &p}
+}
+
+// KeyIterator walks through the pages of a key listing.
+type KeyIterator struct {
+	ctx    context.Context
+	client *Client
+	params *types.KeyListParams
+	keys   []*types.Key
+	key    *types.Key
+	last   bool
+	err    error
+}
+
+// Next advances the iterator to the next key. It returns false
+// when there are no more keys or fetching a page failed.
+func (it *KeyIterator) Next() bool {
+	for len(it.keys) == 0 {
+		if it.last || it.err != nil {
+			it.key = nil
+			return false
+		}
+		page, err := it.client.ListKeys(it.ctx, it.params)
+		if err != nil {
+			it.err = err
+			continue
+		}
+		it.keys = page.Keys
+		it.params.Cursor = page.NextCursor
+		it.last = page.NextCursor == ""
+	}
+	it.key, it.keys = it.keys[0], it.keys[1:]
+	return true
+}
+
+// Key returns the current key.
+func (it *KeyIterator) Key() *types.Key {
+	return it.key
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *KeyIterator) Err() error {
+	return it.err
 }
 
 // CanceledKey updates key canceled with given id
 func (c *Client) CanceledKey(ctx context.Context, id string) error {
 	request := canceledKeyRequest{ID: id}
-	response, err := c.canceledKey(ctx, request)
+	return c.idempotent(ctx, func(ctx context.Context) error {
+		response, err := c.canceledKey(ctx, request)
+		if err != nil {
+			return err
+		}
+		return response.(canceledKeyResponse).Err
+	})
+}
+
+// RedeemKey marks an issued key with given id as redeemed.
+// Redeemer is an optional identity of the key user.
+func (c *Client) RedeemKey(ctx context.Context, id, redeemer string) (*types.Key, error) {
+	request := redeemKeyRequest{ID: id, Redeemer: redeemer}
+	response, err := c.redeemKey(ctx, request)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	res := response.(canceledKeyResponse)
-	return res.Err
+	res := response.(redeemKeyResponse)
+	return res.Key, res.Err
+}
+
+// RevokeKey marks a key with given id as revoked.
+func (c *Client) RevokeKey(ctx context.Context, id string) (*types.Key, error) {
+	request := revokeKeyRequest{ID: id}
+	response, err := c.revokeKey(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	res := response.(revokeKeyResponse)
+	return res.Key, res.Err
 }
 
 // VerificationKey return key info
@@ -110,9 +661,30 @@ func (c *Client) VerificationKey(ctx context.Context, id string) (*types.Key, er
 	return res.Key, res.Err
 }
 
-// UnreleasedKey return all unreleased keys
+// KeyHistory returns the audit records of the key with given id
+// in the order of the operations.
+func (c *Client) KeyHistory(ctx context.Context, id string) ([]*types.AuditRecord, error) {
+	request := keyHistoryRequest{ID: id}
+	response, err := c.keyHistory(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	res := response.(keyHistoryResponse)
+	return res.Records, res.Err
+}
+
+// UnreleasedKey return all unreleased keys out of any pool.
+//
+// Deprecated: the number of returned keys is limited, use Keys.
 func (c *Client) UnreleasedKey(ctx context.Context) ([]*types.Key, error) {
-	var request interface{}
+	return c.UnreleasedPoolKey(ctx, "")
+}
+
+// UnreleasedPoolKey return all unreleased keys of the pool.
+//
+// Deprecated: the number of returned keys is limited, use Keys.
+func (c *Client) UnreleasedPoolKey(ctx context.Context, pool string) ([]*types.Key, error) {
+	request := unreleasedKeyRequest{Pool: pool}
 	response, err := c.unreleasedKey(ctx, request)
 	if err != nil {
 		return nil, err
@@ -120,3 +692,165 @@ func (c *Client) UnreleasedKey(ctx context.Context) ([]*types.Key, error) {
 	res := response.(unreleasedKeyResponse)
 	return res.ListKey, res.Err
 }
+
+// CreatePool creates a new key pool. A random ID is assigned if the pool ID is empty.
+func (c *Client) CreatePool(ctx context.Context, pool *types.Pool) (*types.Pool, error) {
+	request := createPoolRequest{Pool: pool}
+	response, err := c.createPool(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	res := response.(createPoolResponse)
+	return res.Pool, res.Err
+}
+
+// GetPool returns a key pool with given id
+func (c *Client) GetPool(ctx context.Context, id string) (*types.Pool, error) {
+	request := getPoolRequest{ID: id}
+	response, err := c.getPool(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	res := response.(getPoolResponse)
+	return res.Pool, res.Err
+}
+
+// ListPools returns all key pools
+func (c *Client) ListPools(ctx context.Context) ([]*types.Pool, error) {
+	var request interface{}
+	response, err := c.listPools(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	res := response.(listPoolsResponse)
+	return res.Pools, res.Err
+}
+
+// CreateTenant creates a new tenant. A random ID is assigned if the tenant
+// ID is empty. The client must authenticate as an admin out of any tenant.
+func (c *Client) CreateTenant(ctx context.Context, tenant *types.Tenant) (*types.Tenant, error) {
+	request := createTenantRequest{Tenant: tenant}
+	response, err := c.createTenant(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	res := response.(createTenantResponse)
+	return res.Tenant, res.Err
+}
+
+// ListTenants returns all tenants. The client must authenticate as an admin out of any tenant.
+func (c *Client) ListTenants(ctx context.Context) ([]*types.Tenant, error) {
+	var request interface{}
+	response, err := c.listTenants(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	res := response.(listTenantsResponse)
+	return res.Tenants, res.Err
+}
+
+// CreateAPIKey creates a new API key of the tenant. The secret is returned
+// in the Secret field only once. Roles may be empty to grant the key full
+// access to the tenant. The client must authenticate as an admin out of any tenant.
+func (c *Client) CreateAPIKey(ctx context.Context, tenant string, roles []types.Role) (*types.APIKey, error) {
+	request := createAPIKeyRequest{Tenant: tenant, Roles: roles}
+	response, err := c.createAPIKey(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	res := response.(createAPIKeyResponse)
+	return res.Key, res.Err
+}
+
+// RevokeAPIKey revokes an API key of the tenant with given id.
+// The client must authenticate as an admin out of any tenant.
+func (c *Client) RevokeAPIKey(ctx context.Context, tenant, id string) error {
+	request := revokeAPIKeyRequest{Tenant: tenant, ID: id}
+	response, err := c.revokeAPIKey(ctx, request)
+	if err != nil {
+		return err
+	}
+	res := response.(revokeAPIKeyResponse)
+	return res.Err
+}
+
+// CreateWebhook subscribes a webhook to the key events. A random secret is
+// assigned if the webhook secret is empty, it is returned only once. A webhook
+// without event types receives all events.
+func (c *Client) CreateWebhook(ctx context.Context, webhook *types.Webhook) (*types.Webhook, error) {
+	request := createWebhookRequest{Webhook: webhook}
+	response, err := c.createWebhook(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	res := response.(createWebhookResponse)
+	return res.Webhook, res.Err
+}
+
+// ListWebhooks returns all webhooks without their secrets
+func (c *Client) ListWebhooks(ctx context.Context) ([]*types.Webhook, error) {
+	var request interface{}
+	response, err := c.listWebhooks(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	res := response.(listWebhooksResponse)
+	return res.Webhooks, res.Err
+}
+
+// DeleteWebhook deletes a webhook with given id
+func (c *Client) DeleteWebhook(ctx context.Context, id string) error {
+	request := deleteWebhookRequest{ID: id}
+	response, err := c.deleteWebhook(ctx, request)
+	if err != nil {
+		return err
+	}
+	res := response.(deleteWebhookResponse)
+	return res.Err
+}
+
+// ListDeliveries returns the most recent webhook deliveries with the given
+// status. An empty status lists the dead deliveries, which have run out of
+// attempts. A zero limit returns the default number of deliveries.
+func (c *Client) ListDeliveries(ctx context.Context, status types.DeliveryStatus, limit int) ([]*types.Delivery, error) {
+	request := listDeliveriesRequest{Status: status, Limit: limit}
+	response, err := c.listDeliveries(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	res := response.(listDeliveriesResponse)
+	return res.Deliveries, res.Err
+}
+
+// RetryDelivery queues a dead webhook delivery with given id for another round of attempts.
+func (c *Client) RetryDelivery(ctx context.Context, id string) (*types.Delivery, error) {
+	request := retryDeliveryRequest{ID: id}
+	response, err := c.retryDelivery(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	res := response.(retryDeliveryResponse)
+	return res.Delivery, res.Err
+}
+
+// WatchEvents calls fn with the key events as the server streams them,
+// starting after the event with the given ID or with the next change if it
+// is empty. It returns when fn fails, the context is done or the server ends
+// the stream. A watch is resumed with the ID of the last event received.
+func (c *Client) WatchEvents(ctx context.Context, lastEventID string, fn func(*types.Event) error) error {
+	request := watchEventsRequest{LastEventID: lastEventID}
+	response, err := c.watchEvents(ctx, request)
+	if err != nil {
+		return err
+	}
+	res := response.(watchEventsResponse)
+	if res.Err != nil {
+		return res.Err
+	}
+	defer res.Body.Close()
+	err = readServerEvents(res.Body, fn)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
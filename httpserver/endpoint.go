@@ -2,6 +2,7 @@ package httpserver
 
 import (
 	"context"
+	"io"
 
 	"github.com/go-kit/kit/endpoint"
 
@@ -10,28 +11,119 @@ import (
 
 func makeCreateKeyEndpoint(svc service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
-		key, err := svc.createKey(ctx)
+		req := request.(createKeyRequest)
+		key, err := svc.createKey(ctx, req.Pool, req.Validity)
 		return createKeyResponse{Key: key, Err: err}, nil
 	}
 }
 
+type createKeyRequest struct {
+	Pool     string
+	Validity *types.KeyValidity
+}
+
 type createKeyResponse struct {
 	Key *types.Key
 	Err error
 }
 
+func makeCreateKeysEndpoint(svc service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(createKeysRequest)
+		events := make(chan createKeysEvent)
+		go func() {
+			defer close(events)
+			send := func(ev createKeysEvent) {
+				select {
+				case events <- ev:
+				case <-ctx.Done():
+				}
+			}
+
+			// The batch is not interrupted if the client disconnects,
+			// so a long running batch is never left half done.
+			// The batch keeps the request tenant, principal and request info.
+			var last *types.BatchProgress
+			batchCtx := types.WithTenant(context.Background(), types.TenantFromContext(ctx))
+			batchCtx = types.WithPrincipal(batchCtx, types.PrincipalFromContext(ctx))
+			batchCtx = types.WithRequest(batchCtx, types.RequestFromContext(ctx))
+			batchID, err := svc.createKeys(batchCtx, req.Pool, req.Count, req.Generator, req.Validity, func(p *types.BatchProgress) {
+				last = p
+				send(createKeysEvent{Progress: p})
+			})
+			if last == nil {
+				if err != nil {
+					send(createKeysEvent{Err: err})
+				}
+				return
+			}
+			final := *last
+			final.BatchID = batchID
+			final.Done = true
+			if err != nil {
+				final.Error = err.Error()
+			}
+			send(createKeysEvent{Progress: &final, Err: err})
+		}()
+		return createKeysResponse{Events: events}, nil
+	}
+}
+
+type createKeysRequest struct {
+	Pool      string              `json:"-"`
+	Count     int                 `json:"count"`
+	Generator *types.KeyGenParams `json:"generator,omitempty"`
+	Validity  *types.KeyValidity  `json:"validity,omitempty"`
+}
+
+// createKeysEvent is a batch progress update or a batch error.
+// Err without Progress means the batch has not been started.
+type createKeysEvent struct {
+	Progress *types.BatchProgress
+	Err      error
+}
+
+type createKeysResponse struct {
+	Events <-chan createKeysEvent // Server side progress events.
+	Body   io.ReadCloser          // Client side progress stream.
+	Err    error
+}
+
 func makeGetKeyEndpoint(svc service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
-		key, err := svc.getKey(ctx)
+		req := request.(getKeyRequest)
+		key, err := svc.getKey(ctx, req.Pool)
 		return getKeyResponse{Key: key, Err: err}, nil
 	}
 }
 
+type getKeyRequest struct {
+	Pool string
+}
+
 type getKeyResponse struct {
 	Key string
 	Err error
 }
 
+func makeIssueKeyEndpoint(svc service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(issueKeyRequest)
+		key, err := svc.issueKey(ctx, req.Pool, req.Issuance)
+		return issueKeyResponse{Key: key, Err: err}, nil
+	}
+}
+
+type issueKeyRequest struct {
+	Pool     string
+	Issuance *types.Issuance
+}
+
+type issueKeyResponse struct {
+	Key *types.Key
+	Err error
+}
+
 func makeCanceledKeyEndpoint(svc service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(canceledKeyRequest)
@@ -48,6 +140,41 @@ type canceledKeyResponse struct {
 	Err error
 }
 
+func makeRedeemKeyEndpoint(svc service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(redeemKeyRequest)
+		key, err := svc.redeemKey(ctx, req.ID, req.Redeemer)
+		return redeemKeyResponse{Key: key, Err: err}, nil
+	}
+}
+
+type redeemKeyRequest struct {
+	ID       string `json:"-"`
+	Redeemer string `json:"redeemer,omitempty"`
+}
+
+type redeemKeyResponse struct {
+	Key *types.Key
+	Err error
+}
+
+func makeRevokeKeyEndpoint(svc service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(revokeKeyRequest)
+		key, err := svc.revokeKey(ctx, req.ID)
+		return revokeKeyResponse{Key: key, Err: err}, nil
+	}
+}
+
+type revokeKeyRequest struct {
+	ID string
+}
+
+type revokeKeyResponse struct {
+	Key *types.Key
+	Err error
+}
+
 func makeVerificationKeyEndpoint(svc service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(verificationKeyRequest)
@@ -65,14 +192,325 @@ type verificationKeyResponse struct {
 	Err error
 }
 
+func makeKeyHistoryEndpoint(svc service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(keyHistoryRequest)
+		records, err := svc.keyHistory(ctx, req.ID)
+		return keyHistoryResponse{Records: records, Err: err}, nil
+	}
+}
+
+type keyHistoryRequest struct {
+	ID string
+}
+
+type keyHistoryResponse struct {
+	Records []*types.AuditRecord
+	Err     error
+}
+
 func makeUnreleasedKeyEndpoint(svc service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
-		listKey, err := svc.unreleasedKey(ctx)
+		req := request.(unreleasedKeyRequest)
+		listKey, err := svc.unreleasedKey(ctx, req.Pool)
 		return unreleasedKeyResponse{ListKey: listKey, Err: err}, nil
 	}
 }
 
+type unreleasedKeyRequest struct {
+	Pool string
+}
+
 type unreleasedKeyResponse struct {
 	ListKey []*types.Key
 	Err     error
 }
+
+func makeListKeysEndpoint(svc service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(listKeysRequest)
+		page, err := svc.listKeys(ctx, req.Params)
+		return listKeysResponse{Page: page, Err: err}, nil
+	}
+}
+
+type listKeysRequest struct {
+	Params *types.KeyListParams
+}
+
+type listKeysResponse struct {
+	Page *types.KeyPage
+	Err  error
+}
+
+func makeExportKeysEndpoint(svc service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(exportKeysRequest)
+		// The keys are exported as the response encoder writes them,
+		// so the result is never held in memory.
+		export := func(fn func(*types.Key) error) error {
+			return svc.exportKeys(ctx, req.Params, fn)
+		}
+		return exportKeysResponse{Format: req.Params.Format, Export: export}, nil
+	}
+}
+
+type exportKeysRequest struct {
+	Params *types.KeyExportParams
+}
+
+type exportKeysResponse struct {
+	Format types.FileFormat
+	Export func(fn func(*types.Key) error) error // Server side key stream.
+	Body   io.ReadCloser                         // Client side export file.
+	Err    error
+}
+
+func makeImportKeysEndpoint(svc service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(importKeysRequest)
+		report, err := svc.importKeys(ctx, req.Pool, req.Keys)
+		return importKeysResponse{Report: report, Err: err}, nil
+	}
+}
+
+type importKeysRequest struct {
+	Pool   string
+	Format types.FileFormat
+	Keys   []*types.ImportKey // Server side decoded keys.
+	File   io.Reader          // Client side import file.
+}
+
+type importKeysResponse struct {
+	Report *types.ImportReport
+	Err    error
+}
+
+func makeKeyStatsEndpoint(svc service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(keyStatsRequest)
+		stats, err := svc.keyStats(ctx, req.Pool)
+		return keyStatsResponse{Stats: stats, Err: err}, nil
+	}
+}
+
+type keyStatsRequest struct {
+	Pool *string
+}
+
+type keyStatsResponse struct {
+	Stats *types.KeyStats
+	Err   error
+}
+
+func makeCreatePoolEndpoint(svc service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(createPoolRequest)
+		pool, err := svc.createPool(ctx, req.Pool)
+		return createPoolResponse{Pool: pool, Err: err}, nil
+	}
+}
+
+type createPoolRequest struct {
+	Pool *types.Pool
+}
+
+type createPoolResponse struct {
+	Pool *types.Pool
+	Err  error
+}
+
+func makeGetPoolEndpoint(svc service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(getPoolRequest)
+		pool, err := svc.getPool(ctx, req.ID)
+		return getPoolResponse{Pool: pool, Err: err}, nil
+	}
+}
+
+type getPoolRequest struct {
+	ID string
+}
+
+type getPoolResponse struct {
+	Pool *types.Pool
+	Err  error
+}
+
+func makeListPoolsEndpoint(svc service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		pools, err := svc.listPools(ctx)
+		return listPoolsResponse{Pools: pools, Err: err}, nil
+	}
+}
+
+type listPoolsResponse struct {
+	Pools []*types.Pool
+	Err   error
+}
+
+func makeCreateTenantEndpoint(svc service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(createTenantRequest)
+		tenant, err := svc.createTenant(ctx, req.Tenant)
+		return createTenantResponse{Tenant: tenant, Err: err}, nil
+	}
+}
+
+type createTenantRequest struct {
+	Tenant *types.Tenant
+}
+
+type createTenantResponse struct {
+	Tenant *types.Tenant
+	Err    error
+}
+
+func makeListTenantsEndpoint(svc service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		tenants, err := svc.listTenants(ctx)
+		return listTenantsResponse{Tenants: tenants, Err: err}, nil
+	}
+}
+
+type listTenantsResponse struct {
+	Tenants []*types.Tenant
+	Err     error
+}
+
+func makeCreateAPIKeyEndpoint(svc service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(createAPIKeyRequest)
+		key, err := svc.createAPIKey(ctx, req.Tenant, req.Roles)
+		return createAPIKeyResponse{Key: key, Err: err}, nil
+	}
+}
+
+type createAPIKeyRequest struct {
+	Tenant string
+	Roles  []types.Role
+}
+
+type createAPIKeyResponse struct {
+	Key *types.APIKey
+	Err error
+}
+
+func makeRevokeAPIKeyEndpoint(svc service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(revokeAPIKeyRequest)
+		err := svc.revokeAPIKey(ctx, req.Tenant, req.ID)
+		return revokeAPIKeyResponse{Err: err}, nil
+	}
+}
+
+type revokeAPIKeyRequest struct {
+	Tenant string
+	ID     string
+}
+
+type revokeAPIKeyResponse struct {
+	Err error
+}
+
+func makeCreateWebhookEndpoint(svc service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(createWebhookRequest)
+		webhook, err := svc.createWebhook(ctx, req.Webhook)
+		return createWebhookResponse{Webhook: webhook, Err: err}, nil
+	}
+}
+
+type createWebhookRequest struct {
+	Webhook *types.Webhook
+}
+
+type createWebhookResponse struct {
+	Webhook *types.Webhook
+	Err     error
+}
+
+func makeListWebhooksEndpoint(svc service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		webhooks, err := svc.listWebhooks(ctx)
+		return listWebhooksResponse{Webhooks: webhooks, Err: err}, nil
+	}
+}
+
+type listWebhooksResponse struct {
+	Webhooks []*types.Webhook
+	Err      error
+}
+
+func makeDeleteWebhookEndpoint(svc service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(deleteWebhookRequest)
+		err := svc.deleteWebhook(ctx, req.ID)
+		return deleteWebhookResponse{Err: err}, nil
+	}
+}
+
+type deleteWebhookRequest struct {
+	ID string
+}
+
+type deleteWebhookResponse struct {
+	Err error
+}
+
+func makeListDeliveriesEndpoint(svc service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(listDeliveriesRequest)
+		deliveries, err := svc.listDeliveries(ctx, req.Status, req.Limit)
+		return listDeliveriesResponse{Deliveries: deliveries, Err: err}, nil
+	}
+}
+
+type listDeliveriesRequest struct {
+	Status types.DeliveryStatus
+	Limit  int
+}
+
+type listDeliveriesResponse struct {
+	Deliveries []*types.Delivery
+	Err        error
+}
+
+func makeRetryDeliveryEndpoint(svc service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(retryDeliveryRequest)
+		delivery, err := svc.retryDelivery(ctx, req.ID)
+		return retryDeliveryResponse{Delivery: delivery, Err: err}, nil
+	}
+}
+
+type retryDeliveryRequest struct {
+	ID string
+}
+
+type retryDeliveryResponse struct {
+	Delivery *types.Delivery
+	Err      error
+}
+
+func makeWatchEventsEndpoint(svc service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(watchEventsRequest)
+		// The events are watched as the response encoder writes them,
+		// until the client disconnects.
+		watch := func(fn func(*types.Event) error) error {
+			return svc.watchEvents(ctx, req.LastEventID, fn)
+		}
+		return watchEventsResponse{Watch: watch}, nil
+	}
+}
+
+type watchEventsRequest struct {
+	LastEventID string
+}
+
+type watchEventsResponse struct {
+	Watch func(fn func(*types.Event) error) error // Server side event stream.
+	Body  io.ReadCloser                           // Client side event stream.
+	Err   error
+}
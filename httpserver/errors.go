@@ -23,6 +23,9 @@ const (
 	ErrNotFound
 	ErrConflict
 	ErrInternal
+	ErrUnauthorized
+	ErrForbidden
+	ErrTooLarge
 )
 
 func errorf(kind ErrorKind, format string, v ...interface{}) error {
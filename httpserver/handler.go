@@ -9,12 +9,16 @@ import (
 	kithttp "github.com/go-kit/kit/transport/http"
 	"github.com/gorilla/mux"
 	"golang.org/x/time/rate"
+
+	"github.com/evgeny08/collection-key/types"
 )
 
 type handlerConfig struct {
-	svc         service
-	logger      log.Logger
-	rateLimiter *rate.Limiter
+	svc            service
+	logger         log.Logger
+	rateLimiter    *rate.Limiter
+	authenticators []Authenticator
+	anonymousRoles []types.Role
 }
 
 // newHandler creates a new HTTP handler serving service endpoints.
@@ -22,55 +26,337 @@ func newHandler(cfg *handlerConfig) http.Handler {
 	svc := &loggingMiddleware{next: cfg.svc, logger: cfg.logger}
 
 	createKeyEndpoint := makeCreateKeyEndpoint(svc)
-	createKeyEndpoint = applyMiddleware(createKeyEndpoint, "CreateKey", cfg)
+	createKeyEndpoint = applyMiddleware(createKeyEndpoint, "CreateKey", cfg, requireRole(types.RoleAdmin))
+
+	createKeysEndpoint := makeCreateKeysEndpoint(svc)
+	createKeysEndpoint = applyMiddleware(createKeysEndpoint, "CreateKeys", cfg, requireRole(types.RoleAdmin))
+
+	importKeysEndpoint := makeImportKeysEndpoint(svc)
+	importKeysEndpoint = applyMiddleware(importKeysEndpoint, "ImportKeys", cfg, requireRole(types.RoleAdmin))
 
 	getKeyEndpoint := makeGetKeyEndpoint(svc)
-	getKeyEndpoint = applyMiddleware(getKeyEndpoint, "GetKey", cfg)
+	getKeyEndpoint = applyMiddleware(getKeyEndpoint, "GetKey", cfg, requireRole(types.RoleIssuer))
+
+	issueKeyEndpoint := makeIssueKeyEndpoint(svc)
+	issueKeyEndpoint = applyMiddleware(issueKeyEndpoint, "IssueKey", cfg, requireRole(types.RoleIssuer))
+
+	listKeysEndpoint := makeListKeysEndpoint(svc)
+	listKeysEndpoint = applyMiddleware(listKeysEndpoint, "ListKeys", cfg, requireRole(types.RoleIssuer))
+
+	exportKeysEndpoint := makeExportKeysEndpoint(svc)
+	exportKeysEndpoint = applyMiddleware(exportKeysEndpoint, "ExportKeys", cfg, requireRole(types.RoleIssuer))
+
+	keyStatsEndpoint := makeKeyStatsEndpoint(svc)
+	keyStatsEndpoint = applyMiddleware(keyStatsEndpoint, "KeyStats", cfg, requireRole(types.RoleIssuer))
 
 	canceledKeyEndpoint := makeCanceledKeyEndpoint(svc)
-	canceledKeyEndpoint = applyMiddleware(canceledKeyEndpoint, "RedemptionKey", cfg)
+	canceledKeyEndpoint = applyMiddleware(canceledKeyEndpoint, "RedemptionKey", cfg, requireRole(types.RoleIssuer))
+
+	redeemKeyEndpoint := makeRedeemKeyEndpoint(svc)
+	redeemKeyEndpoint = applyMiddleware(redeemKeyEndpoint, "RedeemKey", cfg, requireRole(types.RoleVerifier))
+
+	revokeKeyEndpoint := makeRevokeKeyEndpoint(svc)
+	revokeKeyEndpoint = applyMiddleware(revokeKeyEndpoint, "RevokeKey", cfg, requireRole(types.RoleAdmin))
 
 	verificationKeyEndpoint := makeVerificationKeyEndpoint(svc)
-	verificationKeyEndpoint = applyMiddleware(verificationKeyEndpoint, "GetKey", cfg)
+	verificationKeyEndpoint = applyMiddleware(verificationKeyEndpoint, "GetKey", cfg, requireRole(types.RoleVerifier))
+
+	keyHistoryEndpoint := makeKeyHistoryEndpoint(svc)
+	keyHistoryEndpoint = applyMiddleware(keyHistoryEndpoint, "KeyHistory", cfg, requireRole(types.RoleAdmin))
 
 	unreleasedKeyEndpoint := makeUnreleasedKeyEndpoint(svc)
-	unreleasedKeyEndpoint = applyMiddleware(unreleasedKeyEndpoint, "UnreleasedKey", cfg)
+	unreleasedKeyEndpoint = applyMiddleware(unreleasedKeyEndpoint, "UnreleasedKey", cfg, requireRole(types.RoleAdmin))
+
+	createPoolEndpoint := makeCreatePoolEndpoint(svc)
+	createPoolEndpoint = applyMiddleware(createPoolEndpoint, "CreatePool", cfg, requireRole(types.RoleAdmin))
+
+	getPoolEndpoint := makeGetPoolEndpoint(svc)
+	getPoolEndpoint = applyMiddleware(getPoolEndpoint, "GetPool", cfg, requireRole(types.RoleIssuer, types.RoleVerifier))
+
+	listPoolsEndpoint := makeListPoolsEndpoint(svc)
+	listPoolsEndpoint = applyMiddleware(listPoolsEndpoint, "ListPools", cfg, requireRole(types.RoleIssuer, types.RoleVerifier))
+
+	createTenantEndpoint := makeCreateTenantEndpoint(svc)
+	createTenantEndpoint = applyMiddleware(createTenantEndpoint, "CreateTenant", cfg, requireOperator())
+
+	listTenantsEndpoint := makeListTenantsEndpoint(svc)
+	listTenantsEndpoint = applyMiddleware(listTenantsEndpoint, "ListTenants", cfg, requireOperator())
+
+	createAPIKeyEndpoint := makeCreateAPIKeyEndpoint(svc)
+	createAPIKeyEndpoint = applyMiddleware(createAPIKeyEndpoint, "CreateAPIKey", cfg, requireOperator())
+
+	revokeAPIKeyEndpoint := makeRevokeAPIKeyEndpoint(svc)
+	revokeAPIKeyEndpoint = applyMiddleware(revokeAPIKeyEndpoint, "RevokeAPIKey", cfg, requireOperator())
+
+	createWebhookEndpoint := makeCreateWebhookEndpoint(svc)
+	createWebhookEndpoint = applyMiddleware(createWebhookEndpoint, "CreateWebhook", cfg, requireRole(types.RoleAdmin))
+
+	listWebhooksEndpoint := makeListWebhooksEndpoint(svc)
+	listWebhooksEndpoint = applyMiddleware(listWebhooksEndpoint, "ListWebhooks", cfg, requireRole(types.RoleAdmin))
+
+	deleteWebhookEndpoint := makeDeleteWebhookEndpoint(svc)
+	deleteWebhookEndpoint = applyMiddleware(deleteWebhookEndpoint, "DeleteWebhook", cfg, requireRole(types.RoleAdmin))
+
+	listDeliveriesEndpoint := makeListDeliveriesEndpoint(svc)
+	listDeliveriesEndpoint = applyMiddleware(listDeliveriesEndpoint, "ListDeliveries", cfg, requireRole(types.RoleAdmin))
+
+	retryDeliveryEndpoint := makeRetryDeliveryEndpoint(svc)
+	retryDeliveryEndpoint = applyMiddleware(retryDeliveryEndpoint, "RetryDelivery", cfg, requireRole(types.RoleAdmin))
+
+	watchEventsEndpoint := makeWatchEventsEndpoint(svc)
+	watchEventsEndpoint = applyMiddleware(watchEventsEndpoint, "WatchEvents", cfg, requireRole(types.RoleIssuer))
+
+	authn := authMiddleware(svc, cfg.authenticators, cfg.anonymousRoles)
+	// Issuance, creation and cancellation accept an Idempotency-Key header.
+	idempotent := idempotencyMiddleware(svc, cfg.logger)
 
 	router := mux.NewRouter()
 
-	router.Path("/api/v1/key").Methods("POST").Handler(kithttp.NewServer(
+	router.Path("/api/v1/key").Methods("POST").Handler(authn(idempotent(kithttp.NewServer(
 		createKeyEndpoint,
 		decodeCreateKeyRequest,
 		encodeCreateKeyResponse,
-	))
+		kithttp.ServerErrorEncoder(encodeServerError),
+	))))
 
-	router.Path("/api/v1/key/issued").Methods("GET").Handler(kithttp.NewServer(
+	router.Path("/api/v1/keys:batch").Methods("POST").Handler(authn(kithttp.NewServer(
+		createKeysEndpoint,
+		decodeCreateKeysRequest,
+		encodeCreateKeysResponse,
+		kithttp.ServerErrorEncoder(encodeServerError),
+	)))
+
+	router.Path("/api/v1/keys:import").Methods("POST").Handler(authn(kithttp.NewServer(
+		importKeysEndpoint,
+		decodeImportKeysRequest,
+		encodeImportKeysResponse,
+		kithttp.ServerErrorEncoder(encodeServerError),
+	)))
+
+	router.Path("/api/v1/key/issued").Methods("GET").Handler(authn(idempotent(kithttp.NewServer(
 		getKeyEndpoint,
 		decodeGetKeyRequest,
 		encodeGetKeyResponse,
-	))
+		kithttp.ServerErrorEncoder(encodeServerError),
+	))))
+
+	router.Path("/api/v1/key/issued").Methods("POST").Handler(authn(idempotent(kithttp.NewServer(
+		issueKeyEndpoint,
+		decodeIssueKeyRequest,
+		encodeIssueKeyResponse,
+		kithttp.ServerErrorEncoder(encodeServerError),
+	))))
+
+	router.Path("/api/v1/keys").Methods("GET").Handler(authn(kithttp.NewServer(
+		listKeysEndpoint,
+		decodeListKeysRequest,
+		encodeListKeysResponse,
+		kithttp.ServerErrorEncoder(encodeServerError),
+	)))
+
+	router.Path("/api/v1/stats").Methods("GET").Handler(authn(kithttp.NewServer(
+		keyStatsEndpoint,
+		decodeKeyStatsRequest,
+		encodeKeyStatsResponse,
+		kithttp.ServerErrorEncoder(encodeServerError),
+	)))
+
+	router.Path("/api/v1/pools/{pool}/stats").Methods("GET").Handler(authn(kithttp.NewServer(
+		keyStatsEndpoint,
+		decodeKeyStatsRequest,
+		encodeKeyStatsResponse,
+		kithttp.ServerErrorEncoder(encodeServerError),
+	)))
+
+	router.Path("/api/v1/keys:export").Methods("GET").Handler(authn(kithttp.NewServer(
+		exportKeysEndpoint,
+		decodeExportKeysRequest,
+		encodeExportKeysResponse,
+		kithttp.ServerErrorEncoder(encodeServerError),
+	)))
 
-	router.Path("/api/v1/key/{id}/canceled").Methods("POST").Handler(kithttp.NewServer(
+	router.Path("/api/v1/key/{id}/canceled").Methods("POST").Handler(authn(idempotent(kithttp.NewServer(
 		canceledKeyEndpoint,
 		decodeCanceledKeyRequest,
 		encodeCanceledKeyResponse,
-	))
+		kithttp.ServerErrorEncoder(encodeServerError),
+	))))
 
-	router.Path("/api/v1/key/{id}/key").Methods("GET").Handler(kithttp.NewServer(
+	router.Path("/api/v1/key/{id}/redeem").Methods("POST").Handler(authn(kithttp.NewServer(
+		redeemKeyEndpoint,
+		decodeRedeemKeyRequest,
+		encodeRedeemKeyResponse,
+		kithttp.ServerErrorEncoder(encodeServerError),
+	)))
+
+	router.Path("/api/v1/key/{id}/revoke").Methods("POST").Handler(authn(kithttp.NewServer(
+		revokeKeyEndpoint,
+		decodeRevokeKeyRequest,
+		encodeRevokeKeyResponse,
+		kithttp.ServerErrorEncoder(encodeServerError),
+	)))
+
+	router.Path("/api/v1/key/{id}/key").Methods("GET").Handler(authn(kithttp.NewServer(
 		verificationKeyEndpoint,
 		decodeVerificationKeyRequest,
 		encodeVerificationKeyResponse,
-	))
+		kithttp.ServerErrorEncoder(encodeServerError),
+	)))
 
-	router.Path("/api/v1/key").Methods("GET").Handler(kithttp.NewServer(
+	router.Path("/api/v1/key/{id}/history").Methods("GET").Handler(authn(kithttp.NewServer(
+		keyHistoryEndpoint,
+		decodeKeyHistoryRequest,
+		encodeKeyHistoryResponse,
+		kithttp.ServerErrorEncoder(encodeServerError),
+	)))
+
+	router.Path("/api/v1/key").Methods("GET").Handler(authn(kithttp.NewServer(
 		unreleasedKeyEndpoint,
 		decodeUnreleasedKeyRequest,
 		encodeUnreleasedKeyResponse,
-	))
+		kithttp.ServerErrorEncoder(encodeServerError),
+	)))
+
+	router.Path("/api/v1/pools").Methods("POST").Handler(authn(kithttp.NewServer(
+		createPoolEndpoint,
+		decodeCreatePoolRequest,
+		encodeCreatePoolResponse,
+		kithttp.ServerErrorEncoder(encodeServerError),
+	)))
+
+	router.Path("/api/v1/pools").Methods("GET").Handler(authn(kithttp.NewServer(
+		listPoolsEndpoint,
+		decodeListPoolsRequest,
+		encodeListPoolsResponse,
+		kithttp.ServerErrorEncoder(encodeServerError),
+	)))
+
+	router.Path("/api/v1/pools/{pool}").Methods("GET").Handler(authn(kithttp.NewServer(
+		getPoolEndpoint,
+		decodeGetPoolRequest,
+		encodeGetPoolResponse,
+		kithttp.ServerErrorEncoder(encodeServerError),
+	)))
+
+	// Pool-scoped key routes share the endpoints of the keys out of any pool.
+	router.Path("/api/v1/pools/{pool}/keys").Methods("POST").Handler(authn(idempotent(kithttp.NewServer(
+		createKeyEndpoint,
+		decodeCreateKeyRequest,
+		encodeCreateKeyResponse,
+		kithttp.ServerErrorEncoder(encodeServerError),
+	))))
+
+	router.Path("/api/v1/pools/{pool}/keys:batch").Methods("POST").Handler(authn(kithttp.NewServer(
+		createKeysEndpoint,
+		decodeCreateKeysRequest,
+		encodeCreateKeysResponse,
+		kithttp.ServerErrorEncoder(encodeServerError),
+	)))
+
+	router.Path("/api/v1/pools/{pool}/keys:import").Methods("POST").Handler(authn(kithttp.NewServer(
+		importKeysEndpoint,
+		decodeImportKeysRequest,
+		encodeImportKeysResponse,
+		kithttp.ServerErrorEncoder(encodeServerError),
+	)))
+
+	router.Path("/api/v1/pools/{pool}/keys/issued").Methods("GET").Handler(authn(idempotent(kithttp.NewServer(
+		getKeyEndpoint,
+		decodeGetKeyRequest,
+		encodeGetKeyResponse,
+		kithttp.ServerErrorEncoder(encodeServerError),
+	))))
+
+	router.Path("/api/v1/pools/{pool}/keys/issued").Methods("POST").Handler(authn(idempotent(kithttp.NewServer(
+		issueKeyEndpoint,
+		decodeIssueKeyRequest,
+		encodeIssueKeyResponse,
+		kithttp.ServerErrorEncoder(encodeServerError),
+	))))
+
+	router.Path("/api/v1/pools/{pool}/keys").Methods("GET").Handler(authn(kithttp.NewServer(
+		unreleasedKeyEndpoint,
+		decodeUnreleasedKeyRequest,
+		encodeUnreleasedKeyResponse,
+		kithttp.ServerErrorEncoder(encodeServerError),
+	)))
+
+	router.Path("/api/v1/webhooks").Methods("POST").Handler(authn(kithttp.NewServer(
+		createWebhookEndpoint,
+		decodeCreateWebhookRequest,
+		encodeCreateWebhookResponse,
+		kithttp.ServerErrorEncoder(encodeServerError),
+	)))
+
+	router.Path("/api/v1/webhooks").Methods("GET").Handler(authn(kithttp.NewServer(
+		listWebhooksEndpoint,
+		decodeListWebhooksRequest,
+		encodeListWebhooksResponse,
+		kithttp.ServerErrorEncoder(encodeServerError),
+	)))
+
+	router.Path("/api/v1/webhooks/deliveries").Methods("GET").Handler(authn(kithttp.NewServer(
+		listDeliveriesEndpoint,
+		decodeListDeliveriesRequest,
+		encodeListDeliveriesResponse,
+		kithttp.ServerErrorEncoder(encodeServerError),
+	)))
+
+	router.Path("/api/v1/webhooks/deliveries/{id}/retry").Methods("POST").Handler(authn(kithttp.NewServer(
+		retryDeliveryEndpoint,
+		decodeRetryDeliveryRequest,
+		encodeRetryDeliveryResponse,
+		kithttp.ServerErrorEncoder(encodeServerError),
+	)))
+
+	router.Path("/api/v1/webhooks/{id}").Methods("DELETE").Handler(authn(kithttp.NewServer(
+		deleteWebhookEndpoint,
+		decodeDeleteWebhookRequest,
+		encodeDeleteWebhookResponse,
+		kithttp.ServerErrorEncoder(encodeServerError),
+	)))
+
+	router.Path("/api/v1/events").Methods("GET").Handler(authn(kithttp.NewServer(
+		watchEventsEndpoint,
+		decodeWatchEventsRequest,
+		encodeWatchEventsResponse,
+		kithttp.ServerErrorEncoder(encodeServerError),
+	)))
+
+	// Tenant management routes are restricted to the admins out of any tenant.
+	router.Path("/api/v1/tenants").Methods("POST").Handler(authn(kithttp.NewServer(
+		createTenantEndpoint,
+		decodeCreateTenantRequest,
+		encodeCreateTenantResponse,
+		kithttp.ServerErrorEncoder(encodeServerError),
+	)))
+
+	router.Path("/api/v1/tenants").Methods("GET").Handler(authn(kithttp.NewServer(
+		listTenantsEndpoint,
+		decodeListTenantsRequest,
+		encodeListTenantsResponse,
+		kithttp.ServerErrorEncoder(encodeServerError),
+	)))
+
+	router.Path("/api/v1/tenants/{tenant}/api-keys").Methods("POST").Handler(authn(kithttp.NewServer(
+		createAPIKeyEndpoint,
+		decodeCreateAPIKeyRequest,
+		encodeCreateAPIKeyResponse,
+		kithttp.ServerErrorEncoder(encodeServerError),
+	)))
+
+	router.Path("/api/v1/tenants/{tenant}/api-keys/{id}/revoke").Methods("POST").Handler(authn(kithttp.NewServer(
+		revokeAPIKeyEndpoint,
+		decodeRevokeAPIKeyRequest,
+		encodeRevokeAPIKeyResponse,
+		kithttp.ServerErrorEncoder(encodeServerError),
+	)))
 
 	return router
 }
 
-func applyMiddleware(e endpoint.Endpoint, method string, cfg *handlerConfig) endpoint.Endpoint {
+// applyMiddleware applies the rate limiter and the endpoint authorization.
+func applyMiddleware(e endpoint.Endpoint, method string, cfg *handlerConfig, authorize endpoint.Middleware) endpoint.Endpoint {
+	e = authorize(e)
 	return ratelimit.NewErroringLimiter(cfg.rateLimiter)(e)
 }
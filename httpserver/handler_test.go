@@ -2,55 +2,226 @@ package httpserver
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/go-kit/kit/log"
 	"golang.org/x/time/rate"
+	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
+	"os"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/evgeny08/collection-key/auth"
+	"github.com/evgeny08/collection-key/storage"
+	"github.com/evgeny08/collection-key/storage/memstore"
 	"github.com/evgeny08/collection-key/types"
 )
 
 type mockService struct {
-	onCreateKey       func(ctx context.Context) (*types.Key, error)
-	onGetKey          func(ctx context.Context) (string, error)
+	onCreateKey       func(ctx context.Context, pool string, validity *types.KeyValidity) (*types.Key, error)
+	onCreateKeys      func(ctx context.Context, pool string, count int, params *types.KeyGenParams, validity *types.KeyValidity, progress func(*types.BatchProgress)) (string, error)
+	onGetKey          func(ctx context.Context, pool string) (string, error)
+	onIssueKey        func(ctx context.Context, pool string, issuance *types.Issuance) (*types.Key, error)
 	onCanceledKey     func(ctx context.Context, id string) error
+	onRedeemKey       func(ctx context.Context, id, redeemer string) (*types.Key, error)
+	onRevokeKey       func(ctx context.Context, id string) (*types.Key, error)
 	onVerificationKey func(ctx context.Context, id string) (*types.Key, error)
-	onUnreleasedKey   func(ctx context.Context) ([]*types.Key, error)
+	onKeyHistory      func(ctx context.Context, id string) ([]*types.AuditRecord, error)
+	onUnreleasedKey   func(ctx context.Context, pool string) ([]*types.Key, error)
+	onListKeys        func(ctx context.Context, params *types.KeyListParams) (*types.KeyPage, error)
+	onExportKeys      func(ctx context.Context, params *types.KeyExportParams, fn func(*types.Key) error) error
+	onImportKeys      func(ctx context.Context, pool string, keys []*types.ImportKey) (*types.ImportReport, error)
+	onKeyStats        func(ctx context.Context, pool *string) (*types.KeyStats, error)
+	onCreatePool      func(ctx context.Context, pool *types.Pool) (*types.Pool, error)
+	onGetPool         func(ctx context.Context, id string) (*types.Pool, error)
+	onListPools       func(ctx context.Context) ([]*types.Pool, error)
+	onAuthenticate    func(ctx context.Context, apiKey string) (*types.Principal, error)
+	onCreateTenant    func(ctx context.Context, tenant *types.Tenant) (*types.Tenant, error)
+	onListTenants     func(ctx context.Context) ([]*types.Tenant, error)
+	onCreateAPIKey    func(ctx context.Context, tenant string, roles []types.Role) (*types.APIKey, error)
+	onRevokeAPIKey    func(ctx context.Context, tenant, id string) error
+	onCreateWebhook   func(ctx context.Context, webhook *types.Webhook) (*types.Webhook, error)
+	onListWebhooks    func(ctx context.Context) ([]*types.Webhook, error)
+	onDeleteWebhook   func(ctx context.Context, id string) error
+	onListDeliveries  func(ctx context.Context, status types.DeliveryStatus, limit int) ([]*types.Delivery, error)
+	onRetryDelivery   func(ctx context.Context, id string) (*types.Delivery, error)
+	onWatchEvents     func(ctx context.Context, lastEventID string, fn func(*types.Event) error) error
+
+	onBeginIdempotent    func(ctx context.Context, key, fingerprint string) (*types.IdempotencyRecord, error)
+	onCompleteIdempotent func(ctx context.Context, rec *types.IdempotencyRecord) error
+	onAbortIdempotent    func(ctx context.Context, key string) error
+}
+
+func (s *mockService) createKey(ctx context.Context, pool string, validity *types.KeyValidity) (*types.Key, error) {
+	return s.onCreateKey(ctx, pool, validity)
+}
+
+func (s *mockService) createKeys(ctx context.Context, pool string, count int, params *types.KeyGenParams, validity *types.KeyValidity, progress func(*types.BatchProgress)) (string, error) {
+	return s.onCreateKeys(ctx, pool, count, params, validity, progress)
 }
 
-func (s *mockService) createKey(ctx context.Context) (*types.Key, error) {
-	return s.onCreateKey(ctx)
+func (s *mockService) getKey(ctx context.Context, pool string) (string, error) {
+	return s.onGetKey(ctx, pool)
 }
 
-func (s *mockService) getKey(ctx context.Context) (string, error) {
-	return s.onGetKey(ctx)
+func (s *mockService) issueKey(ctx context.Context, pool string, issuance *types.Issuance) (*types.Key, error) {
+	return s.onIssueKey(ctx, pool, issuance)
 }
 
 func (s *mockService) canceledKey(ctx context.Context, id string) error {
 	return s.onCanceledKey(ctx, id)
 }
 
+func (s *mockService) redeemKey(ctx context.Context, id, redeemer string) (*types.Key, error) {
+	return s.onRedeemKey(ctx, id, redeemer)
+}
+
+func (s *mockService) revokeKey(ctx context.Context, id string) (*types.Key, error) {
+	return s.onRevokeKey(ctx, id)
+}
+
 func (s *mockService) verificationKey(ctx context.Context, id string) (*types.Key, error) {
 	return s.onVerificationKey(ctx, id)
 }
 
-func (s *mockService) unreleasedKey(ctx context.Context) ([]*types.Key, error) {
-	return s.onUnreleasedKey(ctx)
+func (s *mockService) keyHistory(ctx context.Context, id string) ([]*types.AuditRecord, error) {
+	return s.onKeyHistory(ctx, id)
+}
+
+func (s *mockService) unreleasedKey(ctx context.Context, pool string) ([]*types.Key, error) {
+	return s.onUnreleasedKey(ctx, pool)
+}
+
+func (s *mockService) listKeys(ctx context.Context, params *types.KeyListParams) (*types.KeyPage, error) {
+	return s.onListKeys(ctx, params)
+}
+
+func (s *mockService) exportKeys(ctx context.Context, params *types.KeyExportParams, fn func(*types.Key) error) error {
+	return s.onExportKeys(ctx, params, fn)
+}
+
+func (s *mockService) importKeys(ctx context.Context, pool string, keys []*types.ImportKey) (*types.ImportReport, error) {
+	return s.onImportKeys(ctx, pool, keys)
+}
+
+func (s *mockService) keyStats(ctx context.Context, pool *string) (*types.KeyStats, error) {
+	return s.onKeyStats(ctx, pool)
+}
+
+func (s *mockService) createPool(ctx context.Context, pool *types.Pool) (*types.Pool, error) {
+	return s.onCreatePool(ctx, pool)
+}
+
+func (s *mockService) getPool(ctx context.Context, id string) (*types.Pool, error) {
+	return s.onGetPool(ctx, id)
+}
+
+func (s *mockService) listPools(ctx context.Context) ([]*types.Pool, error) {
+	return s.onListPools(ctx)
+}
+
+func (s *mockService) authenticate(ctx context.Context, apiKey string) (*types.Principal, error) {
+	return s.onAuthenticate(ctx, apiKey)
+}
+
+func (s *mockService) createTenant(ctx context.Context, tenant *types.Tenant) (*types.Tenant, error) {
+	return s.onCreateTenant(ctx, tenant)
+}
+
+func (s *mockService) listTenants(ctx context.Context) ([]*types.Tenant, error) {
+	return s.onListTenants(ctx)
+}
+
+func (s *mockService) createAPIKey(ctx context.Context, tenant string, roles []types.Role) (*types.APIKey, error) {
+	return s.onCreateAPIKey(ctx, tenant, roles)
+}
+
+func (s *mockService) revokeAPIKey(ctx context.Context, tenant, id string) error {
+	return s.onRevokeAPIKey(ctx, tenant, id)
+}
+
+func (s *mockService) createWebhook(ctx context.Context, webhook *types.Webhook) (*types.Webhook, error) {
+	return s.onCreateWebhook(ctx, webhook)
+}
+
+func (s *mockService) listWebhooks(ctx context.Context) ([]*types.Webhook, error) {
+	return s.onListWebhooks(ctx)
+}
+
+func (s *mockService) deleteWebhook(ctx context.Context, id string) error {
+	return s.onDeleteWebhook(ctx, id)
+}
+
+func (s *mockService) listDeliveries(ctx context.Context, status types.DeliveryStatus, limit int) ([]*types.Delivery, error) {
+	return s.onListDeliveries(ctx, status, limit)
+}
+
+func (s *mockService) retryDelivery(ctx context.Context, id string) (*types.Delivery, error) {
+	return s.onRetryDelivery(ctx, id)
+}
+
+func (s *mockService) watchEvents(ctx context.Context, lastEventID string, fn func(*types.Event) error) error {
+	return s.onWatchEvents(ctx, lastEventID, fn)
+}
+
+func (s *mockService) beginIdempotent(ctx context.Context, key, fingerprint string) (*types.IdempotencyRecord, error) {
+	return s.onBeginIdempotent(ctx, key, fingerprint)
+}
+
+func (s *mockService) completeIdempotent(ctx context.Context, rec *types.IdempotencyRecord) error {
+	return s.onCompleteIdempotent(ctx, rec)
+}
+
+func (s *mockService) abortIdempotent(ctx context.Context, key string) error {
+	return s.onAbortIdempotent(ctx, key)
+}
+
+const (
+	testAdminToken  = "admin-token-0123456789"
+	testHMACKeyID   = "pos"
+	testHMACSecret  = "0123456789abcdef0123456789abcdef"
+	testIssuerToken = "issuer-token-0123456789"
+)
+
+// testAuthenticators authenticates the admin and issuer bearer tokens
+// out of any tenant and the HMAC key of a verifier of tenant t1.
+func testAuthenticators(t *testing.T) []Authenticator {
+	tokens, err := auth.NewTokens([]auth.Token{
+		{Token: testAdminToken, Identity: auth.Identity{Subject: "operator", Roles: []types.Role{types.RoleAdmin}}},
+		{Token: testIssuerToken, Identity: auth.Identity{Subject: "shop", Roles: []types.Role{types.RoleIssuer}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hmac, err := auth.NewHMAC([]auth.HMACKey{
+		{ID: testHMACKeyID, Secret: testHMACSecret, Identity: auth.Identity{Subject: "pos", Tenant: "t1", Roles: []types.Role{types.RoleVerifier}}},
+	}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []Authenticator{tokens, hmac}
 }
 
-func startTestServer(t *testing.T) (*httptest.Server, *Client, *mockService) {
+func startTestServer(t *testing.T, opts ...ClientOption) (*httptest.Server, *Client, *mockService) {
 	svc := &mockService{}
 
 	handler := newHandler(&handlerConfig{
-		svc:         svc,
-		logger:      log.NewNopLogger(),
-		rateLimiter: rate.NewLimiter(rate.Inf, 1),
+		svc:            svc,
+		logger:         log.NewNopLogger(),
+		rateLimiter:    rate.NewLimiter(rate.Inf, 1),
+		authenticators: testAuthenticators(t),
+		anonymousRoles: []types.Role{types.RoleAdmin},
 	})
 
 	server := httptest.NewServer(handler)
 
-	client, err := NewClient(server.URL)
+	client, err := NewClient(server.URL, opts...)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -58,32 +229,71 @@ func startTestServer(t *testing.T) (*httptest.Server, *Client, *mockService) {
 	return server, client, svc
 }
 
+// startWriteTimeoutTestServer starts a test server as startTestServer does
+// with the given write timeout.
+func startWriteTimeoutTestServer(t *testing.T, timeout time.Duration) (*httptest.Server, *Client, *mockService) {
+	svc := &mockService{}
+	server := httptest.NewUnstartedServer(newHandler(&handlerConfig{
+		svc:            svc,
+		logger:         log.NewNopLogger(),
+		rateLimiter:    rate.NewLimiter(rate.Inf, 1),
+		anonymousRoles: []types.Role{types.RoleAdmin},
+	}))
+	server.Config.WriteTimeout = timeout
+	server.Start()
+
+	client, err := NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, client, svc
+}
+
 func TestCreateKey(t *testing.T) {
 	server, client, svc := startTestServer(t)
 	defer server.Close()
 
+	expiresAt := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
 	testCases := []struct {
-		name string
-		key  *types.Key
-		err  error
+		name     string
+		validity *types.KeyValidity
+		key      *types.Key
+		err      error
 	}{
 		{
 			name: "ok response",
 			key: &types.Key{
-				ID:       "7777",
-				Issued:   false,
-				Canceled: false,
+				ID:     "7777",
+				Status: types.StatusAvailable,
+			},
+			err: nil,
+		},
+		{
+			name:     "ok response with validity",
+			validity: &types.KeyValidity{ExpiresAt: &expiresAt},
+			key: &types.Key{
+				ID:        "8888",
+				ExpiresAt: &expiresAt,
 			},
 			err: nil,
 		},
+		{
+			name: "err response",
+			key:  nil,
+			err:  errorf(ErrBadParams, "expiry time is in the past"),
+		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			svc.onCreateKey = func(ctx context.Context) (*types.Key, error) {
+			svc.onCreateKey = func(ctx context.Context, pool string, validity *types.KeyValidity) (*types.Key, error) {
+				if !reflect.DeepEqual(validity, tc.validity) {
+					t.Fatalf("got validity %#v want %#v", validity, tc.validity)
+				}
 				return tc.key, tc.err
 			}
-			gotKey, gotErr := client.CreateKey(context.Background())
+			gotKey, gotErr := client.CreateKey(context.Background(), tc.validity)
 			if !reflect.DeepEqual(gotKey, tc.key) {
 				t.Fatalf("got key %#v want %#v", gotKey, tc.key)
 			}
@@ -95,50 +305,415 @@ func TestCreateKey(t *testing.T) {
 	}
 }
 
+func TestCreateKeys(t *testing.T) {
+	server, client, svc := startTestServer(t)
+	defer server.Close()
+
+	testCases := []struct {
+		name         string
+		count        int
+		batchID      string
+		err          error
+		wantProgress []types.BatchProgress
+		wantErr      error
+	}{
+		{
+			name:    "ok response",
+			count:   3,
+			batchID: "b1",
+			wantProgress: []types.BatchProgress{
+				{BatchID: "b1", Created: 0, Total: 3},
+				{BatchID: "b1", Created: 2, Total: 3},
+				{BatchID: "b1", Created: 3, Total: 3},
+				{BatchID: "b1", Created: 3, Total: 3, Done: true},
+			},
+		},
+		{
+			name:    "err before start",
+			count:   0,
+			err:     errorf(ErrBadParams, "count must be between 1 and %d", maxBatchKeys),
+			wantErr: errorf(ErrBadParams, "count must be between 1 and %d", maxBatchKeys),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			svc.onCreateKeys = func(ctx context.Context, pool string, count int, params *types.KeyGenParams, validity *types.KeyValidity, progress func(*types.BatchProgress)) (string, error) {
+				if tc.err != nil {
+					return "", tc.err
+				}
+				progress(&types.BatchProgress{BatchID: tc.batchID, Total: count})
+				progress(&types.BatchProgress{BatchID: tc.batchID, Created: 2, Total: count})
+				progress(&types.BatchProgress{BatchID: tc.batchID, Created: 3, Total: count})
+				return tc.batchID, nil
+			}
+			var gotProgress []types.BatchProgress
+			gotBatchID, gotErr := client.CreateKeys(context.Background(), tc.count, nil, nil, func(p *types.BatchProgress) {
+				gotProgress = append(gotProgress, *p)
+			})
+			if gotBatchID != tc.batchID {
+				t.Fatalf("got batch id %q want %q", gotBatchID, tc.batchID)
+			}
+			if !reflect.DeepEqual(gotProgress, tc.wantProgress) {
+				t.Fatalf("got progress %#v want %#v", gotProgress, tc.wantProgress)
+			}
+			if !reflect.DeepEqual(gotErr, tc.wantErr) {
+				t.Fatalf("got error %#v want %#v", gotErr, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestCreateKeysWriteTimeout(t *testing.T) {
+	server, client, svc := startWriteTimeoutTestServer(t, 50*time.Millisecond)
+	defer server.Close()
+
+	// The batch takes longer than the server write timeout.
+	svc.onCreateKeys = func(ctx context.Context, pool string, count int, params *types.KeyGenParams, validity *types.KeyValidity, progress func(*types.BatchProgress)) (string, error) {
+		for created := 1; created <= count; created++ {
+			progress(&types.BatchProgress{BatchID: "b1", Created: created, Total: count})
+			time.Sleep(30 * time.Millisecond)
+		}
+		return "b1", nil
+	}
+	var last types.BatchProgress
+	batchID, err := client.CreateKeys(context.Background(), 5, nil, nil, func(p *types.BatchProgress) {
+		last = *p
+	})
+	if err != nil || batchID != "b1" {
+		t.Fatalf("got batch %q and error %v want b1", batchID, err)
+	}
+	if want := (types.BatchProgress{BatchID: "b1", Created: 5, Total: 5, Done: true}); last != want {
+		t.Fatalf("got last progress %#v want %#v", last, want)
+	}
+}
+
 func TestGetKey(t *testing.T) {
 	server, client, svc := startTestServer(t)
 	defer server.Close()
 
 	testCases := []struct {
 		name string
-		key  *types.Key
+		key  string
 		err  error
 	}{
 		{
 			name: "ok response",
-			key: &types.Key{
-				ID:       "ki87",
-				Issued:   false,
-				Canceled: false,
-			},
-			err: nil,
+			key:  "ki87",
+			err:  nil,
 		},
 		{
 			name: "err response",
+			key:  "",
+			err:  errorf(ErrNotFound, "failed to find unreleased key"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			svc.onGetKey = func(ctx context.Context, pool string) (string, error) {
+				return tc.key, tc.err
+			}
+			gotKey, gotErr := client.GetKey(context.Background())
+			if gotKey != tc.key {
+				t.Fatalf("got key %q want %q", gotKey, tc.key)
+			}
+			if !reflect.DeepEqual(gotErr, tc.err) {
+				t.Fatalf("got error %#v want %#v", gotErr, tc.err)
+			}
+
+		})
+	}
+}
+
+func TestIssueKey(t *testing.T) {
+	server, client, svc := startTestServer(t)
+	defer server.Close()
+
+	issuedAt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name     string
+		pool     string
+		issuance *types.Issuance
+		key      *types.Key
+		err      error
+	}{
+		{
+			name:     "ok response",
+			issuance: &types.Issuance{Recipient: "customer-1", Metadata: map[string]string{"order": "o-1"}},
 			key: &types.Key{
-				ID:       "trew",
-				Issued:   true,
-				Canceled: false,
+				ID:        "ki87",
+				Status:    types.StatusIssued,
+				IssuedAt:  &issuedAt,
+				Recipient: "customer-1",
+				Metadata:  map[string]string{"order": "o-1"},
 			},
-			err: errorf(ErrNotFound, "failed to find unreleased key"),
+		},
+		{
+			name: "ok response without issuance",
+			pool: "spring",
+			key:  &types.Key{ID: "ki88", Status: types.StatusIssued, PoolID: "spring", IssuedAt: &issuedAt},
+		},
+		{
+			name:     "err response",
+			issuance: &types.Issuance{Recipient: "customer-1"},
+			err:      errorf(ErrNotFound, "key is not found"),
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			svc.onGetKey = func(ctx context.Context) (string, error) {
-				return "", tc.err
+			svc.onIssueKey = func(ctx context.Context, pool string, issuance *types.Issuance) (*types.Key, error) {
+				want := tc.issuance
+				if want == nil {
+					want = &types.Issuance{}
+				}
+				if pool != tc.pool || !reflect.DeepEqual(issuance, want) {
+					t.Fatalf("got pool %q issuance %#v want %q %#v", pool, issuance, tc.pool, want)
+				}
+				return tc.key, tc.err
 			}
-			gotKey, gotErr := client.GetKey(context.Background())
+			gotKey, gotErr := client.IssuePoolKey(context.Background(), tc.pool, tc.issuance)
 			if !reflect.DeepEqual(gotKey, tc.key) {
 				t.Fatalf("got key %#v want %#v", gotKey, tc.key)
 			}
 			if !reflect.DeepEqual(gotErr, tc.err) {
 				t.Fatalf("got error %#v want %#v", gotErr, tc.err)
 			}
+		})
+	}
+}
+
+func TestKeysByRecipient(t *testing.T) {
+	server, client, svc := startTestServer(t)
+	defer server.Close()
+
+	keys := []*types.Key{
+		{ID: "ki87", Status: types.StatusIssued, Recipient: "order #1/a"},
+		{ID: "ki88", Status: types.StatusRedeemed, Recipient: "order #1/a"},
+	}
+	svc.onListKeys = func(ctx context.Context, params *types.KeyListParams) (*types.KeyPage, error) {
+		if params.Sort != types.SortByIssued {
+			return nil, errorf(ErrBadParams, "unexpected sort %q", params.Sort)
+		}
+		if params.Recipient != "order #1/a" {
+			return &types.KeyPage{Keys: []*types.Key{}}, nil
+		}
+		return &types.KeyPage{Keys: keys}, nil
+	}
+
+	gotKeys, err := client.KeysByRecipient(context.Background(), "order #1/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotKeys, keys) {
+		t.Fatalf("got keys %#v want %#v", gotKeys, keys)
+	}
+	gotKeys, err = client.KeysByRecipient(context.Background(), "unknown")
+	if err != nil || len(gotKeys) != 0 {
+		t.Fatalf("got keys %#v, %v want none", gotKeys, err)
+	}
+	_, err = client.KeysByRecipient(context.Background(), "")
+	if wantErr := errorf(ErrBadParams, "empty recipient"); !reflect.DeepEqual(err, wantErr) {
+		t.Fatalf("got error %#v want %#v", err, wantErr)
+	}
+}
+
+func TestListKeys(t *testing.T) {
+	server, client, svc := startTestServer(t)
+	defer server.Close()
+
+	since := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	pool := ""
+	keys := []*types.Key{
+		{ID: "aaaa"}, {ID: "aaab"}, {ID: "aaac"}, {ID: "aaad"}, {ID: "aaae"},
+	}
+	svc.onListKeys = func(ctx context.Context, params *types.KeyListParams) (*types.KeyPage, error) {
+		want := types.KeyFilter{
+			Statuses:     []types.KeyStatus{types.StatusAvailable, types.StatusIssued},
+			PoolID:       &pool,
+			IDPrefix:     "aa",
+			CreatedSince: &since,
+		}
+		if !reflect.DeepEqual(params.KeyFilter, want) {
+			return nil, errorf(ErrBadParams, "got filter %#v want %#v", params.KeyFilter, want)
+		}
+		if params.Sort != types.SortByCreatedDesc || params.Limit != 2 {
+			return nil, errorf(ErrBadParams, "got sort %q and limit %d", params.Sort, params.Limit)
+		}
+		start := 0
+		if params.Cursor != "" {
+			start, _ = strconv.Atoi(params.Cursor)
+		}
+		end := start + params.Limit
+		if end >= len(keys) {
+			return &types.KeyPage{Keys: keys[start:]}, nil
+		}
+		return &types.KeyPage{Keys: keys[start:end], NextCursor: strconv.Itoa(end)}, nil
+	}
+
+	params := &types.KeyListParams{
+		KeyFilter: types.KeyFilter{
+			Statuses:     []types.KeyStatus{types.StatusAvailable, types.StatusIssued},
+			PoolID:       &pool,
+			IDPrefix:     "aa",
+			CreatedSince: &since,
+		},
+		Sort:  types.SortByCreatedDesc,
+		Limit: 2,
+	}
+	page, err := client.ListKeys(context.Background(), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page, &types.KeyPage{Keys: keys[:2], NextCursor: "2"}) {
+		t.Fatalf("got page %#v", page)
+	}
+
+	var gotKeys []*types.Key
+	it := client.Keys(context.Background(), params)
+	for it.Next() {
+		gotKeys = append(gotKeys, it.Key())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotKeys, keys) {
+		t.Fatalf("got keys %#v want %#v", gotKeys, keys)
+	}
+
+	params.Sort = "size"
+	it = client.Keys(context.Background(), params)
+	if it.Next() {
+		t.Fatal("got a key from a failed listing")
+	}
+	if it.Err() == nil {
+		t.Fatal("got no error from a failed listing")
+	}
+}
+
+func TestExportKeysWriteTimeout(t *testing.T) {
+	server, client, svc := startWriteTimeoutTestServer(t, 50*time.Millisecond)
+	defer server.Close()
+
+	// The export takes longer than the server write timeout.
+	svc.onExportKeys = func(ctx context.Context, params *types.KeyExportParams, fn func(*types.Key) error) error {
+		for i := 0; i < 5; i++ {
+			if err := fn(&types.Key{ID: fmt.Sprintf("ke%02d", i), Status: types.StatusAvailable}); err != nil {
+				return err
+			}
+			time.Sleep(30 * time.Millisecond)
+		}
+		return nil
+	}
+	var buf strings.Builder
+	if err := client.ExportKeys(context.Background(), &types.KeyExportParams{Format: types.FormatNDJSON}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 5 {
+		t.Fatalf("got %d exported keys want 5", n)
+	}
+}
+
+func TestExportKeys(t *testing.T) {
+	server, client, svc := startTestServer(t)
+	defer server.Close()
+
+	created := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	keys := []*types.Key{
+		{ID: "ke01", Status: types.StatusAvailable, CreatedAt: &created},
+		{ID: "ke02", Status: types.StatusIssued, Recipient: "order, #2", Metadata: map[string]string{"order": "o-2"}},
+	}
+	svc.onExportKeys = func(ctx context.Context, params *types.KeyExportParams, fn func(*types.Key) error) error {
+		if params.Sort == "size" {
+			return errorf(ErrBadParams, "unknown sort order %q", params.Sort)
+		}
+		if params.Recipient != "" {
+			return nil
+		}
+		for _, key := range keys {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+		if params.IDPrefix == "broken" {
+			return errorf(ErrInternal, "failed to export keys: cursor closed")
+		}
+		return nil
+	}
+
+	testCases := []struct {
+		name   string
+		params *types.KeyExportParams
+		want   string
+		err    error
+	}{
+		{
+			name:   "ndjson",
+			params: &types.KeyExportParams{Format: types.FormatNDJSON},
+			want: `{"id":"ke01","status":"available","created_at":"2020-03-01T12:00:00Z"}` + "\n" +
+				`{"id":"ke02","status":"issued","recipient":"order, #2","metadata":{"order":"o-2"}}` + "\n",
+		},
+		{
+			name:   "csv",
+			params: &types.KeyExportParams{Format: types.FormatCSV},
+			want: "id,status,pool_id,batch_id,recipient,metadata,not_before,expires_at,created_at,issued_at,redeemed_at,canceled_at,expired_at,revoked_at,redeemed_by\n" +
+				"ke01,available,,,,,,,2020-03-01T12:00:00Z,,,,,,\n" +
+				`ke02,issued,,,"order, #2","{""order"":""o-2""}",,,,,,,,,` + "\n",
+		},
+		{
+			name:   "empty csv",
+			params: &types.KeyExportParams{KeyFilter: types.KeyFilter{Recipient: "nobody"}, Format: types.FormatCSV},
+			want:   "id,status,pool_id,batch_id,recipient,metadata,not_before,expires_at,created_at,issued_at,redeemed_at,canceled_at,expired_at,revoked_at,redeemed_by\n",
+		},
+		{
+			name:   "unknown format",
+			params: &types.KeyExportParams{Format: "xlsx"},
+			err:    errorf(ErrBadParams, "unknown export format %q", "xlsx"),
+		},
+		{
+			name:   "unknown sort",
+			params: &types.KeyExportParams{Sort: "size"},
+			err:    errorf(ErrBadParams, "unknown sort order %q", "size"),
+		},
+	}
 
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf strings.Builder
+			err := client.ExportKeys(context.Background(), tc.params, &buf)
+			if !reflect.DeepEqual(err, tc.err) {
+				t.Fatalf("got error %#v want %#v", err, tc.err)
+			}
+			if got := buf.String(); got != tc.want {
+				t.Fatalf("got export %q want %q", got, tc.want)
+			}
 		})
 	}
+
+	t.Run("accept header", func(t *testing.T) {
+		req, err := http.NewRequest("GET", server.URL+"/api/v1/keys:export", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "text/csv")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); ct != "text/csv; charset=utf-8" {
+			t.Fatalf("got content type %q want CSV", ct)
+		}
+	})
+
+	t.Run("failure after the first key", func(t *testing.T) {
+		params := &types.KeyExportParams{KeyFilter: types.KeyFilter{IDPrefix: "broken"}}
+		if err := client.ExportKeys(context.Background(), params, ioutil.Discard); err == nil {
+			t.Fatal("got no error from a truncated export")
+		}
+	})
 }
 
 func TestCanceledKey(t *testing.T) {
@@ -153,18 +728,16 @@ func TestCanceledKey(t *testing.T) {
 		{
 			name: "ok response",
 			key: &types.Key{
-				ID:       "ki87",
-				Issued:   true,
-				Canceled: false,
+				ID:     "ki87",
+				Status: types.StatusIssued,
 			},
 			err: nil,
 		},
 		{
 			name: "err response",
 			key: &types.Key{
-				ID:       "trew",
-				Issued:   false,
-				Canceled: false,
+				ID:     "trew",
+				Status: types.StatusAvailable,
 			},
 			err: errorf(ErrBadParams, "failed to canceled key"),
 		},
@@ -184,56 +757,74 @@ func TestCanceledKey(t *testing.T) {
 	}
 }
 
-func TestVerificationKey(t *testing.T) {
+func TestRedeemKey(t *testing.T) {
 	server, client, svc := startTestServer(t)
 	defer server.Close()
 
+	redeemedAt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
 	testCases := []struct {
-		name string
-		key  *types.Key
-		err  error
+		name     string
+		id       string
+		redeemer string
+		key      *types.Key
+		err      error
 	}{
 		{
-			name: "ok response",
+			name:     "ok response",
+			id:       "ki87",
+			redeemer: "customer-1",
 			key: &types.Key{
-				ID:       "ki87",
-				Issued:   false,
-				Canceled: false,
+				ID:         "ki87",
+				Status:     types.StatusRedeemed,
+				RedeemedAt: &redeemedAt,
+				RedeemedBy: "customer-1",
 			},
 			err: nil,
 		},
 		{
-			name: "err response",
+			name: "ok response without redeemer",
+			id:   "ki88",
 			key: &types.Key{
-				ID:       "trew",
-				Issued:   true,
-				Canceled: false,
+				ID:         "ki88",
+				Status:     types.StatusRedeemed,
+				RedeemedAt: &redeemedAt,
 			},
-			err: errorf(ErrNotFound, "failed to find unreleased key"),
+			err: nil,
+		},
+		{
+			name: "err response",
+			id:   "trew",
+			key:  nil,
+			err:  errorf(ErrConflict, "failed to redeem key: the key has already been redeemed"),
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			svc.onVerificationKey = func(ctx context.Context, id string) (*types.Key, error) {
+			svc.onRedeemKey = func(ctx context.Context, id, redeemer string) (*types.Key, error) {
+				if id != tc.id || redeemer != tc.redeemer {
+					t.Fatalf("got id %q redeemer %q want %q %q", id, redeemer, tc.id, tc.redeemer)
+				}
 				return tc.key, tc.err
 			}
-			gotKey, gotErr := client.VerificationKey(context.Background(), tc.name)
+			gotKey, gotErr := client.RedeemKey(context.Background(), tc.id, tc.redeemer)
 			if !reflect.DeepEqual(gotKey, tc.key) {
 				t.Fatalf("got key %#v want %#v", gotKey, tc.key)
 			}
 			if !reflect.DeepEqual(gotErr, tc.err) {
 				t.Fatalf("got error %#v want %#v", gotErr, tc.err)
 			}
-
 		})
 	}
 }
 
-func TestUnreleasedKey(t *testing.T) {
+func TestRevokeKey(t *testing.T) {
 	server, client, svc := startTestServer(t)
 	defer server.Close()
 
+	revokedAt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
 	testCases := []struct {
 		name string
 		key  *types.Key
@@ -242,27 +833,1301 @@ func TestUnreleasedKey(t *testing.T) {
 		{
 			name: "ok response",
 			key: &types.Key{
-				ID:       "7777",
-				Issued:   false,
-				Canceled: false,
+				ID:        "ki87",
+				Status:    types.StatusRevoked,
+				RevokedAt: &revokedAt,
 			},
 			err: nil,
 		},
+		{
+			name: "err response",
+			key:  nil,
+			err:  errorf(ErrConflict, "failed to revoke key: the key has already been revoked"),
+		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			svc.onUnreleasedKey = func(ctx context.Context) ([]*types.Key, error) {
+			svc.onRevokeKey = func(ctx context.Context, id string) (*types.Key, error) {
 				return tc.key, tc.err
 			}
-			gotKey, gotErr := client.UnreleasedKey(context.Background())
+			gotKey, gotErr := client.RevokeKey(context.Background(), tc.name)
 			if !reflect.DeepEqual(gotKey, tc.key) {
 				t.Fatalf("got key %#v want %#v", gotKey, tc.key)
 			}
 			if !reflect.DeepEqual(gotErr, tc.err) {
 				t.Fatalf("got error %#v want %#v", gotErr, tc.err)
 			}
-
 		})
 	}
 }
+
+func TestVerificationKey(t *testing.T) {
+	server, client, svc := startTestServer(t)
+	defer server.Close()
+
+	testCases := []struct {
+		name string
+		key  *types.Key
+		err  error
+	}{
+		{
+			name: "ok response",
+			key: &types.Key{
+				ID:     "ki87",
+				Status: types.StatusAvailable,
+			},
+			err: nil,
+		},
+		{
+			name: "err response",
+			key:  nil,
+			err:  errorf(ErrNotFound, "failed to find unreleased key"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			svc.onVerificationKey = func(ctx context.Context, id string) (*types.Key, error) {
+				return tc.key, tc.err
+			}
+			gotKey, gotErr := client.VerificationKey(context.Background(), tc.name)
+			if !reflect.DeepEqual(gotKey, tc.key) {
+				t.Fatalf("got key %#v want %#v", gotKey, tc.key)
+			}
+			if !reflect.DeepEqual(gotErr, tc.err) {
+				t.Fatalf("got error %#v want %#v", gotErr, tc.err)
+			}
+
+		})
+	}
+}
+
+func TestKeyHistory(t *testing.T) {
+	server, client, svc := startTestServer(t)
+	defer server.Close()
+
+	at := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		name    string
+		records []*types.AuditRecord
+		err     error
+	}{
+		{
+			name: "ok response",
+			records: []*types.AuditRecord{
+				{
+					KeyID:  "ki87",
+					Action: types.AuditCreated,
+					Actor:  types.ActorSystem,
+					After:  &types.Key{ID: "ki87", Status: types.StatusAvailable},
+					At:     at,
+				},
+				{
+					KeyID:     "ki87",
+					Action:    types.AuditIssued,
+					Actor:     "shop",
+					RequestID: "req-1",
+					ClientIP:  "10.0.0.1",
+					Before:    &types.Key{ID: "ki87", Status: types.StatusAvailable},
+					After:     &types.Key{ID: "ki87", Status: types.StatusIssued},
+					At:        at.Add(time.Minute),
+				},
+			},
+			err: nil,
+		},
+		{
+			name:    "err response",
+			records: nil,
+			err:     errorf(ErrNotFound, "key is not found"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var gotID string
+			svc.onKeyHistory = func(ctx context.Context, id string) ([]*types.AuditRecord, error) {
+				gotID = id
+				return tc.records, tc.err
+			}
+			gotRecords, gotErr := client.KeyHistory(context.Background(), "ki87")
+			if gotID != "ki87" {
+				t.Fatalf("got id %q want %q", gotID, "ki87")
+			}
+			if !reflect.DeepEqual(gotRecords, tc.records) {
+				t.Fatalf("got records %#v want %#v", gotRecords, tc.records)
+			}
+			if !reflect.DeepEqual(gotErr, tc.err) {
+				t.Fatalf("got error %#v want %#v", gotErr, tc.err)
+			}
+		})
+	}
+}
+
+func TestRequestMiddleware(t *testing.T) {
+	var got *types.RequestInfo
+	handler := requestMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = types.RequestFromContext(r.Context())
+	}))
+
+	testCases := []struct {
+		name   string
+		header string
+		keep   bool
+	}{
+		{name: "client id", header: "req-42", keep: true},
+		{name: "no id", header: ""},
+		{name: "too long", header: strings.Repeat("x", maxRequestIDLen+1)},
+		{name: "control characters", header: "req\t42"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/v1/key/k1/history", nil)
+			r.RemoteAddr = "10.0.0.1:5000"
+			if tc.header != "" {
+				r.Header.Set(requestIDHeader, tc.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if got == nil {
+				t.Fatal("no request info in the context")
+			}
+			if got.ClientIP != "10.0.0.1" {
+				t.Fatalf("got client IP %q want %q", got.ClientIP, "10.0.0.1")
+			}
+			if tc.keep && got.ID != tc.header {
+				t.Fatalf("got request ID %q want %q", got.ID, tc.header)
+			}
+			if !tc.keep && (got.ID == "" || got.ID == tc.header) {
+				t.Fatalf("got request ID %q want a generated one", got.ID)
+			}
+			if h := w.Header().Get(requestIDHeader); h != got.ID {
+				t.Fatalf("got response request ID %q want %q", h, got.ID)
+			}
+		})
+	}
+}
+
+func TestUnreleasedKey(t *testing.T) {
+	server, client, svc := startTestServer(t)
+	defer server.Close()
+
+	testCases := []struct {
+		name string
+		key  *types.Key
+		err  error
+	}{
+		{
+			name: "ok response",
+			key: &types.Key{
+				ID:     "7777",
+				Status: types.StatusAvailable,
+			},
+			err: nil,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			svc.onUnreleasedKey = func(ctx context.Context, pool string) ([]*types.Key, error) {
+				return []*types.Key{tc.key}, tc.err
+			}
+			gotKey, gotErr := client.UnreleasedKey(context.Background())
+			if !reflect.DeepEqual(gotKey, []*types.Key{tc.key}) {
+				t.Fatalf("got key %#v want %#v", gotKey, []*types.Key{tc.key})
+			}
+			if !reflect.DeepEqual(gotErr, tc.err) {
+				t.Fatalf("got error %#v want %#v", gotErr, tc.err)
+			}
+
+		})
+	}
+}
+
+func TestPools(t *testing.T) {
+	server, client, svc := startTestServer(t)
+	defer server.Close()
+
+	pool := &types.Pool{ID: "spring", Name: "Spring promo", MaxKeys: 100}
+
+	svc.onCreatePool = func(ctx context.Context, p *types.Pool) (*types.Pool, error) {
+		if !reflect.DeepEqual(p, pool) {
+			t.Fatalf("got pool %#v want %#v", p, pool)
+		}
+		return p, nil
+	}
+	gotPool, err := client.CreatePool(context.Background(), pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotPool, pool) {
+		t.Fatalf("got pool %#v want %#v", gotPool, pool)
+	}
+
+	svc.onGetPool = func(ctx context.Context, id string) (*types.Pool, error) {
+		if id != pool.ID {
+			return nil, errorf(ErrNotFound, "pool is not found")
+		}
+		return pool, nil
+	}
+	gotPool, err = client.GetPool(context.Background(), pool.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotPool, pool) {
+		t.Fatalf("got pool %#v want %#v", gotPool, pool)
+	}
+	_, err = client.GetPool(context.Background(), "missing")
+	if wantErr := errorf(ErrNotFound, "pool is not found"); !reflect.DeepEqual(err, wantErr) {
+		t.Fatalf("got error %#v want %#v", err, wantErr)
+	}
+
+	svc.onListPools = func(ctx context.Context) ([]*types.Pool, error) {
+		return []*types.Pool{pool}, nil
+	}
+	gotPools, err := client.ListPools(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotPools, []*types.Pool{pool}) {
+		t.Fatalf("got pools %#v want %#v", gotPools, []*types.Pool{pool})
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	server, client, svc := startTestServer(t)
+	defer server.Close()
+
+	webhook := &types.Webhook{
+		ID:     "w1",
+		URL:    "https://shop.example.com/hooks",
+		Secret: "0123456789abcdef0123456789abcdef",
+		Events: []types.EventType{types.EventKeyIssued},
+	}
+
+	svc.onCreateWebhook = func(ctx context.Context, w *types.Webhook) (*types.Webhook, error) {
+		if w.URL != webhook.URL || !reflect.DeepEqual(w.Events, webhook.Events) {
+			t.Fatalf("got webhook %#v want %#v", w, webhook)
+		}
+		return webhook, nil
+	}
+	gotWebhook, err := client.CreateWebhook(context.Background(), &types.Webhook{URL: webhook.URL, Events: webhook.Events})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotWebhook, webhook) {
+		t.Fatalf("got webhook %#v want %#v", gotWebhook, webhook)
+	}
+
+	svc.onListWebhooks = func(ctx context.Context) ([]*types.Webhook, error) {
+		return []*types.Webhook{{ID: webhook.ID, URL: webhook.URL}}, nil
+	}
+	gotWebhooks, err := client.ListWebhooks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []*types.Webhook{{ID: webhook.ID, URL: webhook.URL}}; !reflect.DeepEqual(gotWebhooks, want) {
+		t.Fatalf("got webhooks %#v want %#v", gotWebhooks, want)
+	}
+
+	svc.onDeleteWebhook = func(ctx context.Context, id string) error {
+		if id != webhook.ID {
+			return errorf(ErrNotFound, "webhook is not found")
+		}
+		return nil
+	}
+	if err := client.DeleteWebhook(context.Background(), webhook.ID); err != nil {
+		t.Fatal(err)
+	}
+	err = client.DeleteWebhook(context.Background(), "missing")
+	if wantErr := errorf(ErrNotFound, "webhook is not found"); !reflect.DeepEqual(err, wantErr) {
+		t.Fatalf("got error %#v want %#v", err, wantErr)
+	}
+
+	delivery := &types.Delivery{
+		ID:        "d1",
+		WebhookID: webhook.ID,
+		Event:     &types.Event{ID: "e1", Type: types.EventKeyIssued, Key: &types.Key{ID: "7777"}, At: time.Unix(1500000000, 0).UTC()},
+		Status:    types.DeliveryDead,
+		Attempts:  10,
+		LastError: "webhook responded with status 500",
+		CreatedAt: time.Unix(1500000000, 0).UTC(),
+	}
+
+	svc.onListDeliveries = func(ctx context.Context, status types.DeliveryStatus, limit int) ([]*types.Delivery, error) {
+		if status != types.DeliveryDead || limit != 5 {
+			t.Fatalf("got status %q and limit %d want %q and 5", status, limit, types.DeliveryDead)
+		}
+		return []*types.Delivery{delivery}, nil
+	}
+	gotDeliveries, err := client.ListDeliveries(context.Background(), types.DeliveryDead, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotDeliveries, []*types.Delivery{delivery}) {
+		t.Fatalf("got deliveries %#v want %#v", gotDeliveries, []*types.Delivery{delivery})
+	}
+
+	svc.onRetryDelivery = func(ctx context.Context, id string) (*types.Delivery, error) {
+		if id != delivery.ID {
+			return nil, errorf(ErrNotFound, "delivery is not found")
+		}
+		retried := *delivery
+		retried.Status = types.DeliveryPending
+		retried.Attempts = 0
+		return &retried, nil
+	}
+	gotDelivery, err := client.RetryDelivery(context.Background(), delivery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotDelivery.Status != types.DeliveryPending || gotDelivery.Attempts != 0 {
+		t.Fatalf("got delivery %#v want a pending one", gotDelivery)
+	}
+	_, err = client.RetryDelivery(context.Background(), "missing")
+	if wantErr := errorf(ErrNotFound, "delivery is not found"); !reflect.DeepEqual(err, wantErr) {
+		t.Fatalf("got error %#v want %#v", err, wantErr)
+	}
+}
+
+func TestWatchEvents(t *testing.T) {
+	server, client, svc := startTestServer(t)
+	defer server.Close()
+
+	at := time.Unix(1500000000, 0).UTC()
+	events := []*types.Event{
+		{ID: "e1", Type: types.EventKeyCreated, TenantID: "t1", Key: &types.Key{ID: "7777", Status: types.StatusAvailable}, At: at},
+		{ID: "e2", Type: types.EventKeyIssued, TenantID: "t1", Key: &types.Key{ID: "7777", Status: types.StatusIssued}, At: at},
+	}
+	svc.onWatchEvents = func(ctx context.Context, lastEventID string, fn func(*types.Event) error) error {
+		if lastEventID == "gone" {
+			return errorf(ErrConflict, "failed to watch events: the events after the event id are no longer available")
+		}
+		// The heartbeats are not passed to the client callback.
+		if err := fn(nil); err != nil {
+			return err
+		}
+		for _, event := range events {
+			if event.ID <= lastEventID {
+				continue
+			}
+			if err := fn(event); err != nil {
+				return err
+			}
+			if err := fn(nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var got []*types.Event
+	collect := func(event *types.Event) error {
+		got = append(got, event)
+		return nil
+	}
+	if err := client.WatchEvents(context.Background(), "", collect); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, events) {
+		t.Fatalf("got events %#v want %#v", got, events)
+	}
+
+	got = nil
+	if err := client.WatchEvents(context.Background(), "e1", collect); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, events[1:]) {
+		t.Fatalf("got resumed events %#v want %#v", got, events[1:])
+	}
+
+	errStop := errors.New("stop")
+	err := client.WatchEvents(context.Background(), "", func(event *types.Event) error {
+		return errStop
+	})
+	if err != errStop {
+		t.Fatalf("got error %v want %v", err, errStop)
+	}
+
+	err = client.WatchEvents(context.Background(), "gone", collect)
+	wantErr := errorf(ErrConflict, "failed to watch events: the events after the event id are no longer available")
+	if !reflect.DeepEqual(err, wantErr) {
+		t.Fatalf("got error %#v want %#v", err, wantErr)
+	}
+}
+
+func TestPoolScopedRoutes(t *testing.T) {
+	server, client, svc := startTestServer(t)
+	defer server.Close()
+
+	const poolID = "spring"
+	checkPool := func(pool string) {
+		if pool != poolID {
+			t.Errorf("got pool %q want %q", pool, poolID)
+		}
+	}
+
+	svc.onCreateKey = func(ctx context.Context, pool string, validity *types.KeyValidity) (*types.Key, error) {
+		checkPool(pool)
+		return &types.Key{ID: "7777", PoolID: pool}, nil
+	}
+	key, err := client.CreatePoolKey(context.Background(), poolID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.PoolID != poolID {
+		t.Fatalf("got key pool %q want %q", key.PoolID, poolID)
+	}
+
+	svc.onCreateKeys = func(ctx context.Context, pool string, count int, params *types.KeyGenParams, validity *types.KeyValidity, progress func(*types.BatchProgress)) (string, error) {
+		checkPool(pool)
+		progress(&types.BatchProgress{BatchID: "b1", Created: count, Total: count})
+		return "b1", nil
+	}
+	if _, err := client.CreatePoolKeys(context.Background(), poolID, 10, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	svc.onGetKey = func(ctx context.Context, pool string) (string, error) {
+		checkPool(pool)
+		return "7777", nil
+	}
+	if _, err := client.GetPoolKey(context.Background(), poolID); err != nil {
+		t.Fatal(err)
+	}
+
+	svc.onUnreleasedKey = func(ctx context.Context, pool string) ([]*types.Key, error) {
+		checkPool(pool)
+		return []*types.Key{{ID: "7777", PoolID: pool}}, nil
+	}
+	if _, err := client.UnreleasedPoolKey(context.Background(), poolID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	svc := &mockService{
+		onAuthenticate: func(ctx context.Context, apiKey string) (*types.Principal, error) {
+			if apiKey != "ck_good" {
+				return nil, errorf(ErrUnauthorized, "invalid API key")
+			}
+			return &types.Principal{Subject: "api-key:1", Tenant: "t1", Roles: []types.Role{types.RoleAdmin}}, nil
+		},
+		onVerificationKey: func(ctx context.Context, id string) (*types.Key, error) {
+			p := types.PrincipalFromContext(ctx)
+			return &types.Key{ID: id, TenantID: types.TenantFromContext(ctx), RedeemedBy: p.Subject}, nil
+		},
+	}
+
+	testCases := []struct {
+		name           string
+		anonymousRoles []types.Role
+		opts           []ClientOption
+		key            *types.Key
+		err            error
+	}{
+		{
+			name: "tenant api key",
+			opts: []ClientOption{WithAPIKey("ck_good")},
+			key:  &types.Key{ID: "k", TenantID: "t1", RedeemedBy: "api-key:1"},
+		},
+		{
+			name: "invalid api key",
+			opts: []ClientOption{WithAPIKey("ck_bad")},
+			err:  errorf(ErrUnauthorized, "invalid API key"),
+		},
+		{
+			name: "hmac signed request",
+			opts: []ClientOption{WithHMACKey(testHMACKeyID, testHMACSecret)},
+			key:  &types.Key{ID: "k", TenantID: "t1", RedeemedBy: "pos"},
+		},
+		{
+			name: "invalid hmac signature",
+			opts: []ClientOption{WithHMACKey(testHMACKeyID, "fedcba9876543210fedcba9876543210")},
+			err:  errorf(ErrUnauthorized, "invalid signature"),
+		},
+		{
+			name: "bearer token",
+			opts: []ClientOption{WithBearerToken(testAdminToken)},
+			key:  &types.Key{ID: "k", RedeemedBy: "operator"},
+		},
+		{
+			name:           "unknown bearer token",
+			anonymousRoles: []types.Role{types.RoleAdmin},
+			opts:           []ClientOption{WithBearerToken("unknown")},
+			err:            errorf(ErrUnauthorized, "invalid credentials"),
+		},
+		{
+			name: "missing credentials",
+			err:  errorf(ErrUnauthorized, "missing credentials"),
+		},
+		{
+			name:           "anonymous",
+			anonymousRoles: []types.Role{types.RoleVerifier},
+			key:            &types.Key{ID: "k"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := newHandler(&handlerConfig{
+				svc:            svc,
+				logger:         log.NewNopLogger(),
+				rateLimiter:    rate.NewLimiter(rate.Inf, 1),
+				authenticators: testAuthenticators(t),
+				anonymousRoles: tc.anonymousRoles,
+			})
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			client, err := NewClient(server.URL, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotKey, gotErr := client.VerificationKey(context.Background(), "k")
+			if !reflect.DeepEqual(gotKey, tc.key) {
+				t.Fatalf("got key %#v want %#v", gotKey, tc.key)
+			}
+			if !reflect.DeepEqual(gotErr, tc.err) {
+				t.Fatalf("got error %#v want %#v", gotErr, tc.err)
+			}
+		})
+	}
+}
+
+func TestDefaultConfigRejectsAnonymous(t *testing.T) {
+	st := memstore.New()
+	server, err := New(&Config{
+		Logger:       log.NewNopLogger(),
+		Storage:      st,
+		KeyGenerator: &seqKeyGen{},
+		RateLimiter:  rate.NewLimiter(rate.Inf, 1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Shutdown()
+	ts := httptest.NewServer(server.srv.Handler)
+	defer ts.Close()
+
+	client, err := NewClient(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.CreateKey(context.Background(), nil)
+	if wantErr := errorf(ErrUnauthorized, "missing credentials"); !reflect.DeepEqual(err, wantErr) {
+		t.Fatalf("got error %#v want %#v", err, wantErr)
+	}
+	if page, err := st.ListKeys(context.Background(), &types.KeyListParams{}); err != nil || len(page.Keys) != 0 {
+		t.Fatalf("got keys %v, %v want none", page, err)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	handler := newHandler(&handlerConfig{
+		svc: &mockService{
+			onGetKey: func(ctx context.Context, pool string) (string, error) {
+				return "k", nil
+			},
+			onRedeemKey: func(ctx context.Context, id, redeemer string) (*types.Key, error) {
+				return &types.Key{ID: id}, nil
+			},
+			onCreateKey: func(ctx context.Context, pool string, validity *types.KeyValidity) (*types.Key, error) {
+				return &types.Key{ID: "k"}, nil
+			},
+		},
+		logger:         log.NewNopLogger(),
+		rateLimiter:    rate.NewLimiter(rate.Inf, 1),
+		authenticators: testAuthenticators(t),
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	forbidden := errorf(ErrForbidden, "permission denied")
+	calls := map[string]func(c *Client) error{
+		"CreateKey": func(c *Client) error {
+			_, err := c.CreateKey(context.Background(), nil)
+			return err
+		},
+		"GetKey": func(c *Client) error {
+			_, err := c.GetKey(context.Background())
+			return err
+		},
+		"RedeemKey": func(c *Client) error {
+			_, err := c.RedeemKey(context.Background(), "k", "")
+			return err
+		},
+	}
+
+	testCases := []struct {
+		name string
+		opts []ClientOption
+		errs map[string]error
+	}{
+		{
+			name: "admin",
+			opts: []ClientOption{WithBearerToken(testAdminToken)},
+			errs: map[string]error{},
+		},
+		{
+			name: "issuer",
+			opts: []ClientOption{WithBearerToken(testIssuerToken)},
+			errs: map[string]error{"CreateKey": forbidden, "RedeemKey": forbidden},
+		},
+		{
+			name: "verifier",
+			opts: []ClientOption{WithHMACKey(testHMACKeyID, testHMACSecret)},
+			errs: map[string]error{"CreateKey": forbidden, "GetKey": forbidden},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client, err := NewClient(server.URL, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for method, call := range calls {
+				if err := call(client); !reflect.DeepEqual(err, tc.errs[method]) {
+					t.Fatalf("%s: got error %#v want %#v", method, err, tc.errs[method])
+				}
+			}
+		})
+	}
+}
+
+func TestTenantAdmin(t *testing.T) {
+	tenant := &types.Tenant{ID: "acme", Name: "Acme"}
+	apiKey := &types.APIKey{ID: "0a1b2c3d", TenantID: "acme", Secret: "ck_secret", Roles: []types.Role{types.RoleIssuer}}
+
+	server, client, svc := startTestServer(t, WithBearerToken(testAdminToken))
+	defer server.Close()
+
+	svc.onCreateTenant = func(ctx context.Context, t *types.Tenant) (*types.Tenant, error) {
+		return t, nil
+	}
+	svc.onListTenants = func(ctx context.Context) ([]*types.Tenant, error) {
+		return []*types.Tenant{tenant}, nil
+	}
+	svc.onCreateAPIKey = func(ctx context.Context, tenant string, roles []types.Role) (*types.APIKey, error) {
+		if tenant != apiKey.TenantID {
+			return nil, errorf(ErrNotFound, "tenant is not found")
+		}
+		if !reflect.DeepEqual(roles, apiKey.Roles) {
+			return nil, errorf(ErrBadParams, "unexpected roles %v", roles)
+		}
+		return apiKey, nil
+	}
+	svc.onRevokeAPIKey = func(ctx context.Context, tenant, id string) error {
+		if tenant != apiKey.TenantID || id != apiKey.ID {
+			return errorf(ErrNotFound, "API key is not found")
+		}
+		return nil
+	}
+
+	gotTenant, err := client.CreateTenant(context.Background(), tenant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotTenant, tenant) {
+		t.Fatalf("got tenant %#v want %#v", gotTenant, tenant)
+	}
+	gotTenants, err := client.ListTenants(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotTenants, []*types.Tenant{tenant}) {
+		t.Fatalf("got tenants %#v want %#v", gotTenants, []*types.Tenant{tenant})
+	}
+	gotKey, err := client.CreateAPIKey(context.Background(), "acme", apiKey.Roles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotKey, apiKey) {
+		t.Fatalf("got API key %#v want %#v", gotKey, apiKey)
+	}
+	if err := client.RevokeAPIKey(context.Background(), "acme", apiKey.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	svc.onAuthenticate = func(ctx context.Context, apiKey string) (*types.Principal, error) {
+		return &types.Principal{Subject: "api-key:1", Tenant: "acme", Roles: []types.Role{types.RoleAdmin}}, nil
+	}
+	testCases := []struct {
+		name string
+		opts []ClientOption
+		err  error
+	}{
+		{
+			name: "anonymous admin",
+			err:  errorf(ErrForbidden, "permission denied"),
+		},
+		{
+			name: "tenant admin",
+			opts: []ClientOption{WithAPIKey("ck_acme")},
+			err:  errorf(ErrForbidden, "permission denied"),
+		},
+		{
+			name: "issuer",
+			opts: []ClientOption{WithBearerToken(testIssuerToken)},
+			err:  errorf(ErrForbidden, "permission denied"),
+		},
+		{
+			name: "wrong token",
+			opts: []ClientOption{WithBearerToken("wrong")},
+			err:  errorf(ErrUnauthorized, "invalid credentials"),
+		},
+	}
+	for _, tc := range testCases {
+		other, err := NewClient(server.URL, tc.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := other.CreateTenant(context.Background(), tenant); !reflect.DeepEqual(err, tc.err) {
+			t.Fatalf("%s: got error %#v want %#v", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestImportKeys(t *testing.T) {
+	st := memstore.New()
+	ctx := context.Background()
+	if err := st.InsertKey(ctx, &types.Key{ID: "EXISTING", Status: types.StatusAvailable}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.CreatePool(ctx, &types.Pool{ID: "steam", MaxKeys: 1}); err != nil {
+		t.Fatal(err)
+	}
+	handler := newHandler(&handlerConfig{
+		svc:            &basicService{logger: log.NewNopLogger(), storage: st},
+		logger:         log.NewNopLogger(),
+		rateLimiter:    rate.NewLimiter(rate.Inf, 1),
+		anonymousRoles: []types.Role{types.RoleAdmin},
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	client, err := NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type row struct {
+		id     string
+		status types.ImportStatus
+	}
+	testCases := []struct {
+		name   string
+		pool   string
+		format types.FileFormat
+		file   string
+		rows   []row
+		err    error
+	}{
+		{
+			name:   "csv",
+			format: types.FormatCSV,
+			file: "\ufeffid,platform,expires_at\n" +
+				"CSV-1,steam,\n" +
+				"CSV-2,,2999-01-01T00:00:00Z\n" +
+				"CSV-1,steam,\n" +
+				"EXISTING,,\n" +
+				"has space,,\n" +
+				"CSV-3,,tomorrow\n" +
+				"CSV-4\n",
+			rows: []row{
+				{"CSV-1", types.ImportAccepted},
+				{"CSV-2", types.ImportAccepted},
+				{"CSV-1", types.ImportRejected},
+				{"EXISTING", types.ImportRejected},
+				{"has space", types.ImportRejected},
+				{"CSV-3", types.ImportRejected},
+				{"", types.ImportRejected},
+			},
+		},
+		{
+			name:   "ndjson",
+			format: types.FormatNDJSON,
+			file: `{"id":"JSON-1","metadata":{"platform":"steam"}}` + "\n\n" +
+				`{"id":` + "\n" +
+				`{"id":"JSON-2","expires_at":"2000-01-01T00:00:00Z"}` + "\n",
+			rows: []row{
+				{"JSON-1", types.ImportAccepted},
+				{"", types.ImportRejected},
+				{"JSON-2", types.ImportRejected},
+			},
+		},
+		{
+			name:   "reserved characters",
+			format: types.FormatNDJSON,
+			file: `{"id":"AB:CD"}` + "\n" + `{"id":"AB/CD"}` + "\n" + `{"id":"AB+CD"}` + "\n" +
+				`{"id":"AB%CD"}` + "\n" + `{"id":"AB?CD"}` + "\n" + `{"id":"Ab.c_d~E-9"}` + "\n",
+			rows: []row{
+				{"AB:CD", types.ImportRejected},
+				{"AB/CD", types.ImportRejected},
+				{"AB+CD", types.ImportRejected},
+				{"AB%CD", types.ImportRejected},
+				{"AB?CD", types.ImportRejected},
+				{"Ab.c_d~E-9", types.ImportAccepted},
+			},
+		},
+		{
+			name:   "pool quota",
+			pool:   "steam",
+			format: types.FormatNDJSON,
+			file:   `{"id":"POOL-1"}` + "\n" + `{"id":"POOL-2"}` + "\n",
+			rows: []row{
+				{"POOL-1", types.ImportRejected},
+				{"POOL-2", types.ImportRejected},
+			},
+		},
+		{
+			name:   "no id column",
+			format: types.FormatCSV,
+			file:   "code\nX-1\n",
+			err:    errorf(ErrBadParams, "CSV header has no id column"),
+		},
+		{
+			name:   "empty",
+			format: types.FormatNDJSON,
+			err:    errorf(ErrBadParams, "import has no keys"),
+		},
+		{
+			name:   "unknown pool",
+			pool:   "epic",
+			format: types.FormatNDJSON,
+			file:   `{"id":"POOL-3"}` + "\n",
+			err:    errorf(ErrNotFound, "pool is not found"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			report, err := client.ImportPoolKeys(ctx, tc.pool, tc.format, strings.NewReader(tc.file))
+			if !reflect.DeepEqual(err, tc.err) {
+				t.Fatalf("got error %#v want %#v", err, tc.err)
+			}
+			if err != nil {
+				return
+			}
+			var got []row
+			accepted := 0
+			for _, r := range report.Rows {
+				got = append(got, row{r.ID, r.Status})
+				if r.Status == types.ImportAccepted {
+					accepted++
+				} else if r.Reason == "" {
+					t.Fatalf("got rejected row %d without a reason", r.Row)
+				}
+			}
+			if !reflect.DeepEqual(got, tc.rows) {
+				t.Fatalf("got rows %v want %v", got, tc.rows)
+			}
+			if report.Accepted != accepted || report.Rejected != len(got)-accepted {
+				t.Fatalf("got %d accepted and %d rejected rows", report.Accepted, report.Rejected)
+			}
+		})
+	}
+
+	// Every accepted ID is addressable through the client.
+	key, err := client.VerificationKey(ctx, "Ab.c_d~E-9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.ID != "Ab.c_d~E-9" {
+		t.Fatalf("got key %q want Ab.c_d~E-9", key.ID)
+	}
+	if _, err := client.RevokeKey(ctx, "Ab.c_d~E-9"); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err = st.VerificationKey(ctx, "JSON-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Metadata["platform"] != "steam" || key.BatchID == "" || key.Status != types.StatusAvailable {
+		t.Fatalf("got imported key %#v", key)
+	}
+	key, err = st.VerificationKey(ctx, "CSV-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Metadata["platform"] != "steam" {
+		t.Fatalf("got imported key metadata %v", key.Metadata)
+	}
+}
+
+func TestKeyStats(t *testing.T) {
+	st := memstore.New()
+	ctx := context.Background()
+	if err := st.CreatePool(ctx, &types.Pool{ID: "spring"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		key := &types.Key{ID: fmt.Sprintf("key-%d", i), Status: types.StatusAvailable}
+		if i >= 4 {
+			key.PoolID = "spring"
+		}
+		if err := st.InsertKey(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := st.GetKey(ctx, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := st.GetKey(ctx, "spring", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := newHandler(&handlerConfig{
+		svc:            &basicService{logger: log.NewNopLogger(), storage: st},
+		logger:         log.NewNopLogger(),
+		rateLimiter:    rate.NewLimiter(rate.Inf, 1),
+		anonymousRoles: []types.Role{types.RoleAdmin},
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	client, err := NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spring, noPool := "spring", ""
+	testCases := []struct {
+		name      string
+		stats     func() (*types.KeyStats, error)
+		pool      *string
+		available int64
+		issued    int64
+	}{
+		{"all", func() (*types.KeyStats, error) { return client.Stats(ctx) }, nil, 2, 4},
+		{"pool", func() (*types.KeyStats, error) { return client.PoolStats(ctx, "spring") }, &spring, 1, 1},
+		{"out of any pool", func() (*types.KeyStats, error) { return client.PoolStats(ctx, "") }, &noPool, 1, 3},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stats, err := tc.stats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(stats.PoolID, tc.pool) {
+				t.Fatalf("got pool %v want %v", stats.PoolID, tc.pool)
+			}
+			if stats.Total != tc.available+tc.issued {
+				t.Fatalf("got total %d want %d", stats.Total, tc.available+tc.issued)
+			}
+			if stats.Statuses[types.StatusAvailable] != tc.available || stats.Statuses[types.StatusIssued] != tc.issued {
+				t.Fatalf("got statuses %v", stats.Statuses)
+			}
+			if n, ok := stats.Statuses[types.StatusRevoked]; !ok || n != 0 {
+				t.Fatalf("got no zero count of revoked keys in %v", stats.Statuses)
+			}
+			if len(stats.Issuance) != len(statsWindows) {
+				t.Fatalf("got %d issuance windows want %d", len(stats.Issuance), len(statsWindows))
+			}
+			for _, rate := range stats.Issuance {
+				if rate.Issued != tc.issued {
+					t.Fatalf("got %d keys issued in %s want %d", rate.Issued, rate.Window, tc.issued)
+				}
+			}
+			if hour := stats.Issuance[0]; hour.Window != "1h" || hour.PerHour != float64(tc.issued) {
+				t.Fatalf("got hourly issuance rate %#v", hour)
+			}
+		})
+	}
+
+	_, err = client.PoolStats(ctx, "summer")
+	if wantErr := errorf(ErrNotFound, "pool is not found"); !reflect.DeepEqual(err, wantErr) {
+		t.Fatalf("got error %#v want %#v", err, wantErr)
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	st := memstore.New()
+	for i := 0; i < 10; i++ {
+		key := &types.Key{ID: fmt.Sprintf("key-%d", i), Status: types.StatusAvailable}
+		if err := st.InsertKey(context.Background(), key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handler := newHandler(&handlerConfig{
+		svc:            &basicService{logger: log.NewNopLogger(), storage: st, idempotencyTTL: time.Hour},
+		logger:         log.NewNopLogger(),
+		rateLimiter:    rate.NewLimiter(rate.Inf, 1),
+		anonymousRoles: []types.Role{types.RoleAdmin},
+	})
+	// The first response of every request with an idempotency key
+	// is lost as if the client timed out.
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		mu.Lock()
+		lose := key != "" && !seen[key]
+		seen[key] = true
+		mu.Unlock()
+		if lose {
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, WithIdempotentRetries(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	first, err := client.GetKey(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := client.GetKey(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != "key-0" || second != "key-1" {
+		t.Fatalf("got keys %q and %q want key-0 and key-1", first, second)
+	}
+	if err := client.CanceledKey(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+
+	// An explicit idempotency key replays the response to another call.
+	reqCtx := WithIdempotencyKey(ctx, "req-1")
+	third, err := client.GetKey(reqCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := client.GetKey(reqCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third != "key-2" || again != third {
+		t.Fatalf("got keys %q and %q want key-2 twice", third, again)
+	}
+	_, err = client.GetPoolKey(reqCtx, "spring")
+	if wantErr := errorf(ErrBadParams, "idempotency key is used by another request"); !reflect.DeepEqual(err, wantErr) {
+		t.Fatalf("got error %#v want %#v", err, wantErr)
+	}
+
+	// Without retries the lost response is an error.
+	plain, err := NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plain.GetKey(WithIdempotencyKey(ctx, "req-2")); err == nil {
+		t.Fatal("expected an error of the lost response")
+	}
+	if key, err := plain.GetKey(WithIdempotencyKey(ctx, "req-2")); err != nil || key != "key-3" {
+		t.Fatalf("got key %q error %v want key-3", key, err)
+	}
+
+	pool := ""
+	page, err := st.ListKeys(ctx, &types.KeyListParams{
+		KeyFilter: types.KeyFilter{Statuses: []types.KeyStatus{types.StatusAvailable}, PoolID: &pool},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Keys) != 6 {
+		t.Fatalf("got %d unreleased keys want 6", len(page.Keys))
+	}
+}
+
+func TestIdempotencyBodyLimit(t *testing.T) {
+	st := memstore.New()
+	if err := st.InsertKey(context.Background(), &types.Key{ID: "key-0", Status: types.StatusAvailable}); err != nil {
+		t.Fatal(err)
+	}
+	handler := newHandler(&handlerConfig{
+		svc:            &basicService{logger: log.NewNopLogger(), storage: st, idempotencyTTL: time.Hour},
+		logger:         log.NewNopLogger(),
+		rateLimiter:    rate.NewLimiter(rate.Inf, 1),
+		anonymousRoles: []types.Role{types.RoleAdmin},
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	post := func(body string) *http.Response {
+		req, err := http.NewRequest("POST", server.URL+"/api/v1/key/issued", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(idempotencyKeyHeader, "req-1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if resp := post(strings.Repeat(" ", maxIdempotentBodyLen+1)); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got status %d of oversized body want %d", resp.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+	// The rejected request does not take the idempotency key.
+	if resp := post("{}"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+// failingIdempotencyStorage fails to complete and release the idempotency keys.
+type failingIdempotencyStorage struct {
+	Storage
+}
+
+func (s *failingIdempotencyStorage) CompleteIdempotencyRecord(ctx context.Context, rec *types.IdempotencyRecord) error {
+	return errors.New("storage is down")
+}
+
+func (s *failingIdempotencyStorage) DeleteIdempotencyRecord(ctx context.Context, key string) error {
+	return errors.New("storage is down")
+}
+
+func TestIdempotencyStorageFailure(t *testing.T) {
+	st := memstore.New()
+	for i := 0; i < 2; i++ {
+		key := &types.Key{ID: fmt.Sprintf("key-%d", i), Status: types.StatusAvailable}
+		if err := st.InsertKey(context.Background(), key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	logged := make(chan string, 100)
+	logger := log.LoggerFunc(func(keyvals ...interface{}) error {
+		select {
+		case logged <- fmt.Sprint(keyvals...):
+		default:
+		}
+		return nil
+	})
+	handler := newHandler(&handlerConfig{
+		svc:            &basicService{logger: log.NewNopLogger(), storage: &failingIdempotencyStorage{st}, idempotencyTTL: time.Hour},
+		logger:         logger,
+		rateLimiter:    rate.NewLimiter(rate.Inf, 1),
+		anonymousRoles: []types.Role{types.RoleAdmin},
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	client, err := NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitLogged := func(msg string) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case line := <-logged:
+				if strings.Contains(line, msg) {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("got no %q log", msg)
+			}
+		}
+	}
+
+	ctx := WithIdempotencyKey(context.Background(), "req-1")
+	if key, err := client.GetKey(ctx); err != nil || key != "key-0" {
+		t.Fatalf("got key %q error %v want key-0", key, err)
+	}
+	waitLogged("failed to store idempotent response")
+	// The retry of the incomplete request is rejected
+	// rather than issuing another key.
+	_, err = client.GetKey(ctx)
+	if wantErr := errorf(ErrConflict, "request with the idempotency key is in progress"); !reflect.DeepEqual(err, wantErr) {
+		t.Fatalf("got error %#v want %#v", err, wantErr)
+	}
+
+	if _, err := client.GetPoolKey(WithIdempotencyKey(context.Background(), "req-2"), "missing"); err == nil {
+		t.Fatal("got no error issuing a key of a missing pool")
+	}
+	waitLogged("failed to release idempotency key")
+
+	if key, err := client.GetKey(context.Background()); err != nil || key != "key-1" {
+		t.Fatalf("got key %q error %v want key-1", key, err)
+	}
+}
+
+func TestGetKeyConcurrent(t *testing.T) {
+	var st Storage = memstore.New()
+	if mongoURL := os.Getenv("KEY_TEST_MONGO_URL"); mongoURL != "" {
+		mongoDB, err := storage.New(&storage.Config{
+			URL:    mongoURL,
+			DBName: fmt.Sprintf("collection-key-test-%d", time.Now().UnixNano()),
+			Logger: log.NewNopLogger(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer mongoDB.Shutdown()
+		st = mongoDB
+	}
+
+	const (
+		numKeys    = 200
+		numWorkers = 50
+	)
+
+	for i := 0; i < numKeys; i++ {
+		key := &types.Key{ID: fmt.Sprintf("key-%d", i), Status: types.StatusAvailable}
+		if err := st.InsertKey(context.Background(), key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handler := newHandler(&handlerConfig{
+		svc:            &basicService{logger: log.NewNopLogger(), storage: st},
+		logger:         log.NewNopLogger(),
+		rateLimiter:    rate.NewLimiter(rate.Inf, 1),
+		anonymousRoles: []types.Role{types.RoleAdmin},
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	client, err := NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu     sync.Mutex
+		issued = make(map[string]int)
+		wg     sync.WaitGroup
+	)
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				id, err := client.GetKey(context.Background())
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				issued[id]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for id, n := range issued {
+		if n != 1 {
+			t.Errorf("key %q issued %d times", id, n)
+		}
+	}
+	if len(issued) != numKeys {
+		t.Fatalf("got %d issued keys want %d", len(issued), numKeys)
+	}
+}
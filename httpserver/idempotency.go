@@ -0,0 +1,153 @@
+package httpserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/evgeny08/collection-key/types"
+)
+
+const (
+	// idempotencyKeyHeader is a request header carrying the idempotency key.
+	idempotencyKeyHeader = "Idempotency-Key"
+	// idempotentReplayedHeader marks the replayed responses.
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	// maxIdempotencyKeyLen is the maximum length of an idempotency key.
+	maxIdempotencyKeyLen = 255
+	// maxIdempotentBodyLen limits the body of a request with an
+	// idempotency key, which is read whole to be fingerprinted.
+	maxIdempotentBodyLen = 1 << 20
+)
+
+// idempotencyMiddleware makes the requests with an Idempotency-Key header
+// idempotent: the successful response is stored and replayed to the retries
+// of the request, so a retried issuance does not consume another key.
+// Failed requests are not stored and may be retried. The bodies of such
+// requests are limited to maxIdempotentBodyLen bytes. The middleware must
+// run after authMiddleware, as the keys are scoped to the tenant.
+func idempotencyMiddleware(svc service, logger log.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(idempotencyKeyHeader)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > maxIdempotencyKeyLen {
+				encodeError(w, errorf(ErrBadParams, "idempotency key is too long"), true)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, maxIdempotentBodyLen)
+			fingerprint, err := requestFingerprint(r)
+			if err != nil {
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					encodeError(w, errorf(ErrTooLarge, "request body exceeds %d bytes", maxIdempotentBodyLen), true)
+					return
+				}
+				encodeError(w, errorf(ErrBadParams, "failed to read request: %v", err), true)
+				return
+			}
+
+			rec, err := svc.beginIdempotent(r.Context(), key, fingerprint)
+			if err != nil {
+				encodeError(w, err, true)
+				return
+			}
+			if rec != nil {
+				if rec.ContentType != "" {
+					w.Header().Set("Content-Type", rec.ContentType)
+				}
+				w.Header().Set(idempotentReplayedHeader, "true")
+				w.WriteHeader(rec.StatusCode)
+				w.Write(rec.Body)
+				return
+			}
+
+			rw := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rw, r)
+
+			// The client may be gone, which is when the response
+			// is needed most, so the request context is not used.
+			ctx, cancel := context.WithTimeout(types.WithTenant(context.Background(), types.TenantFromContext(r.Context())), 10*time.Second)
+			defer cancel()
+			// The response is already sent, so the failures are logged. The
+			// key of an incomplete request stays locked until the lock times
+			// out, so its retries are rejected rather than processed again.
+			if rw.status < 200 || rw.status > 299 {
+				if err := svc.abortIdempotent(ctx, key); err != nil {
+					level.Error(logger).Log("msg", "failed to release idempotency key", "key", key, "err", err)
+				}
+				return
+			}
+			err = svc.completeIdempotent(ctx, &types.IdempotencyRecord{
+				Key:         key,
+				Fingerprint: fingerprint,
+				StatusCode:  rw.status,
+				ContentType: rw.Header().Get("Content-Type"),
+				Body:        rw.body.Bytes(),
+			})
+			if err != nil {
+				level.Error(logger).Log("msg", "failed to store idempotent response", "key", key, "status", rw.status, "err", err)
+			}
+		})
+	}
+}
+
+// requestFingerprint returns the hash of the request method, URL, principal
+// and body. The body is read and replaced so the handler may read it again.
+func requestFingerprint(r *http.Request) (string, error) {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			return "", err
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	var subject string
+	if p := types.PrincipalFromContext(r.Context()); p != nil {
+		subject = p.Subject
+	}
+
+	h := sha256.New()
+	for _, s := range []string{r.Method, r.URL.EscapedPath(), r.URL.RawQuery, subject} {
+		io.WriteString(h, s)
+		h.Write([]byte{0})
+	}
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// recordingWriter is a http.ResponseWriter recording the response.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap returns the recorded writer for http.ResponseController.
+func (w *recordingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
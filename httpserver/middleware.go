@@ -2,6 +2,7 @@ package httpserver
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -16,34 +17,68 @@ type loggingMiddleware struct {
 	logger log.Logger
 }
 
-func (m *loggingMiddleware) createKey(ctx context.Context) (*types.Key, error) {
+func (m *loggingMiddleware) createKey(ctx context.Context, pool string, validity *types.KeyValidity) (*types.Key, error) {
 	begin := time.Now()
-	key, err := m.next.createKey(ctx)
-	err = level.Info(m.logger).Log(
+	key, err := m.next.createKey(ctx, pool, validity)
+	level.Info(m.logger).Log(
 		"method", "CreateKey",
 		"err", err,
 		"elapsed", time.Since(begin),
-		"id", key.ID,
+		"pool", pool,
+		"id", keyID(key),
 	)
 	return key, err
 }
 
-func (m *loggingMiddleware) getKey(ctx context.Context) (string, error) {
+func (m *loggingMiddleware) createKeys(ctx context.Context, pool string, count int, params *types.KeyGenParams, validity *types.KeyValidity, progress func(*types.BatchProgress)) (string, error) {
 	begin := time.Now()
-	key, err := m.next.getKey(ctx)
-	err = level.Info(m.logger).Log(
+	batchID, err := m.next.createKeys(ctx, pool, count, params, validity, progress)
+	level.Info(m.logger).Log(
+		"method", "CreateKeys",
+		"err", err,
+		"elapsed", time.Since(begin),
+		"pool", pool,
+		"count", count,
+		"batch_id", batchID,
+	)
+	return batchID, err
+}
+
+func (m *loggingMiddleware) getKey(ctx context.Context, pool string) (string, error) {
+	begin := time.Now()
+	key, err := m.next.getKey(ctx, pool)
+	level.Info(m.logger).Log(
 		"method", "GetKey",
 		"err", err,
 		"elapsed", time.Since(begin),
+		"pool", pool,
 		"id", key,
 	)
 	return key, err
 }
 
+func (m *loggingMiddleware) issueKey(ctx context.Context, pool string, issuance *types.Issuance) (*types.Key, error) {
+	begin := time.Now()
+	key, err := m.next.issueKey(ctx, pool, issuance)
+	var recipient string
+	if issuance != nil {
+		recipient = issuance.Recipient
+	}
+	level.Info(m.logger).Log(
+		"method", "IssueKey",
+		"err", err,
+		"elapsed", time.Since(begin),
+		"pool", pool,
+		"recipient", recipient,
+		"id", keyID(key),
+	)
+	return key, err
+}
+
 func (m *loggingMiddleware) canceledKey(ctx context.Context, id string) error {
 	begin := time.Now()
 	err := m.next.canceledKey(ctx, id)
-	err = level.Info(m.logger).Log(
+	level.Info(m.logger).Log(
 		"method", "CanceledKey",
 		"err", err,
 		"elapsed", time.Since(begin),
@@ -52,25 +87,381 @@ func (m *loggingMiddleware) canceledKey(ctx context.Context, id string) error {
 	return err
 }
 
+func (m *loggingMiddleware) redeemKey(ctx context.Context, id, redeemer string) (*types.Key, error) {
+	begin := time.Now()
+	key, err := m.next.redeemKey(ctx, id, redeemer)
+	level.Info(m.logger).Log(
+		"method", "RedeemKey",
+		"err", err,
+		"elapsed", time.Since(begin),
+		"id", id,
+		"redeemer", redeemer,
+	)
+	return key, err
+}
+
+func (m *loggingMiddleware) revokeKey(ctx context.Context, id string) (*types.Key, error) {
+	begin := time.Now()
+	key, err := m.next.revokeKey(ctx, id)
+	level.Info(m.logger).Log(
+		"method", "RevokeKey",
+		"err", err,
+		"elapsed", time.Since(begin),
+		"id", id,
+	)
+	return key, err
+}
+
 func (m *loggingMiddleware) verificationKey(ctx context.Context, id string) (*types.Key, error) {
 	begin := time.Now()
 	key, err := m.next.verificationKey(ctx, id)
-	err = level.Info(m.logger).Log(
+	level.Info(m.logger).Log(
 		"method", "VerificationKey",
 		"err", err,
 		"elapsed", time.Since(begin),
-		"id", key.ID,
+		"id", id,
 	)
 	return key, err
 }
 
-func (m *loggingMiddleware) unreleasedKey(ctx context.Context) ([]*types.Key, error) {
+func (m *loggingMiddleware) keyHistory(ctx context.Context, id string) ([]*types.AuditRecord, error) {
+	begin := time.Now()
+	records, err := m.next.keyHistory(ctx, id)
+	level.Info(m.logger).Log(
+		"method", "KeyHistory",
+		"err", err,
+		"elapsed", time.Since(begin),
+		"id", id,
+	)
+	return records, err
+}
+
+func (m *loggingMiddleware) unreleasedKey(ctx context.Context, pool string) ([]*types.Key, error) {
 	begin := time.Now()
-	listKey, err := m.next.unreleasedKey(ctx)
-	err = level.Info(m.logger).Log(
+	listKey, err := m.next.unreleasedKey(ctx, pool)
+	level.Info(m.logger).Log(
 		"method", "UnreleasedKey",
 		"err", err,
 		"elapsed", time.Since(begin),
+		"pool", pool,
 	)
 	return listKey, err
 }
+
+func (m *loggingMiddleware) listKeys(ctx context.Context, params *types.KeyListParams) (*types.KeyPage, error) {
+	begin := time.Now()
+	page, err := m.next.listKeys(ctx, params)
+	var count int
+	if page != nil {
+		count = len(page.Keys)
+	}
+	level.Info(m.logger).Log(
+		"method", "ListKeys",
+		"err", err,
+		"elapsed", time.Since(begin),
+		"sort", params.Sort,
+		"count", count,
+	)
+	return page, err
+}
+
+func (m *loggingMiddleware) exportKeys(ctx context.Context, params *types.KeyExportParams, fn func(*types.Key) error) error {
+	begin := time.Now()
+	var count int
+	err := m.next.exportKeys(ctx, params, func(key *types.Key) error {
+		count++
+		return fn(key)
+	})
+	level.Info(m.logger).Log(
+		"method", "ExportKeys",
+		"err", err,
+		"elapsed", time.Since(begin),
+		"format", params.Format,
+		"count", count,
+	)
+	return err
+}
+
+func (m *loggingMiddleware) importKeys(ctx context.Context, pool string, keys []*types.ImportKey) (*types.ImportReport, error) {
+	begin := time.Now()
+	report, err := m.next.importKeys(ctx, pool, keys)
+	var batchID string
+	var accepted, rejected int
+	if report != nil {
+		batchID, accepted, rejected = report.BatchID, report.Accepted, report.Rejected
+	}
+	level.Info(m.logger).Log(
+		"method", "ImportKeys",
+		"err", err,
+		"elapsed", time.Since(begin),
+		"pool", pool,
+		"count", len(keys),
+		"batch_id", batchID,
+		"accepted", accepted,
+		"rejected", rejected,
+	)
+	return report, err
+}
+
+func (m *loggingMiddleware) keyStats(ctx context.Context, pool *string) (*types.KeyStats, error) {
+	begin := time.Now()
+	stats, err := m.next.keyStats(ctx, pool)
+	var poolID interface{}
+	if pool != nil {
+		poolID = *pool
+	}
+	level.Info(m.logger).Log(
+		"method", "KeyStats",
+		"err", err,
+		"elapsed", time.Since(begin),
+		"pool", poolID,
+	)
+	return stats, err
+}
+
+func (m *loggingMiddleware) createPool(ctx context.Context, pool *types.Pool) (*types.Pool, error) {
+	begin := time.Now()
+	created, err := m.next.createPool(ctx, pool)
+	level.Info(m.logger).Log(
+		"method", "CreatePool",
+		"err", err,
+		"elapsed", time.Since(begin),
+		"pool", poolID(created),
+	)
+	return created, err
+}
+
+func (m *loggingMiddleware) getPool(ctx context.Context, id string) (*types.Pool, error) {
+	begin := time.Now()
+	pool, err := m.next.getPool(ctx, id)
+	level.Info(m.logger).Log(
+		"method", "GetPool",
+		"err", err,
+		"elapsed", time.Since(begin),
+		"pool", id,
+	)
+	return pool, err
+}
+
+func (m *loggingMiddleware) listPools(ctx context.Context) ([]*types.Pool, error) {
+	begin := time.Now()
+	pools, err := m.next.listPools(ctx)
+	level.Info(m.logger).Log(
+		"method", "ListPools",
+		"err", err,
+		"elapsed", time.Since(begin),
+	)
+	return pools, err
+}
+
+func (m *loggingMiddleware) authenticate(ctx context.Context, apiKey string) (*types.Principal, error) {
+	begin := time.Now()
+	principal, err := m.next.authenticate(ctx, apiKey)
+	if err != nil {
+		level.Info(m.logger).Log(
+			"method", "Authenticate",
+			"err", err,
+			"elapsed", time.Since(begin),
+		)
+	}
+	return principal, err
+}
+
+func (m *loggingMiddleware) createTenant(ctx context.Context, tenant *types.Tenant) (*types.Tenant, error) {
+	begin := time.Now()
+	created, err := m.next.createTenant(ctx, tenant)
+	level.Info(m.logger).Log(
+		"method", "CreateTenant",
+		"err", err,
+		"elapsed", time.Since(begin),
+		"tenant", tenantID(created),
+	)
+	return created, err
+}
+
+func (m *loggingMiddleware) listTenants(ctx context.Context) ([]*types.Tenant, error) {
+	begin := time.Now()
+	tenants, err := m.next.listTenants(ctx)
+	level.Info(m.logger).Log(
+		"method", "ListTenants",
+		"err", err,
+		"elapsed", time.Since(begin),
+	)
+	return tenants, err
+}
+
+func (m *loggingMiddleware) createAPIKey(ctx context.Context, tenant string, roles []types.Role) (*types.APIKey, error) {
+	begin := time.Now()
+	key, err := m.next.createAPIKey(ctx, tenant, roles)
+	var id string
+	if key != nil {
+		id = key.ID
+	}
+	level.Info(m.logger).Log(
+		"method", "CreateAPIKey",
+		"err", err,
+		"elapsed", time.Since(begin),
+		"tenant", tenant,
+		"roles", fmt.Sprint(roles),
+		"id", id,
+	)
+	return key, err
+}
+
+func (m *loggingMiddleware) revokeAPIKey(ctx context.Context, tenant, id string) error {
+	begin := time.Now()
+	err := m.next.revokeAPIKey(ctx, tenant, id)
+	level.Info(m.logger).Log(
+		"method", "RevokeAPIKey",
+		"err", err,
+		"elapsed", time.Since(begin),
+		"tenant", tenant,
+		"id", id,
+	)
+	return err
+}
+
+func (m *loggingMiddleware) createWebhook(ctx context.Context, webhook *types.Webhook) (*types.Webhook, error) {
+	begin := time.Now()
+	created, err := m.next.createWebhook(ctx, webhook)
+	var id string
+	if created != nil {
+		id = created.ID
+	}
+	level.Info(m.logger).Log(
+		"method", "CreateWebhook",
+		"err", err,
+		"elapsed", time.Since(begin),
+		"id", id,
+	)
+	return created, err
+}
+
+func (m *loggingMiddleware) listWebhooks(ctx context.Context) ([]*types.Webhook, error) {
+	begin := time.Now()
+	webhooks, err := m.next.listWebhooks(ctx)
+	level.Info(m.logger).Log(
+		"method", "ListWebhooks",
+		"err", err,
+		"elapsed", time.Since(begin),
+	)
+	return webhooks, err
+}
+
+func (m *loggingMiddleware) deleteWebhook(ctx context.Context, id string) error {
+	begin := time.Now()
+	err := m.next.deleteWebhook(ctx, id)
+	level.Info(m.logger).Log(
+		"method", "DeleteWebhook",
+		"err", err,
+		"elapsed", time.Since(begin),
+		"id", id,
+	)
+	return err
+}
+
+func (m *loggingMiddleware) listDeliveries(ctx context.Context, status types.DeliveryStatus, limit int) ([]*types.Delivery, error) {
+	begin := time.Now()
+	deliveries, err := m.next.listDeliveries(ctx, status, limit)
+	level.Info(m.logger).Log(
+		"method", "ListDeliveries",
+		"err", err,
+		"elapsed", time.Since(begin),
+		"status", status,
+		"count", len(deliveries),
+	)
+	return deliveries, err
+}
+
+func (m *loggingMiddleware) retryDelivery(ctx context.Context, id string) (*types.Delivery, error) {
+	begin := time.Now()
+	delivery, err := m.next.retryDelivery(ctx, id)
+	level.Info(m.logger).Log(
+		"method", "RetryDelivery",
+		"err", err,
+		"elapsed", time.Since(begin),
+		"id", id,
+	)
+	return delivery, err
+}
+
+func (m *loggingMiddleware) watchEvents(ctx context.Context, lastEventID string, fn func(*types.Event) error) error {
+	begin := time.Now()
+	var count int
+	err := m.next.watchEvents(ctx, lastEventID, func(event *types.Event) error {
+		if event != nil {
+			count++
+		}
+		return fn(event)
+	})
+	level.Info(m.logger).Log(
+		"method", "WatchEvents",
+		"err", err,
+		"elapsed", time.Since(begin),
+		"last_event_id", lastEventID,
+		"count", count,
+	)
+	return err
+}
+
+func (m *loggingMiddleware) beginIdempotent(ctx context.Context, key, fingerprint string) (*types.IdempotencyRecord, error) {
+	begin := time.Now()
+	rec, err := m.next.beginIdempotent(ctx, key, fingerprint)
+	level.Info(m.logger).Log(
+		"method", "BeginIdempotent",
+		"err", err,
+		"elapsed", time.Since(begin),
+		"key", key,
+		"replay", rec != nil,
+	)
+	return rec, err
+}
+
+func (m *loggingMiddleware) completeIdempotent(ctx context.Context, rec *types.IdempotencyRecord) error {
+	begin := time.Now()
+	err := m.next.completeIdempotent(ctx, rec)
+	level.Info(m.logger).Log(
+		"method", "CompleteIdempotent",
+		"err", err,
+		"elapsed", time.Since(begin),
+		"key", rec.Key,
+		"status", rec.StatusCode,
+	)
+	return err
+}
+
+func (m *loggingMiddleware) abortIdempotent(ctx context.Context, key string) error {
+	begin := time.Now()
+	err := m.next.abortIdempotent(ctx, key)
+	level.Info(m.logger).Log(
+		"method", "AbortIdempotent",
+		"err", err,
+		"elapsed", time.Since(begin),
+		"key", key,
+	)
+	return err
+}
+
+// keyID returns the key ID or an empty string for a nil key.
+func keyID(key *types.Key) string {
+	if key == nil {
+		return ""
+	}
+	return key.ID
+}
+
+// poolID returns the pool ID or an empty string for a nil pool.
+func poolID(pool *types.Pool) string {
+	if pool == nil {
+		return ""
+	}
+	return pool.ID
+}
+
+// tenantID returns the tenant ID or an empty string for a nil tenant.
+func tenantID(tenant *types.Tenant) string {
+	if tenant == nil {
+		return ""
+	}
+	return tenant.ID
+}
@@ -0,0 +1,300 @@
+package httpserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/evgeny08/collection-key/types"
+)
+
+// Outbox relay defaults.
+const (
+	defaultOutboxInterval = time.Second
+	outboxBatchSize       = 100
+	maxOutboxBackoff      = 5 * time.Minute
+	// outboxLease is how long the claimed outbox entries are not
+	// claimed again. It exceeds the time to publish a batch.
+	outboxLease = time.Minute
+)
+
+// Sink receives the key events relayed from the outbox. An event is
+// published at least once: it is published again if any sink of the relay
+// fails or the relay stops before recording the outcome, so the sinks and
+// their consumers should skip the events with the IDs already seen.
+type Sink interface {
+	Publish(ctx context.Context, events []*types.Event) error
+}
+
+// relay drains the outbox written by the storage together with the key
+// changes and publishes the events to the sinks in order. The events are
+// removed from the outbox once all sinks accept them, the failed ones are
+// retried after the interval doubled with every attempt and hold up the
+// events behind them until then.
+type relay struct {
+	storage  Storage
+	logger   log.Logger
+	sinks    []Sink
+	interval time.Duration
+
+	wake chan struct{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newRelay(storage Storage, logger log.Logger, sinks []Sink, interval time.Duration) *relay {
+	if interval <= 0 {
+		interval = defaultOutboxInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &relay{
+		storage:  storage,
+		logger:   logger,
+		sinks:    sinks,
+		interval: interval,
+		wake:     make(chan struct{}, 1),
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+}
+
+// run relays the due events until the relay is stopped.
+func (r *relay) run() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		r.relayDue()
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.wake:
+		}
+	}
+}
+
+// stop stops the relay and waits for a running batch to finish.
+func (r *relay) stop() {
+	r.cancel()
+	<-r.done
+}
+
+// notify wakes the relay up to relay the queued events.
+func (r *relay) notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// relayDue relays the due events a batch at a time until none is left
+// or a batch fails.
+func (r *relay) relayDue() {
+	for r.ctx.Err() == nil {
+		entries, err := r.storage.ClaimOutbox(r.ctx, time.Now(), outboxLease, outboxBatchSize)
+		if err != nil {
+			if r.ctx.Err() == nil {
+				level.Error(r.logger).Log("msg", "failed to claim outbox events", "err", err)
+			}
+			return
+		}
+		if len(entries) == 0 || !r.relayBatch(entries) || len(entries) < outboxBatchSize {
+			return
+		}
+	}
+}
+
+// relayBatch publishes the events of the entries to all sinks and removes
+// them from the outbox. It reports whether the batch is published.
+func (r *relay) relayBatch(entries []*types.OutboxEntry) bool {
+	events := make([]*types.Event, len(entries))
+	ids := make([]string, len(entries))
+	for i, e := range entries {
+		events[i] = e.Event
+		ids[i] = e.Event.ID
+	}
+
+	for _, sink := range r.sinks {
+		err := sink.Publish(r.ctx, events)
+		if err == nil {
+			continue
+		}
+		if r.ctx.Err() != nil {
+			// The batch is interrupted by the shutdown, it is
+			// claimed again once the lease runs out.
+			return false
+		}
+		level.Warn(r.logger).Log("msg", "failed to publish outbox events", "count", len(events), "err", err)
+		now := time.Now()
+		for _, e := range entries {
+			e.Attempts++
+			e.NextAttemptAt = now.Add(backoffDelay(r.interval, maxOutboxBackoff, e.Attempts))
+			e.LastError = err.Error()
+			if err := r.storage.UpdateOutbox(r.ctx, e); err != nil {
+				level.Error(r.logger).Log("msg", "failed to update outbox event", "event", e.Event.ID, "err", err)
+			}
+		}
+		return false
+	}
+
+	if err := r.storage.DeleteOutbox(r.ctx, ids); err != nil {
+		level.Error(r.logger).Log("msg", "failed to delete relayed outbox events", "count", len(ids), "err", err)
+		return false
+	}
+	return true
+}
+
+// backoffDelay returns the delay before the next attempt of an operation
+// failed the given number of times. It starts at base and doubles with
+// every attempt up to max.
+func backoffDelay(base, max time.Duration, attempts int) time.Duration {
+	delay := base
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// webhookSink queues the events for delivery to the webhooks of their
+// tenants subscribed to them. The delivery IDs are derived from the event
+// and webhook IDs, so an event published again is not delivered twice.
+type webhookSink struct {
+	storage Storage
+	// queued is called when deliveries are queued. It may be nil.
+	queued func()
+}
+
+// Publish queues the deliveries of the events.
+func (s *webhookSink) Publish(ctx context.Context, events []*types.Event) error {
+	var tenants []string
+	byTenant := make(map[string][]*types.Event)
+	for _, event := range events {
+		if _, ok := byTenant[event.TenantID]; !ok {
+			tenants = append(tenants, event.TenantID)
+		}
+		byTenant[event.TenantID] = append(byTenant[event.TenantID], event)
+	}
+
+	queued := false
+	for _, tenant := range tenants {
+		tctx := types.WithTenant(ctx, tenant)
+		webhooks, err := s.storage.ListWebhooks(tctx)
+		if err != nil {
+			return fmt.Errorf("failed to get webhooks of tenant %q: %v", tenant, err)
+		}
+		now := time.Now().UTC()
+		var deliveries []*types.Delivery
+		for _, event := range byTenant[tenant] {
+			for _, webhook := range webhooks {
+				if !webhook.Subscribed(event.Type) {
+					continue
+				}
+				deliveries = append(deliveries, &types.Delivery{
+					ID:            event.ID + "-" + webhook.ID,
+					WebhookID:     webhook.ID,
+					Event:         event,
+					Status:        types.DeliveryPending,
+					NextAttemptAt: now,
+					CreatedAt:     now,
+				})
+			}
+		}
+		if len(deliveries) == 0 {
+			continue
+		}
+		if err := s.storage.EnqueueDeliveries(tctx, deliveries); err != nil {
+			return fmt.Errorf("failed to queue webhook deliveries of tenant %q: %v", tenant, err)
+		}
+		queued = true
+	}
+	if queued && s.queued != nil {
+		s.queued()
+	}
+	return nil
+}
+
+// ndjsonSink writes the events as newline-delimited JSON.
+type ndjsonSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewNDJSONSink returns a sink writing the events to w as newline-delimited
+// JSON, one event per line. If w has a Sync method, such as *os.File, it is
+// called after every batch, so the accepted events survive a crash.
+func NewNDJSONSink(w io.Writer) Sink {
+	return &ndjsonSink{w: w}
+}
+
+// Publish writes the events.
+func (s *ndjsonSink) Publish(ctx context.Context, events []*types.Event) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, event := range events {
+		if err := enc.Encode(event); err != nil {
+			return fmt.Errorf("failed to encode event: %v", err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if f, ok := s.w.(interface{ Sync() error }); ok {
+		return f.Sync()
+	}
+	return nil
+}
+
+// Broker publishes messages to a message broker, such as Kafka or NATS.
+// Publish returns once the broker has accepted the message.
+type Broker interface {
+	Publish(ctx context.Context, topic, key string, value []byte) error
+}
+
+// brokerSink publishes the events to a message broker.
+type brokerSink struct {
+	broker Broker
+	topic  string
+}
+
+// NewBrokerSink returns a sink publishing the events to the broker topic
+// as JSON messages keyed by the key ID, so a broker partitioning the topic
+// by the message key keeps the events of a key in order.
+func NewBrokerSink(broker Broker, topic string) Sink {
+	return &brokerSink{broker: broker, topic: topic}
+}
+
+// Publish publishes the events in order.
+func (s *brokerSink) Publish(ctx context.Context, events []*types.Event) error {
+	for _, event := range events {
+		value, err := json.Marshal(event)
+		if err != nil {
+			return fmt.Errorf("failed to encode event: %v", err)
+		}
+		var key string
+		if event.Key != nil {
+			key = event.Key.ID
+		}
+		if err := s.broker.Publish(ctx, s.topic, key, value); err != nil {
+			return fmt.Errorf("failed to publish event to %s: %v", s.topic, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package httpserver
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/evgeny08/collection-key/types"
+)
+
+// defaultReplenishInterval is how often the key stock is checked by default.
+const defaultReplenishInterval = time.Minute
+
+// stockRef identifies the keys of a tenant pool.
+type stockRef struct {
+	tenant string
+	pool   string
+}
+
+// replenisher watches the available keys of the pools with a replenish
+// policy. It raises an alert when a pool drops below its low-water mark
+// and creates keys up to the high-water mark if the policy is automatic.
+// The stock is checked periodically and on every issuance.
+type replenisher struct {
+	svc      *basicService
+	logger   log.Logger
+	interval time.Duration
+	// policy is the replenish policy of the default tenant keys out of any pool.
+	policy     *types.ReplenishPolicy
+	onLowStock func(alert *types.StockAlert)
+
+	checks chan stockRef
+	// low holds the pools below the low-water mark, so an alert is
+	// raised once per drop. It is used by the run goroutine only.
+	low map[stockRef]bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newReplenisher(svc *basicService, logger log.Logger, interval time.Duration, policy *types.ReplenishPolicy, onLowStock func(*types.StockAlert)) *replenisher {
+	if interval <= 0 {
+		interval = defaultReplenishInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &replenisher{
+		svc:        svc,
+		logger:     logger,
+		interval:   interval,
+		policy:     policy,
+		onLowStock: onLowStock,
+		checks:     make(chan stockRef, 64),
+		low:        make(map[stockRef]bool),
+		ctx:        ctx,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+}
+
+// run checks the key stock until the replenisher is stopped.
+func (r *replenisher) run() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	r.checkAll()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			r.checkAll()
+		case ref := <-r.checks:
+			r.checkPool(ref)
+		}
+	}
+}
+
+// stop stops the replenisher and waits for a running check to finish.
+// A running key batch is canceled.
+func (r *replenisher) stop() {
+	r.cancel()
+	<-r.done
+}
+
+// notify schedules a stock check of the context tenant pool. The check
+// is dropped if too many are pending, the periodic check catches up.
+func (r *replenisher) notify(ctx context.Context, pool string) {
+	select {
+	case r.checks <- stockRef{types.TenantFromContext(ctx), pool}:
+	default:
+	}
+}
+
+// checkAll checks the stock of all pools with a replenish policy.
+func (r *replenisher) checkAll() {
+	if r.policy != nil {
+		r.check(stockRef{}, r.policy)
+	}
+	tenants, err := r.svc.storage.ListTenants(r.ctx)
+	if err != nil {
+		level.Error(r.logger).Log("msg", "failed to list tenants for stock check", "err", err)
+		return
+	}
+	ids := []string{""}
+	for _, tenant := range tenants {
+		ids = append(ids, tenant.ID)
+	}
+	for _, tenant := range ids {
+		pools, err := r.svc.storage.ListPools(types.WithTenant(r.ctx, tenant))
+		if err != nil {
+			level.Error(r.logger).Log("msg", "failed to list pools for stock check", "tenant", tenant, "err", err)
+			continue
+		}
+		for _, pool := range pools {
+			if pool.Replenish != nil {
+				r.check(stockRef{tenant, pool.ID}, pool.Replenish)
+			}
+		}
+	}
+}
+
+// checkPool checks the stock of the pool if it has a replenish policy.
+func (r *replenisher) checkPool(ref stockRef) {
+	if ref.pool == "" {
+		if ref.tenant == "" && r.policy != nil {
+			r.check(ref, r.policy)
+		}
+		return
+	}
+	pool, err := r.svc.storage.GetPool(types.WithTenant(r.ctx, ref.tenant), ref.pool)
+	if err != nil || pool.Replenish == nil {
+		return
+	}
+	r.check(ref, pool.Replenish)
+}
+
+// check raises an alert if the pool is below the low-water mark
+// and replenishes it if the policy is automatic.
+func (r *replenisher) check(ref stockRef, policy *types.ReplenishPolicy) {
+	ctx := types.WithTenant(r.ctx, ref.tenant)
+	stats, err := r.svc.storage.KeyStats(ctx, &ref.pool, nil)
+	if err != nil {
+		level.Error(r.logger).Log("msg", "failed to check key stock", "tenant", ref.tenant, "pool", ref.pool, "err", err)
+		return
+	}
+	available := stats.Statuses[types.StatusAvailable]
+	if available >= int64(policy.LowWater) {
+		delete(r.low, ref)
+		return
+	}
+
+	if !r.low[ref] {
+		r.low[ref] = true
+		level.Warn(r.logger).Log(
+			"msg", "pool is low on keys",
+			"tenant", ref.tenant,
+			"pool", ref.pool,
+			"available", available,
+			"low_water", policy.LowWater,
+		)
+		if r.onLowStock != nil {
+			r.onLowStock(&types.StockAlert{
+				TenantID:  ref.tenant,
+				PoolID:    ref.pool,
+				Available: available,
+				LowWater:  policy.LowWater,
+				At:        time.Now().UTC(),
+			})
+		}
+	}
+	if !policy.Auto {
+		return
+	}
+
+	count := policy.HighWater - int(available)
+	batchID, err := r.svc.createKeys(ctx, ref.pool, count, nil, nil, func(*types.BatchProgress) {})
+	if err != nil {
+		level.Error(r.logger).Log("msg", "failed to replenish pool", "tenant", ref.tenant, "pool", ref.pool, "batch_id", batchID, "err", err)
+		return
+	}
+	level.Info(r.logger).Log("msg", "replenished pool", "tenant", ref.tenant, "pool", ref.pool, "batch_id", batchID, "count", count)
+}
+
+// validateReplenish checks the replenish policy.
+func validateReplenish(policy *types.ReplenishPolicy) error {
+	if policy == nil {
+		return nil
+	}
+	if policy.LowWater < 1 {
+		return errorf(ErrBadParams, "low-water mark must be positive")
+	}
+	if policy.Auto && (policy.HighWater <= policy.LowWater || policy.HighWater > maxBatchKeys) {
+		return errorf(ErrBadParams, "high-water mark must be above the low-water mark and at most %d", maxBatchKeys)
+	}
+	return nil
+}
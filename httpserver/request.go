@@ -0,0 +1,59 @@
+package httpserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+
+	"github.com/evgeny08/collection-key/types"
+)
+
+const (
+	// requestIDHeader is a request and response header carrying the request ID.
+	requestIDHeader = "X-Request-ID"
+	// maxRequestIDLen is the maximum length of a client request ID.
+	maxRequestIDLen = 128
+)
+
+// requestMiddleware puts the request ID and the client IP into the request
+// context, so the audit records of the key operations tell which request
+// performed them. The request ID of the client is kept if it is valid,
+// a new one is generated otherwise. It is returned in the response header.
+func requestMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := types.WithRequest(r.Context(), &types.RequestInfo{ID: id, ClientIP: ip})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// validRequestID reports whether the request ID is not empty, fits
+// the length limit and consists of printable ASCII characters.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
@@ -14,25 +14,115 @@ import (
 
 // ServerHTTP is a service structure http server.
 type ServerHTTP struct {
-	logger log.Logger
-	srv    *http.Server
+	logger      log.Logger
+	srv         *http.Server
+	replenisher *replenisher
+	dispatcher  *dispatcher
+	relay       *relay
 }
 
 // Config is a http server configuration.
 type Config struct {
-	Logger      log.Logger
-	Port        string
-	Storage     Storage
-	RateLimiter *rate.Limiter
+	Logger       log.Logger
+	Port         string
+	Storage      Storage
+	KeyGenerator KeyGenerator
+	// KeyGeneratorFactory creates a generator with custom parameters
+	// for batch key creation and key pools. Custom parameters
+	// are rejected if it is nil.
+	KeyGeneratorFactory func(params *types.KeyGenParams) (KeyGenerator, error)
+	RateLimiter         *rate.Limiter
+	// Authenticators authenticate the requests without an API key
+	// and are tried in order.
+	Authenticators []Authenticator
+	// AnonymousRoles are the roles of the requests without credentials in
+	// the default tenant. Such requests are rejected if there are none.
+	AnonymousRoles []types.Role
+	// IdempotencyTTL is how long the responses of the requests with an
+	// Idempotency-Key header are kept. Defaults to 24 hours.
+	IdempotencyTTL time.Duration
+	// ReplenishInterval is how often the key stock of the pools with
+	// a replenish policy is checked. Defaults to one minute.
+	ReplenishInterval time.Duration
+	// Replenish is the replenish policy of the default tenant keys
+	// out of any pool. Nil disables it.
+	Replenish *types.ReplenishPolicy
+	// OnLowStock is called when the available keys of a pool drop below
+	// the low-water mark. It is called from the replenisher goroutine
+	// and may be nil.
+	OnLowStock func(alert *types.StockAlert)
+	// OutboxInterval is how often the outbox is checked for the key events
+	// to publish. Defaults to one second.
+	OutboxInterval time.Duration
+	// Sinks receive the key events in addition to the webhooks.
+	Sinks []Sink
+	// WebhookInterval is how often the webhook delivery queue is checked
+	// for the retries due. Defaults to 10 seconds.
+	WebhookInterval time.Duration
+	// WebhookMaxAttempts is the number of attempts to deliver an event
+	// before the delivery is marked dead. Defaults to 10.
+	WebhookMaxAttempts int
+	// WebhookBackoff is the delay before the first retry of a webhook
+	// delivery, doubled with every retry. Defaults to 30 seconds.
+	WebhookBackoff time.Duration
+	// WebhookClient sends the webhook requests. Defaults to a client
+	// with a 10 second timeout that does not follow redirects and only
+	// connects to the public addresses.
+	WebhookClient *http.Client
 }
 
 // Storage is a persistent collection-key storage.
 type Storage interface {
 	InsertKey(ctx context.Context, key *types.Key) error
-	GetKey(ctx context.Context) (*types.Key, error)
-	CanceledKey(ctx context.Context, id string) error
+	InsertKeys(ctx context.Context, keys []*types.Key) (int, error)
+	ImportKeys(ctx context.Context, keys []*types.Key) ([]error, error)
+	GetKey(ctx context.Context, pool string, issuance *types.Issuance) (*types.Key, error)
+	CanceledKey(ctx context.Context, id string) (*types.Key, error)
+	RedeemKey(ctx context.Context, id, redeemer string) (*types.Key, error)
+	RevokeKey(ctx context.Context, id string) (*types.Key, error)
 	VerificationKey(ctx context.Context, id string) (*types.Key, error)
-	UnreleasedKey(ctx context.Context) ([]*types.Key, error)
+	KeyHistory(ctx context.Context, id string) ([]*types.AuditRecord, error)
+	ListKeys(ctx context.Context, params *types.KeyListParams) (*types.KeyPage, error)
+	ExportKeys(ctx context.Context, filter *types.KeyFilter, sort types.KeySort, fn func(*types.Key) error) error
+	KeyStats(ctx context.Context, pool *string, issuedSince []time.Time) (*types.KeyStats, error)
+	CreatePool(ctx context.Context, pool *types.Pool) error
+	GetPool(ctx context.Context, id string) (*types.Pool, error)
+	ListPools(ctx context.Context) ([]*types.Pool, error)
+	CreateTenant(ctx context.Context, tenant *types.Tenant) error
+	GetTenant(ctx context.Context, id string) (*types.Tenant, error)
+	ListTenants(ctx context.Context) ([]*types.Tenant, error)
+	CreateAPIKey(ctx context.Context, key *types.APIKey) error
+	GetAPIKey(ctx context.Context, hash string) (*types.APIKey, error)
+	RevokeAPIKey(ctx context.Context, tenant, id string) error
+	CreateIdempotencyRecord(ctx context.Context, rec *types.IdempotencyRecord) error
+	GetIdempotencyRecord(ctx context.Context, key string) (*types.IdempotencyRecord, error)
+	CompleteIdempotencyRecord(ctx context.Context, rec *types.IdempotencyRecord) error
+	DeleteIdempotencyRecord(ctx context.Context, key string) error
+	CreateWebhook(ctx context.Context, webhook *types.Webhook) error
+	GetWebhook(ctx context.Context, id string) (*types.Webhook, error)
+	ListWebhooks(ctx context.Context) ([]*types.Webhook, error)
+	DeleteWebhook(ctx context.Context, id string) error
+	EnqueueDeliveries(ctx context.Context, deliveries []*types.Delivery) error
+	ClaimDelivery(ctx context.Context, now time.Time, lease time.Duration, skip []string) (*types.Delivery, error)
+	UpdateDelivery(ctx context.Context, d *types.Delivery) error
+	ListDeliveries(ctx context.Context, status types.DeliveryStatus, limit int) ([]*types.Delivery, error)
+	RetryDelivery(ctx context.Context, id string, now time.Time) (*types.Delivery, error)
+	ClaimOutbox(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*types.OutboxEntry, error)
+	UpdateOutbox(ctx context.Context, e *types.OutboxEntry) error
+	DeleteOutbox(ctx context.Context, ids []string) error
+	WatchKeys(ctx context.Context, resumeAfter string, idle time.Duration, fn func(*types.Event) error) error
+}
+
+// Storage methods of keys, pools, webhooks and idempotency records are scoped
+// to the tenant carried by the context, see types.TenantFromContext, except
+// for the delivery queue and outbox methods used by the dispatcher and the
+// relay. Key operations are recorded in the audit log with the context
+// principal and request info, and the key changes queue their events in the
+// outbox together with the changes.
+
+// KeyGenerator generates new key IDs.
+type KeyGenerator interface {
+	Generate() (string, error)
 }
 
 // New creates a new http server.
@@ -51,18 +141,43 @@ func New(cfg *Config) (*ServerHTTP, error) {
 		srv:    srv,
 	}
 
+	if err := validateReplenish(cfg.Replenish); err != nil {
+		return nil, err
+	}
+
+	idempotencyTTL := cfg.IdempotencyTTL
+	if idempotencyTTL <= 0 {
+		idempotencyTTL = defaultIdempotencyTTL
+	}
+
 	svc := &basicService{
-		logger:  cfg.Logger,
-		storage: cfg.Storage,
+		logger:         cfg.Logger,
+		storage:        cfg.Storage,
+		keyGen:         cfg.KeyGenerator,
+		newKeyGen:      cfg.KeyGeneratorFactory,
+		idempotencyTTL: idempotencyTTL,
 	}
+	server.replenisher = newReplenisher(svc, cfg.Logger, cfg.ReplenishInterval, cfg.Replenish, cfg.OnLowStock)
+	svc.stockChanged = server.replenisher.notify
+	go server.replenisher.run()
+
+	server.dispatcher = newDispatcher(cfg.Storage, cfg.Logger, cfg.WebhookClient, cfg.WebhookInterval, cfg.WebhookMaxAttempts, cfg.WebhookBackoff)
+	svc.deliveriesQueued = server.dispatcher.notify
+	go server.dispatcher.run()
+
+	sinks := append([]Sink{&webhookSink{storage: cfg.Storage, queued: server.dispatcher.notify}}, cfg.Sinks...)
+	server.relay = newRelay(cfg.Storage, cfg.Logger, sinks, cfg.OutboxInterval)
+	go server.relay.run()
 
 	handler := newHandler(&handlerConfig{
-		svc:         svc,
-		logger:      cfg.Logger,
-		rateLimiter: cfg.RateLimiter,
+		svc:            svc,
+		logger:         cfg.Logger,
+		rateLimiter:    cfg.RateLimiter,
+		authenticators: cfg.Authenticators,
+		anonymousRoles: cfg.AnonymousRoles,
 	})
 
-	mux.Handle("/api/v1/", accessControl(handler))
+	mux.Handle("/api/v1/", accessControl(requestMiddleware(handler)))
 
 	return server, nil
 }
@@ -72,7 +187,8 @@ func accessControl(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Authorization, "+apiKeyHeader+", "+idempotencyKeyHeader+", "+requestIDHeader+", "+lastEventIDHeader)
+		w.Header().Set("Access-Control-Expose-Headers", requestIDHeader)
 
 		if r.Method == "OPTIONS" {
 			return
@@ -91,8 +207,12 @@ func (s *ServerHTTP) Run() error {
 	return nil
 }
 
-// Shutdown stopped the http server.
+// Shutdown stopped the http server, the key replenisher,
+// the outbox relay and the webhook dispatcher.
 func (s *ServerHTTP) Shutdown() {
+	s.replenisher.stop()
+	s.relay.stop()
+	s.dispatcher.stop()
 	err := s.srv.Close()
 	if err != nil {
 		err := level.Info(s.logger).Log("msg", "HTTP server: shutdown has err", "err:", err)
@@ -2,8 +2,14 @@ package httpserver
 
 import (
 	"context"
-	"math/rand"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/go-kit/kit/log"
 
@@ -12,92 +18,1041 @@ import (
 
 // service manages HTTP server methods.
 type service interface {
-	createKey(ctx context.Context) (*types.Key, error)
-	getKey(ctx context.Context) (string, error)
+	createKey(ctx context.Context, pool string, validity *types.KeyValidity) (*types.Key, error)
+	createKeys(ctx context.Context, pool string, count int, params *types.KeyGenParams, validity *types.KeyValidity, progress func(*types.BatchProgress)) (string, error)
+	getKey(ctx context.Context, pool string) (string, error)
+	issueKey(ctx context.Context, pool string, issuance *types.Issuance) (*types.Key, error)
 	canceledKey(ctx context.Context, id string) error
+	redeemKey(ctx context.Context, id, redeemer string) (*types.Key, error)
+	revokeKey(ctx context.Context, id string) (*types.Key, error)
 	verificationKey(ctx context.Context, id string) (*types.Key, error)
-	unreleasedKey(ctx context.Context) ([]*types.Key, error)
+	keyHistory(ctx context.Context, id string) ([]*types.AuditRecord, error)
+	unreleasedKey(ctx context.Context, pool string) ([]*types.Key, error)
+	listKeys(ctx context.Context, params *types.KeyListParams) (*types.KeyPage, error)
+	exportKeys(ctx context.Context, params *types.KeyExportParams, fn func(*types.Key) error) error
+	importKeys(ctx context.Context, pool string, keys []*types.ImportKey) (*types.ImportReport, error)
+	keyStats(ctx context.Context, pool *string) (*types.KeyStats, error)
+	createPool(ctx context.Context, pool *types.Pool) (*types.Pool, error)
+	getPool(ctx context.Context, id string) (*types.Pool, error)
+	listPools(ctx context.Context) ([]*types.Pool, error)
+	authenticate(ctx context.Context, apiKey string) (*types.Principal, error)
+	createTenant(ctx context.Context, tenant *types.Tenant) (*types.Tenant, error)
+	listTenants(ctx context.Context) ([]*types.Tenant, error)
+	createAPIKey(ctx context.Context, tenant string, roles []types.Role) (*types.APIKey, error)
+	revokeAPIKey(ctx context.Context, tenant, id string) error
+	createWebhook(ctx context.Context, webhook *types.Webhook) (*types.Webhook, error)
+	listWebhooks(ctx context.Context) ([]*types.Webhook, error)
+	deleteWebhook(ctx context.Context, id string) error
+	listDeliveries(ctx context.Context, status types.DeliveryStatus, limit int) ([]*types.Delivery, error)
+	retryDelivery(ctx context.Context, id string) (*types.Delivery, error)
+	watchEvents(ctx context.Context, lastEventID string, fn func(*types.Event) error) error
+	beginIdempotent(ctx context.Context, key, fingerprint string) (*types.IdempotencyRecord, error)
+	completeIdempotent(ctx context.Context, rec *types.IdempotencyRecord) error
+	abortIdempotent(ctx context.Context, key string) error
 }
 
 type basicService struct {
-	logger  log.Logger
-	storage Storage
+	logger    log.Logger
+	storage   Storage
+	keyGen    KeyGenerator
+	newKeyGen func(params *types.KeyGenParams) (KeyGenerator, error)
+
+	idempotencyTTL time.Duration
+	// stockChanged is called with the pool of every issued key
+	// and every issuance failing for a lack of keys. It may be nil.
+	stockChanged func(ctx context.Context, pool string)
+	// deliveriesQueued is called when a dead webhook delivery
+	// is retried. It may be nil.
+	deliveriesQueued func()
 }
 
-// createKey creates a new key
-func (s *basicService) createKey(ctx context.Context) (*types.Key, error) {
-	keyLength := 4
-	key := &types.Key{
-		ID:       genKey(keyLength),
-		Issued:   false,
-		Canceled: false,
+// maxCreateKeyAttempts is a number of attempts to generate a unique key ID.
+const maxCreateKeyAttempts = 5
+
+// createKey creates a new key of the pool with an optional validity window.
+// An empty pool creates a key out of any pool.
+func (s *basicService) createKey(ctx context.Context, pool string, validity *types.KeyValidity) (*types.Key, error) {
+	if err := validateValidity(validity); err != nil {
+		return nil, err
 	}
-	err := s.storage.InsertKey(ctx, key)
+	keyGen, err := s.poolKeyGen(ctx, pool, nil)
 	if err != nil {
-		return nil, errorf(ErrBadParams, "failed to insert key: %v", err)
+		return nil, err
 	}
-	return key, nil
+	for i := 0; i < maxCreateKeyAttempts; i++ {
+		id, err := keyGen.Generate()
+		if err != nil {
+			return nil, errorf(ErrInternal, "failed to generate key: %v", err)
+		}
+		key := &types.Key{ID: id, PoolID: pool}
+		key.SetStatus(types.StatusAvailable, time.Now())
+		setValidity(key, validity)
+		err = s.storage.InsertKey(ctx, key)
+		if err != nil {
+			if storageErrIsDuplicate(err) {
+				continue
+			}
+			return nil, insertErr(err)
+		}
+		return key, nil
+	}
+	return nil, errorf(ErrConflict, "failed to generate a unique key in %d attempts", maxCreateKeyAttempts)
+}
+
+// validateValidity checks the key validity window.
+func validateValidity(validity *types.KeyValidity) error {
+	if validity == nil {
+		return nil
+	}
+	if validity.ExpiresAt != nil && !validity.ExpiresAt.After(time.Now()) {
+		return errorf(ErrBadParams, "expiry time is in the past")
+	}
+	if validity.NotBefore != nil && validity.ExpiresAt != nil && !validity.ExpiresAt.After(*validity.NotBefore) {
+		return errorf(ErrBadParams, "expiry time must be after the start time")
+	}
+	return nil
 }
 
-// genKey generates a key with given length
-func genKey(n int) string {
-	letterRunes := []rune("1234567890abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
-	b := make([]rune, n)
-	for i := range b {
-		b[i] = letterRunes[rand.Intn(len(letterRunes))]
+// setValidity sets the key validity window.
+func setValidity(key *types.Key, validity *types.KeyValidity) {
+	if validity == nil {
+		return
 	}
-	return string(b)
+	key.NotBefore = validity.NotBefore
+	key.ExpiresAt = validity.ExpiresAt
 }
 
-// GetKey returns an unreleased key
-func (s *basicService) getKey(ctx context.Context) (string, error) {
-	key, err := s.storage.GetKey(ctx)
+// Batch key creation limits.
+const (
+	maxBatchKeys   = 1000000
+	batchChunkSize = 1000
+)
+
+// insertErr maps a storage error of a key insertion to a service error.
+func insertErr(err error) error {
+	if storageErrIsNotFound(err) {
+		return errorf(ErrNotFound, "pool is not found")
+	}
+	if storageErrIsConflict(err) {
+		return errorf(ErrConflict, "failed to insert key: %v", err)
+	}
+	return errorf(ErrBadParams, "failed to insert key: %v", err)
+}
+
+// poolKeyGen returns the key generator for the pool settings overridden
+// by the custom parameters. An empty pool has no settings of its own.
+func (s *basicService) poolKeyGen(ctx context.Context, pool string, params *types.KeyGenParams) (KeyGenerator, error) {
+	if pool != "" {
+		p, err := s.storage.GetPool(ctx, pool)
+		if err != nil {
+			return nil, poolErr(err)
+		}
+		params = p.Generator.Merge(params)
+	}
+	if params == nil {
+		return s.keyGen, nil
+	}
+	if s.newKeyGen == nil {
+		return nil, errorf(ErrBadParams, "custom generator parameters are not supported")
+	}
+	keyGen, err := s.newKeyGen(params)
 	if err != nil {
-		if storageErrIsNotFound(err) {
-			return "", errorf(ErrNotFound, "key is not found")
+		return nil, errorf(ErrBadParams, "invalid generator parameters: %v", err)
+	}
+	return keyGen, nil
+}
+
+// createKeys creates count new keys of the pool in chunks and reports the
+// progress after every chunk. It returns the batch ID assigned to the keys.
+func (s *basicService) createKeys(ctx context.Context, pool string, count int, params *types.KeyGenParams, validity *types.KeyValidity, progress func(*types.BatchProgress)) (string, error) {
+	if count < 1 || count > maxBatchKeys {
+		return "", errorf(ErrBadParams, "count must be between 1 and %d", maxBatchKeys)
+	}
+	if err := validateValidity(validity); err != nil {
+		return "", err
+	}
+
+	keyGen, err := s.poolKeyGen(ctx, pool, params)
+	if err != nil {
+		return "", err
+	}
+
+	batchID, err := newBatchID()
+	if err != nil {
+		return "", errorf(ErrInternal, "failed to generate batch id: %v", err)
+	}
+
+	created := 0
+	progress(&types.BatchProgress{BatchID: batchID, Total: count})
+	for created < count {
+		n := count - created
+		if n > batchChunkSize {
+			n = batchChunkSize
+		}
+		inserted, err := s.insertKeysChunk(ctx, keyGen, pool, batchID, validity, n)
+		created += inserted
+		if err != nil {
+			return batchID, err
+		}
+		progress(&types.BatchProgress{BatchID: batchID, Created: created, Total: count})
+	}
+	return batchID, nil
+}
+
+// insertKeysChunk inserts n new keys, regenerating the IDs
+// that collide with the existing keys.
+func (s *basicService) insertKeysChunk(ctx context.Context, keyGen KeyGenerator, pool, batchID string, validity *types.KeyValidity, n int) (int, error) {
+	inserted := 0
+	for i := 0; i < maxCreateKeyAttempts && inserted < n; i++ {
+		keys := make([]*types.Key, n-inserted)
+		for j := range keys {
+			id, err := keyGen.Generate()
+			if err != nil {
+				return inserted, errorf(ErrInternal, "failed to generate key: %v", err)
+			}
+			keys[j] = &types.Key{ID: id, PoolID: pool, BatchID: batchID}
+			keys[j].SetStatus(types.StatusAvailable, time.Now())
+			setValidity(keys[j], validity)
+		}
+		m, err := s.storage.InsertKeys(ctx, keys)
+		inserted += m
+		if err != nil && !storageErrIsDuplicate(err) {
+			return inserted, insertErr(err)
 		}
-		return "", errorf(ErrBadParams, "failed to get key: %v", err)
+	}
+	if inserted < n {
+		return inserted, errorf(ErrConflict, "failed to generate unique keys in %d attempts", maxCreateKeyAttempts)
+	}
+	return inserted, nil
+}
+
+// Key import limits.
+const maxImportKeys = 100000
+
+// importKeys creates the keys of the pool with the given IDs in chunks. It
+// rejects the invalid keys, the repeated IDs and the keys that already exist,
+// and reports the outcome of every row. The imported keys get a batch ID.
+func (s *basicService) importKeys(ctx context.Context, pool string, keys []*types.ImportKey) (*types.ImportReport, error) {
+	if len(keys) == 0 {
+		return nil, errorf(ErrBadParams, "import has no keys")
+	}
+	if len(keys) > maxImportKeys {
+		return nil, errorf(ErrBadParams, "import has more than %d keys", maxImportKeys)
+	}
+	if pool != "" {
+		if _, err := s.storage.GetPool(ctx, pool); err != nil {
+			return nil, poolErr(err)
+		}
+	}
+	batchID, err := newBatchID()
+	if err != nil {
+		return nil, errorf(ErrInternal, "failed to generate batch id: %v", err)
+	}
+
+	report := &types.ImportReport{BatchID: batchID, Rows: make([]*types.ImportRow, len(keys))}
+	seen := make(map[string]int)
+	var chunk []*types.Key
+	var chunkRows []*types.ImportRow
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		errs, err := s.storage.ImportKeys(ctx, chunk)
+		if err != nil && !storageErrIsNotFound(err) && !storageErrIsConflict(err) {
+			// The keys of the previous chunks are kept and can be
+			// found by the batch ID.
+			return errorf(ErrInternal, "failed to import keys of batch %s: %v", batchID, err)
+		}
+		for i, row := range chunkRows {
+			switch {
+			case err != nil:
+				// The pool is gone or full.
+				row.Status, row.Reason = types.ImportRejected, err.Error()
+			case errs[i] != nil:
+				row.Status, row.Reason = types.ImportRejected, errs[i].Error()
+			default:
+				row.Status = types.ImportAccepted
+			}
+		}
+		chunk, chunkRows = nil, nil
+		return nil
+	}
+
+	for i, k := range keys {
+		row := &types.ImportRow{Row: k.Row, ID: k.ID}
+		report.Rows[i] = row
+		if reason := importKeyReason(k); reason != "" {
+			row.Status, row.Reason = types.ImportRejected, reason
+			continue
+		}
+		if first, ok := seen[k.ID]; ok {
+			row.Status, row.Reason = types.ImportRejected, fmt.Sprintf("duplicate of row %d", first)
+			continue
+		}
+		seen[k.ID] = k.Row
+
+		key := &types.Key{ID: k.ID, PoolID: pool, BatchID: batchID, Metadata: k.Metadata}
+		key.SetStatus(types.StatusAvailable, time.Now())
+		setValidity(key, &types.KeyValidity{NotBefore: k.NotBefore, ExpiresAt: k.ExpiresAt})
+		chunk = append(chunk, key)
+		chunkRows = append(chunkRows, row)
+		if len(chunk) == batchChunkSize {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	for _, row := range report.Rows {
+		if row.Status == types.ImportAccepted {
+			report.Accepted++
+		} else {
+			report.Rejected++
+		}
+	}
+	return report, nil
+}
+
+// importKeyReason returns the reason the import key is invalid, or an empty string.
+func importKeyReason(k *types.ImportKey) string {
+	if k.Invalid != "" {
+		return k.Invalid
+	}
+	if k.ID == "" || len(k.ID) > types.MaxKeyIDLen {
+		return fmt.Sprintf("id must be 1 to %d bytes long", types.MaxKeyIDLen)
+	}
+	// The key IDs are used in request paths, so they
+	// are limited to the URL unreserved characters.
+	if !types.ValidKeyIDChars(k.ID) {
+		return "id must consist of letters, digits and the characters -._~"
+	}
+	if err := validateValidity(&types.KeyValidity{NotBefore: k.NotBefore, ExpiresAt: k.ExpiresAt}); err != nil {
+		return err.Error()
+	}
+	if err := validateIssuance(&types.Issuance{Metadata: k.Metadata}); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// newBatchID generates a random batch ID.
+func newBatchID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// GetKey returns an unreleased key of the pool.
+// An empty pool selects the keys out of any pool.
+func (s *basicService) getKey(ctx context.Context, pool string) (string, error) {
+	key, err := s.issueKey(ctx, pool, nil)
+	if err != nil {
+		return "", err
 	}
 	return key.ID, nil
 }
 
+// Issuance limits.
+const (
+	maxRecipientLen     = 256
+	maxMetadataEntries  = 32
+	maxMetadataKeyLen   = 64
+	maxMetadataValueLen = 512
+)
+
+// issueKey issues an unreleased key of the pool to the optional recipient.
+// An empty pool selects the keys out of any pool.
+func (s *basicService) issueKey(ctx context.Context, pool string, issuance *types.Issuance) (*types.Key, error) {
+	if err := validateIssuance(issuance); err != nil {
+		return nil, err
+	}
+	key, err := s.storage.GetKey(ctx, pool, issuance)
+	if s.stockChanged != nil && (err == nil || storageErrIsNotFound(err)) {
+		s.stockChanged(ctx, pool)
+	}
+	if err != nil {
+		if storageErrIsNotFound(err) {
+			return nil, errorf(ErrNotFound, "%v", err)
+		}
+		if storageErrIsConflict(err) {
+			return nil, errorf(ErrConflict, "failed to get key: %v", err)
+		}
+		return nil, errorf(ErrBadParams, "failed to get key: %v", err)
+	}
+	return key, nil
+}
+
+// validateIssuance checks the issuance fits the limits.
+func validateIssuance(issuance *types.Issuance) error {
+	if issuance == nil {
+		return nil
+	}
+	if len(issuance.Recipient) > maxRecipientLen {
+		return errorf(ErrBadParams, "recipient is longer than %d bytes", maxRecipientLen)
+	}
+	if len(issuance.Metadata) > maxMetadataEntries {
+		return errorf(ErrBadParams, "metadata has more than %d entries", maxMetadataEntries)
+	}
+	for k, v := range issuance.Metadata {
+		if k == "" || len(k) > maxMetadataKeyLen {
+			return errorf(ErrBadParams, "metadata key must be 1 to %d bytes long", maxMetadataKeyLen)
+		}
+		// Keys are stored as document fields.
+		if strings.ContainsAny(k, ".$") {
+			return errorf(ErrBadParams, "metadata key %q contains '.' or '$'", k)
+		}
+		if len(v) > maxMetadataValueLen {
+			return errorf(ErrBadParams, "metadata value of %q is longer than %d bytes", k, maxMetadataValueLen)
+		}
+	}
+	return nil
+}
+
 // canceledKey updates key canceled with given id
 func (s *basicService) canceledKey(ctx context.Context, id string) error {
 	if strings.TrimSpace(id) == "" {
 		return errorf(ErrBadParams, "empty key id")
 	}
 
-	err := s.storage.CanceledKey(ctx, id)
+	_, err := s.storage.CanceledKey(ctx, id)
 	if err != nil {
-		if storageErrIsNotFound(err) {
-			return errorf(ErrNotFound, "key is not found")
-		}
-		return errorf(ErrBadParams, "failed to canceled key: %v", err)
+		return statusChangeErr("cancel", err)
 	}
 	return nil
 }
 
-// VerificationKey return key info
+// redeemKey marks an issued key with given id as redeemed
+func (s *basicService) redeemKey(ctx context.Context, id, redeemer string) (*types.Key, error) {
+	if strings.TrimSpace(id) == "" {
+		return nil, errorf(ErrBadParams, "empty key id")
+	}
+
+	key, err := s.storage.RedeemKey(ctx, id, redeemer)
+	if err != nil {
+		return nil, statusChangeErr("redeem", err)
+	}
+	return key, nil
+}
+
+// revokeKey marks a key with given id as revoked
+func (s *basicService) revokeKey(ctx context.Context, id string) (*types.Key, error) {
+	if strings.TrimSpace(id) == "" {
+		return nil, errorf(ErrBadParams, "empty key id")
+	}
+
+	key, err := s.storage.RevokeKey(ctx, id)
+	if err != nil {
+		return nil, statusChangeErr("revoke", err)
+	}
+	return key, nil
+}
+
+// statusChangeErr maps a storage error of a key status change to a service
+// error. Transitions not allowed by the key status are reported as ErrConflict.
+func statusChangeErr(action string, err error) error {
+	if storageErrIsNotFound(err) {
+		return errorf(ErrNotFound, "key is not found")
+	}
+	if storageErrIsConflict(err) {
+		return errorf(ErrConflict, "failed to %s key: %v", action, err)
+	}
+	return errorf(ErrBadParams, "failed to %s key: %v", action, err)
+}
+
+// VerificationKey return key info with the effective key status
 func (s *basicService) verificationKey(ctx context.Context, id string) (*types.Key, error) {
 	key, err := s.storage.VerificationKey(ctx, id)
 	if err != nil {
+		if storageErrIsNotFound(err) {
+			return nil, errorf(ErrNotFound, "key is not found")
+		}
 		return nil, errorf(ErrBadParams, "failed to find unreleased key: %v", err)
 	}
+	key.Validity = key.ValidityAt(time.Now())
 	return key, nil
 }
 
-// unreleasedKey return all unreleased keys
-func (s *basicService) unreleasedKey(ctx context.Context) ([]*types.Key, error) {
-	listKey, err := s.storage.UnreleasedKey(ctx)
+// keyHistory returns the audit records of the key with given id.
+func (s *basicService) keyHistory(ctx context.Context, id string) ([]*types.AuditRecord, error) {
+	if strings.TrimSpace(id) == "" {
+		return nil, errorf(ErrBadParams, "empty key id")
+	}
+
+	records, err := s.storage.KeyHistory(ctx, id)
 	if err != nil {
 		if storageErrIsNotFound(err) {
-			return nil, errorf(ErrNotFound, "keys is not found")
+			return nil, errorf(ErrNotFound, "key is not found")
 		}
-		return nil, errorf(ErrBadParams, "failed to get keys: %v", err)
+		return nil, errorf(ErrBadParams, "failed to get key history: %v", err)
+	}
+	return records, nil
+}
+
+// Key listing limits.
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+	// maxUnreleasedKeys limits the legacy listing of all unreleased keys.
+	maxUnreleasedKeys = 10000
+)
+
+// unreleasedKey return all unreleased keys of the pool. The number
+// of keys is limited, listKeys pages through any number of keys.
+func (s *basicService) unreleasedKey(ctx context.Context, pool string) ([]*types.Key, error) {
+	params := &types.KeyListParams{
+		KeyFilter: types.KeyFilter{Statuses: []types.KeyStatus{types.StatusAvailable}, PoolID: &pool},
+		Limit:     maxListLimit,
+	}
+	var listKey []*types.Key
+	for {
+		page, err := s.storage.ListKeys(ctx, params)
+		if err != nil {
+			return nil, errorf(ErrBadParams, "failed to get keys: %v", err)
+		}
+		listKey = append(listKey, page.Keys...)
+		if len(listKey) > maxUnreleasedKeys {
+			return nil, errorf(ErrBadParams, "more than %d unreleased keys, use the paginated key listing", maxUnreleasedKeys)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		params.Cursor = page.NextCursor
+	}
+	if len(listKey) == 0 {
+		return nil, errorf(ErrNotFound, "keys is not found")
 	}
 	return listKey, nil
 }
 
+// listKeys returns a page of the keys matching the filter.
+func (s *basicService) listKeys(ctx context.Context, params *types.KeyListParams) (*types.KeyPage, error) {
+	p := *params
+	if p.Sort == "" {
+		p.Sort = types.DefaultKeySort
+	}
+	if err := validateKeySelection(&p.KeyFilter, p.Sort); err != nil {
+		return nil, err
+	}
+	if p.Limit == 0 {
+		p.Limit = defaultListLimit
+	}
+	if p.Limit < 0 || p.Limit > maxListLimit {
+		return nil, errorf(ErrBadParams, "limit must be between 1 and %d", maxListLimit)
+	}
+
+	page, err := s.storage.ListKeys(ctx, &p)
+	if err != nil {
+		return nil, errorf(ErrBadParams, "failed to list keys: %v", err)
+	}
+	return page, nil
+}
+
+// exportKeys calls fn for every key matching the filter. The keys are
+// streamed from storage, the first error of fn stops the export.
+func (s *basicService) exportKeys(ctx context.Context, params *types.KeyExportParams, fn func(*types.Key) error) error {
+	sort := params.Sort
+	if sort == "" {
+		sort = types.DefaultKeySort
+	}
+	if err := validateKeySelection(&params.KeyFilter, sort); err != nil {
+		return err
+	}
+
+	var fnErr error
+	err := s.storage.ExportKeys(ctx, &params.KeyFilter, sort, func(key *types.Key) error {
+		fnErr = fn(key)
+		return fnErr
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil {
+		return errorf(ErrInternal, "failed to export keys: %v", err)
+	}
+	return nil
+}
+
+// validateKeySelection checks the key filter and the sort order.
+func validateKeySelection(f *types.KeyFilter, sort types.KeySort) error {
+	if !types.ValidKeySort(sort) {
+		return errorf(ErrBadParams, "unknown sort order %q", sort)
+	}
+	for _, status := range f.Statuses {
+		if !types.ValidStatus(status) {
+			return errorf(ErrBadParams, "unknown key status %q", status)
+		}
+	}
+	return nil
+}
+
+// statsWindows are the recent time windows of the key issuance rates.
+var statsWindows = []struct {
+	name string
+	d    time.Duration
+}{
+	{"1h", time.Hour},
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+}
+
+// keyStats returns the key counts by status and the recent issuance
+// rates of the pool. A nil pool selects all keys and an empty pool
+// the keys out of any pool.
+func (s *basicService) keyStats(ctx context.Context, pool *string) (*types.KeyStats, error) {
+	if pool != nil && *pool != "" {
+		if _, err := s.storage.GetPool(ctx, *pool); err != nil {
+			return nil, poolErr(err)
+		}
+	}
+
+	now := time.Now().UTC()
+	since := make([]time.Time, len(statsWindows))
+	for i, w := range statsWindows {
+		since[i] = now.Add(-w.d)
+	}
+	stats, err := s.storage.KeyStats(ctx, pool, since)
+	if err != nil {
+		return nil, errorf(ErrInternal, "failed to get key statistics: %v", err)
+	}
+
+	stats.PoolID = pool
+	stats.At = now
+	for _, status := range types.Statuses() {
+		if _, ok := stats.Statuses[status]; !ok {
+			stats.Statuses[status] = 0
+		}
+	}
+	for i, rate := range stats.Issuance {
+		rate.Window = statsWindows[i].name
+		rate.PerHour = float64(rate.Issued) / statsWindows[i].d.Hours()
+	}
+	return stats, nil
+}
+
+// idPattern restricts pool and tenant IDs to characters safe in URL paths.
+var idPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// createPool creates a new key pool. A random ID is assigned if it is empty.
+func (s *basicService) createPool(ctx context.Context, pool *types.Pool) (*types.Pool, error) {
+	if pool == nil {
+		return nil, errorf(ErrBadParams, "empty pool")
+	}
+	if strings.TrimSpace(pool.Name) == "" {
+		return nil, errorf(ErrBadParams, "empty pool name")
+	}
+	if pool.ID == "" {
+		id, err := newBatchID()
+		if err != nil {
+			return nil, errorf(ErrInternal, "failed to generate pool id: %v", err)
+		}
+		pool.ID = id
+	}
+	if !idPattern.MatchString(pool.ID) {
+		return nil, errorf(ErrBadParams, "pool id must be 1 to 64 letters, digits, '-' or '_'")
+	}
+	if pool.MaxKeys < 0 || pool.MaxIssued < 0 {
+		return nil, errorf(ErrBadParams, "pool quotas must not be negative")
+	}
+	if err := validateReplenish(pool.Replenish); err != nil {
+		return nil, err
+	}
+	if pool.Replenish != nil && pool.MaxKeys > 0 && pool.Replenish.HighWater > pool.MaxKeys {
+		return nil, errorf(ErrBadParams, "high-water mark must not exceed the pool key quota")
+	}
+	if pool.Generator != nil {
+		if s.newKeyGen == nil {
+			return nil, errorf(ErrBadParams, "custom generator parameters are not supported")
+		}
+		if _, err := s.newKeyGen(pool.Generator); err != nil {
+			return nil, errorf(ErrBadParams, "invalid generator parameters: %v", err)
+		}
+	}
+
+	now := time.Now()
+	pool.CreatedAt = &now
+	err := s.storage.CreatePool(ctx, pool)
+	if err != nil {
+		if storageErrIsDuplicate(err) {
+			return nil, errorf(ErrConflict, "pool %q already exists", pool.ID)
+		}
+		return nil, errorf(ErrBadParams, "failed to create pool: %v", err)
+	}
+	return pool, nil
+}
+
+// getPool returns a key pool with given id
+func (s *basicService) getPool(ctx context.Context, id string) (*types.Pool, error) {
+	pool, err := s.storage.GetPool(ctx, id)
+	if err != nil {
+		return nil, poolErr(err)
+	}
+	return pool, nil
+}
+
+// listPools returns all key pools
+func (s *basicService) listPools(ctx context.Context) ([]*types.Pool, error) {
+	pools, err := s.storage.ListPools(ctx)
+	if err != nil {
+		return nil, errorf(ErrBadParams, "failed to get pools: %v", err)
+	}
+	return pools, nil
+}
+
+// poolErr maps a storage error of a pool lookup to a service error.
+func poolErr(err error) error {
+	if storageErrIsNotFound(err) {
+		return errorf(ErrNotFound, "pool is not found")
+	}
+	return errorf(ErrBadParams, "failed to get pool: %v", err)
+}
+
+// createTenant creates a new tenant. A random ID is assigned if it is empty.
+func (s *basicService) createTenant(ctx context.Context, tenant *types.Tenant) (*types.Tenant, error) {
+	if tenant == nil {
+		return nil, errorf(ErrBadParams, "empty tenant")
+	}
+	if strings.TrimSpace(tenant.Name) == "" {
+		return nil, errorf(ErrBadParams, "empty tenant name")
+	}
+	if tenant.ID == "" {
+		id, err := newBatchID()
+		if err != nil {
+			return nil, errorf(ErrInternal, "failed to generate tenant id: %v", err)
+		}
+		tenant.ID = id
+	}
+	if !idPattern.MatchString(tenant.ID) {
+		return nil, errorf(ErrBadParams, "tenant id must be 1 to 64 letters, digits, '-' or '_'")
+	}
+
+	now := time.Now()
+	tenant.CreatedAt = &now
+	err := s.storage.CreateTenant(ctx, tenant)
+	if err != nil {
+		if storageErrIsDuplicate(err) {
+			return nil, errorf(ErrConflict, "tenant %q already exists", tenant.ID)
+		}
+		return nil, errorf(ErrBadParams, "failed to create tenant: %v", err)
+	}
+	return tenant, nil
+}
+
+// listTenants returns all tenants
+func (s *basicService) listTenants(ctx context.Context) ([]*types.Tenant, error) {
+	tenants, err := s.storage.ListTenants(ctx)
+	if err != nil {
+		return nil, errorf(ErrBadParams, "failed to get tenants: %v", err)
+	}
+	return tenants, nil
+}
+
+// apiKeyPrefix marks the API key secrets.
+const apiKeyPrefix = "ck_"
+
+// createAPIKey creates a new API key of the tenant. The returned key
+// holds the secret, which is never stored and cannot be read again.
+// A key without roles has full access to the tenant.
+func (s *basicService) createAPIKey(ctx context.Context, tenant string, roles []types.Role) (*types.APIKey, error) {
+	for _, role := range roles {
+		if !types.ValidRole(role) {
+			return nil, errorf(ErrBadParams, "unknown role %q", role)
+		}
+	}
+	if _, err := s.storage.GetTenant(ctx, tenant); err != nil {
+		if storageErrIsNotFound(err) {
+			return nil, errorf(ErrNotFound, "tenant is not found")
+		}
+		return nil, errorf(ErrBadParams, "failed to get tenant: %v", err)
+	}
+
+	id := make([]byte, 4)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, errorf(ErrInternal, "failed to generate API key: %v", err)
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, errorf(ErrInternal, "failed to generate API key: %v", err)
+	}
+	now := time.Now()
+	key := &types.APIKey{
+		ID:        hex.EncodeToString(id),
+		TenantID:  tenant,
+		Secret:    apiKeyPrefix + hex.EncodeToString(secret),
+		Roles:     roles,
+		CreatedAt: &now,
+	}
+	key.Hash = hashAPIKey(key.Secret)
+
+	if err := s.storage.CreateAPIKey(ctx, key); err != nil {
+		if storageErrIsDuplicate(err) {
+			return nil, errorf(ErrConflict, "failed to create API key: %v", err)
+		}
+		return nil, errorf(ErrBadParams, "failed to create API key: %v", err)
+	}
+	return key, nil
+}
+
+// revokeAPIKey revokes an API key of the tenant with given id
+func (s *basicService) revokeAPIKey(ctx context.Context, tenant, id string) error {
+	err := s.storage.RevokeAPIKey(ctx, tenant, id)
+	if err != nil {
+		if storageErrIsNotFound(err) {
+			return errorf(ErrNotFound, "API key is not found")
+		}
+		return errorf(ErrBadParams, "failed to revoke API key: %v", err)
+	}
+	return nil
+}
+
+// authenticate returns the principal of the API key. Keys created
+// without roles act as the tenant admin.
+func (s *basicService) authenticate(ctx context.Context, apiKey string) (*types.Principal, error) {
+	if !strings.HasPrefix(apiKey, apiKeyPrefix) {
+		return nil, errorf(ErrUnauthorized, "invalid API key")
+	}
+	key, err := s.storage.GetAPIKey(ctx, hashAPIKey(apiKey))
+	if err != nil {
+		if storageErrIsNotFound(err) {
+			return nil, errorf(ErrUnauthorized, "invalid API key")
+		}
+		return nil, errorf(ErrInternal, "failed to get API key: %v", err)
+	}
+	if key.RevokedAt != nil {
+		return nil, errorf(ErrUnauthorized, "API key is revoked")
+	}
+	roles := key.Roles
+	if len(roles) == 0 {
+		roles = []types.Role{types.RoleAdmin}
+	}
+	return &types.Principal{
+		Subject: "api-key:" + key.ID,
+		Tenant:  key.TenantID,
+		Roles:   roles,
+	}, nil
+}
+
+// minWebhookSecretLen is the minimum length of a webhook secret set by the client.
+const minWebhookSecretLen = 32
+
+// createWebhook subscribes a webhook of the context tenant to the key events.
+// A random secret is assigned if it is empty. The returned webhook holds
+// the secret, which is not returned by the webhook listing.
+func (s *basicService) createWebhook(ctx context.Context, webhook *types.Webhook) (*types.Webhook, error) {
+	if webhook == nil {
+		return nil, errorf(ErrBadParams, "empty webhook")
+	}
+	if err := validateWebhookURL(webhook.URL); err != nil {
+		return nil, err
+	}
+	for _, event := range webhook.Events {
+		if !types.ValidEventType(event) {
+			return nil, errorf(ErrBadParams, "unknown event type %q", event)
+		}
+	}
+	if webhook.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, errorf(ErrInternal, "failed to generate webhook secret: %v", err)
+		}
+		webhook.Secret = hex.EncodeToString(secret)
+	}
+	if len(webhook.Secret) < minWebhookSecretLen {
+		return nil, errorf(ErrBadParams, "webhook secret must be at least %d characters long", minWebhookSecretLen)
+	}
+	id, err := newBatchID()
+	if err != nil {
+		return nil, errorf(ErrInternal, "failed to generate webhook id: %v", err)
+	}
+	webhook.ID = id
+
+	now := time.Now()
+	webhook.CreatedAt = &now
+	if err := s.storage.CreateWebhook(ctx, webhook); err != nil {
+		if storageErrIsDuplicate(err) {
+			return nil, errorf(ErrConflict, "failed to create webhook: %v", err)
+		}
+		return nil, errorf(ErrBadParams, "failed to create webhook: %v", err)
+	}
+	return webhook, nil
+}
+
+// validateWebhookURL checks the webhook URL is an absolute HTTP(S) URL.
+func validateWebhookURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errorf(ErrBadParams, "webhook url must be an absolute http or https url")
+	}
+	return nil
+}
+
+// listWebhooks returns the webhooks of the context tenant without their secrets.
+func (s *basicService) listWebhooks(ctx context.Context) ([]*types.Webhook, error) {
+	webhooks, err := s.storage.ListWebhooks(ctx)
+	if err != nil {
+		return nil, errorf(ErrBadParams, "failed to get webhooks: %v", err)
+	}
+	for _, webhook := range webhooks {
+		webhook.Secret = ""
+	}
+	return webhooks, nil
+}
+
+// deleteWebhook deletes a webhook of the context tenant with given id.
+// Its queued deliveries are dropped once they are attempted.
+func (s *basicService) deleteWebhook(ctx context.Context, id string) error {
+	err := s.storage.DeleteWebhook(ctx, id)
+	if err != nil {
+		if storageErrIsNotFound(err) {
+			return errorf(ErrNotFound, "webhook is not found")
+		}
+		return errorf(ErrBadParams, "failed to delete webhook: %v", err)
+	}
+	return nil
+}
+
+// listDeliveries returns the most recent webhook deliveries of the
+// context tenant with the given status, the dead ones by default.
+// The dead deliveries are the ones that have run out of attempts.
+func (s *basicService) listDeliveries(ctx context.Context, status types.DeliveryStatus, limit int) ([]*types.Delivery, error) {
+	if status == "" {
+		status = types.DeliveryDead
+	}
+	if !types.ValidDeliveryStatus(status) {
+		return nil, errorf(ErrBadParams, "unknown delivery status %q", status)
+	}
+	if limit == 0 {
+		limit = defaultListLimit
+	}
+	if limit < 0 || limit > maxListLimit {
+		return nil, errorf(ErrBadParams, "limit must be between 1 and %d", maxListLimit)
+	}
+	deliveries, err := s.storage.ListDeliveries(ctx, status, limit)
+	if err != nil {
+		return nil, errorf(ErrBadParams, "failed to get deliveries: %v", err)
+	}
+	return deliveries, nil
+}
+
+// retryDelivery queues a dead delivery with given id for another round of attempts.
+func (s *basicService) retryDelivery(ctx context.Context, id string) (*types.Delivery, error) {
+	d, err := s.storage.RetryDelivery(ctx, id, time.Now())
+	if err != nil {
+		if storageErrIsNotFound(err) {
+			return nil, errorf(ErrNotFound, "delivery is not found")
+		}
+		if storageErrIsConflict(err) {
+			return nil, errorf(ErrConflict, "failed to retry delivery: %v", err)
+		}
+		return nil, errorf(ErrBadParams, "failed to retry delivery: %v", err)
+	}
+	if s.deliveriesQueued != nil {
+		s.deliveriesQueued()
+	}
+	return d, nil
+}
+
+// eventsHeartbeat is the idle period after which
+// the event stream is sent a heartbeat.
+const eventsHeartbeat = 15 * time.Second
+
+// watchEvents calls fn with the events of the context tenant keys as they
+// change, starting after the event with the given ID or with the next change
+// if it is empty. fn is called with nil once watching starts and then as a
+// heartbeat after every idle period. The watch ends with the first error of
+// fn or when the context is done.
+func (s *basicService) watchEvents(ctx context.Context, lastEventID string, fn func(*types.Event) error) error {
+	var fnErr error
+	err := s.storage.WatchKeys(ctx, lastEventID, eventsHeartbeat, func(event *types.Event) error {
+		fnErr = fn(event)
+		return fnErr
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil && ctx.Err() != nil {
+		return nil
+	}
+	if err != nil {
+		if storageErrIsConflict(err) {
+			return errorf(ErrConflict, "failed to watch events: %v", err)
+		}
+		return errorf(ErrBadParams, "failed to watch events: %v", err)
+	}
+	return nil
+}
+
+const (
+	// defaultIdempotencyTTL is how long the idempotent responses are kept by default.
+	defaultIdempotencyTTL = 24 * time.Hour
+	// idempotencyLockTimeout is how long an idempotency key is reserved
+	// for a request being processed. It exceeds the server write timeout.
+	idempotencyLockTimeout = time.Minute
+)
+
+// beginIdempotent reserves the idempotency key for the request with the given
+// fingerprint. It returns the completed record of a retried request to replay
+// its response, or nil if the request is to be processed.
+func (s *basicService) beginIdempotent(ctx context.Context, key, fingerprint string) (*types.IdempotencyRecord, error) {
+	now := time.Now()
+	rec := &types.IdempotencyRecord{
+		Key:         key,
+		Fingerprint: fingerprint,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(idempotencyLockTimeout),
+	}
+	err := s.storage.CreateIdempotencyRecord(ctx, rec)
+	if err == nil {
+		return nil, nil
+	}
+	if !storageErrIsDuplicate(err) {
+		return nil, errorf(ErrInternal, "failed to create idempotency record: %v", err)
+	}
+
+	existing, err := s.storage.GetIdempotencyRecord(ctx, key)
+	if err != nil {
+		if storageErrIsNotFound(err) {
+			// The record has just expired.
+			return nil, errorf(ErrConflict, "request with the idempotency key is in progress")
+		}
+		return nil, errorf(ErrInternal, "failed to get idempotency record: %v", err)
+	}
+	if existing.Fingerprint != fingerprint {
+		return nil, errorf(ErrBadParams, "idempotency key is used by another request")
+	}
+	if !existing.Completed {
+		return nil, errorf(ErrConflict, "request with the idempotency key is in progress")
+	}
+	return existing, nil
+}
+
+// completeIdempotent stores the response of the request reserving the idempotency key.
+func (s *basicService) completeIdempotent(ctx context.Context, rec *types.IdempotencyRecord) error {
+	rec.ExpiresAt = time.Now().Add(s.idempotencyTTL)
+	if err := s.storage.CompleteIdempotencyRecord(ctx, rec); err != nil {
+		return errorf(ErrInternal, "failed to complete idempotency record: %v", err)
+	}
+	return nil
+}
+
+// abortIdempotent releases the idempotency key of a failed request, so it may be retried.
+func (s *basicService) abortIdempotent(ctx context.Context, key string) error {
+	if err := s.storage.DeleteIdempotencyRecord(ctx, key); err != nil {
+		return errorf(ErrInternal, "failed to delete idempotency record: %v", err)
+	}
+	return nil
+}
+
+// hashAPIKey returns the hex encoded SHA-256 hash of the API key secret.
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
 // storageErrIsNotFound checks if the storage error is "not found".
 func storageErrIsNotFound(err error) bool {
 	type notFound interface {
@@ -106,3 +1061,21 @@ func storageErrIsNotFound(err error) bool {
 	e, ok := err.(notFound)
 	return ok && e.NotFound()
 }
+
+// storageErrIsDuplicate checks if the storage error is "duplicate".
+func storageErrIsDuplicate(err error) bool {
+	type duplicate interface {
+		Duplicate() bool
+	}
+	e, ok := err.(duplicate)
+	return ok && e.Duplicate()
+}
+
+// storageErrIsConflict checks if the storage error is "conflict".
+func storageErrIsConflict(err error) bool {
+	type conflict interface {
+		Conflict() bool
+	}
+	e, ok := err.(conflict)
+	return ok && e.Conflict()
+}
@@ -0,0 +1,809 @@
+package httpserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/evgeny08/collection-key/auth"
+	"github.com/evgeny08/collection-key/keygen"
+	"github.com/evgeny08/collection-key/storage"
+	"github.com/evgeny08/collection-key/storage/memstore"
+	"github.com/evgeny08/collection-key/types"
+)
+
+type stubStorage struct {
+	Storage
+	onInsertKey   func(ctx context.Context, key *types.Key) error
+	onInsertKeys  func(ctx context.Context, keys []*types.Key) (int, error)
+	onCanceledKey func(ctx context.Context, id string) (*types.Key, error)
+}
+
+func (s *stubStorage) InsertKey(ctx context.Context, key *types.Key) error {
+	return s.onInsertKey(ctx, key)
+}
+
+func (s *stubStorage) InsertKeys(ctx context.Context, keys []*types.Key) (int, error) {
+	return s.onInsertKeys(ctx, keys)
+}
+
+func (s *stubStorage) CanceledKey(ctx context.Context, id string) (*types.Key, error) {
+	return s.onCanceledKey(ctx, id)
+}
+
+type duplicateErr struct{}
+
+func (duplicateErr) Error() string   { return "duplicate" }
+func (duplicateErr) Duplicate() bool { return true }
+
+type seqKeyGen struct {
+	n int
+}
+
+func (g *seqKeyGen) Generate() (string, error) {
+	g.n++
+	return fmt.Sprintf("%c%d", 'A'+(g.n-1)%26, (g.n-1)/26), nil
+}
+
+func TestCreateKeyRetry(t *testing.T) {
+	testCases := []struct {
+		name       string
+		duplicates int
+		wantID     string
+		wantErr    error
+	}{
+		{
+			name:       "no collisions",
+			duplicates: 0,
+			wantID:     "A0",
+		},
+		{
+			name:       "retry after collision",
+			duplicates: 2,
+			wantID:     "C0",
+		},
+		{
+			name:       "too many collisions",
+			duplicates: maxCreateKeyAttempts,
+			wantErr:    errorf(ErrConflict, "failed to generate a unique key in %d attempts", maxCreateKeyAttempts),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := 0
+			svc := &basicService{
+				logger: log.NewNopLogger(),
+				storage: &stubStorage{
+					onInsertKey: func(ctx context.Context, key *types.Key) error {
+						calls++
+						if calls <= tc.duplicates {
+							return duplicateErr{}
+						}
+						return nil
+					},
+				},
+				keyGen: &seqKeyGen{},
+			}
+
+			key, err := svc.createKey(context.Background(), "", nil)
+			if !reflect.DeepEqual(err, tc.wantErr) {
+				t.Fatalf("got error %#v want %#v", err, tc.wantErr)
+			}
+			if err == nil && key.ID != tc.wantID {
+				t.Fatalf("got key id %q want %q", key.ID, tc.wantID)
+			}
+		})
+	}
+}
+
+func TestCreateKeysChunks(t *testing.T) {
+	inserted := make(map[string]bool)
+	var chunks []int
+	duplicate := true
+	svc := &basicService{
+		logger: log.NewNopLogger(),
+		storage: &stubStorage{
+			onInsertKeys: func(ctx context.Context, keys []*types.Key) (int, error) {
+				chunks = append(chunks, len(keys))
+				if duplicate {
+					// Reject the first key of the first chunk as a duplicate.
+					duplicate = false
+					keys = keys[1:]
+					for _, key := range keys {
+						inserted[key.ID] = true
+					}
+					return len(keys), duplicateErr{}
+				}
+				for _, key := range keys {
+					inserted[key.ID] = true
+				}
+				return len(keys), nil
+			},
+		},
+		keyGen: &seqKeyGen{},
+	}
+
+	count := batchChunkSize + 10
+	var last *types.BatchProgress
+	batchID, err := svc.createKeys(context.Background(), "", count, nil, nil, func(p *types.BatchProgress) {
+		last = p
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batchID == "" || last.BatchID != batchID {
+		t.Fatalf("got batch id %q and progress batch id %q", batchID, last.BatchID)
+	}
+	if last.Created != count || len(inserted) != count {
+		t.Fatalf("got %d created and %d inserted keys want %d", last.Created, len(inserted), count)
+	}
+	wantChunks := []int{batchChunkSize, 1, 10}
+	if !reflect.DeepEqual(chunks, wantChunks) {
+		t.Fatalf("got chunks %v want %v", chunks, wantChunks)
+	}
+}
+
+func TestCreateKeysGeneratorLimits(t *testing.T) {
+	cfg := keygen.Config{Length: 12, Alphabet: keygen.Crockford}
+	svc := &basicService{
+		logger:  log.NewNopLogger(),
+		storage: memstore.New(),
+		keyGen:  &seqKeyGen{},
+		newKeyGen: func(params *types.KeyGenParams) (KeyGenerator, error) {
+			return keygen.New(cfg.Override(params))
+		},
+	}
+
+	testCases := []struct {
+		name   string
+		params *types.KeyGenParams
+	}{
+		{name: "huge length", params: &types.KeyGenParams{Length: 1 << 30}},
+		{name: "long alphabet", params: &types.KeyGenParams{Alphabet: types.KeyIDChars + "!"}},
+		{name: "reserved alphabet", params: &types.KeyGenParams{Alphabet: "0123456789/%?#"}},
+		{name: "reserved separator", params: &types.KeyGenParams{GroupSize: 4, Separator: "/"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := svc.createKeys(context.Background(), "", 1000000, tc.params, nil, func(*types.BatchProgress) {
+				t.Fatal("got batch progress")
+			})
+			if err == nil || err.(*Error).Kind != ErrBadParams {
+				t.Fatalf("got error %#v want a bad params error", err)
+			}
+		})
+	}
+}
+
+func TestStorageErrorMapping(t *testing.T) {
+	testCases := []struct {
+		name    string
+		err     error
+		wantErr error
+	}{
+		{
+			name:    "not found",
+			err:     storage.ErrNotFound,
+			wantErr: errorf(ErrNotFound, "key is not found"),
+		},
+		{
+			name:    "not issued",
+			err:     storage.ErrNotIssued,
+			wantErr: errorf(ErrConflict, "failed to cancel key: %v", storage.ErrNotIssued),
+		},
+		{
+			name:    "illegal transition",
+			err:     &storage.TransitionError{From: types.StatusRedeemed, To: types.StatusCanceled},
+			wantErr: errorf(ErrConflict, "failed to cancel key: cannot change key status from redeemed to canceled"),
+		},
+		{
+			name:    "already canceled",
+			err:     storage.ErrAlreadyCanceled,
+			wantErr: errorf(ErrConflict, "failed to cancel key: %v", storage.ErrAlreadyCanceled),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			svc := &basicService{
+				logger: log.NewNopLogger(),
+				storage: &stubStorage{
+					onCanceledKey: func(ctx context.Context, id string) (*types.Key, error) {
+						return nil, tc.err
+					},
+				},
+			}
+			err := svc.canceledKey(context.Background(), "key")
+			if !reflect.DeepEqual(err, tc.wantErr) {
+				t.Fatalf("got error %#v want %#v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestPoolIsolation(t *testing.T) {
+	ctx := context.Background()
+	var gotParams []*types.KeyGenParams
+	svc := &basicService{
+		logger:  log.NewNopLogger(),
+		storage: memstore.New(),
+		keyGen:  &seqKeyGen{},
+		newKeyGen: func(params *types.KeyGenParams) (KeyGenerator, error) {
+			gotParams = append(gotParams, params)
+			return &seqKeyGen{n: 100 * len(gotParams)}, nil
+		},
+	}
+
+	spring, err := svc.createPool(ctx, &types.Pool{ID: "spring", Name: "Spring", Generator: &types.KeyGenParams{Length: 8}, MaxIssued: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spring.CreatedAt == nil {
+		t.Fatal("pool creation time is not set")
+	}
+	if _, err := svc.createPool(ctx, &types.Pool{ID: "summer", Name: "Summer"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.createPool(ctx, &types.Pool{ID: "spring", Name: "Again"}); !reflect.DeepEqual(err, errorf(ErrConflict, "pool %q already exists", "spring")) {
+		t.Fatalf("got error %#v creating a duplicate pool", err)
+	}
+	if _, err := svc.createPool(ctx, &types.Pool{ID: "bad/id", Name: "Bad"}); err == nil {
+		t.Fatal("pool with an invalid id is created")
+	}
+
+	if _, err := svc.createKeys(ctx, "spring", 3, &types.KeyGenParams{GroupSize: 4}, nil, func(*types.BatchProgress) {}); err != nil {
+		t.Fatal(err)
+	}
+	wantParams := &types.KeyGenParams{Length: 8, GroupSize: 4}
+	if last := gotParams[len(gotParams)-1]; !reflect.DeepEqual(last, wantParams) {
+		t.Fatalf("got generator params %#v want %#v", last, wantParams)
+	}
+	if _, err := svc.createKey(ctx, "missing", nil); !reflect.DeepEqual(err, errorf(ErrNotFound, "pool is not found")) {
+		t.Fatalf("got error %#v creating a key of a missing pool", err)
+	}
+
+	for _, pool := range []string{"", "summer"} {
+		if _, err := svc.getKey(ctx, pool); err == nil || err.(*Error).Kind != ErrNotFound {
+			t.Fatalf("got error %#v issuing a key of pool %q", err, pool)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		id, err := svc.getKey(ctx, "spring")
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := svc.verificationKey(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.PoolID != "spring" {
+			t.Fatalf("got key of pool %q want spring", key.PoolID)
+		}
+	}
+	if _, err := svc.getKey(ctx, "spring"); err == nil || err.(*Error).Kind != ErrConflict {
+		t.Fatalf("got error %#v issuing a key over the pool quota", err)
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	svc := &basicService{
+		logger:  log.NewNopLogger(),
+		storage: memstore.New(),
+		keyGen:  &seqKeyGen{},
+	}
+	ctx := context.Background()
+
+	for _, name := range []string{"acme", "globex"} {
+		if _, err := svc.createTenant(ctx, &types.Tenant{ID: name, Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	acmeKey, err := svc.createAPIKey(ctx, "acme", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifierKey, err := svc.createAPIKey(ctx, "acme", []types.Role{types.RoleVerifier})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.createAPIKey(ctx, "acme", []types.Role{"root"}); !reflect.DeepEqual(err, errorf(ErrBadParams, "unknown role %q", "root")) {
+		t.Fatalf("got error %#v creating an API key with an unknown role", err)
+	}
+	if _, err := svc.createAPIKey(ctx, "missing", nil); !reflect.DeepEqual(err, errorf(ErrNotFound, "tenant is not found")) {
+		t.Fatalf("got error %#v creating an API key of a missing tenant", err)
+	}
+
+	for _, tc := range []struct {
+		key   *types.APIKey
+		roles []types.Role
+	}{
+		{key: acmeKey, roles: []types.Role{types.RoleAdmin}},
+		{key: verifierKey, roles: []types.Role{types.RoleVerifier}},
+	} {
+		p, err := svc.authenticate(ctx, tc.key.Secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := &types.Principal{Subject: "api-key:" + tc.key.ID, Tenant: "acme", Roles: tc.roles}
+		if !reflect.DeepEqual(p, want) {
+			t.Fatalf("got principal %#v want %#v", p, want)
+		}
+	}
+	if _, err := svc.authenticate(ctx, "ck_unknown"); !reflect.DeepEqual(err, errorf(ErrUnauthorized, "invalid API key")) {
+		t.Fatalf("got error %#v authenticating an unknown API key", err)
+	}
+
+	acme := types.WithTenant(ctx, "acme")
+	globex := types.WithTenant(ctx, "globex")
+	key, err := svc.createKey(acme, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.TenantID != "acme" {
+		t.Fatalf("got key of tenant %q want acme", key.TenantID)
+	}
+	for _, c := range []context.Context{globex, ctx} {
+		if _, err := svc.getKey(c, ""); !reflect.DeepEqual(err, errorf(ErrNotFound, "key is not found")) {
+			t.Fatalf("got error %#v issuing a key of another tenant", err)
+		}
+	}
+	id, err := svc.getKey(acme, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.verificationKey(globex, id); !reflect.DeepEqual(err, errorf(ErrNotFound, "key is not found")) {
+		t.Fatalf("got error %#v verifying a key of another tenant", err)
+	}
+	if err := svc.canceledKey(globex, id); !reflect.DeepEqual(err, errorf(ErrNotFound, "key is not found")) {
+		t.Fatalf("got error %#v canceling a key of another tenant", err)
+	}
+	if err := svc.canceledKey(acme, id); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := svc.revokeAPIKey(ctx, "acme", acmeKey.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.authenticate(ctx, acmeKey.Secret); !reflect.DeepEqual(err, errorf(ErrUnauthorized, "API key is revoked")) {
+		t.Fatalf("got error %#v authenticating a revoked API key", err)
+	}
+}
+
+func TestReplenisher(t *testing.T) {
+	st := memstore.New()
+	ctx := context.Background()
+	for _, pool := range []*types.Pool{
+		{ID: "auto", Name: "auto", Replenish: &types.ReplenishPolicy{LowWater: 3, HighWater: 5, Auto: true}},
+		{ID: "manual", Name: "manual", Replenish: &types.ReplenishPolicy{LowWater: 1}},
+		{ID: "plain", Name: "plain"},
+	} {
+		if err := st.CreatePool(ctx, pool); err != nil {
+			t.Fatal(err)
+		}
+	}
+	svc := &basicService{logger: log.NewNopLogger(), storage: st, keyGen: &seqKeyGen{}}
+
+	var alerts []string
+	r := newReplenisher(svc, log.NewNopLogger(), time.Hour, nil, func(alert *types.StockAlert) {
+		alerts = append(alerts, fmt.Sprintf("%s:%d", alert.PoolID, alert.Available))
+	})
+	available := func(pool string) int64 {
+		stats, err := st.KeyStats(ctx, &pool, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stats.Statuses[types.StatusAvailable]
+	}
+
+	r.checkAll()
+	r.checkAll()
+	if want := []string{"auto:0", "manual:0"}; !reflect.DeepEqual(alerts, want) {
+		t.Fatalf("got alerts %v want %v", alerts, want)
+	}
+	if n := available("auto"); n != 5 {
+		t.Fatalf("got %d available keys of replenished pool want 5", n)
+	}
+	if n := available("manual") + available("plain"); n != 0 {
+		t.Fatalf("got %d available keys of pools without automatic replenishment", n)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := svc.issueKey(ctx, "auto", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.checkPool(stockRef{pool: "auto"})
+	if want := []string{"auto:0", "manual:0", "auto:2"}; !reflect.DeepEqual(alerts, want) {
+		t.Fatalf("got alerts %v want %v", alerts, want)
+	}
+	if n := available("auto"); n != 5 {
+		t.Fatalf("got %d available keys of replenished pool want 5", n)
+	}
+
+	// Issuance schedules a check of the pool, which stops with the replenisher.
+	svc.stockChanged = r.notify
+	go r.run()
+	for i := 0; i < 4; i++ {
+		if _, err := svc.issueKey(ctx, "auto", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for available("auto") < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	r.stop()
+	if n := available("auto"); n < 3 {
+		t.Fatalf("got %d available keys of replenished pool want at least 3", n)
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	st := memstore.New()
+	ctx := context.Background()
+	svc := &basicService{logger: log.NewNopLogger(), storage: st, keyGen: &seqKeyGen{}}
+
+	const secret = "0123456789abcdef0123456789abcdef"
+	var (
+		mu       sync.Mutex
+		received []string
+		failing  = true
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := auth.VerifyWebhook(r, secret, time.Minute, time.Now())
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var event types.Event
+		if err := json.Unmarshal(body, &event); err != nil || string(event.Type) != r.Header.Get(webhookEventHeader) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path == "/failing" && failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		received = append(received, r.URL.Path+" "+string(event.Type)+" "+event.Key.ID)
+	}))
+	defer receiver.Close()
+
+	if _, err := svc.createWebhook(ctx, &types.Webhook{
+		URL:    receiver.URL + "/orders",
+		Secret: secret,
+		Events: []types.EventType{types.EventKeyIssued, types.EventKeyExpired},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	failingHook, err := svc.createWebhook(ctx, &types.Webhook{URL: receiver.URL + "/failing", Secret: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The default client refuses to connect to the loopback receiver.
+	d := newDispatcher(st, log.NewNopLogger(), &http.Client{Timeout: webhookTimeout}, time.Hour, 3, time.Millisecond)
+	svc.deliveriesQueued = d.notify
+	go d.run()
+	defer d.stop()
+	r := newRelay(st, log.NewNopLogger(), []Sink{&webhookSink{storage: st, queued: d.notify}}, time.Hour)
+
+	if _, err := svc.createKey(ctx, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	expiresAt := time.Now().Add(100 * time.Millisecond)
+	if _, err := svc.createKey(ctx, "", &types.KeyValidity{ExpiresAt: &expiresAt}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.issueKey(ctx, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Until(expiresAt))
+	if n, err := st.SweepExpired(ctx); err != nil || n != 1 {
+		t.Fatalf("got %d expired keys and error %v want 1", n, err)
+	}
+	r.relayDue()
+
+	// The deliveries to the failing webhook run out of attempts.
+	var dead []*types.Delivery
+	deadline := time.Now().Add(5 * time.Second)
+	for len(dead) < 4 && time.Now().Before(deadline) {
+		// The retries are due long before the dispatcher interval.
+		d.notify()
+		time.Sleep(10 * time.Millisecond)
+		if dead, err = svc.listDeliveries(ctx, "", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(dead) != 4 {
+		t.Fatalf("got %d dead deliveries want 4", len(dead))
+	}
+	for _, delivery := range dead {
+		if delivery.WebhookID != failingHook.ID || delivery.Attempts != 3 || delivery.LastError != "webhook responded with status 500" {
+			t.Fatalf("got dead delivery %+v", delivery)
+		}
+	}
+	mu.Lock()
+	want := []string{"/orders key.issued A0", "/orders key.expired B0"}
+	if !reflect.DeepEqual(received, want) {
+		t.Fatalf("got events %v want %v", received, want)
+	}
+	failing = false
+	mu.Unlock()
+
+	// A dead delivery is retried by hand.
+	if _, err := svc.retryDelivery(ctx, dead[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, "/failing "+string(dead[0].Event.Type)+" "+dead[0].Event.Key.ID)
+	deadline = time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		n := len(received)
+		mu.Unlock()
+		if n == len(want) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(received, want) {
+		t.Fatalf("got events %v want %v", received, want)
+	}
+	if _, err := svc.retryDelivery(ctx, dead[0].ID); !reflect.DeepEqual(err, errorf(ErrConflict, "failed to retry delivery: %v", storage.ErrDeliveryNotDead)) {
+		t.Fatalf("retry delivered delivery: got error %v", err)
+	}
+}
+
+func TestWebhookDeliveryConcurrency(t *testing.T) {
+	st := memstore.New()
+	ctx := context.Background()
+	svc := &basicService{logger: log.NewNopLogger(), storage: st, keyGen: &seqKeyGen{}}
+
+	var (
+		release   = make(chan struct{})
+		fast      = make(chan string, 10)
+		mu        sync.Mutex
+		slow      int
+		maxSlow   int
+		unblocked bool
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/slow" {
+			fast <- r.URL.Path
+			return
+		}
+		mu.Lock()
+		slow++
+		if slow > maxSlow {
+			maxSlow = slow
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		slow--
+		mu.Unlock()
+	}))
+	defer receiver.Close()
+	unblock := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if !unblocked {
+			unblocked = true
+			close(release)
+		}
+	}
+	defer unblock()
+
+	slowHook, err := svc.createWebhook(ctx, &types.Webhook{URL: receiver.URL + "/slow"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fastHook, err := svc.createWebhook(ctx, &types.Webhook{URL: receiver.URL + "/fast"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The deliveries to the slow webhook are due first.
+	var deliveries []*types.Delivery
+	for i, webhook := range []*types.Webhook{slowHook, slowHook, slowHook, fastHook, fastHook} {
+		due := time.Now().Add(time.Duration(i-10) * time.Second)
+		deliveries = append(deliveries, &types.Delivery{
+			ID:            fmt.Sprintf("d%d", i),
+			WebhookID:     webhook.ID,
+			Event:         &types.Event{ID: fmt.Sprintf("e%d", i), Type: types.EventKeyIssued, Key: &types.Key{ID: "k"}, At: due},
+			Status:        types.DeliveryPending,
+			NextAttemptAt: due,
+			CreatedAt:     due,
+		})
+	}
+	if err := st.EnqueueDeliveries(ctx, deliveries); err != nil {
+		t.Fatal(err)
+	}
+
+	d := newDispatcher(st, log.NewNopLogger(), &http.Client{Timeout: webhookTimeout}, time.Hour, 3, time.Millisecond)
+	go d.run()
+	defer d.stop()
+
+	// The deliveries to the fast webhooks are not held up by the slow one.
+	for i := 0; i < 2; i++ {
+		select {
+		case <-fast:
+		case <-time.After(5 * time.Second):
+			t.Fatal("fast webhook deliveries are held up")
+		}
+	}
+	unblock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		delivered, err := st.ListDeliveries(ctx, types.DeliveryDelivered, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(delivered) == len(deliveries) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	d.stop()
+	delivered, err := st.ListDeliveries(ctx, types.DeliveryDelivered, 10)
+	if err != nil || len(delivered) != len(deliveries) {
+		t.Fatalf("got %d delivered deliveries and error %v want %d", len(delivered), err, len(deliveries))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if maxSlow != 1 {
+		t.Fatalf("got %d concurrent deliveries to a webhook want 1", maxSlow)
+	}
+}
+
+func TestWebhookClient(t *testing.T) {
+	var redirected bool
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/moved" {
+			redirected = true
+			return
+		}
+		http.Redirect(w, r, "/moved", http.StatusFound)
+	}))
+	defer target.Close()
+
+	// The internal addresses are refused.
+	client := newWebhookClient()
+	if _, err := client.Post(target.URL, "application/json", nil); err == nil {
+		t.Fatal("got no error posting to a loopback address")
+	}
+	for _, addr := range []string{"127.0.0.1:80", "[::1]:443", "10.0.0.1:80", "172.16.0.1:80", "192.168.1.1:80", "169.254.169.254:80", "[fe80::1]:80", "0.0.0.0:80", "100.64.0.1:80", "[::ffff:127.0.0.1]:80"} {
+		if err := dialPublicOnly("tcp", addr, nil); err == nil {
+			t.Errorf("got no error dialing %s", addr)
+		}
+	}
+	for _, addr := range []string{"93.184.216.34:443", "[2606:2800:220:1::1]:443"} {
+		if err := dialPublicOnly("tcp", addr, nil); err != nil {
+			t.Errorf("dial %s: %v", addr, err)
+		}
+	}
+
+	// The redirects are not followed.
+	client.Transport = http.DefaultTransport
+	resp, err := client.Post(target.URL, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound || redirected {
+		t.Fatalf("got status %d, redirected %v want %d without redirect", resp.StatusCode, redirected, http.StatusFound)
+	}
+}
+
+// recordingSink records the published events and fails while failing is set.
+type recordingSink struct {
+	failing bool
+	events  []string
+}
+
+func (s *recordingSink) Publish(ctx context.Context, events []*types.Event) error {
+	if s.failing {
+		return fmt.Errorf("sink is down")
+	}
+	for _, event := range events {
+		s.events = append(s.events, string(event.Type)+" "+event.Key.ID)
+	}
+	return nil
+}
+
+// recordingBroker records the published messages.
+type recordingBroker struct {
+	messages []string
+}
+
+func (b *recordingBroker) Publish(ctx context.Context, topic, key string, value []byte) error {
+	var event types.Event
+	if err := json.Unmarshal(value, &event); err != nil {
+		return err
+	}
+	b.messages = append(b.messages, topic+" "+key+" "+string(event.Type))
+	return nil
+}
+
+func TestOutboxRelay(t *testing.T) {
+	st := memstore.New()
+	ctx := context.Background()
+
+	for _, id := range []string{"k1", "k2"} {
+		key := &types.Key{ID: id}
+		key.SetStatus(types.StatusAvailable, time.Now())
+		if err := st.InsertKey(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := st.GetKey(ctx, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	// Verification does not change the key and has no event.
+	if _, err := st.VerificationKey(ctx, "k1"); err != nil {
+		t.Fatal(err)
+	}
+
+	var file bytes.Buffer
+	sink := &recordingSink{failing: true}
+	broker := &recordingBroker{}
+	r := newRelay(st, log.NewNopLogger(), []Sink{NewNDJSONSink(&file), sink, NewBrokerSink(broker, "keys")}, time.Millisecond)
+
+	// The failed batch stays in the outbox and is retried after the backoff.
+	r.relayDue()
+	if len(sink.events) != 0 || len(broker.messages) != 0 {
+		t.Fatalf("got events %v and messages %v published by the failed batch", sink.events, broker.messages)
+	}
+	// Claim the entries ahead of time with a lease leaving them due.
+	entries, err := st.ClaimOutbox(ctx, time.Now().Add(time.Hour), -time.Hour, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].Attempts != 1 || entries[0].LastError != "sink is down" {
+		t.Fatalf("got outbox entries %+v want 3 failed once", entries)
+	}
+
+	sink.failing = false
+	time.Sleep(10 * time.Millisecond)
+	r.relayDue()
+	want := []string{"key.created k1", "key.created k2", "key.issued k1"}
+	if !reflect.DeepEqual(sink.events, want) {
+		t.Fatalf("got events %v want %v", sink.events, want)
+	}
+	wantMessages := []string{"keys k1 key.created", "keys k2 key.created", "keys k1 key.issued"}
+	if !reflect.DeepEqual(broker.messages, wantMessages) {
+		t.Fatalf("got messages %v want %v", broker.messages, wantMessages)
+	}
+
+	// The sinks preceding the failed one get the batch again.
+	var ids []string
+	dec := json.NewDecoder(&file)
+	for dec.More() {
+		var event types.Event
+		if err := dec.Decode(&event); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, event.ID)
+	}
+	if len(ids) != 6 || !reflect.DeepEqual(ids[:3], ids[3:]) {
+		t.Fatalf("got file events %v want the batch twice", ids)
+	}
+
+	entries, err = st.ClaimOutbox(ctx, time.Now().Add(time.Hour), 0, 10)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("got outbox entries %v, %v want none after relay", entries, err)
+	}
+}
@@ -1,27 +1,47 @@
 package httpserver
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/evgeny08/collection-key/types"
 )
 
 // Service CreateKey encoders/decoders.
-func encodeCreateKeyRequest(_ context.Context, r *http.Request, _ interface{}) error {
-	r.URL.Path = "/api/v1/key"
-	return nil
+func encodeCreateKeyRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(createKeyRequest)
+	r.URL.Path = keysPath(req.Pool, "/api/v1/key", "")
+	if req.Validity == nil {
+		return nil
+	}
+	return encodeJSONRequest(r, req.Validity)
 }
 
-func decodeCreateKeyRequest(_ context.Context, _ *http.Request) (interface{}, error) {
-	return nil, nil
+// decodeCreateKeyRequest reads an optional validity window from the request body.
+func decodeCreateKeyRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	pool := mux.Vars(r)["pool"]
+	var validity types.KeyValidity
+	err := json.NewDecoder(r.Body).Decode(&validity)
+	if err == io.EOF {
+		return createKeyRequest{Pool: pool}, nil
+	}
+	if err != nil {
+		return nil, errorf(ErrBadParams, "failed to decode request: %v", err)
+	}
+	return createKeyRequest{Pool: pool, Validity: &validity}, nil
 }
 
 func encodeCreateKeyResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
@@ -42,14 +62,92 @@ func decodeCreateKeyResponse(_ context.Context, r *http.Response) (interface{},
 	return res, err
 }
 
+// Service CreateKeys encoders/decoders.
+func encodeCreateKeysRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(createKeysRequest)
+	r.URL.Path = keysPath(req.Pool, "/api/v1/keys:batch", ":batch")
+	return encodeJSONRequest(r, req)
+}
+
+func decodeCreateKeysRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req createKeysRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, errorf(ErrBadParams, "failed to decode request: %v", err)
+	}
+	req.Pool = mux.Vars(r)["pool"]
+	return req, nil
+}
+
+// encodeCreateKeysResponse streams the batch progress as newline
+// delimited JSON, one object per created chunk.
+func encodeCreateKeysResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(createKeysResponse)
+	ev, ok := <-res.Events
+	if ok && ev.Progress == nil {
+		return encodeError(w, ev.Err, true)
+	}
+	// The progress of a large batch outlives the server write timeout.
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	for ; ok; ev, ok = <-res.Events {
+		if err := enc.Encode(ev.Progress); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	return nil
+}
+
+func decodeCreateKeysResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		defer r.Body.Close()
+		return createKeysResponse{Err: decodeError(r)}, nil
+	}
+	return createKeysResponse{Body: r.Body}, nil
+}
+
+// readBatchProgress reads the batch progress stream until the final
+// update and returns the batch ID.
+func readBatchProgress(body io.ReadCloser, progress func(*types.BatchProgress)) (string, error) {
+	defer body.Close()
+	dec := json.NewDecoder(body)
+	var last types.BatchProgress
+	for {
+		var p types.BatchProgress
+		err := dec.Decode(&p)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return last.BatchID, err
+		}
+		last = p
+		if progress != nil {
+			progress(&p)
+		}
+	}
+	if last.Error != "" {
+		return last.BatchID, errors.New(last.Error)
+	}
+	if !last.Done {
+		return last.BatchID, errors.New("batch progress stream ended unexpectedly")
+	}
+	return last.BatchID, nil
+}
+
 // Service GetKey encoders/decoders.
-func encodeGetKeyRequest(_ context.Context, r *http.Request, _ interface{}) error {
-	r.URL.Path = "/api/v1/key/issued"
+func encodeGetKeyRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(getKeyRequest)
+	r.URL.Path = keysPath(req.Pool, "/api/v1/key/issued", "/issued")
 	return nil
 }
 
-func decodeGetKeyRequest(_ context.Context, _ *http.Request) (interface{}, error) {
-	return nil, nil
+func decodeGetKeyRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return getKeyRequest{Pool: mux.Vars(r)["pool"]}, nil
 }
 
 func encodeGetKeyResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
@@ -70,6 +168,43 @@ func decodeGetKeyResponse(_ context.Context, r *http.Response) (interface{}, err
 	return res, err
 }
 
+// Service IssueKey encoders/decoders.
+func encodeIssueKeyRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(issueKeyRequest)
+	r.URL.Path = keysPath(req.Pool, "/api/v1/key/issued", "/issued")
+	issuance := req.Issuance
+	if issuance == nil {
+		issuance = &types.Issuance{}
+	}
+	return encodeJSONRequest(r, issuance)
+}
+
+func decodeIssueKeyRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := issueKeyRequest{Pool: mux.Vars(r)["pool"], Issuance: &types.Issuance{}}
+	if err := json.NewDecoder(r.Body).Decode(req.Issuance); err != nil && err != io.EOF {
+		return nil, errorf(ErrBadParams, "failed to decode request: %v", err)
+	}
+	return req, nil
+}
+
+func encodeIssueKeyResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(issueKeyResponse)
+	if res.Err != nil {
+		return encodeError(w, res.Err, true)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(res.Key)
+}
+
+func decodeIssueKeyResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return issueKeyResponse{Err: decodeError(r)}, nil
+	}
+	res := issueKeyResponse{Key: &types.Key{}}
+	err := json.NewDecoder(r.Body).Decode(res.Key)
+	return res, err
+}
+
 // Service CanceledKey encoders/decoders.
 func encodeCanceledKeyRequest(_ context.Context, r *http.Request, request interface{}) error {
 	req := request.(canceledKeyRequest)
@@ -98,6 +233,75 @@ func decodeCanceledKeyResponse(_ context.Context, r *http.Response) (interface{}
 	return canceledKeyResponse{Err: nil}, nil
 }
 
+// Service RedeemKey encoders/decoders.
+func encodeRedeemKeyRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(redeemKeyRequest)
+	r.URL.Path = "/api/v1/key/" + url.QueryEscape(req.ID) + "/redeem"
+	if req.Redeemer == "" {
+		return nil
+	}
+	return encodeJSONRequest(r, req)
+}
+
+// decodeRedeemKeyRequest reads an optional redeemer identity from the request body.
+func decodeRedeemKeyRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req redeemKeyRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil && err != io.EOF {
+		return nil, errorf(ErrBadParams, "failed to decode request: %v", err)
+	}
+	req.ID = mux.Vars(r)["id"]
+	return req, nil
+}
+
+func encodeRedeemKeyResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(redeemKeyResponse)
+	if res.Err != nil {
+		return encodeError(w, res.Err, true)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(res.Key)
+}
+
+func decodeRedeemKeyResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return redeemKeyResponse{Err: decodeError(r)}, nil
+	}
+	res := redeemKeyResponse{Key: &types.Key{}}
+	err := json.NewDecoder(r.Body).Decode(&res.Key)
+	return res, err
+}
+
+// Service RevokeKey encoders/decoders.
+func encodeRevokeKeyRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(revokeKeyRequest)
+	r.URL.Path = "/api/v1/key/" + url.QueryEscape(req.ID) + "/revoke"
+	return nil
+}
+
+func decodeRevokeKeyRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	id := mux.Vars(r)["id"]
+	return revokeKeyRequest{ID: id}, nil
+}
+
+func encodeRevokeKeyResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(revokeKeyResponse)
+	if res.Err != nil {
+		return encodeError(w, res.Err, true)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(res.Key)
+}
+
+func decodeRevokeKeyResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return revokeKeyResponse{Err: decodeError(r)}, nil
+	}
+	res := revokeKeyResponse{Key: &types.Key{}}
+	err := json.NewDecoder(r.Body).Decode(&res.Key)
+	return res, err
+}
+
 // Service VerificationKey encoders/decoders.
 func encodeVerificationKeyRequest(_ context.Context, r *http.Request, request interface{}) error {
 	req := request.(verificationKeyRequest)
@@ -128,14 +332,45 @@ func decodeVerificationKeyResponse(_ context.Context, r *http.Response) (interfa
 	return res, err
 }
 
+// Service KeyHistory encoders/decoders.
+func encodeKeyHistoryRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(keyHistoryRequest)
+	r.URL.Path = "/api/v1/key/" + url.QueryEscape(req.ID) + "/history"
+	return nil
+}
+
+func decodeKeyHistoryRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	id := mux.Vars(r)["id"]
+	return keyHistoryRequest{ID: id}, nil
+}
+
+func encodeKeyHistoryResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(keyHistoryResponse)
+	if res.Err != nil {
+		return encodeError(w, res.Err, true)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(res.Records)
+}
+
+func decodeKeyHistoryResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return keyHistoryResponse{Err: decodeError(r)}, nil
+	}
+	var res keyHistoryResponse
+	err := json.NewDecoder(r.Body).Decode(&res.Records)
+	return res, err
+}
+
 // Service UnreleasedKey encoders/decoders.
-func encodeUnreleasedKeyRequest(_ context.Context, r *http.Request, _ interface{}) error {
-	r.URL.Path = "/api/v1/key"
+func encodeUnreleasedKeyRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(unreleasedKeyRequest)
+	r.URL.Path = keysPath(req.Pool, "/api/v1/key", "")
 	return nil
 }
 
-func decodeUnreleasedKeyRequest(_ context.Context, _ *http.Request) (interface{}, error) {
-	return nil, nil
+func decodeUnreleasedKeyRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return unreleasedKeyRequest{Pool: mux.Vars(r)["pool"]}, nil
 }
 
 func encodeUnreleasedKeyResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
@@ -156,12 +391,920 @@ func decodeUnreleasedKeyResponse(_ context.Context, r *http.Response) (interface
 	return res, err
 }
 
+// Service ListKeys encoders/decoders.
+func encodeListKeysRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(listKeysRequest)
+	r.URL.Path = "/api/v1/keys"
+	q := url.Values{}
+	encodeKeyFilter(q, &req.Params.KeyFilter)
+	if req.Params.Sort != "" {
+		q.Set("sort", string(req.Params.Sort))
+	}
+	if req.Params.Limit != 0 {
+		q.Set("limit", strconv.Itoa(req.Params.Limit))
+	}
+	if req.Params.Cursor != "" {
+		q.Set("cursor", req.Params.Cursor)
+	}
+	r.URL.RawQuery = q.Encode()
+	return nil
+}
+
+func decodeListKeysRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	q := r.URL.Query()
+	filter, err := decodeKeyFilter(q)
+	if err != nil {
+		return nil, err
+	}
+	params := &types.KeyListParams{
+		KeyFilter: filter,
+		Sort:      types.KeySort(q.Get("sort")),
+		Cursor:    q.Get("cursor"),
+	}
+	if v := q.Get("limit"); v != "" {
+		if params.Limit, err = strconv.Atoi(v); err != nil {
+			return nil, errorf(ErrBadParams, "invalid limit %q", v)
+		}
+	}
+	return listKeysRequest{Params: params}, nil
+}
+
+func encodeListKeysResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(listKeysResponse)
+	if res.Err != nil {
+		return encodeError(w, res.Err, true)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(res.Page)
+}
+
+func decodeListKeysResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return listKeysResponse{Err: decodeError(r)}, nil
+	}
+	res := listKeysResponse{Page: &types.KeyPage{}}
+	err := json.NewDecoder(r.Body).Decode(res.Page)
+	return res, err
+}
+
+// Service ExportKeys encoders/decoders.
+func encodeExportKeysRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(exportKeysRequest)
+	r.URL.Path = "/api/v1/keys:export"
+	q := url.Values{}
+	encodeKeyFilter(q, &req.Params.KeyFilter)
+	if req.Params.Sort != "" {
+		q.Set("sort", string(req.Params.Sort))
+	}
+	if req.Params.Format != "" {
+		q.Set("format", string(req.Params.Format))
+	}
+	r.URL.RawQuery = q.Encode()
+	return nil
+}
+
+// decodeExportKeysRequest reads the export format from the format query
+// parameter or else from the Accept header. NDJSON is the default format.
+func decodeExportKeysRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	q := r.URL.Query()
+	filter, err := decodeKeyFilter(q)
+	if err != nil {
+		return nil, err
+	}
+	params := &types.KeyExportParams{
+		KeyFilter: filter,
+		Sort:      types.KeySort(q.Get("sort")),
+		Format:    types.FileFormat(q.Get("format")),
+	}
+	switch params.Format {
+	case types.FormatCSV, types.FormatNDJSON:
+	case "":
+		params.Format = types.FormatNDJSON
+		if strings.Contains(r.Header.Get("Accept"), "text/csv") {
+			params.Format = types.FormatCSV
+		}
+	default:
+		return nil, errorf(ErrBadParams, "unknown export format %q", params.Format)
+	}
+	return exportKeysRequest{Params: params}, nil
+}
+
+// encodeExportKeysResponse writes the keys as they are read from storage.
+// An export failing before the first key is reported with an error status.
+// A later failure aborts the response, so the client gets a truncated
+// transfer rather than an export that looks complete.
+func encodeExportKeysResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(exportKeysResponse)
+	if res.Err != nil {
+		return encodeError(w, res.Err, true)
+	}
+	// A large export outlives the server write timeout.
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	var write func(key *types.Key) error
+	var flush func() error
+	started := false
+	start := func() error {
+		started = true
+		if res.Format == types.FormatCSV {
+			w.Header().Set("Content-Type", fileContentType(res.Format))
+			w.Header().Set("Content-Disposition", `attachment; filename="keys.csv"`)
+			cw := csv.NewWriter(w)
+			write = func(key *types.Key) error { return cw.Write(keyCSVRecord(key)) }
+			flush = func() error { cw.Flush(); return cw.Error() }
+			return cw.Write(keyCSVHeader)
+		}
+		w.Header().Set("Content-Type", fileContentType(res.Format))
+		enc := json.NewEncoder(w)
+		write = func(key *types.Key) error { return enc.Encode(key) }
+		flush = func() error { return nil }
+		return nil
+	}
+
+	err := res.Export(func(key *types.Key) error {
+		if !started {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		return write(key)
+	})
+	if err != nil && !started {
+		return encodeError(w, err, true)
+	}
+	if err == nil && !started {
+		err = start()
+	}
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	return nil
+}
+
+func decodeExportKeysResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		defer r.Body.Close()
+		return exportKeysResponse{Err: decodeError(r)}, nil
+	}
+	return exportKeysResponse{Body: r.Body}, nil
+}
+
+// keyCSVHeader names the columns of the CSV key export.
+var keyCSVHeader = []string{
+	"id", "status", "pool_id", "batch_id", "recipient", "metadata",
+	"not_before", "expires_at", "created_at", "issued_at", "redeemed_at",
+	"canceled_at", "expired_at", "revoked_at", "redeemed_by",
+}
+
+// keyCSVRecord returns the CSV export columns of the key. Times are
+// in RFC 3339 format and metadata is a JSON object.
+func keyCSVRecord(key *types.Key) []string {
+	var metadata string
+	if len(key.Metadata) > 0 {
+		b, _ := json.Marshal(key.Metadata)
+		metadata = string(b)
+	}
+	return []string{
+		key.ID, string(key.Status), key.PoolID, key.BatchID, key.Recipient, metadata,
+		csvTime(key.NotBefore), csvTime(key.ExpiresAt), csvTime(key.CreatedAt), csvTime(key.IssuedAt), csvTime(key.RedeemedAt),
+		csvTime(key.CanceledAt), csvTime(key.ExpiredAt), csvTime(key.RevokedAt), key.RedeemedBy,
+	}
+}
+
+func csvTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// Service ImportKeys encoders/decoders.
+func encodeImportKeysRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(importKeysRequest)
+	r.URL.Path = keysPath(req.Pool, "/api/v1/keys:import", ":import")
+	r.URL.RawQuery = url.Values{"format": {string(req.Format)}}.Encode()
+	r.Header.Set("Content-Type", fileContentType(req.Format))
+	r.Body = ioutil.NopCloser(req.File)
+	return nil
+}
+
+// decodeImportKeysRequest reads the import file in the format given by the
+// format query parameter or else by the content type. The rows that cannot
+// be read are passed on as invalid keys to be reported.
+func decodeImportKeysRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	format := types.FileFormat(r.URL.Query().Get("format"))
+	switch format {
+	case types.FormatCSV, types.FormatNDJSON:
+	case "":
+		format = types.FormatNDJSON
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+			format = types.FormatCSV
+		}
+	default:
+		return nil, errorf(ErrBadParams, "unknown import format %q", format)
+	}
+
+	var keys []*types.ImportKey
+	var err error
+	if format == types.FormatCSV {
+		keys, err = readImportCSV(r.Body)
+	} else {
+		keys, err = readImportNDJSON(r.Body)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return importKeysRequest{Pool: mux.Vars(r)["pool"], Format: format, Keys: keys}, nil
+}
+
+func encodeImportKeysResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(importKeysResponse)
+	if res.Err != nil {
+		return encodeError(w, res.Err, true)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(res.Report)
+}
+
+func decodeImportKeysResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return importKeysResponse{Err: decodeError(r)}, nil
+	}
+	res := importKeysResponse{Report: &types.ImportReport{}}
+	err := json.NewDecoder(r.Body).Decode(res.Report)
+	return res, err
+}
+
+// fileContentType returns the content type of the key file format.
+func fileContentType(format types.FileFormat) string {
+	if format == types.FormatCSV {
+		return "text/csv; charset=utf-8"
+	}
+	return "application/x-ndjson"
+}
+
+// maxImportLineLen limits the length of an import file line.
+const maxImportLineLen = 64 * 1024
+
+// readImportCSV reads the keys of a CSV import file. The header names the
+// columns: id is required, not_before and expires_at are RFC 3339 times,
+// metadata is a JSON object and any other column is a metadata entry.
+// Reading stops after maxImportKeys+1 rows, which the service rejects.
+func readImportCSV(r io.Reader) ([]*types.ImportKey, error) {
+	cr := csv.NewReader(bufio.NewReaderSize(r, maxImportLineLen))
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, errorf(ErrBadParams, "failed to read CSV header: %v", err)
+	}
+	header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	idColumn := -1
+	for i, name := range header {
+		header[i] = strings.TrimSpace(name)
+		if header[i] == "id" {
+			idColumn = i
+		}
+	}
+	if idColumn < 0 {
+		return nil, errorf(ErrBadParams, "CSV header has no id column")
+	}
+
+	var keys []*types.ImportKey
+	for row := 1; len(keys) <= maxImportKeys; row++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		key := &types.ImportKey{Row: row}
+		keys = append(keys, key)
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); !ok {
+				return nil, errorf(ErrBadParams, "failed to read import: %v", err)
+			}
+			key.Invalid = err.Error()
+			continue
+		}
+		if len(record) != len(header) {
+			key.Invalid = fmt.Sprintf("row has %d fields, want %d", len(record), len(header))
+			continue
+		}
+		key.Invalid = readImportRecord(key, header, record)
+	}
+	return keys, nil
+}
+
+// readImportRecord sets the import key fields from the CSV record. It
+// returns the reason the record is invalid, or an empty string.
+func readImportRecord(key *types.ImportKey, header, record []string) string {
+	for i, value := range record {
+		var err error
+		switch header[i] {
+		case "id":
+			key.ID = strings.TrimSpace(value)
+		case "not_before":
+			key.NotBefore, err = parseImportTime(value)
+		case "expires_at":
+			key.ExpiresAt, err = parseImportTime(value)
+		case "metadata":
+			if value == "" {
+				continue
+			}
+			var metadata map[string]string
+			if err := json.Unmarshal([]byte(value), &metadata); err != nil {
+				return fmt.Sprintf("invalid metadata: %v", err)
+			}
+			for k, v := range metadata {
+				setImportMetadata(key, k, v)
+			}
+		default:
+			if value != "" {
+				setImportMetadata(key, header[i], value)
+			}
+		}
+		if err != nil {
+			return fmt.Sprintf("invalid %s %q, want an RFC 3339 time", header[i], value)
+		}
+	}
+	return ""
+}
+
+func setImportMetadata(key *types.ImportKey, k, v string) {
+	if key.Metadata == nil {
+		key.Metadata = make(map[string]string)
+	}
+	key.Metadata[k] = v
+}
+
+func parseImportTime(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// readImportNDJSON reads the keys of an NDJSON import file, one JSON
+// object per line. Empty lines are skipped, rows are line numbers.
+// Reading stops after maxImportKeys+1 rows, which the service rejects.
+func readImportNDJSON(r io.Reader) ([]*types.ImportKey, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 4096), maxImportLineLen)
+	var keys []*types.ImportKey
+	for row := 1; len(keys) <= maxImportKeys && sc.Scan(); row++ {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		key := &types.ImportKey{}
+		if err := json.Unmarshal(line, key); err != nil {
+			key = &types.ImportKey{Invalid: fmt.Sprintf("invalid JSON: %v", err)}
+		}
+		key.Row = row
+		keys = append(keys, key)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, errorf(ErrBadParams, "failed to read import: %v", err)
+	}
+	return keys, nil
+}
+
+// Key filter query parameters.
+const (
+	queryStatus        = "status"
+	queryPool          = "pool"
+	queryRecipient     = "recipient"
+	queryIDPrefix      = "id_prefix"
+	queryCreatedSince  = "created_since"
+	queryCreatedBefore = "created_before"
+	queryIssuedSince   = "issued_since"
+	queryIssuedBefore  = "issued_before"
+)
+
+// encodeKeyFilter adds the key filter to the query parameters.
+func encodeKeyFilter(q url.Values, f *types.KeyFilter) {
+	for _, status := range f.Statuses {
+		q.Add(queryStatus, string(status))
+	}
+	if f.PoolID != nil {
+		q.Set(queryPool, *f.PoolID)
+	}
+	if f.Recipient != "" {
+		q.Set(queryRecipient, f.Recipient)
+	}
+	if f.IDPrefix != "" {
+		q.Set(queryIDPrefix, f.IDPrefix)
+	}
+	for name, t := range map[string]*time.Time{
+		queryCreatedSince:  f.CreatedSince,
+		queryCreatedBefore: f.CreatedBefore,
+		queryIssuedSince:   f.IssuedSince,
+		queryIssuedBefore:  f.IssuedBefore,
+	} {
+		if t != nil {
+			q.Set(name, t.Format(time.RFC3339Nano))
+		}
+	}
+}
+
+// decodeKeyFilter reads the key filter from the query parameters.
+// Statuses may be repeated or comma separated. A present but
+// empty pool selects the keys out of any pool.
+func decodeKeyFilter(q url.Values) (types.KeyFilter, error) {
+	var f types.KeyFilter
+	for _, v := range q[queryStatus] {
+		for _, status := range strings.Split(v, ",") {
+			if status != "" {
+				f.Statuses = append(f.Statuses, types.KeyStatus(status))
+			}
+		}
+	}
+	if pool, ok := q[queryPool]; ok && len(pool) > 0 {
+		f.PoolID = &pool[0]
+	}
+	f.Recipient = q.Get(queryRecipient)
+	f.IDPrefix = q.Get(queryIDPrefix)
+	for name, t := range map[string]**time.Time{
+		queryCreatedSince:  &f.CreatedSince,
+		queryCreatedBefore: &f.CreatedBefore,
+		queryIssuedSince:   &f.IssuedSince,
+		queryIssuedBefore:  &f.IssuedBefore,
+	} {
+		v := q.Get(name)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return f, errorf(ErrBadParams, "invalid %s %q, want an RFC 3339 time", name, v)
+		}
+		*t = &parsed
+	}
+	return f, nil
+}
+
+// Service KeyStats encoders/decoders.
+func encodeKeyStatsRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(keyStatsRequest)
+	r.URL.Path = "/api/v1/stats"
+	if req.Pool != nil {
+		r.URL.RawQuery = url.Values{queryPool: {*req.Pool}}.Encode()
+	}
+	return nil
+}
+
+// decodeKeyStatsRequest reads the pool from the path or the pool query
+// parameter. A present but empty pool selects the keys out of any pool.
+func decodeKeyStatsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	if pool, ok := mux.Vars(r)["pool"]; ok {
+		return keyStatsRequest{Pool: &pool}, nil
+	}
+	if pool, ok := r.URL.Query()[queryPool]; ok && len(pool) > 0 {
+		return keyStatsRequest{Pool: &pool[0]}, nil
+	}
+	return keyStatsRequest{}, nil
+}
+
+func encodeKeyStatsResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(keyStatsResponse)
+	if res.Err != nil {
+		return encodeError(w, res.Err, true)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(res.Stats)
+}
+
+func decodeKeyStatsResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return keyStatsResponse{Err: decodeError(r)}, nil
+	}
+	res := keyStatsResponse{Stats: &types.KeyStats{}}
+	err := json.NewDecoder(r.Body).Decode(res.Stats)
+	return res, err
+}
+
+// Service CreatePool encoders/decoders.
+func encodeCreatePoolRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(createPoolRequest)
+	r.URL.Path = "/api/v1/pools"
+	return encodeJSONRequest(r, req.Pool)
+}
+
+func decodeCreatePoolRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var pool types.Pool
+	if err := json.NewDecoder(r.Body).Decode(&pool); err != nil {
+		return nil, errorf(ErrBadParams, "failed to decode request: %v", err)
+	}
+	return createPoolRequest{Pool: &pool}, nil
+}
+
+func encodeCreatePoolResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(createPoolResponse)
+	if res.Err != nil {
+		return encodeError(w, res.Err, true)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	return json.NewEncoder(w).Encode(res.Pool)
+}
+
+func decodeCreatePoolResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return createPoolResponse{Err: decodeError(r)}, nil
+	}
+	res := createPoolResponse{Pool: &types.Pool{}}
+	err := json.NewDecoder(r.Body).Decode(&res.Pool)
+	return res, err
+}
+
+// Service GetPool encoders/decoders.
+func encodeGetPoolRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(getPoolRequest)
+	r.URL.Path = "/api/v1/pools/" + url.PathEscape(req.ID)
+	return nil
+}
+
+func decodeGetPoolRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return getPoolRequest{ID: mux.Vars(r)["pool"]}, nil
+}
+
+func encodeGetPoolResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(getPoolResponse)
+	if res.Err != nil {
+		return encodeError(w, res.Err, true)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(res.Pool)
+}
+
+func decodeGetPoolResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return getPoolResponse{Err: decodeError(r)}, nil
+	}
+	res := getPoolResponse{Pool: &types.Pool{}}
+	err := json.NewDecoder(r.Body).Decode(&res.Pool)
+	return res, err
+}
+
+// Service ListPools encoders/decoders.
+func encodeListPoolsRequest(_ context.Context, r *http.Request, _ interface{}) error {
+	r.URL.Path = "/api/v1/pools"
+	return nil
+}
+
+func decodeListPoolsRequest(_ context.Context, _ *http.Request) (interface{}, error) {
+	return nil, nil
+}
+
+func encodeListPoolsResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(listPoolsResponse)
+	if res.Err != nil {
+		return encodeError(w, res.Err, true)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(res.Pools)
+}
+
+func decodeListPoolsResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return listPoolsResponse{Err: decodeError(r)}, nil
+	}
+	res := listPoolsResponse{Pools: []*types.Pool{}}
+	err := json.NewDecoder(r.Body).Decode(&res.Pools)
+	return res, err
+}
+
+// Service CreateTenant encoders/decoders.
+func encodeCreateTenantRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(createTenantRequest)
+	r.URL.Path = "/api/v1/tenants"
+	return encodeJSONRequest(r, req.Tenant)
+}
+
+func decodeCreateTenantRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var tenant types.Tenant
+	if err := json.NewDecoder(r.Body).Decode(&tenant); err != nil {
+		return nil, errorf(ErrBadParams, "failed to decode request: %v", err)
+	}
+	return createTenantRequest{Tenant: &tenant}, nil
+}
+
+func encodeCreateTenantResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(createTenantResponse)
+	if res.Err != nil {
+		return encodeError(w, res.Err, true)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	return json.NewEncoder(w).Encode(res.Tenant)
+}
+
+func decodeCreateTenantResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return createTenantResponse{Err: decodeError(r)}, nil
+	}
+	res := createTenantResponse{Tenant: &types.Tenant{}}
+	err := json.NewDecoder(r.Body).Decode(&res.Tenant)
+	return res, err
+}
+
+// Service ListTenants encoders/decoders.
+func encodeListTenantsRequest(_ context.Context, r *http.Request, _ interface{}) error {
+	r.URL.Path = "/api/v1/tenants"
+	return nil
+}
+
+func decodeListTenantsRequest(_ context.Context, _ *http.Request) (interface{}, error) {
+	return nil, nil
+}
+
+func encodeListTenantsResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(listTenantsResponse)
+	if res.Err != nil {
+		return encodeError(w, res.Err, true)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(res.Tenants)
+}
+
+func decodeListTenantsResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return listTenantsResponse{Err: decodeError(r)}, nil
+	}
+	res := listTenantsResponse{Tenants: []*types.Tenant{}}
+	err := json.NewDecoder(r.Body).Decode(&res.Tenants)
+	return res, err
+}
+
+// Service CreateAPIKey encoders/decoders.
+func encodeCreateAPIKeyRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(createAPIKeyRequest)
+	r.URL.Path = "/api/v1/tenants/" + url.PathEscape(req.Tenant) + "/api-keys"
+	return encodeJSONRequest(r, &apiKeyParams{Roles: req.Roles})
+}
+
+func decodeCreateAPIKeyRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := createAPIKeyRequest{Tenant: mux.Vars(r)["tenant"]}
+	// The body is optional, an empty body creates a key with full access to the tenant.
+	var params apiKeyParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil && err != io.EOF {
+		return nil, errorf(ErrBadParams, "failed to decode request: %v", err)
+	}
+	req.Roles = params.Roles
+	return req, nil
+}
+
+// apiKeyParams is a CreateAPIKey request body.
+type apiKeyParams struct {
+	Roles []types.Role `json:"roles,omitempty"`
+}
+
+func encodeCreateAPIKeyResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(createAPIKeyResponse)
+	if res.Err != nil {
+		return encodeError(w, res.Err, true)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	return json.NewEncoder(w).Encode(res.Key)
+}
+
+func decodeCreateAPIKeyResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return createAPIKeyResponse{Err: decodeError(r)}, nil
+	}
+	res := createAPIKeyResponse{Key: &types.APIKey{}}
+	err := json.NewDecoder(r.Body).Decode(&res.Key)
+	return res, err
+}
+
+// Service RevokeAPIKey encoders/decoders.
+func encodeRevokeAPIKeyRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(revokeAPIKeyRequest)
+	r.URL.Path = "/api/v1/tenants/" + url.PathEscape(req.Tenant) + "/api-keys/" + url.PathEscape(req.ID) + "/revoke"
+	return nil
+}
+
+func decodeRevokeAPIKeyRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	return revokeAPIKeyRequest{Tenant: vars["tenant"], ID: vars["id"]}, nil
+}
+
+func encodeRevokeAPIKeyResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(revokeAPIKeyResponse)
+	if res.Err != nil {
+		return encodeError(w, res.Err, true)
+	}
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func decodeRevokeAPIKeyResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return revokeAPIKeyResponse{Err: decodeError(r)}, nil
+	}
+	return revokeAPIKeyResponse{}, nil
+}
+
+// Service CreateWebhook encoders/decoders.
+func encodeCreateWebhookRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(createWebhookRequest)
+	r.URL.Path = "/api/v1/webhooks"
+	return encodeJSONRequest(r, req.Webhook)
+}
+
+func decodeCreateWebhookRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var webhook types.Webhook
+	if err := json.NewDecoder(r.Body).Decode(&webhook); err != nil {
+		return nil, errorf(ErrBadParams, "failed to decode request: %v", err)
+	}
+	return createWebhookRequest{Webhook: &webhook}, nil
+}
+
+func encodeCreateWebhookResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(createWebhookResponse)
+	if res.Err != nil {
+		return encodeError(w, res.Err, true)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	return json.NewEncoder(w).Encode(res.Webhook)
+}
+
+func decodeCreateWebhookResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return createWebhookResponse{Err: decodeError(r)}, nil
+	}
+	res := createWebhookResponse{Webhook: &types.Webhook{}}
+	err := json.NewDecoder(r.Body).Decode(&res.Webhook)
+	return res, err
+}
+
+// Service ListWebhooks encoders/decoders.
+func encodeListWebhooksRequest(_ context.Context, r *http.Request, _ interface{}) error {
+	r.URL.Path = "/api/v1/webhooks"
+	return nil
+}
+
+func decodeListWebhooksRequest(_ context.Context, _ *http.Request) (interface{}, error) {
+	return nil, nil
+}
+
+func encodeListWebhooksResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(listWebhooksResponse)
+	if res.Err != nil {
+		return encodeError(w, res.Err, true)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(res.Webhooks)
+}
+
+func decodeListWebhooksResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return listWebhooksResponse{Err: decodeError(r)}, nil
+	}
+	res := listWebhooksResponse{Webhooks: []*types.Webhook{}}
+	err := json.NewDecoder(r.Body).Decode(&res.Webhooks)
+	return res, err
+}
+
+// Service DeleteWebhook encoders/decoders.
+func encodeDeleteWebhookRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(deleteWebhookRequest)
+	r.URL.Path = "/api/v1/webhooks/" + url.PathEscape(req.ID)
+	return nil
+}
+
+func decodeDeleteWebhookRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return deleteWebhookRequest{ID: mux.Vars(r)["id"]}, nil
+}
+
+func encodeDeleteWebhookResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(deleteWebhookResponse)
+	if res.Err != nil {
+		return encodeError(w, res.Err, true)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func decodeDeleteWebhookResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return deleteWebhookResponse{Err: decodeError(r)}, nil
+	}
+	return deleteWebhookResponse{}, nil
+}
+
+// Service ListDeliveries encoders/decoders.
+func encodeListDeliveriesRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(listDeliveriesRequest)
+	r.URL.Path = "/api/v1/webhooks/deliveries"
+	q := url.Values{}
+	if req.Status != "" {
+		q.Set(queryStatus, string(req.Status))
+	}
+	if req.Limit != 0 {
+		q.Set("limit", strconv.Itoa(req.Limit))
+	}
+	r.URL.RawQuery = q.Encode()
+	return nil
+}
+
+func decodeListDeliveriesRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	q := r.URL.Query()
+	req := listDeliveriesRequest{Status: types.DeliveryStatus(q.Get(queryStatus))}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, errorf(ErrBadParams, "invalid limit %q", v)
+		}
+		req.Limit = limit
+	}
+	return req, nil
+}
+
+func encodeListDeliveriesResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(listDeliveriesResponse)
+	if res.Err != nil {
+		return encodeError(w, res.Err, true)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(res.Deliveries)
+}
+
+func decodeListDeliveriesResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return listDeliveriesResponse{Err: decodeError(r)}, nil
+	}
+	res := listDeliveriesResponse{Deliveries: []*types.Delivery{}}
+	err := json.NewDecoder(r.Body).Decode(&res.Deliveries)
+	return res, err
+}
+
+// Service RetryDelivery encoders/decoders.
+func encodeRetryDeliveryRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(retryDeliveryRequest)
+	r.URL.Path = "/api/v1/webhooks/deliveries/" + url.PathEscape(req.ID) + "/retry"
+	return nil
+}
+
+func decodeRetryDeliveryRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return retryDeliveryRequest{ID: mux.Vars(r)["id"]}, nil
+}
+
+func encodeRetryDeliveryResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(retryDeliveryResponse)
+	if res.Err != nil {
+		return encodeError(w, res.Err, true)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(res.Delivery)
+}
+
+func decodeRetryDeliveryResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return retryDeliveryResponse{Err: decodeError(r)}, nil
+	}
+	res := retryDeliveryResponse{Delivery: &types.Delivery{}}
+	err := json.NewDecoder(r.Body).Decode(&res.Delivery)
+	return res, err
+}
+
+// keysPath returns the path of a pool keys resource with the given suffix,
+// or the legacy path for the keys out of any pool.
+func keysPath(pool, legacy, suffix string) string {
+	if pool == "" {
+		return legacy
+	}
+	return "/api/v1/pools/" + url.PathEscape(pool) + "/keys" + suffix
+}
+
+// encodeJSONRequest writes the JSON encoded request to the request body.
+func encodeJSONRequest(r *http.Request, request interface{}) error {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(request); err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.ContentLength = int64(buf.Len())
+	r.Body = ioutil.NopCloser(&buf)
+	return nil
+}
+
 // errKindToStatus maps service error kinds to the HTTP response codes.
 var errKindToStatus = map[ErrorKind]int{
-	ErrBadParams: http.StatusBadRequest,
-	ErrNotFound:  http.StatusNotFound,
-	ErrConflict:  http.StatusConflict,
-	ErrInternal:  http.StatusInternalServerError,
+	ErrBadParams:    http.StatusBadRequest,
+	ErrNotFound:     http.StatusNotFound,
+	ErrConflict:     http.StatusConflict,
+	ErrInternal:     http.StatusInternalServerError,
+	ErrUnauthorized: http.StatusUnauthorized,
+	ErrForbidden:    http.StatusForbidden,
+	ErrTooLarge:     http.StatusRequestEntityTooLarge,
 }
 
 // encodeError writes a service error to the given http.ResponseWriter.
@@ -186,6 +1329,11 @@ func encodeError(w http.ResponseWriter, err error, writeMessage bool) error {
 	return nil
 }
 
+// encodeServerError writes a request decoding error to the given http.ResponseWriter.
+func encodeServerError(_ context.Context, err error, w http.ResponseWriter) {
+	encodeError(w, err, true)
+}
+
 // decodeError reads a service error from the given *http.Response.
 func decodeError(r *http.Response) error {
 	var buf bytes.Buffer
@@ -203,3 +1351,123 @@ func decodeError(r *http.Response) error {
 	}
 	return fmt.Errorf("%d: %s", r.StatusCode, msg)
 }
+
+// lastEventIDHeader carries the ID of the last event received by a client
+// resuming the event stream, as sent by the browser EventSource.
+const lastEventIDHeader = "Last-Event-ID"
+
+// Service WatchEvents encoders/decoders.
+func encodeWatchEventsRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(watchEventsRequest)
+	r.URL.Path = "/api/v1/events"
+	r.Header.Set("Accept", "text/event-stream")
+	if req.LastEventID != "" {
+		r.Header.Set(lastEventIDHeader, req.LastEventID)
+	}
+	return nil
+}
+
+// decodeWatchEventsRequest reads the ID of the last event received from the
+// Last-Event-ID header or else from the last_event_id query parameter.
+func decodeWatchEventsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	id := r.Header.Get(lastEventIDHeader)
+	if id == "" {
+		id = r.URL.Query().Get("last_event_id")
+	}
+	return watchEventsRequest{LastEventID: id}, nil
+}
+
+// encodeWatchEventsResponse writes the events as server-sent events named
+// after the event types, with the event IDs to resume the stream after and
+// the events as JSON data. The heartbeats are written as comments. A watch
+// failing to start is reported with an error status, a later failure aborts
+// the response.
+func encodeWatchEventsResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(watchEventsResponse)
+	if res.Err != nil {
+		return encodeError(w, res.Err, true)
+	}
+
+	rc := http.NewResponseController(w)
+	started := false
+	err := res.Watch(func(event *types.Event) error {
+		if !started {
+			started = true
+			// The stream outlives the server write timeout.
+			_ = rc.SetWriteDeadline(time.Time{})
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("X-Accel-Buffering", "no")
+			w.WriteHeader(http.StatusOK)
+		}
+		if err := writeServerEvent(w, event); err != nil {
+			return err
+		}
+		return rc.Flush()
+	})
+	if err != nil && !started {
+		return encodeError(w, err, true)
+	}
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	return nil
+}
+
+// writeServerEvent writes the event in the server-sent events format,
+// or a keep-alive comment if the event is nil.
+func writeServerEvent(w io.Writer, event *types.Event) error {
+	if event == nil {
+		_, err := io.WriteString(w, ": keep-alive\n\n")
+		return err
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
+
+func decodeWatchEventsResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		defer r.Body.Close()
+		return watchEventsResponse{Err: decodeError(r)}, nil
+	}
+	return watchEventsResponse{Body: r.Body}, nil
+}
+
+// readServerEvents reads the server-sent events and calls fn with the event
+// of every data field until the stream ends or fn fails. The comments and
+// the other fields are skipped as the event carries its ID and type.
+func readServerEvents(r io.Reader, fn func(*types.Event) error) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), maxServerEventLen)
+	var data []byte
+	for sc.Scan() {
+		line := sc.Bytes()
+		switch {
+		case len(line) == 0:
+			if len(data) == 0 {
+				continue
+			}
+			var event types.Event
+			if err := json.Unmarshal(data, &event); err != nil {
+				return fmt.Errorf("failed to decode event: %v", err)
+			}
+			data = data[:0]
+			if err := fn(&event); err != nil {
+				return err
+			}
+		case bytes.HasPrefix(line, []byte("data:")):
+			if len(data) > 0 {
+				data = append(data, '\n')
+			}
+			data = append(data, bytes.TrimPrefix(line[len("data:"):], []byte(" "))...)
+		}
+	}
+	return sc.Err()
+}
+
+// maxServerEventLen limits the length of a server-sent event line.
+const maxServerEventLen = 1 << 20
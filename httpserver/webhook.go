@@ -0,0 +1,327 @@
+package httpserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/evgeny08/collection-key/auth"
+	"github.com/evgeny08/collection-key/types"
+)
+
+// Webhook delivery defaults.
+const (
+	defaultWebhookInterval    = 10 * time.Second
+	defaultWebhookMaxAttempts = 10
+	defaultWebhookBackoff     = 30 * time.Second
+	maxWebhookBackoff         = 6 * time.Hour
+	webhookTimeout            = 10 * time.Second
+	// maxWebhookWorkers is the number of deliveries sent at once.
+	maxWebhookWorkers = 16
+	// deliveryLease is how long a claimed delivery is not claimed
+	// again. It exceeds the webhook request timeout.
+	deliveryLease = time.Minute
+)
+
+const (
+	// webhookEventHeader carries the type of the delivered event.
+	webhookEventHeader = "X-Webhook-Event"
+	// webhookDeliveryHeader carries the delivery ID, which is the
+	// same for all attempts of a delivery.
+	webhookDeliveryHeader = "X-Webhook-Delivery"
+)
+
+// dispatcher delivers the queued key events to the webhooks. A failed
+// delivery is retried with an exponential backoff until it runs out of
+// attempts and is marked dead. The queue is checked periodically and
+// whenever deliveries are queued or sent. The deliveries to different
+// webhooks are sent concurrently, one at a time per webhook, so a slow
+// endpoint delays only its own events.
+type dispatcher struct {
+	storage     Storage
+	logger      log.Logger
+	client      *http.Client
+	interval    time.Duration
+	maxAttempts int
+	backoff     time.Duration
+
+	wake chan struct{}
+
+	// workers holds a token per delivery being sent.
+	workers chan struct{}
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	// busy is the set of webhooks with a delivery being sent.
+	busy map[string]bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newDispatcher(storage Storage, logger log.Logger, client *http.Client, interval time.Duration, maxAttempts int, backoff time.Duration) *dispatcher {
+	if client == nil {
+		client = newWebhookClient()
+	}
+	if interval <= 0 {
+		interval = defaultWebhookInterval
+	}
+	if maxAttempts <= 0 {
+		maxAttempts = defaultWebhookMaxAttempts
+	}
+	if backoff <= 0 {
+		backoff = defaultWebhookBackoff
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &dispatcher{
+		storage:     storage,
+		logger:      logger,
+		client:      client,
+		interval:    interval,
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+		wake:        make(chan struct{}, 1),
+		workers:     make(chan struct{}, maxWebhookWorkers),
+		busy:        make(map[string]bool),
+		ctx:         ctx,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+	}
+}
+
+// run delivers the due events until the dispatcher is stopped.
+func (d *dispatcher) run() {
+	defer close(d.done)
+	defer d.wg.Wait()
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		d.deliverDue()
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// stop stops the dispatcher and waits for the running deliveries to finish.
+func (d *dispatcher) stop() {
+	d.cancel()
+	<-d.done
+}
+
+// notify wakes the dispatcher up to deliver the queued events.
+func (d *dispatcher) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliverDue starts sending the due events until none is left or all the
+// workers are busy. The deliveries to the webhooks being sent to are not
+// claimed. A worker wakes the dispatcher up once it is done.
+func (d *dispatcher) deliverDue() {
+	for d.ctx.Err() == nil {
+		select {
+		case d.workers <- struct{}{}:
+		default:
+			return
+		}
+		d.mu.Lock()
+		busy := make([]string, 0, len(d.busy))
+		for id := range d.busy {
+			busy = append(busy, id)
+		}
+		d.mu.Unlock()
+
+		delivery, err := d.storage.ClaimDelivery(d.ctx, time.Now(), deliveryLease, busy)
+		if err != nil {
+			<-d.workers
+			if !storageErrIsNotFound(err) && d.ctx.Err() == nil {
+				level.Error(d.logger).Log("msg", "failed to claim webhook delivery", "err", err)
+			}
+			return
+		}
+		d.mu.Lock()
+		d.busy[delivery.WebhookID] = true
+		d.mu.Unlock()
+
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.deliver(delivery)
+
+			d.mu.Lock()
+			delete(d.busy, delivery.WebhookID)
+			d.mu.Unlock()
+			<-d.workers
+			d.notify()
+		}()
+	}
+}
+
+// deliver attempts the delivery and stores the outcome.
+func (d *dispatcher) deliver(delivery *types.Delivery) {
+	err := d.send(delivery)
+	if d.ctx.Err() != nil {
+		// The attempt is interrupted by the shutdown, the delivery
+		// is claimed again once the lease runs out.
+		return
+	}
+
+	now := time.Now()
+	delivery.Attempts++
+	switch {
+	case err == nil:
+		delivery.Status = types.DeliveryDelivered
+		delivery.DeliveredAt = &now
+		delivery.LastError = ""
+	case err == errWebhookDeleted || delivery.Attempts >= d.maxAttempts:
+		delivery.Status = types.DeliveryDead
+		delivery.LastError = err.Error()
+		level.Warn(d.logger).Log(
+			"msg", "webhook delivery is dead",
+			"tenant", delivery.TenantID,
+			"webhook", delivery.WebhookID,
+			"delivery", delivery.ID,
+			"attempts", delivery.Attempts,
+			"err", err,
+		)
+	default:
+		delivery.NextAttemptAt = now.Add(d.retryDelay(delivery.Attempts))
+		delivery.LastError = err.Error()
+	}
+	if err := d.storage.UpdateDelivery(d.ctx, delivery); err != nil {
+		level.Error(d.logger).Log("msg", "failed to update webhook delivery", "delivery", delivery.ID, "err", err)
+	}
+}
+
+// errWebhookDeleted fails the deliveries of the deleted webhooks.
+var errWebhookDeleted = errors.New("webhook is deleted")
+
+// send posts the signed event to the webhook. Any response
+// status other than 2xx fails the attempt.
+func (d *dispatcher) send(delivery *types.Delivery) error {
+	webhook, err := d.storage.GetWebhook(types.WithTenant(d.ctx, delivery.TenantID), delivery.WebhookID)
+	if err != nil {
+		if storageErrIsNotFound(err) {
+			return errWebhookDeleted
+		}
+		return fmt.Errorf("failed to get webhook: %v", err)
+	}
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %v", err)
+	}
+
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(d.ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, string(delivery.Event.Type))
+	req.Header.Set(webhookDeliveryHeader, delivery.ID)
+	auth.SignWebhook(req, webhook.Secret, body, time.Now())
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// retryDelay returns the delay before the next attempt of a delivery
+// failed the given number of times. It doubles with every attempt.
+func (d *dispatcher) retryDelay(attempts int) time.Duration {
+	return backoffDelay(d.backoff, maxWebhookBackoff, attempts)
+}
+
+// newWebhookClient returns the default webhook client. It does not follow
+// redirects and refuses to connect to the loopback, private and link-local
+// addresses, so the webhooks cannot reach the internal services.
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   webhookTimeout,
+		KeepAlive: 30 * time.Second,
+		Control:   dialPublicOnly,
+	}
+	return &http.Client{
+		Timeout: webhookTimeout,
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// nonPublicNets are the IPv4 networks not reachable from the internet
+// that the net.IP methods do not cover.
+var nonPublicNets = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	mustParseCIDR("100.64.0.0/10"),
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// dialPublicOnly fails the connections to the addresses that are not public.
+// It is checked after the host name is resolved, so a public name
+// resolving to an internal address is refused as well.
+func dialPublicOnly(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !publicIP(ip) {
+		return fmt.Errorf("webhook address %s is not public", host)
+	}
+	return nil
+}
+
+// publicIP reports whether ip is a public unicast address.
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
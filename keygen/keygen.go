@@ -0,0 +1,195 @@
+package keygen
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/evgeny08/collection-key/types"
+)
+
+// Crockford is the Crockford base32 alphabet. It leaves out the
+// ambiguous characters I, L, O and U.
+const Crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// Generator generates random keys using crypto/rand.
+type Generator struct {
+	length     int
+	alphabet   []rune
+	index      map[rune]int
+	groupSize  int
+	separator  string
+	checkDigit bool
+}
+
+// Config is a key generator configuration.
+type Config struct {
+	// Length is a number of key characters without separators,
+	// including the check digit if enabled.
+	Length int
+	// Alphabet is a set of characters used in keys.
+	Alphabet string
+	// GroupSize splits a key into groups of the given size
+	// joined with Separator (e.g. XXXX-XXXX-XXXX). Zero disables grouping.
+	GroupSize int
+	Separator string
+	// CheckDigit appends a Luhn mod N check character to a key.
+	CheckDigit bool
+}
+
+// Override returns a copy of the configuration with non-zero
+// parameters replaced by the given ones.
+func (c Config) Override(p *types.KeyGenParams) *Config {
+	if p == nil {
+		return &c
+	}
+	if p.Length != 0 {
+		c.Length = p.Length
+	}
+	if p.Alphabet != "" {
+		c.Alphabet = p.Alphabet
+	}
+	if p.GroupSize != 0 {
+		c.GroupSize = p.GroupSize
+	}
+	if p.Separator != "" {
+		c.Separator = p.Separator
+	}
+	if p.CheckDigit != nil {
+		c.CheckDigit = *p.CheckDigit
+	}
+	return &c
+}
+
+// New creates a new key generator using the given configuration. The keys
+// consist of the URL unreserved characters, see types.KeyIDChars, and are at
+// most types.MaxKeyIDLen bytes long including the separators.
+func New(cfg *Config) (*Generator, error) {
+	if len(cfg.Alphabet) > len(types.KeyIDChars) {
+		return nil, errors.New("alphabet is too long")
+	}
+	alphabet := []rune(cfg.Alphabet)
+	if len(alphabet) < 2 {
+		return nil, errors.New("alphabet must contain at least 2 characters")
+	}
+	if !types.ValidKeyIDChars(cfg.Alphabet) {
+		return nil, errors.New("alphabet must consist of letters, digits and the characters -._~")
+	}
+	index := make(map[rune]int, len(alphabet))
+	for i, r := range alphabet {
+		if _, ok := index[r]; ok {
+			return nil, errors.New("alphabet contains duplicate characters")
+		}
+		index[r] = i
+	}
+	if cfg.Length < 1 || (cfg.CheckDigit && cfg.Length < 2) {
+		return nil, errors.New("key length is too short")
+	}
+	if cfg.GroupSize < 0 {
+		return nil, errors.New("negative group size")
+	}
+	if cfg.GroupSize > 0 && cfg.Separator != "" && strings.ContainsAny(cfg.Separator, cfg.Alphabet) {
+		return nil, errors.New("separator must not contain alphabet characters")
+	}
+	if cfg.GroupSize > 0 && !types.ValidKeyIDChars(cfg.Separator) {
+		return nil, errors.New("separator must consist of letters, digits and the characters -._~")
+	}
+	if cfg.Length > types.MaxKeyIDLen || keyLen(cfg) > types.MaxKeyIDLen {
+		return nil, fmt.Errorf("key length must not exceed %d characters including separators", types.MaxKeyIDLen)
+	}
+
+	return &Generator{
+		length:     cfg.Length,
+		alphabet:   alphabet,
+		index:      index,
+		groupSize:  cfg.GroupSize,
+		separator:  cfg.Separator,
+		checkDigit: cfg.CheckDigit,
+	}, nil
+}
+
+// keyLen returns the length of the keys of the configuration
+// including the separators.
+func keyLen(cfg *Config) int {
+	n := cfg.Length
+	if cfg.GroupSize > 0 {
+		n += (cfg.Length - 1) / cfg.GroupSize * len(cfg.Separator)
+	}
+	return n
+}
+
+// Generate returns a new random key.
+func (g *Generator) Generate() (string, error) {
+	n := g.length
+	if g.checkDigit {
+		n--
+	}
+	max := big.NewInt(int64(len(g.alphabet)))
+	b := make([]rune, n, g.length)
+	for i := range b {
+		v, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = g.alphabet[v.Int64()]
+	}
+	if g.checkDigit {
+		b = append(b, g.checkChar(b))
+	}
+	return g.group(b), nil
+}
+
+// Valid reports whether the given key matches the generator format
+// and has a correct check digit if enabled.
+func (g *Generator) Valid(key string) bool {
+	if g.groupSize > 0 && g.separator != "" {
+		key = strings.Replace(key, g.separator, "", -1)
+	}
+	b := []rune(key)
+	if len(b) != g.length {
+		return false
+	}
+	for _, r := range b {
+		if _, ok := g.index[r]; !ok {
+			return false
+		}
+	}
+	if g.checkDigit {
+		return g.checkChar(b[:len(b)-1]) == b[len(b)-1]
+	}
+	return true
+}
+
+// checkChar computes a Luhn mod N check character for the given payload.
+func (g *Generator) checkChar(payload []rune) rune {
+	n := len(g.alphabet)
+	factor := 2
+	sum := 0
+	for i := len(payload) - 1; i >= 0; i-- {
+		addend := factor * g.index[payload[i]]
+		if factor == 2 {
+			factor = 1
+		} else {
+			factor = 2
+		}
+		sum += addend/n + addend%n
+	}
+	return g.alphabet[(n-sum%n)%n]
+}
+
+// group joins key characters into groups separated by the separator.
+func (g *Generator) group(b []rune) string {
+	if g.groupSize == 0 {
+		return string(b)
+	}
+	var sb strings.Builder
+	for i, r := range b {
+		if i > 0 && i%g.groupSize == 0 {
+			sb.WriteString(g.separator)
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
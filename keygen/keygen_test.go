@@ -0,0 +1,109 @@
+package keygen
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/evgeny08/collection-key/types"
+)
+
+func TestGenerate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		cfg     *Config
+		wantLen int
+	}{
+		{
+			name:    "plain",
+			cfg:     &Config{Length: 16, Alphabet: Crockford},
+			wantLen: 16,
+		},
+		{
+			name:    "grouped",
+			cfg:     &Config{Length: 12, Alphabet: Crockford, GroupSize: 4, Separator: "-"},
+			wantLen: 14,
+		},
+		{
+			name:    "check digit",
+			cfg:     &Config{Length: 12, Alphabet: Crockford, GroupSize: 4, Separator: "-", CheckDigit: true},
+			wantLen: 14,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			g, err := New(tc.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seen := make(map[string]bool)
+			for i := 0; i < 1000; i++ {
+				key, err := g.Generate()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(key) != tc.wantLen {
+					t.Fatalf("got key %q of length %d want %d", key, len(key), tc.wantLen)
+				}
+				if !g.Valid(key) {
+					t.Fatalf("generated key %q is not valid", key)
+				}
+				if seen[key] {
+					t.Fatalf("duplicate key %q", key)
+				}
+				seen[key] = true
+			}
+		})
+	}
+}
+
+func TestValidCheckDigit(t *testing.T) {
+	g, err := New(&Config{Length: 12, Alphabet: Crockford, GroupSize: 4, Separator: "-", CheckDigit: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := g.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the first character to break the check digit.
+	first := key[:1]
+	other := "0"
+	if first == other {
+		other = "1"
+	}
+	broken := other + key[1:]
+	if g.Valid(broken) {
+		t.Fatalf("key %q with a wrong check digit is valid", broken)
+	}
+	if g.Valid(strings.ToLower(key)) {
+		t.Fatalf("key %q with unknown characters is valid", strings.ToLower(key))
+	}
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	testCases := []struct {
+		name string
+		cfg  *Config
+	}{
+		{name: "short alphabet", cfg: &Config{Length: 4, Alphabet: "A"}},
+		{name: "duplicate characters", cfg: &Config{Length: 4, Alphabet: "AAB"}},
+		{name: "zero length", cfg: &Config{Length: 0, Alphabet: Crockford}},
+		{name: "separator in alphabet", cfg: &Config{Length: 4, Alphabet: Crockford, GroupSize: 2, Separator: "A"}},
+		{name: "reserved alphabet characters", cfg: &Config{Length: 4, Alphabet: "AB/%?#"}},
+		{name: "reserved separator", cfg: &Config{Length: 4, Alphabet: Crockford, GroupSize: 2, Separator: "/"}},
+		{name: "long alphabet", cfg: &Config{Length: 4, Alphabet: types.KeyIDChars + "AB"}},
+		{name: "long key", cfg: &Config{Length: types.MaxKeyIDLen + 1, Alphabet: Crockford}},
+		{name: "huge key", cfg: &Config{Length: 1 << 40, Alphabet: Crockford}},
+		{name: "long key with separators", cfg: &Config{Length: 100, Alphabet: Crockford, GroupSize: 4, Separator: "--"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := New(tc.cfg); err == nil {
+				t.Fatal("got nil error")
+			}
+		})
+	}
+}
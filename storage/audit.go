@@ -0,0 +1,350 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/evgeny08/collection-key/types"
+)
+
+// detectTransactions checks whether the deployment supports multi-document
+// transactions. Only replica sets and sharded clusters do, a standalone
+// server writes the audit records and outbox events right after the key changes.
+func (s *Storage) detectTransactions(ctx context.Context) error {
+	var res struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	err := s.session.RunCommand(ctx, bson.M{"isMaster": 1}).Decode(&res)
+	if err != nil {
+		return fmt.Errorf("failed to get server status: %v", err)
+	}
+	s.transactions = res.SetName != "" || res.Msg == "isdbgrid"
+	if !s.transactions {
+		level.Warn(s.logger).Log("msg", "mongodb is not a replica set, audit records and outbox events are written outside of transactions")
+	}
+	return nil
+}
+
+// inTransaction runs fn in a transaction if the deployment supports them,
+// so the key changes, their audit records and events are written together.
+// The transaction is retried on transient errors, so fn may run several times.
+func (s *Storage) inTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if !s.transactions {
+		return fn(ctx)
+	}
+	sess, err := s.session.Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer sess.EndSession(ctx)
+	_, err = sess.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	return err
+}
+
+// insertAudit appends the records to the audit log. Outside of a
+// transaction the key changes are already written, so a failure
+// is logged rather than failing the operation.
+func (s *Storage) insertAudit(ctx context.Context, records ...*types.AuditRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	err := s.appendAudit(ctx, records)
+	if err != nil && !s.transactions {
+		level.Error(s.logger).Log("msg", "failed to write audit records", "count", len(records), "err", err)
+		return nil
+	}
+	return err
+}
+
+// insertVerification appends the record of a key verification to the
+// audit log. Verifications do not change the key, so their records are
+// kept out of the chains and concurrent verifications do not contend for
+// the chain heads. A failure is logged rather than failing the read.
+func (s *Storage) insertVerification(ctx context.Context, rec *types.AuditRecord) {
+	if _, err := s.session.Collection(collectionAudit).InsertOne(ctx, rec); err != nil {
+		level.Error(s.logger).Log("msg", "failed to write verification audit record", "key", rec.KeyID, "err", err)
+	}
+}
+
+// appendAudit links the records to their chains and inserts them. Outside
+// of a transaction the chain heads moved past the records are moved back
+// if the records fail to be inserted, so the chains do not end at records
+// that were never written.
+func (s *Storage) appendAudit(ctx context.Context, records []*types.AuditRecord) error {
+	var chains []auditChain
+	byChain := make(map[auditChain][]*types.AuditRecord)
+	for _, rec := range records {
+		c := auditChain{rec.TenantID, rec.PoolID}
+		if _, ok := byChain[c]; !ok {
+			chains = append(chains, c)
+		}
+		byChain[c] = append(byChain[c], rec)
+	}
+	var linked []AuditHead
+	for _, c := range chains {
+		prev, err := s.linkChain(ctx, c, byChain[c])
+		if err != nil {
+			s.unlinkChains(linked, byChain)
+			return err
+		}
+		linked = append(linked, prev)
+	}
+
+	docs := make([]interface{}, len(records))
+	for i, rec := range records {
+		docs[i] = rec
+	}
+	_, err := s.session.Collection(collectionAudit).InsertMany(ctx, docs)
+	if err != nil {
+		s.unlinkChains(linked, byChain)
+	}
+	return err
+}
+
+// unlinkChains moves the chain heads back to the given previous heads
+// if they still end at the records not written. A head moved further
+// by another operation is left as is and the break is logged.
+func (s *Storage) unlinkChains(prev []AuditHead, byChain map[auditChain][]*types.AuditRecord) {
+	if s.transactions {
+		// The aborted transaction moves the heads back.
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	coll := s.session.Collection(collectionAuditHead)
+	for _, head := range prev {
+		records := byChain[auditChain{head.TenantID, head.PoolID}]
+		last := records[len(records)-1]
+		cas := bson.M{"tenant_id": absentIfEmpty(head.TenantID), "pool_id": absentIfEmpty(head.PoolID), "seq": last.Seq}
+		res, err := coll.UpdateOne(ctx, cas, bson.M{"$set": bson.M{"seq": head.Seq, "hash": head.Hash}})
+		if err != nil {
+			level.Error(s.logger).Log("msg", "failed to move audit chain head back", "tenant", head.TenantID, "pool", head.PoolID, "seq", last.Seq, "err", err)
+			continue
+		}
+		if res.MatchedCount == 0 {
+			level.Error(s.logger).Log("msg", "audit chain is linked past unwritten records", "tenant", head.TenantID, "pool", head.PoolID, "seq", last.Seq)
+		}
+	}
+}
+
+// maxChainAttempts limits the attempts to move a chain head
+// updated concurrently outside of transactions.
+const maxChainAttempts = 10
+
+// linkChain links the records to the end of the chain and moves the chain
+// head past them. The head is compared and set, so concurrent operations
+// never link their records to the same one. It returns the previous head.
+func (s *Storage) linkChain(ctx context.Context, c auditChain, records []*types.AuditRecord) (AuditHead, error) {
+	coll := s.session.Collection(collectionAuditHead)
+	filter := bson.M{"tenant_id": absentIfEmpty(c.tenant), "pool_id": absentIfEmpty(c.pool)}
+	for attempt := 0; attempt < maxChainAttempts; attempt++ {
+		var head AuditHead
+		err := coll.FindOne(ctx, filter).Decode(&head)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return AuditHead{}, err
+		}
+		prev := AuditHead{TenantID: c.tenant, PoolID: c.pool, Seq: head.Seq, Hash: head.Hash}
+		next := prev
+		for _, rec := range records {
+			rec.Link(next.Seq, next.Hash)
+			next.Seq, next.Hash = rec.Seq, rec.Hash
+		}
+
+		if err == mongo.ErrNoDocuments {
+			_, err = coll.InsertOne(ctx, &next)
+			if isDuplicateKeyErr(err) && !s.transactions {
+				continue
+			}
+			return prev, err
+		}
+		cas := bson.M{"tenant_id": filter["tenant_id"], "pool_id": filter["pool_id"], "seq": head.Seq}
+		res, err := coll.UpdateOne(ctx, cas, bson.M{"$set": bson.M{"seq": next.Seq, "hash": next.Hash}})
+		if err != nil {
+			return AuditHead{}, err
+		}
+		if res.MatchedCount == 1 {
+			return prev, nil
+		}
+	}
+	return AuditHead{}, errConcurrentUpdate
+}
+
+// VerifyAuditChain walks the audit chains of all tenants and reports the
+// first broken link. The chain heads are read first, so the records
+// appended during the walk are checked without raising false alarms.
+// The unchained verification records are skipped.
+func (s *Storage) VerifyAuditChain(ctx context.Context) (*types.AuditVerification, error) {
+	var heads []AuditHead
+	cursor, err := s.session.Collection(collectionAuditHead).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &heads); err != nil {
+		return nil, err
+	}
+
+	opts := options.Find().SetSort(primitive.D{{Key: "tenant_id", Value: 1}, {Key: "pool_id", Value: 1}, {Key: "seq", Value: 1}})
+	cursor, err = s.session.Collection(collectionAudit).Find(ctx, bson.M{"seq": bson.M{"$gt": 0}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	v := NewAuditVerifier(heads)
+	for cursor.Next(ctx) {
+		var rec types.AuditRecord
+		if err := cursor.Decode(&rec); err != nil {
+			return nil, err
+		}
+		if !v.Add(&rec) {
+			return v.Result(), nil
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	return v.Finish(), nil
+}
+
+// auditChain identifies the audit chain of a tenant pool.
+type auditChain struct {
+	tenant string
+	pool   string
+}
+
+// AuditHead is the sequence number and the hash
+// of the last record of a tenant pool audit chain.
+type AuditHead struct {
+	TenantID string `bson:"tenant_id,omitempty"`
+	PoolID   string `bson:"pool_id,omitempty"`
+	Seq      int64  `bson:"seq"`
+	Hash     string `bson:"hash"`
+}
+
+// AuditVerifier checks the audit chains record by record. The records
+// must be added chain after chain, in the sequence order within a chain.
+type AuditVerifier struct {
+	result    types.AuditVerification
+	heads     map[auditChain]AuditHead
+	headOrder []auditChain
+	chain     auditChain
+	// ends are the last added records of the chains.
+	ends map[auditChain]AuditHead
+}
+
+// NewAuditVerifier returns a verifier of the audit chains ending at
+// the given heads. The chains may have more records than the heads
+// tell, and the chains created later may have no heads.
+func NewAuditVerifier(heads []AuditHead) *AuditVerifier {
+	v := &AuditVerifier{
+		heads: make(map[auditChain]AuditHead, len(heads)),
+		ends:  make(map[auditChain]AuditHead),
+	}
+	for _, h := range heads {
+		c := auditChain{h.TenantID, h.PoolID}
+		v.heads[c] = h
+		v.headOrder = append(v.headOrder, c)
+	}
+	return v
+}
+
+// Add checks the next record links to the previous one of its chain. It
+// returns false once a broken link is found, the rest need not be added.
+func (v *AuditVerifier) Add(rec *types.AuditRecord) bool {
+	if v.result.Break != nil {
+		return false
+	}
+	c := auditChain{rec.TenantID, rec.PoolID}
+	end, seen := v.ends[c]
+	if !seen {
+		v.result.Chains++
+	} else if c != v.chain {
+		return v.fail(c, rec.Seq, "the chain records are not contiguous")
+	}
+	v.chain = c
+	v.result.Records++
+
+	switch {
+	case rec.Seq > end.Seq+1:
+		return v.fail(c, end.Seq+1, "the record is missing")
+	case rec.Seq <= end.Seq:
+		return v.fail(c, rec.Seq, "the record is duplicated")
+	case rec.PrevHash != end.Hash:
+		return v.fail(c, rec.Seq, "the previous hash does not match the previous record")
+	case rec.Hash != rec.ComputeHash():
+		return v.fail(c, rec.Seq, "the hash does not match the record")
+	}
+	if h, ok := v.heads[c]; ok && h.Seq == rec.Seq && h.Hash != rec.Hash {
+		return v.fail(c, rec.Seq, "the hash does not match the chain head")
+	}
+	v.ends[c] = AuditHead{TenantID: c.tenant, PoolID: c.pool, Seq: rec.Seq, Hash: rec.Hash}
+	return true
+}
+
+// Finish checks no records are missing at the end of the
+// chains and returns the verification result.
+func (v *AuditVerifier) Finish() *types.AuditVerification {
+	if v.result.Break != nil {
+		return v.Result()
+	}
+	for _, c := range v.headOrder {
+		if h, end := v.heads[c], v.ends[c]; end.Seq < h.Seq {
+			v.fail(c, end.Seq+1, "the record is missing")
+			return v.Result()
+		}
+	}
+	return v.Result()
+}
+
+// Result returns the verification result of the records added so far.
+func (v *AuditVerifier) Result() *types.AuditVerification {
+	res := v.result
+	return &res
+}
+
+func (v *AuditVerifier) fail(c auditChain, seq int64, reason string) bool {
+	v.result.Break = &types.AuditChainBreak{TenantID: c.tenant, PoolID: c.pool, Seq: seq, Reason: reason}
+	return false
+}
+
+// KeyHistory returns the audit records of the context tenant key
+// with the given id in the order of the operations. The records
+// of a key changes belong to the chain of its pool.
+func (s *Storage) KeyHistory(ctx context.Context, id string) ([]*types.AuditRecord, error) {
+	filter := bson.M{"key_id": id, "tenant_id": tenantFilter(ctx)}
+	opts := options.Find().SetSort(primitive.D{{Key: "at", Value: 1}, {Key: "seq", Value: 1}})
+	cursor, err := s.session.Collection(collectionAudit).Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	records := []*types.AuditRecord{}
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		n, err := s.session.Collection(collectionKey).CountDocuments(ctx, keyFilter(ctx, id))
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, ErrNotFound
+		}
+	}
+	return records, nil
+}
+
+// auditTime returns the current time at the precision of the stored
+// times, so the keys changed in memory match the stored ones.
+func auditTime() time.Time {
+	return time.Now().Truncate(time.Millisecond)
+}
@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/evgeny08/collection-key/types"
+)
+
+// duplicateKeyCode is the MongoDB error code of a unique index violation.
+const duplicateKeyCode = 11000
+
+// Storage errors. They implement the NotFound, Duplicate and Conflict
+// methods so callers may check the error kind without importing this package.
+var (
+	ErrNotFound        error = &storageError{msg: "key is not found", notFound: true}
+	ErrNotIssued       error = &storageError{msg: "the key was not issued", conflict: true}
+	ErrAlreadyCanceled error = &storageError{msg: "the key has already been canceled", conflict: true}
+	ErrAlreadyRedeemed error = &storageError{msg: "the key has already been redeemed", conflict: true}
+	ErrAlreadyRevoked  error = &storageError{msg: "the key has already been revoked", conflict: true}
+	ErrExpired         error = &storageError{msg: "the key has expired", conflict: true}
+	ErrNotYetValid     error = &storageError{msg: "the key is not yet valid", conflict: true}
+	ErrDuplicate       error = &storageError{msg: "key already exists", duplicate: true}
+	ErrPoolNotFound    error = &storageError{msg: "pool is not found", notFound: true}
+	ErrPoolDuplicate   error = &storageError{msg: "pool already exists", duplicate: true}
+	ErrQuotaExceeded   error = &storageError{msg: "the pool quota is exceeded", conflict: true}
+	ErrTenantNotFound  error = &storageError{msg: "tenant is not found", notFound: true}
+	ErrTenantDuplicate error = &storageError{msg: "tenant already exists", duplicate: true}
+	ErrAPIKeyNotFound  error = &storageError{msg: "API key is not found", notFound: true}
+	ErrInvalidCursor   error = &storageError{msg: "invalid cursor"}
+
+	ErrIdempotencyNotFound  error = &storageError{msg: "idempotency record is not found", notFound: true}
+	ErrIdempotencyDuplicate error = &storageError{msg: "idempotency record already exists", duplicate: true}
+
+	ErrWebhookNotFound  error = &storageError{msg: "webhook is not found", notFound: true}
+	ErrWebhookDuplicate error = &storageError{msg: "webhook already exists", duplicate: true}
+	ErrDeliveryNotFound error = &storageError{msg: "delivery is not found", notFound: true}
+	ErrDeliveryNotDead  error = &storageError{msg: "the delivery is not dead", conflict: true}
+	ErrOutboxNotFound   error = &storageError{msg: "outbox entry is not found", notFound: true}
+
+	ErrInvalidResumeToken error = &storageError{msg: "invalid event id"}
+	ErrResumeTokenExpired error = &storageError{msg: "the events after the event id are no longer available", conflict: true}
+)
+
+// errConcurrentUpdate is returned when a key is changed by
+// a concurrent request while being updated.
+var errConcurrentUpdate error = &storageError{msg: "the key has been changed concurrently", conflict: true}
+
+type storageError struct {
+	msg       string
+	notFound  bool
+	duplicate bool
+	conflict  bool
+}
+
+func (e *storageError) Error() string { return e.msg }
+
+// NotFound reports whether the key is not found.
+func (e *storageError) NotFound() bool { return e.notFound }
+
+// Duplicate reports whether the key already exists.
+func (e *storageError) Duplicate() bool { return e.duplicate }
+
+// Conflict reports whether the operation conflicts with the key state.
+func (e *storageError) Conflict() bool { return e.conflict }
+
+// TransitionError is returned when a key cannot move
+// from its current status to the requested one.
+type TransitionError struct {
+	From types.KeyStatus
+	To   types.KeyStatus
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("cannot change key status from %s to %s", e.From, e.To)
+}
+
+// Conflict reports that the transition conflicts with the key state.
+func (e *TransitionError) Conflict() bool { return true }
+
+// TransitionErr checks the key may move to the given status at the given
+// time. It returns nil if the transition is allowed, one of the specific
+// storage errors or a *TransitionError otherwise.
+func TransitionErr(key *types.Key, to types.KeyStatus, now time.Time) error {
+	from := key.EffectiveStatus(now)
+	if !types.CanTransition(from, to) {
+		switch {
+		case from == types.StatusAvailable && (to == types.StatusRedeemed || to == types.StatusCanceled):
+			return ErrNotIssued
+		case from == types.StatusCanceled:
+			return ErrAlreadyCanceled
+		case from == types.StatusRedeemed && to == types.StatusRedeemed:
+			return ErrAlreadyRedeemed
+		case from == types.StatusRevoked:
+			return ErrAlreadyRevoked
+		case from == types.StatusExpired:
+			return ErrExpired
+		}
+		return &TransitionError{From: from, To: to}
+	}
+	if to == types.StatusRedeemed && key.NotBefore != nil && now.Before(*key.NotBefore) {
+		return ErrNotYetValid
+	}
+	return nil
+}
+
+// notFoundErr replaces mongo.ErrNoDocuments with ErrNotFound.
+func notFoundErr(err error) error {
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	}
+	return err
+}
+
+// poolNotFoundErr replaces mongo.ErrNoDocuments with ErrPoolNotFound.
+func poolNotFoundErr(err error) error {
+	if err == mongo.ErrNoDocuments {
+		return ErrPoolNotFound
+	}
+	return err
+}
+
+// tenantNotFoundErr replaces mongo.ErrNoDocuments with ErrTenantNotFound.
+func tenantNotFoundErr(err error) error {
+	if err == mongo.ErrNoDocuments {
+		return ErrTenantNotFound
+	}
+	return err
+}
+
+// apiKeyNotFoundErr replaces mongo.ErrNoDocuments with ErrAPIKeyNotFound.
+func apiKeyNotFoundErr(err error) error {
+	if err == mongo.ErrNoDocuments {
+		return ErrAPIKeyNotFound
+	}
+	return err
+}
+
+// isDuplicateKeyErr checks if the mongo error is a unique index violation.
+func isDuplicateKeyErr(err error) bool {
+	switch e := err.(type) {
+	case mongo.WriteException:
+		for _, we := range e.WriteErrors {
+			if we.Code == duplicateKeyCode {
+				return true
+			}
+		}
+	case mongo.BulkWriteException:
+		for _, we := range e.WriteErrors {
+			if we.Code == duplicateKeyCode {
+				return true
+			}
+		}
+	case mongo.CommandError:
+		return e.Code == duplicateKeyCode
+	}
+	return false
+}
+
+// isOnlyDuplicateKeyErr checks if all write errors of the
+// unordered bulk insert are unique index violations.
+func isOnlyDuplicateKeyErr(err error) bool {
+	bwe, ok := err.(mongo.BulkWriteException)
+	if !ok || bwe.WriteConcernError != nil || len(bwe.WriteErrors) == 0 {
+		return false
+	}
+	for _, we := range bwe.WriteErrors {
+		if we.Code != duplicateKeyCode {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,23 @@
+package storage
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Drop drops the storage database. It is used to clean up after tests.
+func (s *Storage) Drop() error {
+	return s.session.Drop(context.Background())
+}
+
+// RejectAudit makes the audit log reject the inserted records while reject is set.
+func (s *Storage) RejectAudit(reject bool) error {
+	validator := bson.M{}
+	if reject {
+		validator = bson.M{"rejected": bson.M{"$exists": true}}
+	}
+	cmd := primitive.D{{Key: "collMod", Value: collectionAudit}, {Key: "validator", Value: validator}}
+	return s.session.RunCommand(context.Background(), cmd).Err()
+}
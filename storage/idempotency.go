@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/evgeny08/collection-key/types"
+)
+
+// CreateIdempotencyRecord creates an uncompleted idempotency record of the
+// context tenant. ErrIdempotencyDuplicate is returned if an unexpired
+// record with the same key already exists.
+func (s *Storage) CreateIdempotencyRecord(ctx context.Context, rec *types.IdempotencyRecord) error {
+	rec.TenantID = types.TenantFromContext(ctx)
+	coll := s.session.Collection(collectionIdempotency)
+
+	// The TTL monitor removes the expired records once a minute,
+	// remove the expired record with the same key right away.
+	filter := idempotencyFilter(ctx, rec.Key)
+	filter["expires_at"] = bson.M{"$lte": time.Now()}
+	if _, err := coll.DeleteOne(ctx, filter); err != nil {
+		return err
+	}
+
+	_, err := coll.InsertOne(ctx, rec)
+	if isDuplicateKeyErr(err) {
+		return ErrIdempotencyDuplicate
+	}
+	return err
+}
+
+// GetIdempotencyRecord returns an unexpired idempotency record
+// of the context tenant with the given key.
+func (s *Storage) GetIdempotencyRecord(ctx context.Context, key string) (*types.IdempotencyRecord, error) {
+	filter := idempotencyFilter(ctx, key)
+	filter["expires_at"] = bson.M{"$gt": time.Now()}
+	var rec *types.IdempotencyRecord
+	err := s.session.Collection(collectionIdempotency).FindOne(ctx, filter).Decode(&rec)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrIdempotencyNotFound
+		}
+		return nil, err
+	}
+	return rec, nil
+}
+
+// CompleteIdempotencyRecord stores the response of an uncompleted idempotency
+// record of the context tenant with the key and fingerprint of rec.
+func (s *Storage) CompleteIdempotencyRecord(ctx context.Context, rec *types.IdempotencyRecord) error {
+	filter := idempotencyFilter(ctx, rec.Key)
+	filter["fingerprint"] = rec.Fingerprint
+	filter["completed"] = false
+	update := bson.M{"$set": bson.M{
+		"completed":    true,
+		"status_code":  rec.StatusCode,
+		"content_type": rec.ContentType,
+		"body":         rec.Body,
+		"expires_at":   rec.ExpiresAt,
+	}}
+	res, err := s.session.Collection(collectionIdempotency).UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrIdempotencyNotFound
+	}
+	return nil
+}
+
+// DeleteIdempotencyRecord deletes an uncompleted idempotency record
+// of the context tenant, so the request may be retried.
+func (s *Storage) DeleteIdempotencyRecord(ctx context.Context, key string) error {
+	filter := idempotencyFilter(ctx, key)
+	filter["completed"] = false
+	res, err := s.session.Collection(collectionIdempotency).DeleteOne(ctx, filter)
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrIdempotencyNotFound
+	}
+	return nil
+}
+
+// idempotencyFilter returns a filter matching the idempotency
+// record of the context tenant with the given key.
+func idempotencyFilter(ctx context.Context, key string) bson.M {
+	return bson.M{"tenant_id": absentIfEmpty(types.TenantFromContext(ctx)), "key": key}
+}
@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/evgeny08/collection-key/types"
+)
+
+// Cursor is a position in a key listing
+// after the last key of a page.
+type Cursor struct {
+	Sort types.KeySort `json:"s"`
+	Time *time.Time    `json:"t,omitempty"`
+	ID   string        `json:"id"`
+}
+
+// NewCursor returns the position after the key in the listing order.
+func NewCursor(key *types.Key, sort types.KeySort) *Cursor {
+	return &Cursor{Sort: sort, Time: sort.TimeOf(key), ID: key.ID}
+}
+
+// Encode returns the cursor as an opaque URL-safe string.
+func (c *Cursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// After reports whether the key goes after the cursor.
+func (c *Cursor) After(key *types.Key) bool {
+	return c.Sort.After(key, c.Time, c.ID)
+}
+
+// DecodeCursor decodes a cursor of the listing in the given order.
+// ErrInvalidCursor is returned if the cursor is malformed
+// or belongs to a listing in another order.
+func DecodeCursor(s string, sort types.KeySort) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c Cursor
+	if err := json.Unmarshal(b, &c); err != nil || c.Sort != sort || c.ID == "" {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
+
+// ListKeys returns a page of the context tenant keys matching the filter
+// in the given order. A zero limit returns all the keys. The query is
+// served by the tenant indexes of the sort fields.
+func (s *Storage) ListKeys(ctx context.Context, params *types.KeyListParams) (*types.KeyPage, error) {
+	sort := params.Sort
+	if sort == "" {
+		sort = types.DefaultKeySort
+	}
+	filter := listFilter(ctx, &params.KeyFilter)
+	if params.Cursor != "" {
+		c, err := DecodeCursor(params.Cursor, sort)
+		if err != nil {
+			return nil, err
+		}
+		filter["$and"] = []bson.M{cursorFilter(c)}
+	}
+	opts := options.Find().SetSort(sortOrder(sort))
+	if params.Limit > 0 {
+		// The extra key tells if there is a next page.
+		opts.SetLimit(int64(params.Limit) + 1)
+	}
+
+	cursor, err := s.session.Collection(collectionKey).Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	page := &types.KeyPage{Keys: []*types.Key{}}
+	for cursor.Next(ctx) {
+		var key *types.Key
+		if err := cursor.Decode(&key); err != nil {
+			return nil, err
+		}
+		if params.Limit > 0 && len(page.Keys) == params.Limit {
+			page.NextCursor = NewCursor(page.Keys[len(page.Keys)-1], sort).Encode()
+			break
+		}
+		page.Keys = append(page.Keys, key)
+	}
+	return page, cursor.Err()
+}
+
+// ExportKeys calls fn for every context tenant key matching the filter in
+// the given order. The keys are read from a database cursor as fn consumes
+// them, so any number of keys can be exported. The first error of fn stops
+// the export and is returned.
+func (s *Storage) ExportKeys(ctx context.Context, filter *types.KeyFilter, sort types.KeySort, fn func(*types.Key) error) error {
+	if sort == "" {
+		sort = types.DefaultKeySort
+	}
+	opts := options.Find().SetSort(sortOrder(sort))
+	cursor, err := s.session.Collection(collectionKey).Find(ctx, listFilter(ctx, filter), opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var key *types.Key
+		if err := cursor.Decode(&key); err != nil {
+			return err
+		}
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// listFilter returns a filter matching the context tenant keys selected by the key filter.
+func listFilter(ctx context.Context, f *types.KeyFilter) bson.M {
+	filter := bson.M{"tenant_id": tenantFilter(ctx)}
+	if len(f.Statuses) > 0 {
+		filter["status"] = bson.M{"$in": f.Statuses}
+	}
+	if f.PoolID != nil {
+		filter["pool_id"] = absentIfEmpty(*f.PoolID)
+	}
+	if f.Recipient != "" {
+		filter["recipient"] = f.Recipient
+	}
+	if f.IDPrefix != "" {
+		// An anchored prefix expression is served by the index.
+		filter["id"] = bson.M{"$regex": "^" + regexp.QuoteMeta(f.IDPrefix)}
+	}
+	if r := timeRange(f.CreatedSince, f.CreatedBefore); r != nil {
+		filter["created_at"] = r
+	}
+	if r := timeRange(f.IssuedSince, f.IssuedBefore); r != nil {
+		filter["issued_at"] = r
+	}
+	return filter
+}
+
+// timeRange returns a filter value matching the times in the optional range.
+func timeRange(since, before *time.Time) bson.M {
+	if since == nil && before == nil {
+		return nil
+	}
+	r := bson.M{}
+	if since != nil {
+		r["$gte"] = *since
+	}
+	if before != nil {
+		r["$lt"] = *before
+	}
+	return r
+}
+
+// sortOrder returns the sort document of the listing order.
+func sortOrder(sort types.KeySort) primitive.D {
+	dir := 1
+	if sort.Descending() {
+		dir = -1
+	}
+	if sort.Field() == "id" {
+		return primitive.D{{Key: "id", Value: dir}}
+	}
+	return primitive.D{{Key: sort.Field(), Value: dir}, {Key: "id", Value: dir}}
+}
+
+// cursorFilter returns a filter matching the keys after the cursor as
+// Cursor.After does. Missing times sort before any time in MongoDB.
+func cursorFilter(c *Cursor) bson.M {
+	field := c.Sort.Field()
+	if field == "id" {
+		if c.Sort.Descending() {
+			return bson.M{"id": bson.M{"$lt": c.ID}}
+		}
+		return bson.M{"id": bson.M{"$gt": c.ID}}
+	}
+
+	switch {
+	case c.Time == nil && !c.Sort.Descending():
+		return bson.M{"$or": []bson.M{
+			{field: bson.M{"$ne": nil}},
+			{field: nil, "id": bson.M{"$gt": c.ID}},
+		}}
+	case c.Time == nil:
+		return bson.M{field: nil, "id": bson.M{"$lt": c.ID}}
+	case !c.Sort.Descending():
+		return bson.M{"$or": []bson.M{
+			{field: bson.M{"$gt": *c.Time}},
+			{field: *c.Time, "id": bson.M{"$gt": c.ID}},
+		}}
+	default:
+		return bson.M{"$or": []bson.M{
+			{field: bson.M{"$lt": *c.Time}},
+			{field: nil},
+			{field: *c.Time, "id": bson.M{"$lt": c.ID}},
+		}}
+	}
+}
@@ -0,0 +1,1014 @@
+package memstore
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/evgeny08/collection-key/storage"
+	"github.com/evgeny08/collection-key/types"
+)
+
+// Storage is a concurrency-safe in-memory key storage.
+// It has the same semantics as the MongoDB storage and is meant
+// for tests and local development.
+type Storage struct {
+	mu    sync.Mutex
+	keys  []*types.Key
+	index map[keyRef]*types.Key
+	pools map[poolRef]*types.Pool
+	// next is a position of the first key of a pool that may be available.
+	next map[poolRef]int
+
+	tenants map[string]*types.Tenant
+	apiKeys map[string]*types.APIKey // By hash.
+
+	idempotency map[idempotencyRef]*types.IdempotencyRecord
+
+	// audit is the append-only audit log of all tenants,
+	// chained by the tenant pool.
+	audit      []*types.AuditRecord
+	auditHeads map[poolRef]storage.AuditHead
+
+	// outbox holds the events of the key changes until relayed.
+	outbox []*types.OutboxEntry
+	// changed is closed and replaced when a key change is recorded.
+	changed chan struct{}
+
+	webhooks   map[webhookRef]*types.Webhook
+	deliveries []*types.Delivery
+}
+
+// webhookRef identifies a webhook of a tenant.
+type webhookRef struct {
+	tenant string
+	id     string
+}
+
+// idempotencyRef identifies an idempotency record of a tenant.
+type idempotencyRef struct {
+	tenant string
+	key    string
+}
+
+// keyRef identifies a key of a tenant. Key IDs are unique per tenant.
+type keyRef struct {
+	tenant string
+	id     string
+}
+
+// poolRef identifies a pool of a tenant.
+type poolRef struct {
+	tenant string
+	id     string
+}
+
+// New creates a new empty in-memory storage.
+func New() *Storage {
+	return &Storage{
+		index:   make(map[keyRef]*types.Key),
+		pools:   make(map[poolRef]*types.Pool),
+		next:    make(map[poolRef]int),
+		tenants: make(map[string]*types.Tenant),
+		apiKeys: make(map[string]*types.APIKey),
+
+		idempotency: make(map[idempotencyRef]*types.IdempotencyRecord),
+		auditHeads:  make(map[poolRef]storage.AuditHead),
+		webhooks:    make(map[webhookRef]*types.Webhook),
+		changed:     make(chan struct{}),
+	}
+}
+
+// InsertKey creates a key of the context tenant in storage.
+func (s *Storage) InsertKey(ctx context.Context, key *types.Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key.TenantID = types.TenantFromContext(ctx)
+	if err := s.checkPoolKeys(key.TenantID, map[string]int{key.PoolID: 1}); err != nil {
+		return err
+	}
+	if _, ok := s.index[keyRef{key.TenantID, key.ID}]; ok {
+		return storage.ErrDuplicate
+	}
+	s.insert(ctx, key)
+	return nil
+}
+
+// InsertKeys creates keys of the context tenant in storage. If some of the keys already
+// exist, the rest are inserted and storage.ErrDuplicate is returned.
+// Nothing is inserted if the keys exceed the quota of their pools.
+func (s *Storage) InsertKeys(ctx context.Context, keys []*types.Key) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tenant := types.TenantFromContext(ctx)
+	counts := make(map[string]int)
+	for _, key := range keys {
+		key.TenantID = tenant
+		counts[key.PoolID]++
+	}
+	if err := s.checkPoolKeys(tenant, counts); err != nil {
+		return 0, err
+	}
+
+	var err error
+	inserted := 0
+	for _, key := range keys {
+		if _, ok := s.index[keyRef{key.TenantID, key.ID}]; ok {
+			err = storage.ErrDuplicate
+			continue
+		}
+		s.insert(ctx, key)
+		inserted++
+	}
+	return inserted, err
+}
+
+// ImportKeys creates keys of the context tenant in storage. It returns
+// an error for every key, which is nil if the key is inserted and
+// storage.ErrDuplicate if a key with the same ID already exists.
+// Nothing is inserted if the keys exceed the quota of their pools.
+func (s *Storage) ImportKeys(ctx context.Context, keys []*types.Key) ([]error, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tenant := types.TenantFromContext(ctx)
+	counts := make(map[string]int)
+	for _, key := range keys {
+		key.TenantID = tenant
+		counts[key.PoolID]++
+	}
+	if err := s.checkPoolKeys(tenant, counts); err != nil {
+		return nil, err
+	}
+
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		if _, ok := s.index[keyRef{key.TenantID, key.ID}]; ok {
+			errs[i] = storage.ErrDuplicate
+			continue
+		}
+		s.insert(ctx, key)
+	}
+	return errs, nil
+}
+
+// checkPoolKeys checks the tenant pools exist and may hold the
+// given number of new keys. Keys out of any pool have no quota.
+func (s *Storage) checkPoolKeys(tenant string, counts map[string]int) error {
+	for id, n := range counts {
+		if id == "" {
+			continue
+		}
+		pool, ok := s.pools[poolRef{tenant, id}]
+		if !ok {
+			return storage.ErrPoolNotFound
+		}
+		if pool.MaxKeys > 0 && pool.KeyCount+n > pool.MaxKeys {
+			return storage.ErrQuotaExceeded
+		}
+	}
+	return nil
+}
+
+func (s *Storage) insert(ctx context.Context, key *types.Key) {
+	k := copyKey(key)
+	s.keys = append(s.keys, k)
+	s.index[keyRef{k.TenantID, k.ID}] = k
+	if pool, ok := s.pools[poolRef{k.TenantID, k.PoolID}]; ok {
+		pool.KeyCount++
+	}
+	s.record(ctx, types.AuditCreated, nil, k, time.Now())
+}
+
+// record appends an audit record of the key operation to the chain
+// of the key pool and queues the event of the key change in the outbox.
+// The records of the verifications are left out of the chains.
+// The before and after keys are copied.
+func (s *Storage) record(ctx context.Context, action types.AuditAction, before, after *types.Key, now time.Time) {
+	if before != nil {
+		before = copyKey(before)
+	}
+	rec := types.NewAuditRecord(ctx, action, before, copyKey(after), now)
+	if action != types.AuditVerified {
+		ref := poolRef{rec.TenantID, rec.PoolID}
+		head := s.auditHeads[ref]
+		rec.Link(head.Seq, head.Hash)
+		s.auditHeads[ref] = storage.AuditHead{TenantID: ref.tenant, PoolID: ref.id, Seq: rec.Seq, Hash: rec.Hash}
+	}
+	s.audit = append(s.audit, rec)
+	if event := rec.Event(storage.NewEventID()); event != nil {
+		s.outbox = append(s.outbox, &types.OutboxEntry{Event: event, NextAttemptAt: now})
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// GetKey returns an available key of the context tenant pool that is not
+// expired and marks it as issued. An empty pool selects the keys out of any pool.
+// The optional issuance is stored with the key.
+func (s *Storage) GetKey(ctx context.Context, pool string, issuance *types.Issuance) (*types.Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ref := poolRef{types.TenantFromContext(ctx), pool}
+	p, ok := s.pools[ref]
+	if pool != "" {
+		if !ok {
+			return nil, storage.ErrPoolNotFound
+		}
+		if p.MaxIssued > 0 && p.IssuedCount >= p.MaxIssued {
+			return nil, storage.ErrQuotaExceeded
+		}
+	}
+
+	now := time.Now()
+	// Keys never become available again, so the search
+	// position moves past every key that cannot be issued.
+	next := s.next[ref]
+	defer func() { s.next[ref] = next }()
+	for ; next < len(s.keys); next++ {
+		key := s.keys[next]
+		if key.TenantID != ref.tenant || key.PoolID != pool {
+			continue
+		}
+		if storage.TransitionErr(key, types.StatusIssued, now) == nil {
+			before := copyKey(key)
+			key.SetStatus(types.StatusIssued, now)
+			if issuance != nil {
+				if issuance.Recipient != "" {
+					key.Recipient = issuance.Recipient
+				}
+				if len(issuance.Metadata) > 0 {
+					key.Metadata = copyMetadata(issuance.Metadata)
+				}
+			}
+			if p != nil {
+				p.IssuedCount++
+			}
+			s.record(ctx, types.AuditIssued, before, key, now)
+			return copyKey(key), nil
+		}
+	}
+	return nil, storage.ErrNotFound
+}
+
+// SweepExpired marks the keys of all tenants past their expiry
+// time as expired and returns the number of marked keys.
+func (s *Storage) SweepExpired(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	n := 0
+	for _, key := range s.keys {
+		if key.Status != types.StatusExpired && key.EffectiveStatus(now) == types.StatusExpired {
+			before := copyKey(key)
+			key.SetStatus(types.StatusExpired, now)
+			s.record(ctx, types.AuditExpired, before, key, now)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// CanceledKey marks an issued key with the given id as canceled.
+func (s *Storage) CanceledKey(ctx context.Context, id string) (*types.Key, error) {
+	return s.transitionKey(ctx, id, types.StatusCanceled, nil)
+}
+
+// RedeemKey marks an issued, valid key with the given id as redeemed.
+func (s *Storage) RedeemKey(ctx context.Context, id, redeemer string) (*types.Key, error) {
+	return s.transitionKey(ctx, id, types.StatusRedeemed, func(key *types.Key) {
+		key.RedeemedBy = redeemer
+	})
+}
+
+// RevokeKey marks a key with the given id as revoked.
+func (s *Storage) RevokeKey(ctx context.Context, id string) (*types.Key, error) {
+	return s.transitionKey(ctx, id, types.StatusRevoked, nil)
+}
+
+// transitionKey moves a key of the context tenant with the given id
+// to the given status and applies the optional update.
+func (s *Storage) transitionKey(ctx context.Context, id string, to types.KeyStatus, update func(key *types.Key)) (*types.Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.lookup(ctx, id)
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	now := time.Now()
+	if err := storage.TransitionErr(key, to, now); err != nil {
+		return nil, err
+	}
+	before := copyKey(key)
+	key.SetStatus(to, now)
+	if update != nil {
+		update(key)
+	}
+	s.record(ctx, types.TransitionAction(to), before, key, now)
+	return copyKey(key), nil
+}
+
+// VerificationKey returns the key of the context tenant with the given id.
+func (s *Storage) VerificationKey(ctx context.Context, id string) (*types.Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.lookup(ctx, id)
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	s.record(ctx, types.AuditVerified, nil, key, time.Now())
+	return copyKey(key), nil
+}
+
+// VerifyAuditChain walks the audit chains of all tenants
+// and reports the first broken link.
+func (s *Storage) VerifyAuditChain(ctx context.Context) (*types.AuditVerification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	heads := make([]storage.AuditHead, 0, len(s.auditHeads))
+	for _, h := range s.auditHeads {
+		heads = append(heads, h)
+	}
+	var records []*types.AuditRecord
+	for _, rec := range s.audit {
+		if rec.Seq > 0 {
+			records = append(records, rec)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.TenantID != b.TenantID {
+			return a.TenantID < b.TenantID
+		}
+		if a.PoolID != b.PoolID {
+			return a.PoolID < b.PoolID
+		}
+		return a.Seq < b.Seq
+	})
+
+	v := storage.NewAuditVerifier(heads)
+	for _, rec := range records {
+		if !v.Add(rec) {
+			break
+		}
+	}
+	return v.Finish(), nil
+}
+
+// KeyHistory returns the audit records of the context tenant key
+// with the given id in the order of the operations.
+func (s *Storage) KeyHistory(ctx context.Context, id string) ([]*types.AuditRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tenant := types.TenantFromContext(ctx)
+	records := []*types.AuditRecord{}
+	for _, rec := range s.audit {
+		if rec.KeyID != id || rec.TenantID != tenant {
+			continue
+		}
+		r := *rec
+		if r.Before != nil {
+			r.Before = copyKey(r.Before)
+		}
+		r.After = copyKey(r.After)
+		records = append(records, &r)
+	}
+	if len(records) == 0 {
+		if _, ok := s.lookup(ctx, id); !ok {
+			return nil, storage.ErrNotFound
+		}
+	}
+	return records, nil
+}
+
+// lookup returns the key of the context tenant with the given id.
+func (s *Storage) lookup(ctx context.Context, id string) (*types.Key, bool) {
+	key, ok := s.index[keyRef{types.TenantFromContext(ctx), id}]
+	return key, ok
+}
+
+// ListKeys returns a page of the context tenant keys matching
+// the filter in the given order. A zero limit returns all the keys.
+func (s *Storage) ListKeys(ctx context.Context, params *types.KeyListParams) (*types.KeyPage, error) {
+	order := params.Sort
+	if order == "" {
+		order = types.DefaultKeySort
+	}
+	var after *storage.Cursor
+	if params.Cursor != "" {
+		c, err := storage.DecodeCursor(params.Cursor, order)
+		if err != nil {
+			return nil, err
+		}
+		after = c
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tenant := types.TenantFromContext(ctx)
+	var keys []*types.Key
+	for _, key := range s.keys {
+		if key.TenantID == tenant && params.Match(key) && (after == nil || after.After(key)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return order.Less(keys[i], keys[j]) })
+
+	page := &types.KeyPage{Keys: []*types.Key{}}
+	for _, key := range keys {
+		if params.Limit > 0 && len(page.Keys) == params.Limit {
+			page.NextCursor = storage.NewCursor(page.Keys[len(page.Keys)-1], order).Encode()
+			break
+		}
+		page.Keys = append(page.Keys, copyKey(key))
+	}
+	return page, nil
+}
+
+// ExportKeys calls fn for every context tenant key matching the filter
+// in the given order. The first error of fn stops the export.
+func (s *Storage) ExportKeys(ctx context.Context, filter *types.KeyFilter, sort types.KeySort, fn func(*types.Key) error) error {
+	page, err := s.ListKeys(ctx, &types.KeyListParams{KeyFilter: *filter, Sort: sort})
+	if err != nil {
+		return err
+	}
+	for _, key := range page.Keys {
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// KeyStats counts the context tenant keys of the pool by status, and the
+// keys issued since each of the given times. A nil pool selects all keys
+// and an empty pool the keys out of any pool.
+func (s *Storage) KeyStats(ctx context.Context, pool *string, issuedSince []time.Time) (*types.KeyStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := &types.KeyStats{Statuses: make(map[types.KeyStatus]int64)}
+	for _, since := range issuedSince {
+		stats.Issuance = append(stats.Issuance, &types.IssuanceRate{Since: since})
+	}
+	tenant := types.TenantFromContext(ctx)
+	for _, key := range s.keys {
+		if key.TenantID != tenant || (pool != nil && key.PoolID != *pool) {
+			continue
+		}
+		stats.Statuses[key.Status]++
+		stats.Total++
+		for _, rate := range stats.Issuance {
+			if key.IssuedAt != nil && !key.IssuedAt.Before(rate.Since) {
+				rate.Issued++
+			}
+		}
+	}
+	return stats, nil
+}
+
+// copyKey returns a deep copy of the key, so the stored
+// keys cannot be changed by the callers.
+func copyKey(key *types.Key) *types.Key {
+	k := *key
+	k.Metadata = copyMetadata(key.Metadata)
+	return &k
+}
+
+func copyMetadata(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// CreatePool creates a key pool of the context tenant in storage.
+func (s *Storage) CreatePool(ctx context.Context, pool *types.Pool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pool.TenantID = types.TenantFromContext(ctx)
+	ref := poolRef{pool.TenantID, pool.ID}
+	if _, ok := s.pools[ref]; ok {
+		return storage.ErrPoolDuplicate
+	}
+	p := *pool
+	p.KeyCount = 0
+	p.IssuedCount = 0
+	s.pools[ref] = &p
+	return nil
+}
+
+// GetPool returns a key pool of the context tenant with the given id.
+func (s *Storage) GetPool(ctx context.Context, id string) (*types.Pool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pool, ok := s.pools[poolRef{types.TenantFromContext(ctx), id}]
+	if !ok {
+		return nil, storage.ErrPoolNotFound
+	}
+	p := *pool
+	return &p, nil
+}
+
+// ListPools returns all key pools of the context tenant ordered by ID.
+func (s *Storage) ListPools(ctx context.Context) ([]*types.Pool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tenant := types.TenantFromContext(ctx)
+	pools := []*types.Pool{}
+	for ref, pool := range s.pools {
+		if ref.tenant != tenant {
+			continue
+		}
+		p := *pool
+		pools = append(pools, &p)
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].ID < pools[j].ID })
+	return pools, nil
+}
+
+// CreateTenant creates a tenant in storage.
+func (s *Storage) CreateTenant(ctx context.Context, tenant *types.Tenant) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tenants[tenant.ID]; ok {
+		return storage.ErrTenantDuplicate
+	}
+	t := *tenant
+	s.tenants[t.ID] = &t
+	return nil
+}
+
+// GetTenant returns a tenant with the given id.
+func (s *Storage) GetTenant(ctx context.Context, id string) (*types.Tenant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tenant, ok := s.tenants[id]
+	if !ok {
+		return nil, storage.ErrTenantNotFound
+	}
+	t := *tenant
+	return &t, nil
+}
+
+// ListTenants returns all tenants ordered by ID.
+func (s *Storage) ListTenants(ctx context.Context) ([]*types.Tenant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tenants := make([]*types.Tenant, 0, len(s.tenants))
+	for _, tenant := range s.tenants {
+		t := *tenant
+		tenants = append(tenants, &t)
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].ID < tenants[j].ID })
+	return tenants, nil
+}
+
+// CreateAPIKey stores a tenant API key.
+func (s *Storage) CreateAPIKey(ctx context.Context, key *types.APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.apiKeys[key.Hash]; ok {
+		return storage.ErrDuplicate
+	}
+	for _, k := range s.apiKeys {
+		if k.TenantID == key.TenantID && k.ID == key.ID {
+			return storage.ErrDuplicate
+		}
+	}
+	k := *key
+	k.Secret = ""
+	s.apiKeys[k.Hash] = &k
+	return nil
+}
+
+// GetAPIKey returns an API key with the given secret hash.
+func (s *Storage) GetAPIKey(ctx context.Context, hash string) (*types.APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.apiKeys[hash]
+	if !ok {
+		return nil, storage.ErrAPIKeyNotFound
+	}
+	k := *key
+	return &k, nil
+}
+
+// RevokeAPIKey marks an API key of the tenant with the given id as revoked.
+func (s *Storage) RevokeAPIKey(ctx context.Context, tenant, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range s.apiKeys {
+		if key.TenantID == tenant && key.ID == id && key.RevokedAt == nil {
+			now := time.Now()
+			key.RevokedAt = &now
+			return nil
+		}
+	}
+	return storage.ErrAPIKeyNotFound
+}
+
+// CreateIdempotencyRecord creates an uncompleted idempotency record of the
+// context tenant. storage.ErrIdempotencyDuplicate is returned if an unexpired
+// record with the same key already exists.
+func (s *Storage) CreateIdempotencyRecord(ctx context.Context, rec *types.IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Remove the expired records as the MongoDB TTL index does.
+	now := time.Now()
+	for ref, r := range s.idempotency {
+		if !now.Before(r.ExpiresAt) {
+			delete(s.idempotency, ref)
+		}
+	}
+
+	rec.TenantID = types.TenantFromContext(ctx)
+	ref := idempotencyRef{tenant: rec.TenantID, key: rec.Key}
+	if _, ok := s.idempotency[ref]; ok {
+		return storage.ErrIdempotencyDuplicate
+	}
+	r := *rec
+	s.idempotency[ref] = &r
+	return nil
+}
+
+// GetIdempotencyRecord returns an unexpired idempotency record
+// of the context tenant with the given key.
+func (s *Storage) GetIdempotencyRecord(ctx context.Context, key string) (*types.IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.idempotency[idempotencyRef{tenant: types.TenantFromContext(ctx), key: key}]
+	if !ok || !time.Now().Before(rec.ExpiresAt) {
+		return nil, storage.ErrIdempotencyNotFound
+	}
+	r := *rec
+	return &r, nil
+}
+
+// CompleteIdempotencyRecord stores the response of an uncompleted idempotency
+// record of the context tenant with the key and fingerprint of rec.
+func (s *Storage) CompleteIdempotencyRecord(ctx context.Context, rec *types.IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.idempotency[idempotencyRef{tenant: types.TenantFromContext(ctx), key: rec.Key}]
+	if !ok || r.Completed || r.Fingerprint != rec.Fingerprint {
+		return storage.ErrIdempotencyNotFound
+	}
+	r.Completed = true
+	r.StatusCode = rec.StatusCode
+	r.ContentType = rec.ContentType
+	r.Body = append([]byte(nil), rec.Body...)
+	r.ExpiresAt = rec.ExpiresAt
+	return nil
+}
+
+// DeleteIdempotencyRecord deletes an uncompleted idempotency record
+// of the context tenant, so the request may be retried.
+func (s *Storage) DeleteIdempotencyRecord(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ref := idempotencyRef{tenant: types.TenantFromContext(ctx), key: key}
+	r, ok := s.idempotency[ref]
+	if !ok || r.Completed {
+		return storage.ErrIdempotencyNotFound
+	}
+	delete(s.idempotency, ref)
+	return nil
+}
+
+// CreateWebhook creates a webhook of the context tenant in storage.
+func (s *Storage) CreateWebhook(ctx context.Context, webhook *types.Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	webhook.TenantID = types.TenantFromContext(ctx)
+	ref := webhookRef{webhook.TenantID, webhook.ID}
+	if _, ok := s.webhooks[ref]; ok {
+		return storage.ErrWebhookDuplicate
+	}
+	s.webhooks[ref] = copyWebhook(webhook)
+	return nil
+}
+
+// GetWebhook returns a webhook of the context tenant with the given id.
+func (s *Storage) GetWebhook(ctx context.Context, id string) (*types.Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	webhook, ok := s.webhooks[webhookRef{types.TenantFromContext(ctx), id}]
+	if !ok {
+		return nil, storage.ErrWebhookNotFound
+	}
+	return copyWebhook(webhook), nil
+}
+
+// ListWebhooks returns all webhooks of the context tenant ordered by ID.
+func (s *Storage) ListWebhooks(ctx context.Context) ([]*types.Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tenant := types.TenantFromContext(ctx)
+	webhooks := []*types.Webhook{}
+	for ref, webhook := range s.webhooks {
+		if ref.tenant == tenant {
+			webhooks = append(webhooks, copyWebhook(webhook))
+		}
+	}
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].ID < webhooks[j].ID })
+	return webhooks, nil
+}
+
+// DeleteWebhook deletes a webhook of the context tenant with the given id.
+func (s *Storage) DeleteWebhook(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ref := webhookRef{types.TenantFromContext(ctx), id}
+	if _, ok := s.webhooks[ref]; !ok {
+		return storage.ErrWebhookNotFound
+	}
+	delete(s.webhooks, ref)
+	return nil
+}
+
+func copyWebhook(webhook *types.Webhook) *types.Webhook {
+	w := *webhook
+	w.Events = append([]types.EventType(nil), webhook.Events...)
+	return &w
+}
+
+// EnqueueDeliveries adds the deliveries of the context tenant to the delivery
+// queue. The deliveries with the IDs already queued are skipped.
+func (s *Storage) EnqueueDeliveries(ctx context.Context, deliveries []*types.Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	queued := make(map[string]bool, len(s.deliveries))
+	for _, d := range s.deliveries {
+		queued[d.ID] = true
+	}
+	tenant := types.TenantFromContext(ctx)
+	for _, d := range deliveries {
+		d.TenantID = tenant
+		if queued[d.ID] {
+			continue
+		}
+		queued[d.ID] = true
+		s.deliveries = append(s.deliveries, copyDelivery(d))
+	}
+	return nil
+}
+
+// ClaimDelivery returns the pending delivery of any tenant due the longest
+// at the given time and postpones its next attempt by the lease. The
+// deliveries to the webhooks with the skipped IDs are not claimed.
+// storage.ErrDeliveryNotFound is returned if no delivery is due.
+func (s *Storage) ClaimDelivery(ctx context.Context, now time.Time, lease time.Duration, skip []string) (*types.Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	skipped := make(map[string]bool, len(skip))
+	for _, id := range skip {
+		skipped[id] = true
+	}
+	var due *types.Delivery
+	for _, d := range s.deliveries {
+		if d.Status != types.DeliveryPending || d.NextAttemptAt.After(now) || skipped[d.WebhookID] {
+			continue
+		}
+		if due == nil || d.NextAttemptAt.Before(due.NextAttemptAt) {
+			due = d
+		}
+	}
+	if due == nil {
+		return nil, storage.ErrDeliveryNotFound
+	}
+	due.NextAttemptAt = now.Add(lease)
+	return copyDelivery(due), nil
+}
+
+// UpdateDelivery stores the outcome of a delivery attempt of any tenant.
+func (s *Storage) UpdateDelivery(ctx context.Context, d *types.Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, stored := range s.deliveries {
+		if stored.ID == d.ID {
+			stored.Status = d.Status
+			stored.Attempts = d.Attempts
+			stored.NextAttemptAt = d.NextAttemptAt
+			stored.LastError = d.LastError
+			stored.DeliveredAt = d.DeliveredAt
+			return nil
+		}
+	}
+	return storage.ErrDeliveryNotFound
+}
+
+// ListDeliveries returns up to limit deliveries of the context tenant
+// with the given status, the most recent first.
+func (s *Storage) ListDeliveries(ctx context.Context, status types.DeliveryStatus, limit int) ([]*types.Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tenant := types.TenantFromContext(ctx)
+	deliveries := []*types.Delivery{}
+	for i := len(s.deliveries) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		d := s.deliveries[i]
+		if d.TenantID == tenant && d.Status == status {
+			deliveries = append(deliveries, copyDelivery(d))
+		}
+	}
+	sort.SliceStable(deliveries, func(i, j int) bool { return deliveries[i].CreatedAt.After(deliveries[j].CreatedAt) })
+	return deliveries, nil
+}
+
+// RetryDelivery moves a dead delivery of the context tenant with the given
+// id back to the queue with a fresh set of attempts due at the given time.
+func (s *Storage) RetryDelivery(ctx context.Context, id string, now time.Time) (*types.Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tenant := types.TenantFromContext(ctx)
+	for _, d := range s.deliveries {
+		if d.ID != id || d.TenantID != tenant {
+			continue
+		}
+		if d.Status != types.DeliveryDead {
+			return nil, storage.ErrDeliveryNotDead
+		}
+		d.Status = types.DeliveryPending
+		d.Attempts = 0
+		d.NextAttemptAt = now
+		return copyDelivery(d), nil
+	}
+	return nil, storage.ErrDeliveryNotFound
+}
+
+func copyDelivery(delivery *types.Delivery) *types.Delivery {
+	d := *delivery
+	d.Event = copyEvent(delivery.Event)
+	return &d
+}
+
+// ClaimOutbox returns up to limit outbox entries of all tenants due at the
+// given time in the order of their events and postpones their next attempt
+// by the lease. The entries after the first one not due are not claimed.
+func (s *Storage) ClaimOutbox(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*types.OutboxEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	claimed := []*types.OutboxEntry{}
+	for _, e := range s.outbox {
+		if len(claimed) == limit || e.NextAttemptAt.After(now) {
+			break
+		}
+		e.NextAttemptAt = now.Add(lease)
+		claimed = append(claimed, copyOutboxEntry(e))
+	}
+	return claimed, nil
+}
+
+// UpdateOutbox stores the outcome of a failed attempt to relay an outbox entry.
+func (s *Storage) UpdateOutbox(ctx context.Context, e *types.OutboxEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, stored := range s.outbox {
+		if stored.Event.ID == e.Event.ID {
+			stored.Attempts = e.Attempts
+			stored.NextAttemptAt = e.NextAttemptAt
+			stored.LastError = e.LastError
+			return nil
+		}
+	}
+	return storage.ErrOutboxNotFound
+}
+
+// DeleteOutbox removes the relayed outbox entries with the given event IDs.
+func (s *Storage) DeleteOutbox(ctx context.Context, ids []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	relayed := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		relayed[id] = true
+	}
+	outbox := s.outbox[:0]
+	for _, e := range s.outbox {
+		if !relayed[e.Event.ID] {
+			outbox = append(outbox, e)
+		}
+	}
+	for i := len(outbox); i < len(s.outbox); i++ {
+		s.outbox[i] = nil
+	}
+	s.outbox = outbox
+	return nil
+}
+
+// WatchKeys calls fn with the events of the context tenant keys as they
+// change, starting after the event with the given ID or with the next change
+// if it is empty. The event IDs are the positions in the audit log. fn is
+// called with nil once watching starts and after every idle period without
+// changes. WatchKeys returns when fn fails or the context is done.
+func (s *Storage) WatchKeys(ctx context.Context, resumeAfter string, idle time.Duration, fn func(*types.Event) error) error {
+	tenant := types.TenantFromContext(ctx)
+
+	s.mu.Lock()
+	next := len(s.audit)
+	if resumeAfter != "" {
+		n, err := strconv.Atoi(resumeAfter)
+		if err != nil || n < 1 || n > len(s.audit) {
+			s.mu.Unlock()
+			return storage.ErrInvalidResumeToken
+		}
+		next = n
+	}
+	s.mu.Unlock()
+	if err := fn(nil); err != nil {
+		return err
+	}
+
+	for {
+		s.mu.Lock()
+		var events []*types.Event
+		for ; next < len(s.audit); next++ {
+			rec := s.audit[next]
+			if rec.TenantID != tenant {
+				continue
+			}
+			if event := rec.Event(strconv.Itoa(next + 1)); event != nil {
+				events = append(events, copyEvent(event))
+			}
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		for _, event := range events {
+			if err := fn(event); err != nil {
+				return err
+			}
+		}
+		if len(events) > 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		case <-time.After(idle):
+			if err := fn(nil); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func copyOutboxEntry(entry *types.OutboxEntry) *types.OutboxEntry {
+	e := *entry
+	e.Event = copyEvent(entry.Event)
+	return &e
+}
+
+func copyEvent(event *types.Event) *types.Event {
+	if event == nil {
+		return nil
+	}
+	e := *event
+	if e.Key != nil {
+		e.Key = copyKey(e.Key)
+	}
+	return &e
+}
+
+// Shutdown does nothing. It exists to match the MongoDB storage.
+func (s *Storage) Shutdown() {}
@@ -0,0 +1,96 @@
+package memstore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/evgeny08/collection-key/httpserver"
+	"github.com/evgeny08/collection-key/storage/storagetest"
+	"github.com/evgeny08/collection-key/types"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) (httpserver.Storage, func()) {
+		return New(), func() {}
+	})
+}
+
+func TestVerifyAuditChain(t *testing.T) {
+	newStorage := func(t *testing.T) *Storage {
+		s := New()
+		ctx := context.Background()
+		for _, id := range []string{"k1", "k2"} {
+			if err := s.InsertKey(ctx, &types.Key{ID: id, Status: types.StatusAvailable}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := s.GetKey(ctx, "", nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.RedeemKey(ctx, "k1", "pos"); err != nil {
+			t.Fatal(err)
+		}
+		// Another tenant has a separate chain.
+		if err := s.InsertKey(types.WithTenant(ctx, "t1"), &types.Key{ID: "k3", Status: types.StatusAvailable}); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	testCases := []struct {
+		name   string
+		tamper func(s *Storage)
+		want   *types.AuditChainBreak
+	}{
+		{
+			name:   "intact",
+			tamper: func(s *Storage) {},
+		},
+		{
+			name:   "edited record",
+			tamper: func(s *Storage) { s.audit[2].Actor = "someone" },
+			want:   &types.AuditChainBreak{Seq: 3, Reason: "the hash does not match the record"},
+		},
+		{
+			name: "rehashed record",
+			tamper: func(s *Storage) {
+				s.audit[1].After.Status = types.StatusRevoked
+				s.audit[1].Hash = s.audit[1].ComputeHash()
+			},
+			want: &types.AuditChainBreak{Seq: 3, Reason: "the previous hash does not match the previous record"},
+		},
+		{
+			name:   "deleted record",
+			tamper: func(s *Storage) { s.audit = append(s.audit[:1], s.audit[2:]...) },
+			want:   &types.AuditChainBreak{Seq: 2, Reason: "the record is missing"},
+		},
+		{
+			name:   "deleted last record",
+			tamper: func(s *Storage) { s.audit = append(s.audit[:3], s.audit[4:]...) },
+			want:   &types.AuditChainBreak{Seq: 4, Reason: "the record is missing"},
+		},
+		{
+			name:   "other tenant",
+			tamper: func(s *Storage) { s.audit[4].KeyID = "k4" },
+			want:   &types.AuditChainBreak{TenantID: "t1", Seq: 1, Reason: "the hash does not match the record"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newStorage(t)
+			tc.tamper(s)
+			res, err := s.VerifyAuditChain(context.Background())
+			if err != nil {
+				t.Fatalf("verify audit chain: %v", err)
+			}
+			if !reflect.DeepEqual(res.Break, tc.want) {
+				t.Fatalf("got break %#v want %#v", res.Break, tc.want)
+			}
+			if tc.want == nil && (res.Chains != 2 || res.Records != 5) {
+				t.Fatalf("got %d chains of %d records want 2 chains of 5 records", res.Chains, res.Records)
+			}
+		})
+	}
+}
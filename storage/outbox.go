@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/evgeny08/collection-key/types"
+)
+
+// NewEventID returns a unique event ID. The IDs generated
+// later by a process sort after the earlier ones.
+func NewEventID() string {
+	return primitive.NewObjectID().Hex()
+}
+
+// recordChanges appends the audit records of the key changes to the audit
+// log and queues their events in the outbox. In a transaction both are
+// written together with the key changes.
+func (s *Storage) recordChanges(ctx context.Context, records ...*types.AuditRecord) error {
+	if err := s.insertAudit(ctx, records...); err != nil {
+		return err
+	}
+	return s.insertOutbox(ctx, records)
+}
+
+// insertOutbox queues the events of the recorded key changes. Outside of
+// a transaction the key changes are already written when it fails, the
+// operation fails nonetheless rather than losing the events unnoticed.
+func (s *Storage) insertOutbox(ctx context.Context, records []*types.AuditRecord) error {
+	var docs []interface{}
+	for _, rec := range records {
+		event := rec.Event(NewEventID())
+		if event == nil {
+			continue
+		}
+		docs = append(docs, &types.OutboxEntry{Event: event, NextAttemptAt: rec.At})
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+	_, err := s.session.Collection(collectionOutbox).InsertMany(ctx, docs)
+	if err != nil && !s.transactions {
+		level.Error(s.logger).Log("msg", "failed to write outbox events of written key changes", "count", len(docs), "err", err)
+	}
+	return err
+}
+
+// ClaimOutbox returns up to limit outbox entries of all tenants due at the
+// given time in the order of their events and postpones their next attempt
+// by the lease, so they are not claimed again while being relayed. The
+// entries after the first one not due, such as a failed or leased one, are
+// not claimed, so the events are relayed in order.
+func (s *Storage) ClaimOutbox(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*types.OutboxEntry, error) {
+	coll := s.session.Collection(collectionOutbox)
+	opts := options.Find().SetSort(bson.M{"event.id": 1}).SetLimit(int64(limit))
+	cursor, err := coll.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var due []*types.OutboxEntry
+	if err := cursor.All(ctx, &due); err != nil {
+		return nil, err
+	}
+
+	// An entry claimed concurrently by another relay no longer
+	// matches its attempt time and ends the claimed entries.
+	claimed := []*types.OutboxEntry{}
+	for _, e := range due {
+		if e.NextAttemptAt.After(now) {
+			break
+		}
+		cas := bson.M{"event.id": e.Event.ID, "next_attempt_at": e.NextAttemptAt}
+		update := bson.M{"$set": bson.M{"next_attempt_at": now.Add(lease)}}
+		res, err := coll.UpdateOne(ctx, cas, update)
+		if err != nil {
+			return nil, err
+		}
+		if res.ModifiedCount == 0 {
+			break
+		}
+		e.NextAttemptAt = now.Add(lease)
+		claimed = append(claimed, e)
+	}
+	return claimed, nil
+}
+
+// UpdateOutbox stores the outcome of a failed attempt to relay an outbox entry.
+func (s *Storage) UpdateOutbox(ctx context.Context, e *types.OutboxEntry) error {
+	update := bson.M{"$set": bson.M{
+		"attempts":        e.Attempts,
+		"next_attempt_at": e.NextAttemptAt,
+		"last_error":      e.LastError,
+	}}
+	res, err := s.session.Collection(collectionOutbox).UpdateOne(ctx, bson.M{"event.id": e.Event.ID}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrOutboxNotFound
+	}
+	return nil
+}
+
+// DeleteOutbox removes the relayed outbox entries with the given event IDs.
+func (s *Storage) DeleteOutbox(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := s.session.Collection(collectionOutbox).DeleteMany(ctx, bson.M{"event.id": bson.M{"$in": ids}})
+	return err
+}
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/evgeny08/collection-key/types"
+)
+
+// CreatePool creates a key pool of the context tenant in storage.
+// ErrPoolDuplicate is returned if the tenant has a pool with the same ID.
+func (s *Storage) CreatePool(ctx context.Context, pool *types.Pool) error {
+	pool.TenantID = types.TenantFromContext(ctx)
+	pool.KeyCount = 0
+	pool.IssuedCount = 0
+	_, err := s.session.Collection(collectionPool).InsertOne(ctx, pool)
+	if isDuplicateKeyErr(err) {
+		return ErrPoolDuplicate
+	}
+	return err
+}
+
+// GetPool returns a key pool of the context tenant with the given id.
+func (s *Storage) GetPool(ctx context.Context, id string) (*types.Pool, error) {
+	var pool *types.Pool
+	err := s.session.Collection(collectionPool).FindOne(ctx, poolFilter(types.TenantFromContext(ctx), id)).Decode(&pool)
+	if err != nil {
+		return nil, poolNotFoundErr(err)
+	}
+	return pool, nil
+}
+
+// ListPools returns all key pools of the context tenant ordered by ID.
+func (s *Storage) ListPools(ctx context.Context) ([]*types.Pool, error) {
+	opts := options.Find().SetSort(bson.M{"id": 1})
+	cursor, err := s.session.Collection(collectionPool).Find(ctx, bson.M{"tenant_id": tenantFilter(ctx)}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	pools := []*types.Pool{}
+	for cursor.Next(ctx) {
+		var pool *types.Pool
+		if err := cursor.Decode(&pool); err != nil {
+			return nil, err
+		}
+		pools = append(pools, pool)
+	}
+	return pools, cursor.Err()
+}
+
+// reservePoolKeys counts n new keys against the MaxKeys quota of the pool.
+// The check and the increment are a single atomic update.
+func (s *Storage) reservePoolKeys(ctx context.Context, tenant, pool string, n int) error {
+	return s.reservePool(ctx, tenant, pool, "key_count", "max_keys", n)
+}
+
+// releasePoolKeys returns n reserved keys back to the pool quota.
+func (s *Storage) releasePoolKeys(tenant, pool string, n int) {
+	s.releasePool(tenant, pool, "key_count", n)
+}
+
+// reservePoolIssue counts an issued key against the MaxIssued quota of the pool.
+func (s *Storage) reservePoolIssue(ctx context.Context, tenant, pool string) error {
+	return s.reservePool(ctx, tenant, pool, "issued_count", "max_issued", 1)
+}
+
+// releasePoolIssue returns a reserved issue back to the pool quota.
+func (s *Storage) releasePoolIssue(tenant, pool string) {
+	s.releasePool(tenant, pool, "issued_count", 1)
+}
+
+// reservePool increments the pool counter by n unless it would exceed the limit.
+// Keys out of any pool have no quota.
+func (s *Storage) reservePool(ctx context.Context, tenant, pool, counter, limit string, n int) error {
+	if pool == "" {
+		return nil
+	}
+	filter := poolFilter(tenant, pool)
+	filter["$or"] = []bson.M{
+		{limit: 0},
+		{"$expr": bson.M{"$lte": []interface{}{bson.M{"$add": []interface{}{"$" + counter, n}}, "$" + limit}}},
+	}
+	res, err := s.session.Collection(collectionPool).UpdateOne(ctx, filter, bson.M{"$inc": bson.M{counter: n}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount > 0 {
+		return nil
+	}
+	if _, err := s.GetPool(types.WithTenant(ctx, tenant), pool); err != nil {
+		return err
+	}
+	return ErrQuotaExceeded
+}
+
+// releasePool decrements the pool counter by n. It must succeed even if
+// the request context is canceled, so it uses the storage context.
+func (s *Storage) releasePool(tenant, pool, counter string, n int) {
+	if pool == "" || n == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, 10*time.Second)
+	defer cancel()
+
+	_, err := s.session.Collection(collectionPool).UpdateOne(ctx, poolFilter(tenant, pool), bson.M{"$inc": bson.M{counter: -n}})
+	if err != nil {
+		level.Error(s.logger).Log("msg", "failed to release pool quota", "tenant", tenant, "pool", pool, "counter", counter, "err", err)
+	}
+}
+
+// poolFilter returns a filter matching the tenant pool with the given id.
+func poolFilter(tenant, id string) bson.M {
+	return bson.M{"id": id, "tenant_id": absentIfEmpty(tenant)}
+}
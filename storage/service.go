@@ -2,85 +2,457 @@ package storage
 
 import (
 	"context"
-	"errors"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"gopkg.in/mgo.v2/bson"
+	"time"
 
 	"github.com/evgeny08/collection-key/types"
 )
 
-// CreateUser creates a user in storage
+// InsertKey creates a key of the context tenant in storage.
+// ErrDuplicate is returned if a key with the same ID already exists.
+// ErrQuotaExceeded is returned if the key pool is full.
 func (s *Storage) InsertKey(ctx context.Context, key *types.Key) error {
-	_, err := s.session.Collection(collectionKey).InsertOne(context.TODO(), &key)
+	tenant := types.TenantFromContext(ctx)
+	key.TenantID = tenant
+	if err := s.reservePoolKeys(ctx, tenant, key.PoolID, 1); err != nil {
+		return err
+	}
+	err := s.inTransaction(ctx, func(ctx context.Context) error {
+		_, err := s.session.Collection(collectionKey).InsertOne(ctx, &key)
+		if err != nil {
+			return err
+		}
+		return s.recordChanges(ctx, types.NewAuditRecord(ctx, types.AuditCreated, nil, key, auditTime()))
+	})
+	if err != nil {
+		s.releasePoolKeys(tenant, key.PoolID, 1)
+	}
+	if isDuplicateKeyErr(err) {
+		return ErrDuplicate
+	}
 	return err
 }
 
-// GetKey returns an unreleased key
-func (s *Storage) GetKey(ctx context.Context) (*types.Key, error) {
-	var key *types.Key
-	filter := bson.M{"issued": false}
-	err := s.session.Collection(collectionKey).FindOne(context.TODO(), filter).Decode(&key)
+// InsertKeys creates keys of the context tenant in storage using a single bulk insert.
+// It returns the number of inserted keys. If some of the keys already
+// exist, the rest are inserted and ErrDuplicate is returned.
+// Nothing is inserted if the keys exceed the quota of their pools.
+func (s *Storage) InsertKeys(ctx context.Context, keys []*types.Key) (int, error) {
+	errs, err := s.insertMany(ctx, keys)
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+	inserted := 0
+	for _, err := range errs {
+		if err == nil {
+			inserted++
+		}
+	}
+	for _, err := range errs {
+		if err != nil && err != ErrDuplicate {
+			return inserted, err
+		}
+	}
+	if inserted < len(keys) {
+		return inserted, ErrDuplicate
 	}
+	return inserted, nil
+}
 
-	_, err = s.session.Collection(collectionKey).UpdateOne(context.TODO(), bson.M{"issued": key.Issued}, bson.M{"$set": bson.M{"issued": true}})
+// ImportKeys creates keys of the context tenant in storage as InsertKeys does.
+// It returns an error for every key, which is nil if the key is inserted
+// and ErrDuplicate if a key with the same ID already exists.
+func (s *Storage) ImportKeys(ctx context.Context, keys []*types.Key) ([]error, error) {
+	return s.insertMany(ctx, keys)
+}
+
+// insertMany inserts the keys of the context tenant with their audit records.
+// It returns an error for every key, which is nil if the key is inserted,
+// or an error if the insert failed as a whole.
+func (s *Storage) insertMany(ctx context.Context, keys []*types.Key) ([]error, error) {
+	errs := make([]error, len(keys))
+	if len(keys) == 0 {
+		return errs, nil
+	}
+	tenant := types.TenantFromContext(ctx)
+	pools := make(map[string]int)
+	for _, key := range keys {
+		key.TenantID = tenant
+		pools[key.PoolID]++
+	}
+	reserved := make(map[string]int)
+	for pool, n := range pools {
+		if err := s.reservePoolKeys(ctx, tenant, pool, n); err != nil {
+			for pool, n := range reserved {
+				s.releasePoolKeys(tenant, pool, n)
+			}
+			return nil, err
+		}
+		reserved[pool] = n
+	}
+
+	err := s.inTransaction(ctx, func(ctx context.Context) error {
+		for i := range errs {
+			errs[i] = nil
+		}
+		insert := s.insertUnordered
+		if s.transactions {
+			insert = s.insertNew
+		}
+		if err := insert(ctx, keys, errs); err != nil {
+			return err
+		}
+		now := auditTime()
+		var records []*types.AuditRecord
+		for i, key := range keys {
+			if errs[i] == nil {
+				records = append(records, types.NewAuditRecord(ctx, types.AuditCreated, nil, key, now))
+			}
+		}
+		return s.recordChanges(ctx, records...)
+	})
 	if err != nil {
+		for pool, n := range reserved {
+			s.releasePoolKeys(tenant, pool, n)
+		}
 		return nil, err
 	}
-	key.Issued = true
-
-	return key, nil
+	failed := make(map[string]int)
+	for i, err := range errs {
+		if err != nil {
+			failed[keys[i].PoolID]++
+		}
+	}
+	for pool, n := range failed {
+		s.releasePoolKeys(tenant, pool, n)
+	}
+	return errs, nil
 }
 
-// CanceledKey updates key Redemption with given id
-func (s *Storage) CanceledKey(ctx context.Context, id string) error {
-	var key *types.Key
-	err := s.session.Collection(collectionKey).FindOne(context.TODO(), bson.M{"id": id}).Decode(&key)
-	if err != nil {
+// insertUnordered inserts the keys using a single unordered bulk
+// insert and sets the errors of the keys that are not inserted.
+func (s *Storage) insertUnordered(ctx context.Context, keys []*types.Key, errs []error) error {
+	docs := make([]interface{}, len(keys))
+	for i, key := range keys {
+		docs[i] = key
+	}
+	opts := options.InsertMany().SetOrdered(false)
+	_, err := s.session.Collection(collectionKey).InsertMany(ctx, docs, opts)
+	if err == nil {
+		return nil
+	}
+	bwe, ok := err.(mongo.BulkWriteException)
+	if !ok || bwe.WriteConcernError != nil {
 		return err
 	}
-	if !key.Issued {
-		return errors.New("the key was not issued")
+	for _, we := range bwe.WriteErrors {
+		if we.Index < 0 || we.Index >= len(keys) {
+			continue
+		}
+		if we.Code == duplicateKeyCode {
+			errs[we.Index] = ErrDuplicate
+		} else {
+			errs[we.Index] = we
+		}
 	}
-	if key.Canceled {
-		return errors.New("the key has already been canceled")
+	return nil
+}
+
+// insertNew inserts the keys which do not exist yet in the context tenant
+// and sets ErrDuplicate for the rest. A failed write aborts a transaction, so the existing
+// keys are looked up rather than rejected by the unique index.
+func (s *Storage) insertNew(ctx context.Context, keys []*types.Key, errs []error) error {
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		ids[i] = key.ID
 	}
-	_, err = s.session.Collection(collectionKey).UpdateOne(context.TODO(), bson.M{"id": id}, bson.M{"$set": bson.M{"canceled": true}})
+	opts := options.Find().SetProjection(bson.M{"id": 1, "_id": 0})
+	filter := bson.M{"tenant_id": tenantFilter(ctx), "id": bson.M{"$in": ids}}
+	cursor, err := s.session.Collection(collectionKey).Find(ctx, filter, opts)
 	if err != nil {
 		return err
 	}
-	return nil
+	var existing []struct {
+		ID string `bson:"id"`
+	}
+	if err := cursor.All(ctx, &existing); err != nil {
+		return err
+	}
+	seen := make(map[string]bool, len(keys))
+	for _, e := range existing {
+		seen[e.ID] = true
+	}
+	var docs []interface{}
+	for i, key := range keys {
+		if seen[key.ID] {
+			errs[i] = ErrDuplicate
+			continue
+		}
+		seen[key.ID] = true
+		docs = append(docs, key)
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+	_, err = s.session.Collection(collectionKey).InsertMany(ctx, docs)
+	return err
 }
 
-// VerificationKey return key info
-func (s *Storage) VerificationKey(ctx context.Context, id string) (*types.Key, error) {
+// GetKey returns an available key of the context tenant pool that is not
+// expired and marks it as issued. An empty pool selects the keys out of any pool.
+// The key is found and updated in a single atomic find-and-modify,
+// so every key is handed out at most once.
+// The optional issuance is stored with the key.
+// ErrQuotaExceeded is returned if the pool has issued all the allowed keys.
+func (s *Storage) GetKey(ctx context.Context, pool string, issuance *types.Issuance) (*types.Key, error) {
+	tenant := types.TenantFromContext(ctx)
+	if err := s.reservePoolIssue(ctx, tenant, pool); err != nil {
+		return nil, err
+	}
+
+	now := auditTime()
+	filter := transitionFilter(types.StatusIssued, now)
+	filter["tenant_id"] = absentIfEmpty(tenant)
+	filter["pool_id"] = absentIfEmpty(pool)
+	set := statusUpdate(types.StatusIssued, now)
+	if issuance != nil {
+		if issuance.Recipient != "" {
+			set["recipient"] = issuance.Recipient
+		}
+		if len(issuance.Metadata) > 0 {
+			set["metadata"] = issuance.Metadata
+		}
+	}
+	update := bson.M{"$set": set}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+
 	var key *types.Key
-	err := s.session.Collection(collectionKey).FindOne(context.TODO(), bson.M{"id": id}).Decode(&key)
+	err := s.inTransaction(ctx, func(ctx context.Context) error {
+		var before *types.Key
+		err := s.session.Collection(collectionKey).FindOneAndUpdate(ctx, filter, update, opts).Decode(&before)
+		if err != nil {
+			return notFoundErr(err)
+		}
+		after := *before
+		after.SetStatus(types.StatusIssued, now)
+		if issuance != nil {
+			if issuance.Recipient != "" {
+				after.Recipient = issuance.Recipient
+			}
+			if len(issuance.Metadata) > 0 {
+				after.Metadata = issuance.Metadata
+			}
+		}
+		key = &after
+		return s.recordChanges(ctx, types.NewAuditRecord(ctx, types.AuditIssued, before, key, now))
+	})
 	if err != nil {
+		s.releasePoolIssue(tenant, pool)
 		return nil, err
 	}
 	return key, nil
 }
 
-// UnreleasedKey return list unreleased key
-func (s *Storage) UnreleasedKey(ctx context.Context) ([]*types.Key, error) {
-	filter := bson.M{"issued": false}
-	cursor, err := s.session.Collection(collectionKey).Find(context.TODO(), filter)
+// sweepBatchSize is the number of keys marked expired in a single transaction.
+const sweepBatchSize = 1000
+
+// SweepExpired marks the keys of all tenants past their expiry
+// time as expired and returns the number of marked keys.
+func (s *Storage) SweepExpired(ctx context.Context) (int, error) {
+	n := 0
+	for {
+		marked, err := s.sweepBatch(ctx)
+		n += marked
+		if err != nil || marked < sweepBatchSize {
+			return n, err
+		}
+	}
+}
+
+// sweepBatch marks a batch of expired keys and returns the number of marked keys.
+func (s *Storage) sweepBatch(ctx context.Context) (int, error) {
+	now := auditTime()
+	filter := transitionFilter(types.StatusExpired, now)
+	n := 0
+	err := s.inTransaction(ctx, func(ctx context.Context) error {
+		n = 0
+		cursor, err := s.session.Collection(collectionKey).Find(ctx, filter, options.Find().SetLimit(sweepBatchSize))
+		if err != nil {
+			return err
+		}
+		var keys []*types.Key
+		if err := cursor.All(ctx, &keys); err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		ids := make([]string, len(keys))
+		records := make([]*types.AuditRecord, len(keys))
+		for i, key := range keys {
+			ids[i] = key.ID
+			after := *key
+			after.SetStatus(types.StatusExpired, now)
+			records[i] = types.NewAuditRecord(ctx, types.AuditExpired, key, &after, now)
+		}
+		batch := transitionFilter(types.StatusExpired, now)
+		batch["id"] = bson.M{"$in": ids}
+		update := bson.M{"$set": statusUpdate(types.StatusExpired, now)}
+		if _, err := s.session.Collection(collectionKey).UpdateMany(ctx, batch, update); err != nil {
+			return err
+		}
+		n = len(keys)
+		return s.recordChanges(ctx, records...)
+	})
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	var listKey []*types.Key
-	for cursor.Next(context.TODO()) {
-		var key *types.Key
-		err := cursor.Decode(&key)
+	return n, nil
+}
+
+// CanceledKey marks an issued key with given id as canceled.
+func (s *Storage) CanceledKey(ctx context.Context, id string) (*types.Key, error) {
+	return s.transitionKey(ctx, id, types.StatusCanceled, nil, nil)
+}
+
+// RedeemKey marks an issued, valid key with the given id as redeemed.
+func (s *Storage) RedeemKey(ctx context.Context, id, redeemer string) (*types.Key, error) {
+	if redeemer == "" {
+		return s.transitionKey(ctx, id, types.StatusRedeemed, nil, nil)
+	}
+	return s.transitionKey(ctx, id, types.StatusRedeemed, bson.M{"redeemed_by": redeemer}, func(key *types.Key) {
+		key.RedeemedBy = redeemer
+	})
+}
+
+// RevokeKey marks a key with the given id as revoked.
+func (s *Storage) RevokeKey(ctx context.Context, id string) (*types.Key, error) {
+	return s.transitionKey(ctx, id, types.StatusRevoked, nil, nil)
+}
+
+// transitionKey moves a key of the context tenant with the given id to the
+// given status and sets the additional fields, which apply sets to the
+// returned key. The key is checked and updated in a single atomic
+// find-and-modify, so concurrent transitions of the same key never both succeed.
+func (s *Storage) transitionKey(ctx context.Context, id string, to types.KeyStatus, set bson.M, apply func(key *types.Key)) (*types.Key, error) {
+	now := auditTime()
+	filter := transitionFilter(to, now)
+	filter["id"] = id
+	filter["tenant_id"] = tenantFilter(ctx)
+	update := statusUpdate(to, now)
+	for k, v := range set {
+		update[k] = v
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+
+	var key *types.Key
+	err := s.inTransaction(ctx, func(ctx context.Context) error {
+		var before *types.Key
+		err := s.session.Collection(collectionKey).FindOneAndUpdate(ctx, filter, bson.M{"$set": update}, opts).Decode(&before)
+		if err == mongo.ErrNoDocuments {
+			return s.transitionErr(ctx, id, to, now)
+		}
 		if err != nil {
-			return nil, err
+			return err
+		}
+		after := *before
+		after.SetStatus(to, now)
+		if apply != nil {
+			apply(&after)
 		}
-		listKey = append(listKey, key)
+		key = &after
+		return s.recordChanges(ctx, types.NewAuditRecord(ctx, types.TransitionAction(to), before, key, now))
+	})
+	if err != nil {
+		return nil, err
 	}
-	if len(listKey) == 0 {
-		return nil, mongo.ErrNoDocuments
+	return key, nil
+}
+
+// transitionErr finds out why a key of the context tenant with the
+// given id may not move to the status.
+func (s *Storage) transitionErr(ctx context.Context, id string, to types.KeyStatus, now time.Time) error {
+	var key *types.Key
+	err := s.session.Collection(collectionKey).FindOne(ctx, keyFilter(ctx, id)).Decode(&key)
+	if err != nil {
+		return notFoundErr(err)
+	}
+	if err := TransitionErr(key, to, now); err != nil {
+		return err
+	}
+	// The key has been changed concurrently between the two queries.
+	return errConcurrentUpdate
+}
+
+// statusTimeFields maps key statuses to the transition time fields.
+var statusTimeFields = map[types.KeyStatus]string{
+	types.StatusAvailable: "created_at",
+	types.StatusIssued:    "issued_at",
+	types.StatusRedeemed:  "redeemed_at",
+	types.StatusCanceled:  "canceled_at",
+	types.StatusExpired:   "expired_at",
+	types.StatusRevoked:   "revoked_at",
+}
+
+// statusUpdate returns the fields to set when a key moves to the given status.
+func statusUpdate(to types.KeyStatus, now time.Time) bson.M {
+	return bson.M{
+		"status":             to,
+		statusTimeFields[to]: now,
+	}
+}
+
+// transitionFilter returns a filter matching the keys that may move
+// to the given status at the given time, as TransitionErr does.
+func transitionFilter(to types.KeyStatus, now time.Time) bson.M {
+	filter := bson.M{"status": bson.M{"$in": types.TransitionSources(to)}}
+	var and []bson.M
+	switch to {
+	case types.StatusExpired:
+		filter["expires_at"] = bson.M{"$lte": now}
+	case types.StatusRevoked:
+	default:
+		// Keys past their expiry time are expired even if not marked yet.
+		and = append(and, bson.M{"$or": []bson.M{{"expires_at": nil}, {"expires_at": bson.M{"$gt": now}}}})
+	}
+	if to == types.StatusRedeemed {
+		and = append(and, bson.M{"$or": []bson.M{{"not_before": nil}, {"not_before": bson.M{"$lte": now}}}})
+	}
+	if len(and) > 0 {
+		filter["$and"] = and
+	}
+	return filter
+}
+
+// VerificationKey return key info of the context tenant and records the verification.
+func (s *Storage) VerificationKey(ctx context.Context, id string) (*types.Key, error) {
+	var key *types.Key
+	err := s.session.Collection(collectionKey).FindOne(ctx, keyFilter(ctx, id)).Decode(&key)
+	if err != nil {
+		return nil, notFoundErr(err)
+	}
+	s.insertVerification(ctx, types.NewAuditRecord(ctx, types.AuditVerified, nil, key, auditTime()))
+	return key, nil
+}
+
+// keyFilter returns a filter matching the context tenant key with the given id.
+func keyFilter(ctx context.Context, id string) bson.M {
+	return bson.M{"id": id, "tenant_id": tenantFilter(ctx)}
+}
+
+// tenantFilter returns the filter value matching the documents of the
+// context tenant. Documents of the default tenant have no tenant_id field.
+func tenantFilter(ctx context.Context) interface{} {
+	return absentIfEmpty(types.TenantFromContext(ctx))
+}
+
+// absentIfEmpty returns the filter value matching the given string field
+// value. Empty values are omitted on insertion, so they match a missing field.
+func absentIfEmpty(v string) interface{} {
+	if v == "" {
+		return nil
 	}
-	return listKey, nil
+	return v
 }
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/evgeny08/collection-key/types"
+)
+
+// KeyStats counts the context tenant keys of the pool by status, and the
+// keys issued since each of the given times. A nil pool selects all keys
+// and an empty pool the keys out of any pool. The counts are computed by
+// a single aggregation covered by an index.
+func (s *Storage) KeyStats(ctx context.Context, pool *string, issuedSince []time.Time) (*types.KeyStats, error) {
+	match := bson.M{"tenant_id": tenantFilter(ctx)}
+	if pool != nil {
+		match["pool_id"] = absentIfEmpty(*pool)
+	}
+	group := bson.M{"_id": "$status", "count": bson.M{"$sum": 1}}
+	for i, since := range issuedSince {
+		// A missing issue time sorts before any time.
+		issued := bson.M{"$gte": []interface{}{"$issued_at", since}}
+		group[issuedField(i)] = bson.M{"$sum": bson.M{"$cond": []interface{}{issued, 1, 0}}}
+	}
+	pipeline := []bson.M{{"$match": match}, {"$group": group}}
+
+	cursor, err := s.session.Collection(collectionKey).Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	stats := &types.KeyStats{Statuses: make(map[types.KeyStatus]int64)}
+	for _, since := range issuedSince {
+		stats.Issuance = append(stats.Issuance, &types.IssuanceRate{Since: since})
+	}
+	for cursor.Next(ctx) {
+		var doc bson.M
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		status, _ := doc["_id"].(string)
+		count := toInt64(doc["count"])
+		stats.Statuses[types.KeyStatus(status)] += count
+		stats.Total += count
+		for i, rate := range stats.Issuance {
+			rate.Issued += toInt64(doc[issuedField(i)])
+		}
+	}
+	return stats, cursor.Err()
+}
+
+func issuedField(i int) string {
+	return fmt.Sprintf("issued_%d", i)
+}
+
+// toInt64 converts an aggregated count to int64.
+func toInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	case float64:
+		return int64(n)
+	}
+	return 0
+}
@@ -3,7 +3,10 @@ package storage
 import (
 	"context"
 	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2/bson"
 	"sync"
 	"time"
 
@@ -11,10 +14,22 @@ import (
 	"github.com/go-kit/kit/log/level"
 
 	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/evgeny08/collection-key/types"
 )
 
 const (
-	collectionKey = "collection_key"
+	collectionKey    = "collection_key"
+	collectionPool   = "collection_pool"
+	collectionTenant = "collection_tenant"
+	collectionAPIKey = "collection_api_key"
+
+	collectionIdempotency = "collection_idempotency"
+	collectionAudit       = "collection_audit"
+	collectionAuditHead   = "collection_audit_head"
+	collectionWebhook     = "collection_webhook"
+	collectionDelivery    = "collection_delivery"
+	collectionOutbox      = "collection_outbox"
 )
 
 // Storage stores keys.
@@ -26,10 +41,13 @@ type Storage struct {
 	mu      sync.RWMutex
 	session *mongo.Database
 	lastErr error
+	// transactions reports whether the deployment supports transactions.
+	transactions bool
 
-	ctx    context.Context
-	cancel context.CancelFunc
-	donec  chan struct{}
+	ctx       context.Context
+	cancel    context.CancelFunc
+	donec     chan struct{}
+	sweepDone chan struct{}
 }
 
 // Config is a storage configuration.
@@ -37,10 +55,60 @@ type Config struct {
 	URL    string
 	Logger log.Logger
 	DBName string
+	// SweepInterval is an interval of marking expired keys.
+	// Zero disables the sweeper.
+	SweepInterval time.Duration
 }
 
 // New creates a new MongoDB storage using the given configuration.
 func New(cfg *Config) (*Storage, error) {
+	s, err := dial(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.migrateKeyIndexes()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.ensureIndexes()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.detectTransactions(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.migrateStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.SweepInterval > 0 {
+		go s.sweepLoop(cfg.SweepInterval)
+	} else {
+		close(s.sweepDone)
+	}
+	return s, nil
+}
+
+// Open connects to the storage without writing to it: the indexes are not
+// ensured, the keys are not migrated and the sweeper is not started.
+// It is meant for the read-only tools such as the audit verification.
+func Open(cfg *Config) (*Storage, error) {
+	s, err := dial(cfg)
+	if err != nil {
+		return nil, err
+	}
+	close(s.sweepDone)
+	return s, nil
+}
+
+// dial creates a storage connected to the database.
+func dial(cfg *Config) (*Storage, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	s := &Storage{
@@ -48,18 +116,261 @@ func New(cfg *Config) (*Storage, error) {
 		dbName: cfg.DBName,
 		logger: cfg.Logger,
 
-		ctx:    ctx,
-		cancel: cancel,
-		donec:  make(chan struct{}),
+		ctx:       ctx,
+		cancel:    cancel,
+		donec:     make(chan struct{}),
+		sweepDone: make(chan struct{}),
 	}
 
 	err := s.connect(cfg)
 	if err != nil {
-		return nil, level.Error(s.logger).Log("msg", "failed to connect mongodb", "error:", err)
+		cancel()
+		level.Error(s.logger).Log("msg", "failed to connect mongodb", "error:", err)
+		return nil, err
 	}
 	return s, nil
 }
 
+// migrateStatus sets the status of the keys stored before the status
+// was introduced from the legacy issued, canceled, expired and redeemed flags.
+func (s *Storage) migrateStatus() error {
+	ctx, cancel := context.WithTimeout(s.ctx, 5*time.Minute)
+	defer cancel()
+
+	// The order matters: a legacy key may have several flags set.
+	migrations := []struct {
+		flag   string
+		status types.KeyStatus
+	}{
+		{"canceled", types.StatusCanceled},
+		{"redeemed", types.StatusRedeemed},
+		{"expired", types.StatusExpired},
+		{"issued", types.StatusIssued},
+		{"", types.StatusAvailable},
+	}
+	unset := bson.M{"issued": "", "canceled": "", "expired": "", "redeemed": ""}
+	for _, m := range migrations {
+		filter := bson.M{"status": bson.M{"$exists": false}}
+		if m.flag != "" {
+			filter[m.flag] = true
+		}
+		update := bson.M{"$set": bson.M{"status": m.status}, "$unset": unset}
+		res, err := s.session.Collection(collectionKey).UpdateMany(ctx, filter, update)
+		if err != nil {
+			return fmt.Errorf("failed to migrate key status: %v", err)
+		}
+		if res.ModifiedCount > 0 {
+			level.Info(s.logger).Log("msg", "migrated key status", "status", m.status, "count", res.ModifiedCount)
+		}
+	}
+	return nil
+}
+
+// migrateKeyIndexes drops the key indexes replaced by the unique index of
+// the key IDs per tenant: the unique index of the key IDs across all tenants
+// and the key listing index of the same fields.
+func (s *Storage) migrateKeyIndexes() error {
+	ctx, cancel := context.WithTimeout(s.ctx, 30*time.Second)
+	defer cancel()
+
+	indexes := s.session.Collection(collectionKey).Indexes()
+	cursor, err := indexes.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list key indexes: %v", err)
+	}
+	var specs []struct {
+		Name   string `bson:"name"`
+		Unique bool   `bson:"unique"`
+	}
+	if err := cursor.All(ctx, &specs); err != nil {
+		return fmt.Errorf("failed to list key indexes: %v", err)
+	}
+	for _, spec := range specs {
+		if spec.Name != "id_1" && (spec.Name != "tenant_id_1_id_1" || spec.Unique) {
+			continue
+		}
+		if _, err := indexes.DropOne(ctx, spec.Name); err != nil {
+			return fmt.Errorf("failed to drop key index %s: %v", spec.Name, err)
+		}
+		level.Info(s.logger).Log("msg", "dropped key index", "index", spec.Name)
+	}
+	return nil
+}
+
+// sweepLoop periodically marks expired keys until the storage is shut down.
+func (s *Storage) sweepLoop(interval time.Duration) {
+	defer close(s.sweepDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n, err := s.SweepExpired(s.ctx)
+		if err != nil {
+			level.Error(s.logger).Log("msg", "failed to mark expired keys", "err", err)
+			continue
+		}
+		if n > 0 {
+			level.Info(s.logger).Log("msg", "marked expired keys", "count", n)
+		}
+	}
+}
+
+// ensureIndexes creates the collection indexes if they do not exist.
+func (s *Storage) ensureIndexes() error {
+	ctx, cancel := context.WithTimeout(s.ctx, 30*time.Second)
+	defer cancel()
+
+	_, err := s.session.Collection(collectionKey).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		// Key IDs are unique per tenant. The index
+		// also covers the key listing by ID.
+		{
+			Keys:    primitive.D{{Key: "tenant_id", Value: 1}, {Key: "id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.M{"status": 1},
+		},
+		{
+			Keys: primitive.D{{Key: "tenant_id", Value: 1}, {Key: "pool_id", Value: 1}, {Key: "status", Value: 1}},
+		},
+		{
+			Keys: bson.M{"expires_at": 1},
+		},
+		{
+			Keys:    primitive.D{{Key: "tenant_id", Value: 1}, {Key: "recipient", Value: 1}},
+			Options: options.Index().SetSparse(true),
+		},
+		// Covers the key statistics aggregation.
+		{
+			Keys: primitive.D{{Key: "tenant_id", Value: 1}, {Key: "pool_id", Value: 1}, {Key: "status", Value: 1}, {Key: "issued_at", Value: 1}},
+		},
+		// Key listing orders.
+		{
+			Keys: primitive.D{{Key: "tenant_id", Value: 1}, {Key: "created_at", Value: 1}, {Key: "id", Value: 1}},
+		},
+		{
+			Keys: primitive.D{{Key: "tenant_id", Value: 1}, {Key: "issued_at", Value: 1}, {Key: "id", Value: 1}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create indexes: %v", err)
+	}
+
+	_, err = s.session.Collection(collectionPool).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    primitive.D{{Key: "tenant_id", Value: 1}, {Key: "id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create pool indexes: %v", err)
+	}
+
+	_, err = s.session.Collection(collectionTenant).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"id": 1},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create tenant indexes: %v", err)
+	}
+
+	_, err = s.session.Collection(collectionAPIKey).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.M{"hash": 1},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    primitive.D{{Key: "tenant_id", Value: 1}, {Key: "id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create API key indexes: %v", err)
+	}
+
+	_, err = s.session.Collection(collectionIdempotency).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    primitive.D{{Key: "tenant_id", Value: 1}, {Key: "key", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.M{"expires_at": 1},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create idempotency indexes: %v", err)
+	}
+
+	_, err = s.session.Collection(collectionAudit).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: primitive.D{{Key: "tenant_id", Value: 1}, {Key: "key_id", Value: 1}, {Key: "at", Value: 1}},
+		},
+		// Audit chain walk.
+		{
+			Keys: primitive.D{{Key: "tenant_id", Value: 1}, {Key: "pool_id", Value: 1}, {Key: "seq", Value: 1}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create audit indexes: %v", err)
+	}
+
+	_, err = s.session.Collection(collectionAuditHead).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    primitive.D{{Key: "tenant_id", Value: 1}, {Key: "pool_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create audit head indexes: %v", err)
+	}
+
+	_, err = s.session.Collection(collectionWebhook).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    primitive.D{{Key: "tenant_id", Value: 1}, {Key: "id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create webhook indexes: %v", err)
+	}
+
+	_, err = s.session.Collection(collectionDelivery).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.M{"id": 1},
+			Options: options.Index().SetUnique(true),
+		},
+		// Delivery queue.
+		{
+			Keys: primitive.D{{Key: "status", Value: 1}, {Key: "next_attempt_at", Value: 1}},
+		},
+		{
+			Keys: primitive.D{{Key: "tenant_id", Value: 1}, {Key: "status", Value: 1}, {Key: "created_at", Value: 1}},
+		},
+		// The delivered events are kept for a week, the dead ones until retried.
+		{
+			Keys:    bson.M{"delivered_at": 1},
+			Options: options.Index().SetExpireAfterSeconds(deliveredRetention),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create delivery indexes: %v", err)
+	}
+
+	_, err = s.session.Collection(collectionOutbox).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.M{"event.id": 1},
+			Options: options.Index().SetUnique(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create outbox indexes: %v", err)
+	}
+	return nil
+}
+
+// deliveredRetention is how long the delivered events are kept, in seconds.
+const deliveredRetention = 7 * 24 * 60 * 60
+
 func (s *Storage) connect(cfg *Config) error {
 	defer close(s.donec)
 	for {
@@ -69,8 +380,9 @@ func (s *Storage) connect(cfg *Config) error {
 			return nil
 		default:
 		}
-		ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		session, err := mongo.Connect(ctx, options.Client().ApplyURI(cfg.URL))
+		cancel()
 		if err != nil {
 			return err
 		}
@@ -96,6 +408,9 @@ func (s *Storage) connect(cfg *Config) error {
 
 // Shutdown close mongo session
 func (s *Storage) Shutdown() {
+	// Stop the sweeper.
+	s.cancel()
+	<-s.sweepDone
 
 	// Close mongo session.
 	if s.session != nil {
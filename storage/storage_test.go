@@ -0,0 +1,71 @@
+package storage_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/evgeny08/collection-key/httpserver"
+	"github.com/evgeny08/collection-key/storage"
+	"github.com/evgeny08/collection-key/storage/storagetest"
+	"github.com/evgeny08/collection-key/types"
+)
+
+// newTestStorage connects to the test MongoDB given by KEY_TEST_MONGO_URL
+// with a new database. The test is skipped if the URL is not set.
+func newTestStorage(t *testing.T) (*storage.Storage, func()) {
+	mongoURL := os.Getenv("KEY_TEST_MONGO_URL")
+	if mongoURL == "" {
+		t.Skip("KEY_TEST_MONGO_URL is not set")
+	}
+	s, err := storage.New(&storage.Config{
+		URL:    mongoURL,
+		DBName: fmt.Sprintf("collection-key-test-%d", time.Now().UnixNano()),
+		Logger: log.NewNopLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, func() {
+		s.Drop()
+		s.Shutdown()
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) (httpserver.Storage, func()) {
+		return newTestStorage(t)
+	})
+}
+
+func TestAuditInsertFailure(t *testing.T) {
+	s, cleanup := newTestStorage(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	if err := s.RejectAudit(true); err != nil {
+		t.Fatal(err)
+	}
+	// Outside of a transaction the key is inserted without its audit
+	// record, in a transaction the insertion fails.
+	s.InsertKey(ctx, &types.Key{ID: "key-0", Status: types.StatusAvailable})
+	if err := s.RejectAudit(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.InsertKey(ctx, &types.Key{ID: "key-1", Status: types.StatusAvailable}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The chain does not end at the record never written.
+	res, err := s.VerifyAuditChain(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Break != nil || res.Records != 1 {
+		t.Fatalf("got audit verification %+v break %+v want one intact record", res, res.Break)
+	}
+}
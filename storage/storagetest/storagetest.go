@@ -0,0 +1,1592 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/evgeny08/collection-key/httpserver"
+	"github.com/evgeny08/collection-key/storage"
+	"github.com/evgeny08/collection-key/types"
+)
+
+// Factory creates a new empty storage for a single test
+// and returns a function releasing it.
+type Factory func(t *testing.T) (httpserver.Storage, func())
+
+// Run runs the storage conformance suite against the storage
+// created by the given factory.
+func Run(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s httpserver.Storage)
+	}{
+		{"InsertKey", testInsertKey},
+		{"InsertKeys", testInsertKeys},
+		{"ImportKeys", testImportKeys},
+		{"GetKey", testGetKey},
+		{"GetKeyConcurrent", testGetKeyConcurrent},
+		{"GetKeySkipsExpired", testGetKeySkipsExpired},
+		{"CanceledKey", testCanceledKey},
+		{"RedeemKey", testRedeemKey},
+		{"RevokeKey", testRevokeKey},
+		{"VerificationKey", testVerificationKey},
+		{"VerificationKeyConcurrent", testVerificationKeyConcurrent},
+		{"KeyHistory", testKeyHistory},
+		{"ListKeys", testListKeys},
+		{"ListKeysPaging", testListKeysPaging},
+		{"ExportKeys", testExportKeys},
+		{"KeyStats", testKeyStats},
+		{"Pools", testPools},
+		{"PoolIsolation", testPoolIsolation},
+		{"PoolQuotas", testPoolQuotas},
+		{"TenantIsolation", testTenantIsolation},
+		{"TenantKeyIDs", testTenantKeyIDs},
+		{"Tenants", testTenants},
+		{"APIKeys", testAPIKeys},
+		{"Idempotency", testIdempotency},
+		{"Recipient", testRecipient},
+		{"Webhooks", testWebhooks},
+		{"Deliveries", testDeliveries},
+		{"Outbox", testOutbox},
+		{"WatchKeys", testWatchKeys},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			s, release := factory(t)
+			defer release()
+			tt.fn(t, s)
+		})
+	}
+}
+
+func testInsertKey(t *testing.T, s httpserver.Storage) {
+	ctx := context.Background()
+	key := &types.Key{ID: "key-1", Status: types.StatusAvailable, BatchID: "batch-1"}
+	if err := s.InsertKey(ctx, key); err != nil {
+		t.Fatalf("insert key: %v", err)
+	}
+
+	got, err := s.VerificationKey(ctx, key.ID)
+	if err != nil {
+		t.Fatalf("verification key: %v", err)
+	}
+	if !reflect.DeepEqual(got, key) {
+		t.Fatalf("got key %#v want %#v", got, key)
+	}
+
+	err = s.InsertKey(ctx, &types.Key{ID: "key-1", Status: types.StatusAvailable})
+	if err != storage.ErrDuplicate {
+		t.Fatalf("insert duplicate key: got error %v want %v", err, storage.ErrDuplicate)
+	}
+}
+
+func testInsertKeys(t *testing.T, s httpserver.Storage) {
+	ctx := context.Background()
+	n, err := s.InsertKeys(ctx, seedKeys(3))
+	if err != nil || n != 3 {
+		t.Fatalf("insert keys: got %d, %v want 3, nil", n, err)
+	}
+
+	keys := seedKeys(3)
+	keys[0].ID = "key-new"
+	n, err = s.InsertKeys(ctx, keys)
+	if err != storage.ErrDuplicate {
+		t.Fatalf("insert duplicate keys: got error %v want %v", err, storage.ErrDuplicate)
+	}
+	if n != 1 {
+		t.Fatalf("insert duplicate keys: got %d inserted want 1", n)
+	}
+	if _, err := s.VerificationKey(ctx, "key-new"); err != nil {
+		t.Fatalf("verification key: %v", err)
+	}
+}
+
+func testImportKeys(t *testing.T, s httpserver.Storage) {
+	ctx := context.Background()
+	insertKeys(t, s, seedKeys(2))
+
+	keys := seedKeys(3)
+	keys[0].ID = "key-a"
+	keys[2].ID = "key-b"
+	errs, err := s.ImportKeys(ctx, keys)
+	if err != nil {
+		t.Fatalf("import keys: %v", err)
+	}
+	want := []error{nil, storage.ErrDuplicate, nil}
+	if len(errs) != len(want) {
+		t.Fatalf("got %d errors want %d", len(errs), len(want))
+	}
+	for i := range want {
+		if errs[i] != want[i] {
+			t.Fatalf("key %s: got error %v want %v", keys[i].ID, errs[i], want[i])
+		}
+	}
+	for _, id := range []string{"key-a", "key-b"} {
+		if _, err := s.VerificationKey(ctx, id); err != nil {
+			t.Fatalf("verification of imported key %s: %v", id, err)
+		}
+	}
+
+	if err := s.CreatePool(ctx, &types.Pool{ID: "small", MaxKeys: 1}); err != nil {
+		t.Fatalf("create pool: %v", err)
+	}
+	pooled := seedKeys(2)
+	for i, key := range pooled {
+		key.ID = fmt.Sprintf("pooled-%d", i)
+		key.PoolID = "small"
+	}
+	if _, err := s.ImportKeys(ctx, pooled); err != storage.ErrQuotaExceeded {
+		t.Fatalf("import keys over quota: got error %v want %v", err, storage.ErrQuotaExceeded)
+	}
+}
+
+func testGetKey(t *testing.T, s httpserver.Storage) {
+	ctx := context.Background()
+	insertKeys(t, s, seedKeys(3))
+
+	issued := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		key, err := s.GetKey(ctx, "", nil)
+		if err != nil {
+			t.Fatalf("get key: %v", err)
+		}
+		if key.Status != types.StatusIssued || key.IssuedAt == nil {
+			t.Fatalf("got key %#v not marked as issued", key)
+		}
+		if issued[key.ID] {
+			t.Fatalf("key %q issued twice", key.ID)
+		}
+		issued[key.ID] = true
+
+		stored, err := s.VerificationKey(ctx, key.ID)
+		if err != nil {
+			t.Fatalf("verification key: %v", err)
+		}
+		if stored.Status != types.StatusIssued {
+			t.Fatalf("stored key %#v not marked as issued", stored)
+		}
+	}
+
+	_, err := s.GetKey(ctx, "", nil)
+	if err != storage.ErrNotFound {
+		t.Fatalf("get key from empty stock: got error %v want %v", err, storage.ErrNotFound)
+	}
+}
+
+func testGetKeyConcurrent(t *testing.T, s httpserver.Storage) {
+	const (
+		numKeys    = 100
+		numWorkers = 20
+	)
+	insertKeys(t, s, seedKeys(numKeys))
+
+	var (
+		mu     sync.Mutex
+		issued = make(map[string]int)
+		wg     sync.WaitGroup
+	)
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				key, err := s.GetKey(context.Background(), "", nil)
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				issued[key.ID]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for id, n := range issued {
+		if n != 1 {
+			t.Errorf("key %q issued %d times", id, n)
+		}
+	}
+	if len(issued) != numKeys {
+		t.Fatalf("got %d issued keys want %d", len(issued), numKeys)
+	}
+}
+
+func testGetKeySkipsExpired(t *testing.T, s httpserver.Storage) {
+	ctx := context.Background()
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	insertKeys(t, s, []*types.Key{
+		{ID: "expired", Status: types.StatusAvailable, ExpiresAt: &past},
+		{ID: "valid", Status: types.StatusAvailable, ExpiresAt: &future},
+	})
+
+	key, err := s.GetKey(ctx, "", nil)
+	if err != nil {
+		t.Fatalf("get key: %v", err)
+	}
+	if key.ID != "valid" {
+		t.Fatalf("got key %q want %q", key.ID, "valid")
+	}
+
+	_, err = s.GetKey(ctx, "", nil)
+	if err != storage.ErrNotFound {
+		t.Fatalf("get key from expired stock: got error %v want %v", err, storage.ErrNotFound)
+	}
+}
+
+func testCanceledKey(t *testing.T, s httpserver.Storage) {
+	ctx := context.Background()
+	insertKeys(t, s, seedKeys(1))
+
+	_, err := s.CanceledKey(ctx, "unknown")
+	if err != storage.ErrNotFound {
+		t.Fatalf("cancel unknown key: got error %v want %v", err, storage.ErrNotFound)
+	}
+
+	_, err = s.CanceledKey(ctx, "key-0")
+	if err != storage.ErrNotIssued {
+		t.Fatalf("cancel not issued key: got error %v want %v", err, storage.ErrNotIssued)
+	}
+
+	if _, err := s.GetKey(ctx, "", nil); err != nil {
+		t.Fatalf("get key: %v", err)
+	}
+	canceled, err := s.CanceledKey(ctx, "key-0")
+	if err != nil {
+		t.Fatalf("cancel issued key: %v", err)
+	}
+
+	key, err := s.VerificationKey(ctx, "key-0")
+	if err != nil {
+		t.Fatalf("verification key: %v", err)
+	}
+	if key.Status != types.StatusCanceled || key.IssuedAt == nil || key.CanceledAt == nil {
+		t.Fatalf("got key %#v want issued and canceled", key)
+	}
+	if !reflect.DeepEqual(canceled, key) {
+		t.Fatalf("got canceled key %#v want %#v", canceled, key)
+	}
+
+	_, err = s.CanceledKey(ctx, "key-0")
+	if err != storage.ErrAlreadyCanceled {
+		t.Fatalf("cancel canceled key: got error %v want %v", err, storage.ErrAlreadyCanceled)
+	}
+}
+
+func testRedeemKey(t *testing.T, s httpserver.Storage) {
+	ctx := context.Background()
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	insertKeys(t, s, []*types.Key{
+		{ID: "key", Status: types.StatusIssued},
+		{ID: "not-issued", Status: types.StatusAvailable},
+		{ID: "canceled", Status: types.StatusCanceled},
+		{ID: "expired", Status: types.StatusIssued, ExpiresAt: &past},
+		{ID: "not-yet-valid", Status: types.StatusIssued, NotBefore: &future},
+		{ID: "revoked", Status: types.StatusRevoked},
+	})
+
+	testCases := []struct {
+		id      string
+		wantErr error
+	}{
+		{"unknown", storage.ErrNotFound},
+		{"not-issued", storage.ErrNotIssued},
+		{"canceled", storage.ErrAlreadyCanceled},
+		{"expired", storage.ErrExpired},
+		{"not-yet-valid", storage.ErrNotYetValid},
+		{"revoked", storage.ErrAlreadyRevoked},
+	}
+	for _, tc := range testCases {
+		_, err := s.RedeemKey(ctx, tc.id, "")
+		if err != tc.wantErr {
+			t.Fatalf("redeem %s key: got error %v want %v", tc.id, err, tc.wantErr)
+		}
+	}
+
+	key, err := s.RedeemKey(ctx, "key", "customer-1")
+	if err != nil {
+		t.Fatalf("redeem key: %v", err)
+	}
+	if key.Status != types.StatusRedeemed || key.RedeemedAt == nil || key.RedeemedBy != "customer-1" {
+		t.Fatalf("got key %#v want redeemed by customer-1", key)
+	}
+
+	_, err = s.RedeemKey(ctx, "key", "customer-2")
+	if err != storage.ErrAlreadyRedeemed {
+		t.Fatalf("redeem redeemed key: got error %v want %v", err, storage.ErrAlreadyRedeemed)
+	}
+
+	stored, err := s.VerificationKey(ctx, "key")
+	if err != nil {
+		t.Fatalf("verification key: %v", err)
+	}
+	if stored.Status != types.StatusRedeemed || stored.RedeemedBy != "customer-1" {
+		t.Fatalf("got stored key %#v want redeemed by customer-1", stored)
+	}
+}
+
+func testRevokeKey(t *testing.T, s httpserver.Storage) {
+	ctx := context.Background()
+	insertKeys(t, s, []*types.Key{
+		{ID: "available", Status: types.StatusAvailable},
+		{ID: "redeemed", Status: types.StatusRedeemed},
+		{ID: "canceled", Status: types.StatusCanceled},
+	})
+
+	for _, id := range []string{"available", "redeemed"} {
+		key, err := s.RevokeKey(ctx, id)
+		if err != nil {
+			t.Fatalf("revoke %s key: %v", id, err)
+		}
+		if key.Status != types.StatusRevoked || key.RevokedAt == nil {
+			t.Fatalf("got key %#v want revoked", key)
+		}
+	}
+
+	_, err := s.RevokeKey(ctx, "available")
+	if err != storage.ErrAlreadyRevoked {
+		t.Fatalf("revoke revoked key: got error %v want %v", err, storage.ErrAlreadyRevoked)
+	}
+	_, err = s.RevokeKey(ctx, "canceled")
+	if err != storage.ErrAlreadyCanceled {
+		t.Fatalf("revoke canceled key: got error %v want %v", err, storage.ErrAlreadyCanceled)
+	}
+
+	// A revoked key is never issued.
+	_, err = s.GetKey(ctx, "", nil)
+	if err != storage.ErrNotFound {
+		t.Fatalf("get key: got error %v want %v", err, storage.ErrNotFound)
+	}
+}
+
+func testVerificationKey(t *testing.T, s httpserver.Storage) {
+	ctx := context.Background()
+	insertKeys(t, s, seedKeys(1))
+
+	key, err := s.VerificationKey(ctx, "key-0")
+	if err != nil {
+		t.Fatalf("verification key: %v", err)
+	}
+	if key.ID != "key-0" || key.Status != types.StatusAvailable {
+		t.Fatalf("got key %#v want new key-0", key)
+	}
+
+	_, err = s.VerificationKey(ctx, "unknown")
+	if err != storage.ErrNotFound {
+		t.Fatalf("verification unknown key: got error %v want %v", err, storage.ErrNotFound)
+	}
+}
+
+// auditVerifier is implemented by the storages verifying their audit chains.
+type auditVerifier interface {
+	VerifyAuditChain(ctx context.Context) (*types.AuditVerification, error)
+}
+
+func testVerificationKeyConcurrent(t *testing.T, s httpserver.Storage) {
+	const (
+		numKeys    = 5
+		numWorkers = 20
+	)
+	ctx := context.Background()
+	insertKeys(t, s, seedKeys(numKeys))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if _, err := s.VerificationKey(ctx, id); err != nil {
+				errs <- err
+			}
+		}(fmt.Sprintf("key-%d", i%numKeys))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("concurrent verification: %v", err)
+	}
+
+	records, err := s.KeyHistory(ctx, "key-0")
+	if err != nil {
+		t.Fatalf("key history: %v", err)
+	}
+	if len(records) != 1+numWorkers/numKeys {
+		t.Fatalf("got %d records want %d", len(records), 1+numWorkers/numKeys)
+	}
+	// The verifications are kept out of the pool chain.
+	for _, rec := range records[1:] {
+		if rec.Action != types.AuditVerified || rec.Seq != 0 || rec.Hash != "" {
+			t.Fatalf("got %s record with seq %d and hash %q want unchained verification", rec.Action, rec.Seq, rec.Hash)
+		}
+	}
+	if v, ok := s.(auditVerifier); ok {
+		res, err := v.VerifyAuditChain(ctx)
+		if err != nil {
+			t.Fatalf("verify audit chain: %v", err)
+		}
+		if res.Break != nil || res.Records != numKeys {
+			t.Fatalf("got break %+v after %d records want %d unbroken", res.Break, res.Records, numKeys)
+		}
+	}
+}
+
+func testKeyHistory(t *testing.T, s httpserver.Storage) {
+	ctx := types.WithTenant(context.Background(), "t1")
+	ctx = types.WithPrincipal(ctx, &types.Principal{Subject: "admin", Tenant: "t1", Roles: []types.Role{types.RoleAdmin}})
+	ctx = types.WithRequest(ctx, &types.RequestInfo{ID: "req-1", ClientIP: "10.0.0.1"})
+
+	if err := s.InsertKey(ctx, &types.Key{ID: "key", Status: types.StatusAvailable}); err != nil {
+		t.Fatalf("insert key: %v", err)
+	}
+	if _, err := s.GetKey(ctx, "", &types.Issuance{Recipient: "customer-1"}); err != nil {
+		t.Fatalf("get key: %v", err)
+	}
+	if _, err := s.RedeemKey(ctx, "key", "pos-1"); err != nil {
+		t.Fatalf("redeem key: %v", err)
+	}
+	if _, err := s.VerificationKey(ctx, "key"); err != nil {
+		t.Fatalf("verification key: %v", err)
+	}
+	// Failed operations are not recorded.
+	if _, err := s.RedeemKey(ctx, "key", "pos-2"); err != storage.ErrAlreadyRedeemed {
+		t.Fatalf("redeem redeemed key: got error %v want %v", err, storage.ErrAlreadyRedeemed)
+	}
+
+	records, err := s.KeyHistory(ctx, "key")
+	if err != nil {
+		t.Fatalf("key history: %v", err)
+	}
+	want := []struct {
+		action types.AuditAction
+		before types.KeyStatus
+		after  types.KeyStatus
+	}{
+		{types.AuditCreated, "", types.StatusAvailable},
+		{types.AuditIssued, types.StatusAvailable, types.StatusIssued},
+		{types.AuditRedeemed, types.StatusIssued, types.StatusRedeemed},
+		{types.AuditVerified, "", types.StatusRedeemed},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got %d records want %d", len(records), len(want))
+	}
+	for i, rec := range records {
+		w := want[i]
+		if rec.KeyID != "key" || rec.TenantID != "t1" || rec.Action != w.action {
+			t.Fatalf("record %d: got %s of key %s in tenant %q want %s of key in t1", i, rec.Action, rec.KeyID, rec.TenantID, w.action)
+		}
+		if rec.Actor != "admin" || rec.RequestID != "req-1" || rec.ClientIP != "10.0.0.1" {
+			t.Fatalf("record %d: got actor %q, request %q from %q want admin, req-1 from 10.0.0.1", i, rec.Actor, rec.RequestID, rec.ClientIP)
+		}
+		if (w.before == "") != (rec.Before == nil) || (rec.Before != nil && rec.Before.Status != w.before) {
+			t.Fatalf("record %d: got before %#v want status %q", i, rec.Before, w.before)
+		}
+		if rec.After == nil || rec.After.Status != w.after {
+			t.Fatalf("record %d: got after %#v want status %q", i, rec.After, w.after)
+		}
+		if rec.At.IsZero() || (i > 0 && rec.At.Before(records[i-1].At)) {
+			t.Fatalf("record %d: got time %v after %v", i, rec.At, records[i-1].At)
+		}
+		if rec.Action == types.AuditVerified {
+			if rec.Seq != 0 || rec.PrevHash != "" || rec.Hash != "" {
+				t.Fatalf("record %d: got verification with seq %d and hash %q, chained", i, rec.Seq, rec.Hash)
+			}
+			continue
+		}
+		// The key is the only one of the tenant, so its changes form the chain.
+		prevHash := ""
+		if i > 0 {
+			prevHash = records[i-1].Hash
+		}
+		if rec.Seq != int64(i+1) || rec.PrevHash != prevHash || rec.Hash != rec.ComputeHash() {
+			t.Fatalf("record %d: got seq %d linked to %q with hash %q, not chained", i, rec.Seq, rec.PrevHash, rec.Hash)
+		}
+	}
+	if records[1].After.Recipient != "customer-1" || records[2].After.RedeemedBy != "pos-1" {
+		t.Fatalf("got issued %#v and redeemed %#v want recipient and redeemer", records[1].After, records[2].After)
+	}
+
+	// Operations without a principal are performed by the system.
+	if err := s.InsertKey(context.Background(), &types.Key{ID: "other", Status: types.StatusAvailable}); err != nil {
+		t.Fatalf("insert key: %v", err)
+	}
+	records, err = s.KeyHistory(context.Background(), "other")
+	if err != nil {
+		t.Fatalf("key history: %v", err)
+	}
+	if len(records) != 1 || records[0].Actor != types.ActorSystem || records[0].RequestID != "" {
+		t.Fatalf("got records %#v want one created by the system", records)
+	}
+
+	for _, id := range []string{"unknown", "other"} {
+		_, err = s.KeyHistory(ctx, id)
+		if err != storage.ErrNotFound {
+			t.Fatalf("history of %s key: got error %v want %v", id, err, storage.ErrNotFound)
+		}
+	}
+}
+
+func testListKeys(t *testing.T, s httpserver.Storage) {
+	ctx := context.Background()
+
+	page, err := s.ListKeys(ctx, &types.KeyListParams{})
+	if err != nil || len(page.Keys) != 0 || page.NextCursor != "" {
+		t.Fatalf("list keys of empty storage: got %#v, %v", page, err)
+	}
+
+	if err := s.CreatePool(ctx, &types.Pool{ID: "spring"}); err != nil {
+		t.Fatalf("create pool: %v", err)
+	}
+	base := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	keys := seedKeys(5)
+	for i, key := range keys {
+		created := base.Add(time.Duration(i) * time.Hour)
+		key.CreatedAt = &created
+	}
+	keys[3].ID = "other-3"
+	keys[3].PoolID = "spring"
+	keys[4].PoolID = "spring"
+	insertKeys(t, s, keys)
+	issued, err := s.GetKey(ctx, "", nil)
+	if err != nil {
+		t.Fatalf("get key: %v", err)
+	}
+	pool, noPool := "spring", ""
+
+	for _, tc := range []struct {
+		name   string
+		params types.KeyListParams
+		want   []string
+	}{
+		{"all", types.KeyListParams{}, []string{"key-0", "key-1", "key-2", "key-4", "other-3"}},
+		{"descending", types.KeyListParams{Sort: types.SortByIDDesc}, []string{"other-3", "key-4", "key-2", "key-1", "key-0"}},
+		{"created", types.KeyListParams{Sort: types.SortByCreatedDesc}, []string{"key-4", "other-3", "key-2", "key-1", "key-0"}},
+		{"issued first", types.KeyListParams{Sort: types.SortByIssuedDesc, Limit: 1}, []string{issued.ID}},
+		{"status", types.KeyListParams{KeyFilter: types.KeyFilter{Statuses: []types.KeyStatus{types.StatusIssued}}}, []string{issued.ID}},
+		{"pool", types.KeyListParams{KeyFilter: types.KeyFilter{PoolID: &pool}}, []string{"key-4", "other-3"}},
+		{"no pool available", types.KeyListParams{KeyFilter: types.KeyFilter{PoolID: &noPool, Statuses: []types.KeyStatus{types.StatusAvailable}}}, without([]string{"key-0", "key-1", "key-2"}, issued.ID)},
+		{"prefix", types.KeyListParams{KeyFilter: types.KeyFilter{IDPrefix: "oth"}}, []string{"other-3"}},
+		{"prefix meta", types.KeyListParams{KeyFilter: types.KeyFilter{IDPrefix: "key.."}}, nil},
+		{"created range", types.KeyListParams{KeyFilter: types.KeyFilter{CreatedSince: timePtr(base.Add(time.Hour)), CreatedBefore: timePtr(base.Add(3 * time.Hour))}}, []string{"key-1", "key-2"}},
+		{"issued range", types.KeyListParams{KeyFilter: types.KeyFilter{IssuedSince: timePtr(base)}}, []string{issued.ID}},
+	} {
+		page, err := s.ListKeys(ctx, &tc.params)
+		if err != nil {
+			t.Fatalf("list keys %s: %v", tc.name, err)
+		}
+		if got := keyIDs(page.Keys); fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Fatalf("list keys %s: got %v want %v", tc.name, got, tc.want)
+		}
+	}
+
+	if _, err := s.ListKeys(ctx, &types.KeyListParams{Cursor: "garbage"}); err != storage.ErrInvalidCursor {
+		t.Fatalf("list keys with invalid cursor: got error %v want %v", err, storage.ErrInvalidCursor)
+	}
+	page, err = s.ListKeys(ctx, &types.KeyListParams{Limit: 1})
+	if err != nil {
+		t.Fatalf("list keys: %v", err)
+	}
+	if _, err := s.ListKeys(ctx, &types.KeyListParams{Sort: types.SortByCreated, Cursor: page.NextCursor}); err != storage.ErrInvalidCursor {
+		t.Fatalf("list keys with cursor of another order: got error %v want %v", err, storage.ErrInvalidCursor)
+	}
+}
+
+func testListKeysPaging(t *testing.T, s httpserver.Storage) {
+	ctx := context.Background()
+
+	base := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	keys := seedKeys(7)
+	for i, key := range keys {
+		// Equal times are ordered by ID, keys without a time go first.
+		if i > 1 {
+			created := base.Add(time.Duration(i/2) * time.Hour)
+			key.CreatedAt = &created
+		}
+	}
+	insertKeys(t, s, keys)
+
+	for _, order := range []types.KeySort{types.SortByID, types.SortByIDDesc, types.SortByCreated, types.SortByCreatedDesc} {
+		want := make([]*types.Key, len(keys))
+		copy(want, keys)
+		sort.Slice(want, func(i, j int) bool { return order.Less(want[i], want[j]) })
+
+		var got []*types.Key
+		params := &types.KeyListParams{Sort: order, Limit: 2}
+		for pages := 0; ; pages++ {
+			if pages > len(keys) {
+				t.Fatalf("list keys by %s: too many pages", order)
+			}
+			page, err := s.ListKeys(ctx, params)
+			if err != nil {
+				t.Fatalf("list keys by %s: %v", order, err)
+			}
+			if len(page.Keys) > params.Limit {
+				t.Fatalf("list keys by %s: got %d keys want at most %d", order, len(page.Keys), params.Limit)
+			}
+			got = append(got, page.Keys...)
+			if page.NextCursor == "" {
+				break
+			}
+			params.Cursor = page.NextCursor
+		}
+		if fmt.Sprint(keyIDs(got)) != fmt.Sprint(keyIDs(want)) {
+			t.Fatalf("list keys by %s: got %v want %v", order, keyIDs(got), keyIDs(want))
+		}
+	}
+}
+
+func testExportKeys(t *testing.T, s httpserver.Storage) {
+	acme := types.WithTenant(context.Background(), "acme")
+	insertKeys(t, s, seedKeys(4))
+	for _, key := range seedKeys(2) {
+		key.ID = "acme-" + key.ID
+		if err := s.InsertKey(acme, key); err != nil {
+			t.Fatalf("insert key: %v", err)
+		}
+	}
+	issued, err := s.GetKey(context.Background(), "", nil)
+	if err != nil {
+		t.Fatalf("get key: %v", err)
+	}
+
+	var got []string
+	filter := &types.KeyFilter{Statuses: []types.KeyStatus{types.StatusAvailable}}
+	err = s.ExportKeys(context.Background(), filter, types.SortByIDDesc, func(key *types.Key) error {
+		got = append(got, key.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("export keys: %v", err)
+	}
+	if want := without([]string{"key-3", "key-2", "key-1", "key-0"}, issued.ID); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got exported keys %v want %v", got, want)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = s.ExportKeys(acme, &types.KeyFilter{}, "", func(key *types.Key) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Fatalf("stopped export: got %d calls, error %v want 1, %v", calls, err, stop)
+	}
+}
+
+func testKeyStats(t *testing.T, s httpserver.Storage) {
+	ctx := context.Background()
+	acme := types.WithTenant(ctx, "acme")
+
+	stats, err := s.KeyStats(ctx, nil, nil)
+	if err != nil || stats.Total != 0 || len(stats.Statuses) != 0 {
+		t.Fatalf("stats of empty storage: got %#v, %v", stats, err)
+	}
+
+	if err := s.CreatePool(ctx, &types.Pool{ID: "spring"}); err != nil {
+		t.Fatalf("create pool: %v", err)
+	}
+	keys := seedKeys(5)
+	keys[3].PoolID = "spring"
+	keys[4].PoolID = "spring"
+	insertKeys(t, s, keys)
+	if err := s.InsertKey(acme, &types.Key{ID: "acme-key", Status: types.StatusAvailable}); err != nil {
+		t.Fatalf("insert key: %v", err)
+	}
+	before := time.Now().Add(-time.Minute)
+	for _, pool := range []string{"", "", "spring"} {
+		if _, err := s.GetKey(ctx, pool, nil); err != nil {
+			t.Fatalf("get key: %v", err)
+		}
+	}
+	after := time.Now().Add(time.Minute)
+
+	spring, noPool := "spring", ""
+	for _, tc := range []struct {
+		name      string
+		pool      *string
+		available int64
+		issued    int64
+	}{
+		{"all", nil, 2, 3},
+		{"pool", &spring, 1, 1},
+		{"out of any pool", &noPool, 1, 2},
+	} {
+		stats, err := s.KeyStats(ctx, tc.pool, []time.Time{before, after})
+		if err != nil {
+			t.Fatalf("stats of %s keys: %v", tc.name, err)
+		}
+		if stats.Total != tc.available+tc.issued ||
+			stats.Statuses[types.StatusAvailable] != tc.available ||
+			stats.Statuses[types.StatusIssued] != tc.issued {
+			t.Fatalf("stats of %s keys: got total %d, statuses %v", tc.name, stats.Total, stats.Statuses)
+		}
+		if len(stats.Issuance) != 2 || stats.Issuance[0].Issued != tc.issued || stats.Issuance[1].Issued != 0 {
+			t.Fatalf("stats of %s keys: got issuance %v", tc.name, stats.Issuance)
+		}
+		if !stats.Issuance[0].Since.Equal(before) {
+			t.Fatalf("stats of %s keys: got issuance since %v want %v", tc.name, stats.Issuance[0].Since, before)
+		}
+	}
+}
+
+// availableKeys returns the available keys of the pool.
+func availableKeys(ctx context.Context, s httpserver.Storage, pool string) ([]*types.Key, error) {
+	page, err := s.ListKeys(ctx, &types.KeyListParams{
+		KeyFilter: types.KeyFilter{Statuses: []types.KeyStatus{types.StatusAvailable}, PoolID: &pool},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return page.Keys, nil
+}
+
+func without(ids []string, id string) []string {
+	var out []string
+	for _, v := range ids {
+		if v != id {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+func testPools(t *testing.T, s httpserver.Storage) {
+	ctx := context.Background()
+
+	pools, err := s.ListPools(ctx)
+	if err != nil || len(pools) != 0 {
+		t.Fatalf("list pools of empty storage: got %v, %v want no pools", pools, err)
+	}
+
+	pool := &types.Pool{ID: "spring", Name: "Spring", Generator: &types.KeyGenParams{Length: 8}, MaxKeys: 10}
+	if err := s.CreatePool(ctx, pool); err != nil {
+		t.Fatalf("create pool: %v", err)
+	}
+	if err := s.CreatePool(ctx, &types.Pool{ID: "autumn", Name: "Autumn"}); err != nil {
+		t.Fatalf("create pool: %v", err)
+	}
+	if err := s.CreatePool(ctx, &types.Pool{ID: "spring", Name: "Again"}); err != storage.ErrPoolDuplicate {
+		t.Fatalf("create duplicate pool: got error %v want %v", err, storage.ErrPoolDuplicate)
+	}
+
+	got, err := s.GetPool(ctx, "spring")
+	if err != nil {
+		t.Fatalf("get pool: %v", err)
+	}
+	if got.Name != pool.Name || got.MaxKeys != pool.MaxKeys || got.Generator == nil || got.Generator.Length != 8 {
+		t.Fatalf("got pool %#v want %#v", got, pool)
+	}
+	if _, err := s.GetPool(ctx, "missing"); err != storage.ErrPoolNotFound {
+		t.Fatalf("get missing pool: got error %v want %v", err, storage.ErrPoolNotFound)
+	}
+
+	pools, err = s.ListPools(ctx)
+	if err != nil {
+		t.Fatalf("list pools: %v", err)
+	}
+	var ids []string
+	for _, p := range pools {
+		ids = append(ids, p.ID)
+	}
+	if fmt.Sprint(ids) != "[autumn spring]" {
+		t.Fatalf("got pools %v want [autumn spring]", ids)
+	}
+}
+
+func testPoolIsolation(t *testing.T, s httpserver.Storage) {
+	ctx := context.Background()
+	for _, id := range []string{"spring", "summer"} {
+		if err := s.CreatePool(ctx, &types.Pool{ID: id, Name: id}); err != nil {
+			t.Fatalf("create pool: %v", err)
+		}
+	}
+
+	keys := seedKeys(4)
+	keys[0].PoolID = "spring"
+	keys[1].PoolID = "spring"
+	keys[2].PoolID = "summer"
+	if n, err := s.InsertKeys(ctx, keys); err != nil || n != 4 {
+		t.Fatalf("insert keys: got %d, %v want 4, nil", n, err)
+	}
+	if err := s.InsertKey(ctx, &types.Key{ID: "key-x", PoolID: "missing", Status: types.StatusAvailable}); err != storage.ErrPoolNotFound {
+		t.Fatalf("insert key of missing pool: got error %v want %v", err, storage.ErrPoolNotFound)
+	}
+
+	listKey, err := availableKeys(ctx, s, "spring")
+	if err != nil || len(listKey) != 2 {
+		t.Fatalf("unreleased keys of pool: got %d, %v want 2, nil", len(listKey), err)
+	}
+
+	for _, tc := range []struct {
+		pool string
+		want []string
+	}{
+		{"spring", []string{"key-0", "key-1"}},
+		{"summer", []string{"key-2"}},
+		{"", []string{"key-3"}},
+	} {
+		var got []string
+		for {
+			key, err := s.GetKey(ctx, tc.pool, nil)
+			if err == storage.ErrNotFound {
+				break
+			}
+			if err != nil {
+				t.Fatalf("get key of pool %q: %v", tc.pool, err)
+			}
+			if key.PoolID != tc.pool {
+				t.Fatalf("got key of pool %q want %q", key.PoolID, tc.pool)
+			}
+			got = append(got, key.ID)
+		}
+		sort.Strings(got)
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Fatalf("got issued keys of pool %q %v want %v", tc.pool, got, tc.want)
+		}
+	}
+}
+
+func testPoolQuotas(t *testing.T, s httpserver.Storage) {
+	ctx := context.Background()
+	if err := s.CreatePool(ctx, &types.Pool{ID: "spring", Name: "Spring", MaxKeys: 3, MaxIssued: 1}); err != nil {
+		t.Fatalf("create pool: %v", err)
+	}
+
+	keys := seedKeys(4)
+	for _, key := range keys {
+		key.PoolID = "spring"
+	}
+	if _, err := s.InsertKeys(ctx, keys); err != storage.ErrQuotaExceeded {
+		t.Fatalf("insert keys over quota: got error %v want %v", err, storage.ErrQuotaExceeded)
+	}
+	if n, err := s.InsertKeys(ctx, keys[:2]); err != nil || n != 2 {
+		t.Fatalf("insert keys: got %d, %v want 2, nil", n, err)
+	}
+	// A duplicate does not count against the quota.
+	if err := s.InsertKey(ctx, keys[0]); err != storage.ErrDuplicate {
+		t.Fatalf("insert duplicate key: got error %v want %v", err, storage.ErrDuplicate)
+	}
+	if err := s.InsertKey(ctx, keys[2]); err != nil {
+		t.Fatalf("insert key: %v", err)
+	}
+	if err := s.InsertKey(ctx, keys[3]); err != storage.ErrQuotaExceeded {
+		t.Fatalf("insert key over quota: got error %v want %v", err, storage.ErrQuotaExceeded)
+	}
+
+	if _, err := s.GetKey(ctx, "spring", nil); err != nil {
+		t.Fatalf("get key: %v", err)
+	}
+	if _, err := s.GetKey(ctx, "spring", nil); err != storage.ErrQuotaExceeded {
+		t.Fatalf("get key over quota: got error %v want %v", err, storage.ErrQuotaExceeded)
+	}
+
+	pool, err := s.GetPool(ctx, "spring")
+	if err != nil {
+		t.Fatalf("get pool: %v", err)
+	}
+	if pool.KeyCount != 3 || pool.IssuedCount != 1 {
+		t.Fatalf("got pool counters %d/%d want 3/1", pool.KeyCount, pool.IssuedCount)
+	}
+}
+
+func testTenantIsolation(t *testing.T, s httpserver.Storage) {
+	acme := types.WithTenant(context.Background(), "acme")
+	globex := types.WithTenant(context.Background(), "globex")
+
+	// Both tenants may have a pool with the same ID.
+	for _, ctx := range []context.Context{acme, globex} {
+		if err := s.CreatePool(ctx, &types.Pool{ID: "promo", Name: "Promo"}); err != nil {
+			t.Fatalf("create pool: %v", err)
+		}
+	}
+	keys := seedKeys(3)
+	keys[0].PoolID = "promo"
+	if n, err := s.InsertKeys(acme, keys); err != nil || n != 3 {
+		t.Fatalf("insert keys: got %d, %v want 3, nil", n, err)
+	}
+	if keys[0].TenantID != "acme" {
+		t.Fatalf("got key tenant %q want acme", keys[0].TenantID)
+	}
+
+	for _, ctx := range []context.Context{globex, context.Background()} {
+		if _, err := s.GetKey(ctx, "", nil); err != storage.ErrNotFound {
+			t.Fatalf("get key of another tenant: got error %v want %v", err, storage.ErrNotFound)
+		}
+		if _, err := s.GetKey(ctx, "promo", nil); err != storage.ErrNotFound && err != storage.ErrPoolNotFound {
+			t.Fatalf("get pool key of another tenant: got error %v", err)
+		}
+		if keys, err := availableKeys(ctx, s, ""); err != nil || len(keys) != 0 {
+			t.Fatalf("available keys of another tenant: got %v, %v want none", keyIDs(keys), err)
+		}
+		if _, err := s.VerificationKey(ctx, "key-1"); err != storage.ErrNotFound {
+			t.Fatalf("verification key of another tenant: got error %v want %v", err, storage.ErrNotFound)
+		}
+		if _, err := s.RevokeKey(ctx, "key-1"); err != storage.ErrNotFound {
+			t.Fatalf("revoke key of another tenant: got error %v want %v", err, storage.ErrNotFound)
+		}
+	}
+	pool, err := s.GetPool(globex, "promo")
+	if err != nil {
+		t.Fatalf("get pool: %v", err)
+	}
+	if pool.TenantID != "globex" || pool.KeyCount != 0 {
+		t.Fatalf("got pool %#v of another tenant", pool)
+	}
+
+	issued, err := s.GetKey(acme, "", nil)
+	if err != nil {
+		t.Fatalf("get key: %v", err)
+	}
+	if _, err := s.CanceledKey(globex, issued.ID); err != storage.ErrNotFound {
+		t.Fatalf("cancel key of another tenant: got error %v want %v", err, storage.ErrNotFound)
+	}
+	if _, err := s.CanceledKey(acme, issued.ID); err != nil {
+		t.Fatalf("cancel key: %v", err)
+	}
+	if _, err := s.GetKey(acme, "promo", nil); err != nil {
+		t.Fatalf("get pool key: %v", err)
+	}
+}
+
+func testTenantKeyIDs(t *testing.T, s httpserver.Storage) {
+	acme := types.WithTenant(context.Background(), "acme")
+	globex := types.WithTenant(context.Background(), "globex")
+
+	// The key IDs are unique per tenant, so a tenant
+	// cannot tell the IDs used by other tenants.
+	for _, ctx := range []context.Context{acme, globex, context.Background()} {
+		if err := s.InsertKey(ctx, &types.Key{ID: "key-0", Status: types.StatusAvailable}); err != nil {
+			t.Fatalf("insert key: %v", err)
+		}
+		if n, err := s.InsertKeys(ctx, seedKeys(2)[1:]); err != nil || n != 1 {
+			t.Fatalf("insert keys: got %d, %v want 1, nil", n, err)
+		}
+		errs, err := s.ImportKeys(ctx, []*types.Key{{ID: "key-2", Status: types.StatusAvailable}})
+		if err != nil || errs[0] != nil {
+			t.Fatalf("import keys: got %v, %v want no errors", errs, err)
+		}
+	}
+	if err := s.InsertKey(acme, &types.Key{ID: "key-0", Status: types.StatusAvailable}); err != storage.ErrDuplicate {
+		t.Fatalf("insert duplicate key: got error %v want %v", err, storage.ErrDuplicate)
+	}
+	errs, err := s.ImportKeys(globex, []*types.Key{{ID: "key-2", Status: types.StatusAvailable}})
+	if err != nil || len(errs) != 1 || errs[0] != storage.ErrDuplicate {
+		t.Fatalf("import duplicate key: got %v, %v want %v", errs, err, storage.ErrDuplicate)
+	}
+
+	if _, err := s.RevokeKey(acme, "key-1"); err != nil {
+		t.Fatalf("revoke key: %v", err)
+	}
+	for _, ctx := range []context.Context{globex, context.Background()} {
+		key, err := s.VerificationKey(ctx, "key-1")
+		if err != nil {
+			t.Fatalf("verification key: %v", err)
+		}
+		if key.Status != types.StatusAvailable || key.TenantID != types.TenantFromContext(ctx) {
+			t.Fatalf("got key %#v want an available key of tenant %q", key, types.TenantFromContext(ctx))
+		}
+	}
+}
+
+func testTenants(t *testing.T, s httpserver.Storage) {
+	ctx := context.Background()
+	for _, id := range []string{"globex", "acme"} {
+		if err := s.CreateTenant(ctx, &types.Tenant{ID: id, Name: id}); err != nil {
+			t.Fatalf("create tenant: %v", err)
+		}
+	}
+	if err := s.CreateTenant(ctx, &types.Tenant{ID: "acme", Name: "Again"}); err != storage.ErrTenantDuplicate {
+		t.Fatalf("create duplicate tenant: got error %v want %v", err, storage.ErrTenantDuplicate)
+	}
+	tenant, err := s.GetTenant(ctx, "acme")
+	if err != nil || tenant.Name != "acme" {
+		t.Fatalf("get tenant: got %#v, %v", tenant, err)
+	}
+	if _, err := s.GetTenant(ctx, "missing"); err != storage.ErrTenantNotFound {
+		t.Fatalf("get missing tenant: got error %v want %v", err, storage.ErrTenantNotFound)
+	}
+	tenants, err := s.ListTenants(ctx)
+	if err != nil {
+		t.Fatalf("list tenants: %v", err)
+	}
+	var ids []string
+	for _, tenant := range tenants {
+		ids = append(ids, tenant.ID)
+	}
+	if fmt.Sprint(ids) != "[acme globex]" {
+		t.Fatalf("got tenants %v want [acme globex]", ids)
+	}
+}
+
+func testAPIKeys(t *testing.T, s httpserver.Storage) {
+	ctx := context.Background()
+	key := &types.APIKey{ID: "k1", TenantID: "acme", Hash: "hash-1"}
+	if err := s.CreateAPIKey(ctx, key); err != nil {
+		t.Fatalf("create API key: %v", err)
+	}
+	if err := s.CreateAPIKey(ctx, &types.APIKey{ID: "k2", TenantID: "acme", Hash: "hash-1"}); err != storage.ErrDuplicate {
+		t.Fatalf("create API key with duplicate hash: got error %v want %v", err, storage.ErrDuplicate)
+	}
+
+	got, err := s.GetAPIKey(ctx, "hash-1")
+	if err != nil {
+		t.Fatalf("get API key: %v", err)
+	}
+	if got.ID != "k1" || got.TenantID != "acme" || got.RevokedAt != nil {
+		t.Fatalf("got API key %#v want %#v", got, key)
+	}
+	if _, err := s.GetAPIKey(ctx, "hash-2"); err != storage.ErrAPIKeyNotFound {
+		t.Fatalf("get missing API key: got error %v want %v", err, storage.ErrAPIKeyNotFound)
+	}
+
+	if err := s.RevokeAPIKey(ctx, "globex", "k1"); err != storage.ErrAPIKeyNotFound {
+		t.Fatalf("revoke API key of another tenant: got error %v want %v", err, storage.ErrAPIKeyNotFound)
+	}
+	if err := s.RevokeAPIKey(ctx, "acme", "k1"); err != nil {
+		t.Fatalf("revoke API key: %v", err)
+	}
+	if err := s.RevokeAPIKey(ctx, "acme", "k1"); err != storage.ErrAPIKeyNotFound {
+		t.Fatalf("revoke revoked API key: got error %v want %v", err, storage.ErrAPIKeyNotFound)
+	}
+	got, err = s.GetAPIKey(ctx, "hash-1")
+	if err != nil {
+		t.Fatalf("get API key: %v", err)
+	}
+	if got.RevokedAt == nil {
+		t.Fatal("API key is not revoked")
+	}
+}
+
+func testIdempotency(t *testing.T, s httpserver.Storage) {
+	acme := types.WithTenant(context.Background(), "acme")
+	globex := types.WithTenant(context.Background(), "globex")
+	now := time.Now()
+
+	rec := &types.IdempotencyRecord{Key: "req-1", Fingerprint: "fp-1", CreatedAt: now, ExpiresAt: now.Add(time.Minute)}
+	if err := s.CreateIdempotencyRecord(acme, rec); err != nil {
+		t.Fatalf("create idempotency record: %v", err)
+	}
+	if err := s.CreateIdempotencyRecord(acme, rec); err != storage.ErrIdempotencyDuplicate {
+		t.Fatalf("create duplicate idempotency record: got error %v want %v", err, storage.ErrIdempotencyDuplicate)
+	}
+	if _, err := s.GetIdempotencyRecord(globex, "req-1"); err != storage.ErrIdempotencyNotFound {
+		t.Fatalf("get idempotency record of another tenant: got error %v want %v", err, storage.ErrIdempotencyNotFound)
+	}
+
+	wrong := &types.IdempotencyRecord{Key: "req-1", Fingerprint: "fp-2", StatusCode: 200, ExpiresAt: now.Add(time.Hour)}
+	if err := s.CompleteIdempotencyRecord(acme, wrong); err != storage.ErrIdempotencyNotFound {
+		t.Fatalf("complete idempotency record of another request: got error %v want %v", err, storage.ErrIdempotencyNotFound)
+	}
+	done := &types.IdempotencyRecord{
+		Key:         "req-1",
+		Fingerprint: "fp-1",
+		StatusCode:  200,
+		ContentType: "application/json",
+		Body:        []byte(`"KEY-1"`),
+		ExpiresAt:   now.Add(time.Hour),
+	}
+	if err := s.CompleteIdempotencyRecord(acme, done); err != nil {
+		t.Fatalf("complete idempotency record: %v", err)
+	}
+	got, err := s.GetIdempotencyRecord(acme, "req-1")
+	if err != nil {
+		t.Fatalf("get idempotency record: %v", err)
+	}
+	if !got.Completed || got.StatusCode != 200 || got.ContentType != "application/json" || string(got.Body) != `"KEY-1"` || got.TenantID != "acme" {
+		t.Fatalf("got idempotency record %#v", got)
+	}
+	if err := s.DeleteIdempotencyRecord(acme, "req-1"); err != storage.ErrIdempotencyNotFound {
+		t.Fatalf("delete completed idempotency record: got error %v want %v", err, storage.ErrIdempotencyNotFound)
+	}
+
+	// The same key of another tenant is another record.
+	if err := s.CreateIdempotencyRecord(globex, &types.IdempotencyRecord{Key: "req-1", Fingerprint: "fp-1", CreatedAt: now, ExpiresAt: now.Add(time.Minute)}); err != nil {
+		t.Fatalf("create idempotency record of another tenant: %v", err)
+	}
+	if err := s.DeleteIdempotencyRecord(globex, "req-1"); err != nil {
+		t.Fatalf("delete idempotency record: %v", err)
+	}
+	if _, err := s.GetIdempotencyRecord(globex, "req-1"); err != storage.ErrIdempotencyNotFound {
+		t.Fatalf("get deleted idempotency record: got error %v want %v", err, storage.ErrIdempotencyNotFound)
+	}
+
+	// An expired record is gone and its key may be reused.
+	expired := &types.IdempotencyRecord{Key: "req-2", Fingerprint: "fp-1", CreatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(-time.Minute)}
+	if err := s.CreateIdempotencyRecord(acme, expired); err != nil {
+		t.Fatalf("create expired idempotency record: %v", err)
+	}
+	if _, err := s.GetIdempotencyRecord(acme, "req-2"); err != storage.ErrIdempotencyNotFound {
+		t.Fatalf("get expired idempotency record: got error %v want %v", err, storage.ErrIdempotencyNotFound)
+	}
+	if err := s.CreateIdempotencyRecord(acme, &types.IdempotencyRecord{Key: "req-2", Fingerprint: "fp-2", CreatedAt: now, ExpiresAt: now.Add(time.Minute)}); err != nil {
+		t.Fatalf("reuse expired idempotency key: %v", err)
+	}
+}
+
+func testRecipient(t *testing.T, s httpserver.Storage) {
+	acme := types.WithTenant(context.Background(), "acme")
+	globex := types.WithTenant(context.Background(), "globex")
+	for _, ctx := range []context.Context{acme, globex} {
+		for _, key := range seedKeys(3) {
+			key.ID = types.TenantFromContext(ctx) + "-" + key.ID
+			if err := s.InsertKey(ctx, key); err != nil {
+				t.Fatalf("insert key: %v", err)
+			}
+		}
+	}
+
+	issuance := &types.Issuance{Recipient: "customer-1", Metadata: map[string]string{"order": "o-1"}}
+	first, err := s.GetKey(acme, "", issuance)
+	if err != nil {
+		t.Fatalf("get key: %v", err)
+	}
+	if first.Recipient != "customer-1" || first.Metadata["order"] != "o-1" || first.IssuedAt == nil {
+		t.Fatalf("got issued key %#v", first)
+	}
+	if _, err := s.GetKey(acme, "", nil); err != nil {
+		t.Fatalf("get key: %v", err)
+	}
+	second, err := s.GetKey(acme, "", &types.Issuance{Recipient: "customer-1"})
+	if err != nil {
+		t.Fatalf("get key: %v", err)
+	}
+	if _, err := s.GetKey(globex, "", &types.Issuance{Recipient: "customer-1"}); err != nil {
+		t.Fatalf("get key: %v", err)
+	}
+
+	byRecipient := func(recipient string) []*types.Key {
+		params := &types.KeyListParams{Sort: types.SortByIssued}
+		params.Recipient = recipient
+		page, err := s.ListKeys(acme, params)
+		if err != nil {
+			t.Fatalf("keys by recipient: %v", err)
+		}
+		return page.Keys
+	}
+	keys := byRecipient("customer-1")
+	if len(keys) != 2 || keys[0].ID != first.ID || keys[1].ID != second.ID {
+		t.Fatalf("got keys %v want %s and %s", keyIDs(keys), first.ID, second.ID)
+	}
+	if keys[0].Metadata["order"] != "o-1" || keys[1].Metadata != nil {
+		t.Fatalf("got metadata %v and %v", keys[0].Metadata, keys[1].Metadata)
+	}
+	if keys := byRecipient("customer-2"); len(keys) != 0 {
+		t.Fatalf("got keys %v of unknown recipient", keyIDs(keys))
+	}
+}
+
+// seedKeys returns n new keys with IDs key-0, key-1, ...
+func testWebhooks(t *testing.T, s httpserver.Storage) {
+	t1 := types.WithTenant(context.Background(), "t1")
+	t2 := types.WithTenant(context.Background(), "t2")
+
+	webhook := &types.Webhook{ID: "w1", URL: "https://t1.example.com/hooks", Secret: "secret", Events: []types.EventType{types.EventKeyIssued}}
+	if err := s.CreateWebhook(t1, webhook); err != nil {
+		t.Fatalf("create webhook: %v", err)
+	}
+	if err := s.CreateWebhook(t1, &types.Webhook{ID: "w1", URL: "https://t1.example.com/again"}); err != storage.ErrWebhookDuplicate {
+		t.Fatalf("create duplicate webhook: got error %v want %v", err, storage.ErrWebhookDuplicate)
+	}
+	if err := s.CreateWebhook(t2, &types.Webhook{ID: "w1", URL: "https://t2.example.com/hooks"}); err != nil {
+		t.Fatalf("create webhook of another tenant: %v", err)
+	}
+	if err := s.CreateWebhook(t1, &types.Webhook{ID: "w0", URL: "https://t1.example.com/all"}); err != nil {
+		t.Fatalf("create webhook: %v", err)
+	}
+
+	got, err := s.GetWebhook(t1, "w1")
+	if err != nil {
+		t.Fatalf("get webhook: %v", err)
+	}
+	if got.TenantID != "t1" || got.URL != webhook.URL || got.Secret != webhook.Secret || fmt.Sprint(got.Events) != "[key.issued]" {
+		t.Fatalf("got webhook %#v want %#v", got, webhook)
+	}
+	if _, err := s.GetWebhook(t2, "w0"); err != storage.ErrWebhookNotFound {
+		t.Fatalf("get webhook of another tenant: got error %v want %v", err, storage.ErrWebhookNotFound)
+	}
+
+	webhooks, err := s.ListWebhooks(t1)
+	if err != nil {
+		t.Fatalf("list webhooks: %v", err)
+	}
+	var ids []string
+	for _, w := range webhooks {
+		ids = append(ids, w.ID)
+	}
+	if fmt.Sprint(ids) != "[w0 w1]" {
+		t.Fatalf("got webhooks %v want [w0 w1]", ids)
+	}
+
+	if err := s.DeleteWebhook(t1, "w1"); err != nil {
+		t.Fatalf("delete webhook: %v", err)
+	}
+	if err := s.DeleteWebhook(t1, "w1"); err != storage.ErrWebhookNotFound {
+		t.Fatalf("delete deleted webhook: got error %v want %v", err, storage.ErrWebhookNotFound)
+	}
+	if _, err := s.GetWebhook(t2, "w1"); err != nil {
+		t.Fatalf("get webhook of another tenant after delete: %v", err)
+	}
+}
+
+func testDeliveries(t *testing.T, s httpserver.Storage) {
+	t1 := types.WithTenant(context.Background(), "t1")
+	t2 := types.WithTenant(context.Background(), "t2")
+	now := time.Now().UTC().Truncate(time.Millisecond)
+
+	delivery := func(id string, due time.Time) *types.Delivery {
+		return &types.Delivery{
+			ID:            id,
+			WebhookID:     "w1",
+			Event:         &types.Event{ID: "e-" + id, Type: types.EventKeyIssued, Key: &types.Key{ID: "key-" + id}, At: now},
+			Status:        types.DeliveryPending,
+			NextAttemptAt: due,
+			CreatedAt:     due,
+		}
+	}
+	if err := s.EnqueueDeliveries(t1, []*types.Delivery{
+		delivery("d1", now.Add(-time.Second)),
+		delivery("d3", now.Add(time.Hour)),
+	}); err != nil {
+		t.Fatalf("enqueue deliveries: %v", err)
+	}
+	if err := s.EnqueueDeliveries(t2, []*types.Delivery{delivery("d2", now)}); err != nil {
+		t.Fatalf("enqueue deliveries: %v", err)
+	}
+	// The deliveries already queued are skipped.
+	if err := s.EnqueueDeliveries(t1, []*types.Delivery{delivery("d1", now.Add(-time.Second)), delivery("d2", now)}); err != nil {
+		t.Fatalf("enqueue queued deliveries: %v", err)
+	}
+
+	// The deliveries to the skipped webhooks are not claimed.
+	if d, err := s.ClaimDelivery(context.Background(), now, time.Minute, []string{"w1"}); err != storage.ErrDeliveryNotFound {
+		t.Fatalf("claim delivery of skipped webhook: got %v, %v want error %v", d, err, storage.ErrDeliveryNotFound)
+	}
+
+	// The due deliveries of all tenants are claimed in order, each once per lease.
+	var claimed []string
+	for {
+		d, err := s.ClaimDelivery(context.Background(), now, time.Minute, nil)
+		if err == storage.ErrDeliveryNotFound {
+			break
+		}
+		if err != nil {
+			t.Fatalf("claim delivery: %v", err)
+		}
+		claimed = append(claimed, d.TenantID+"/"+d.ID)
+		if d.ID == "d1" && (d.Event == nil || d.Event.Key == nil || d.Event.Key.ID != "key-d1") {
+			t.Fatalf("got claimed delivery event %#v", d.Event)
+		}
+	}
+	if fmt.Sprint(claimed) != "[t1/d1 t2/d2]" {
+		t.Fatalf("got claimed deliveries %v want [t1/d1 t2/d2]", claimed)
+	}
+	d, err := s.ClaimDelivery(context.Background(), now.Add(2*time.Minute), time.Minute, nil)
+	if err != nil || d.ID != "d1" {
+		t.Fatalf("claim delivery after lease: got %v, %v want d1", d, err)
+	}
+
+	d.Status = types.DeliveryDead
+	d.Attempts = 10
+	d.LastError = "webhook responded with status 500"
+	if err := s.UpdateDelivery(context.Background(), d); err != nil {
+		t.Fatalf("update delivery: %v", err)
+	}
+	if err := s.UpdateDelivery(context.Background(), delivery("missing", now)); err != storage.ErrDeliveryNotFound {
+		t.Fatalf("update missing delivery: got error %v want %v", err, storage.ErrDeliveryNotFound)
+	}
+
+	dead, err := s.ListDeliveries(t1, types.DeliveryDead, 10)
+	if err != nil {
+		t.Fatalf("list dead deliveries: %v", err)
+	}
+	if len(dead) != 1 || dead[0].ID != "d1" || dead[0].Attempts != 10 || dead[0].LastError != d.LastError {
+		t.Fatalf("got dead deliveries %#v want d1", dead)
+	}
+	if dead, err := s.ListDeliveries(t2, types.DeliveryDead, 10); err != nil || len(dead) != 0 {
+		t.Fatalf("list dead deliveries of another tenant: got %v, %v want none", dead, err)
+	}
+	pending, err := s.ListDeliveries(t1, types.DeliveryPending, 10)
+	if err != nil || len(pending) != 1 || pending[0].ID != "d3" {
+		t.Fatalf("list pending deliveries: got %v, %v want d3", pending, err)
+	}
+
+	if _, err := s.RetryDelivery(t2, "d1", now); err != storage.ErrDeliveryNotFound {
+		t.Fatalf("retry delivery of another tenant: got error %v want %v", err, storage.ErrDeliveryNotFound)
+	}
+	if _, err := s.RetryDelivery(t1, "d3", now); err != storage.ErrDeliveryNotDead {
+		t.Fatalf("retry pending delivery: got error %v want %v", err, storage.ErrDeliveryNotDead)
+	}
+	retried, err := s.RetryDelivery(t1, "d1", now.Add(3*time.Minute))
+	if err != nil {
+		t.Fatalf("retry delivery: %v", err)
+	}
+	if retried.Status != types.DeliveryPending || retried.Attempts != 0 {
+		t.Fatalf("got retried delivery %#v want a pending one", retried)
+	}
+	claimed = nil
+	for {
+		d, err := s.ClaimDelivery(context.Background(), now.Add(3*time.Minute), time.Minute, nil)
+		if err == storage.ErrDeliveryNotFound {
+			break
+		}
+		if err != nil {
+			t.Fatalf("claim delivery: %v", err)
+		}
+		claimed = append(claimed, d.ID)
+	}
+	// The lease of d2 has run out before d1 is retried.
+	if fmt.Sprint(claimed) != "[d2 d1]" {
+		t.Fatalf("got claimed deliveries %v want [d2 d1]", claimed)
+	}
+}
+
+func testOutbox(t *testing.T, s httpserver.Storage) {
+	ctx := types.WithTenant(context.Background(), "t1")
+
+	keys := seedKeys(3)
+	if err := s.InsertKey(ctx, keys[0]); err != nil {
+		t.Fatalf("insert key: %v", err)
+	}
+	if n, err := s.InsertKeys(ctx, keys[1:]); err != nil || n != 2 {
+		t.Fatalf("insert keys: got %d, %v want 2, nil", n, err)
+	}
+	issued, err := s.GetKey(ctx, "", nil)
+	if err != nil {
+		t.Fatalf("get key: %v", err)
+	}
+	if _, err := s.RedeemKey(ctx, issued.ID, "pos-1"); err != nil {
+		t.Fatalf("redeem key: %v", err)
+	}
+	// Failed changes and verifications queue no events.
+	if _, err := s.RedeemKey(ctx, issued.ID, "pos-1"); err == nil {
+		t.Fatal("redeem redeemed key: got no error")
+	}
+	if _, err := s.VerificationKey(ctx, issued.ID); err != nil {
+		t.Fatalf("verify key: %v", err)
+	}
+	if _, err := s.RevokeKey(ctx, "key-2"); err != nil {
+		t.Fatalf("revoke key: %v", err)
+	}
+
+	now := time.Now()
+	entries, err := s.ClaimOutbox(context.Background(), now, time.Minute, 4)
+	if err != nil {
+		t.Fatalf("claim outbox: %v", err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, fmt.Sprintf("%s %s %s %s", e.Event.TenantID, e.Event.Type, e.Event.Key.ID, e.Event.Key.Status))
+	}
+	want := []string{
+		"t1 key.created key-0 available",
+		"t1 key.created key-1 available",
+		"t1 key.created key-2 available",
+		"t1 key.issued key-0 issued",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got outbox events %v want %v", got, want)
+	}
+
+	// The entries behind the leased ones are not claimed.
+	blocked, err := s.ClaimOutbox(context.Background(), now, time.Minute, 10)
+	if err != nil || len(blocked) != 0 {
+		t.Fatalf("claim outbox behind leased entries: got %d entries and error %v want none", len(blocked), err)
+	}
+
+	failed := entries[0]
+	failed.Attempts = 1
+	failed.NextAttemptAt = now.Add(30 * time.Minute)
+	failed.LastError = "sink is down"
+	if err := s.UpdateOutbox(context.Background(), failed); err != nil {
+		t.Fatalf("update outbox: %v", err)
+	}
+	missing := &types.OutboxEntry{Event: &types.Event{ID: "missing"}}
+	if err := s.UpdateOutbox(context.Background(), missing); err != storage.ErrOutboxNotFound {
+		t.Fatalf("update missing outbox entry: got error %v want %v", err, storage.ErrOutboxNotFound)
+	}
+
+	var ids []string
+	for _, e := range entries[1:] {
+		ids = append(ids, e.Event.ID)
+	}
+	if err := s.DeleteOutbox(context.Background(), ids); err != nil {
+		t.Fatalf("delete outbox: %v", err)
+	}
+	// The entries behind the failed one wait for its retry.
+	blocked, err = s.ClaimOutbox(context.Background(), now.Add(2*time.Minute), time.Minute, 10)
+	if err != nil || len(blocked) != 0 {
+		t.Fatalf("claim outbox behind failed entry: got %d entries and error %v want none", len(blocked), err)
+	}
+
+	left, err := s.ClaimOutbox(context.Background(), now.Add(time.Hour), time.Minute, 10)
+	if err != nil {
+		t.Fatalf("claim outbox: %v", err)
+	}
+	if len(left) == 0 || left[0].Event.ID != failed.Event.ID || left[0].Attempts != 1 || left[0].LastError != failed.LastError {
+		t.Fatalf("got outbox entries %#v want the failed one first", left)
+	}
+	got = nil
+	for _, e := range left[1:] {
+		got = append(got, fmt.Sprintf("%s %s %s", e.Event.Type, e.Event.Key.ID, e.Event.Key.RedeemedBy))
+	}
+	if fmt.Sprint(got) != "[key.redeemed key-0 pos-1 key.revoked key-2 ]" {
+		t.Fatalf("got outbox events %v want the redeemed and revoked keys", got)
+	}
+}
+
+func testWatchKeys(t *testing.T, s httpserver.Storage) {
+	ctx, cancel := context.WithCancel(types.WithTenant(context.Background(), "t1"))
+	defer cancel()
+
+	events, errc := watchKeys(t, ctx, s, "")
+	keys := seedKeys(2)
+	if err := s.InsertKey(ctx, keys[0]); err != nil {
+		t.Fatalf("insert key: %v", err)
+	}
+	// The changes of other tenants and verifications are not watched.
+	if err := s.InsertKey(types.WithTenant(context.Background(), "t2"), keys[1]); err != nil {
+		t.Fatalf("insert key: %v", err)
+	}
+	issued, err := s.GetKey(ctx, "", nil)
+	if err != nil {
+		t.Fatalf("get key: %v", err)
+	}
+	if _, err := s.VerificationKey(ctx, issued.ID); err != nil {
+		t.Fatalf("verify key: %v", err)
+	}
+	if _, err := s.RedeemKey(ctx, issued.ID, "pos-1"); err != nil {
+		t.Fatalf("redeem key: %v", err)
+	}
+
+	got := receiveEvents(t, events, 3)
+	want := []string{"key.created key-0", "key.issued key-0", "key.redeemed key-0"}
+	if !reflect.DeepEqual(eventNames(got), want) {
+		t.Fatalf("got events %v want %v", eventNames(got), want)
+	}
+	// The key of an event is the key right after the change even if
+	// it has changed again since.
+	statuses := []types.KeyStatus{types.StatusAvailable, types.StatusIssued, types.StatusRedeemed}
+	for i, event := range got {
+		if event.TenantID != "t1" || event.At.IsZero() {
+			t.Fatalf("got event %+v want one of tenant t1 with the change time", event)
+		}
+		if event.Key.Status != statuses[i] {
+			t.Fatalf("got %s event key status %q want %q", event.Type, event.Key.Status, statuses[i])
+		}
+	}
+	cancel()
+	if err := <-errc; err == nil {
+		t.Fatal("watch after cancel: got no error")
+	}
+
+	// A watch resumes after the given event.
+	ctx, cancel = context.WithCancel(types.WithTenant(context.Background(), "t1"))
+	defer cancel()
+	resumed, _ := watchKeys(t, ctx, s, got[0].ID)
+	if names := eventNames(receiveEvents(t, resumed, 2)); !reflect.DeepEqual(names, want[1:]) {
+		t.Fatalf("got resumed events %v want %v", names, want[1:])
+	}
+
+	err = s.WatchKeys(ctx, "zz", time.Millisecond, func(*types.Event) error {
+		t.Fatal("watch with invalid event id: got callback")
+		return nil
+	})
+	if err != storage.ErrInvalidResumeToken {
+		t.Fatalf("watch with invalid event id: got error %v want %v", err, storage.ErrInvalidResumeToken)
+	}
+
+	errStop := errors.New("stop")
+	err = s.WatchKeys(ctx, "", time.Millisecond, func(*types.Event) error { return errStop })
+	if err != errStop {
+		t.Fatalf("watch with failing callback: got error %v want %v", err, errStop)
+	}
+}
+
+// watchKeys starts watching the keys and returns the watched events and the
+// watch error once the watch ends. It returns once the watch is open.
+func watchKeys(t *testing.T, ctx context.Context, s httpserver.Storage, resumeAfter string) (<-chan *types.Event, <-chan error) {
+	events := make(chan *types.Event, 10)
+	errc := make(chan error, 1)
+	open := make(chan struct{})
+	go func() {
+		opened := false
+		errc <- s.WatchKeys(ctx, resumeAfter, 10*time.Millisecond, func(event *types.Event) error {
+			if !opened {
+				opened = true
+				close(open)
+			}
+			if event != nil {
+				events <- event
+			}
+			return nil
+		})
+	}()
+	select {
+	case <-open:
+	case err := <-errc:
+		t.Fatalf("watch keys: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch keys: timed out opening the watch")
+	}
+	return events, errc
+}
+
+func receiveEvents(t *testing.T, events <-chan *types.Event, n int) []*types.Event {
+	var got []*types.Event
+	for len(got) < n {
+		select {
+		case event := <-events:
+			got = append(got, event)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d events want %d", len(got), n)
+		}
+	}
+	return got
+}
+
+func eventNames(events []*types.Event) []string {
+	names := make([]string, len(events))
+	for i, event := range events {
+		names[i] = string(event.Type) + " " + event.Key.ID
+	}
+	return names
+}
+
+func seedKeys(n int) []*types.Key {
+	keys := make([]*types.Key, n)
+	for i := range keys {
+		keys[i] = &types.Key{ID: fmt.Sprintf("key-%d", i), Status: types.StatusAvailable}
+	}
+	return keys
+}
+
+func insertKeys(t *testing.T, s httpserver.Storage, keys []*types.Key) {
+	for _, key := range keys {
+		if err := s.InsertKey(context.Background(), key); err != nil {
+			t.Fatalf("insert key: %v", err)
+		}
+	}
+}
+
+// keyIDs returns the IDs of the keys.
+func keyIDs(keys []*types.Key) []string {
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		ids[i] = key.ID
+	}
+	return ids
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/evgeny08/collection-key/types"
+)
+
+// CreateTenant creates a tenant in storage.
+// ErrTenantDuplicate is returned if a tenant with the same ID already exists.
+func (s *Storage) CreateTenant(ctx context.Context, tenant *types.Tenant) error {
+	_, err := s.session.Collection(collectionTenant).InsertOne(ctx, tenant)
+	if isDuplicateKeyErr(err) {
+		return ErrTenantDuplicate
+	}
+	return err
+}
+
+// GetTenant returns a tenant with the given id.
+func (s *Storage) GetTenant(ctx context.Context, id string) (*types.Tenant, error) {
+	var tenant *types.Tenant
+	err := s.session.Collection(collectionTenant).FindOne(ctx, bson.M{"id": id}).Decode(&tenant)
+	if err != nil {
+		return nil, tenantNotFoundErr(err)
+	}
+	return tenant, nil
+}
+
+// ListTenants returns all tenants ordered by ID.
+func (s *Storage) ListTenants(ctx context.Context) ([]*types.Tenant, error) {
+	opts := options.Find().SetSort(bson.M{"id": 1})
+	cursor, err := s.session.Collection(collectionTenant).Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	tenants := []*types.Tenant{}
+	for cursor.Next(ctx) {
+		var tenant *types.Tenant
+		if err := cursor.Decode(&tenant); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, tenant)
+	}
+	return tenants, cursor.Err()
+}
+
+// CreateAPIKey stores a tenant API key.
+func (s *Storage) CreateAPIKey(ctx context.Context, key *types.APIKey) error {
+	_, err := s.session.Collection(collectionAPIKey).InsertOne(ctx, key)
+	if isDuplicateKeyErr(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+// GetAPIKey returns an API key with the given secret hash.
+func (s *Storage) GetAPIKey(ctx context.Context, hash string) (*types.APIKey, error) {
+	var key *types.APIKey
+	err := s.session.Collection(collectionAPIKey).FindOne(ctx, bson.M{"hash": hash}).Decode(&key)
+	if err != nil {
+		return nil, apiKeyNotFoundErr(err)
+	}
+	return key, nil
+}
+
+// RevokeAPIKey marks an API key of the tenant with the given id as revoked.
+func (s *Storage) RevokeAPIKey(ctx context.Context, tenant, id string) error {
+	filter := bson.M{"tenant_id": tenant, "id": id, "revoked_at": nil}
+	res, err := s.session.Collection(collectionAPIKey).UpdateOne(ctx, filter, bson.M{"$set": bson.M{"revoked_at": time.Now()}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
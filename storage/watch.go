@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"context"
+	"encoding/hex"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/evgeny08/collection-key/types"
+)
+
+// MongoDB error codes of the change streams failing to resume.
+const (
+	invalidResumeTokenCode      = 260
+	changeStreamFatalErrorCode  = 280
+	changeStreamHistoryLostCode = 286
+)
+
+// auditChange is a change stream event of the audit log.
+type auditChange struct {
+	FullDocument *types.AuditRecord `bson:"fullDocument"`
+}
+
+// WatchKeys calls fn with the events of the context tenant keys as they
+// change, starting after the event with the given ID or with the next change
+// if it is empty. The events are read from the audit log, so the key of an
+// event is the key right after the change. The event IDs are the change
+// stream resume tokens. fn is called with nil once the stream is open and
+// after every idle period without changes. WatchKeys returns when fn or the
+// change stream fails or the context is done.
+// ErrInvalidResumeToken is returned if the event ID is malformed and
+// ErrResumeTokenExpired if the events after it are no longer in the oplog.
+func (s *Storage) WatchKeys(ctx context.Context, resumeAfter string, idle time.Duration, fn func(*types.Event) error) error {
+	match := bson.M{
+		"operationType":          "insert",
+		"fullDocument.tenant_id": tenantFilter(ctx),
+		"fullDocument.action":    bson.M{"$ne": types.AuditVerified},
+		"fullDocument.after":     bson.M{"$exists": true},
+	}
+	pipeline := mongo.Pipeline{primitive.D{{Key: "$match", Value: match}}}
+	opts := options.ChangeStream().SetMaxAwaitTime(idle)
+	if resumeAfter != "" {
+		if _, err := hex.DecodeString(resumeAfter); err != nil {
+			return ErrInvalidResumeToken
+		}
+		opts.SetResumeAfter(bson.M{"_data": resumeAfter})
+	}
+
+	stream, err := s.session.Collection(collectionAudit).Watch(ctx, pipeline, opts)
+	if err != nil {
+		return resumeErr(err)
+	}
+	defer stream.Close(context.Background())
+	if err := fn(nil); err != nil {
+		return err
+	}
+
+	for {
+		if !stream.TryNext(ctx) {
+			if err := stream.Err(); err != nil {
+				return resumeErr(err)
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(nil); err != nil {
+				return err
+			}
+			continue
+		}
+		var change auditChange
+		if err := stream.Decode(&change); err != nil {
+			return err
+		}
+		if change.FullDocument == nil {
+			continue
+		}
+		event := change.FullDocument.Event(stream.ResumeToken().Lookup("_data").StringValue())
+		if event == nil {
+			continue
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+}
+
+// resumeErr maps the errors of the change streams failing to resume.
+func resumeErr(err error) error {
+	if e, ok := err.(mongo.CommandError); ok {
+		switch e.Code {
+		case invalidResumeTokenCode:
+			return ErrInvalidResumeToken
+		case changeStreamFatalErrorCode, changeStreamHistoryLostCode:
+			return ErrResumeTokenExpired
+		}
+	}
+	return err
+}
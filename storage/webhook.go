@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/evgeny08/collection-key/types"
+)
+
+// CreateWebhook creates a webhook of the context tenant in storage.
+func (s *Storage) CreateWebhook(ctx context.Context, webhook *types.Webhook) error {
+	webhook.TenantID = types.TenantFromContext(ctx)
+	_, err := s.session.Collection(collectionWebhook).InsertOne(ctx, webhook)
+	if isDuplicateKeyErr(err) {
+		return ErrWebhookDuplicate
+	}
+	return err
+}
+
+// GetWebhook returns a webhook of the context tenant with the given id.
+func (s *Storage) GetWebhook(ctx context.Context, id string) (*types.Webhook, error) {
+	var webhook *types.Webhook
+	filter := bson.M{"id": id, "tenant_id": tenantFilter(ctx)}
+	err := s.session.Collection(collectionWebhook).FindOne(ctx, filter).Decode(&webhook)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrWebhookNotFound
+		}
+		return nil, err
+	}
+	return webhook, nil
+}
+
+// ListWebhooks returns all webhooks of the context tenant ordered by ID.
+func (s *Storage) ListWebhooks(ctx context.Context) ([]*types.Webhook, error) {
+	opts := options.Find().SetSort(bson.M{"id": 1})
+	cursor, err := s.session.Collection(collectionWebhook).Find(ctx, bson.M{"tenant_id": tenantFilter(ctx)}, opts)
+	if err != nil {
+		return nil, err
+	}
+	webhooks := []*types.Webhook{}
+	if err := cursor.All(ctx, &webhooks); err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+// DeleteWebhook deletes a webhook of the context tenant with the given id.
+// Its pending deliveries fail once they are attempted.
+func (s *Storage) DeleteWebhook(ctx context.Context, id string) error {
+	filter := bson.M{"id": id, "tenant_id": tenantFilter(ctx)}
+	res, err := s.session.Collection(collectionWebhook).DeleteOne(ctx, filter)
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// EnqueueDeliveries adds the deliveries of the context tenant to the delivery
+// queue. The deliveries with the IDs already queued are skipped, so an event
+// relayed again is not delivered twice.
+func (s *Storage) EnqueueDeliveries(ctx context.Context, deliveries []*types.Delivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	tenant := types.TenantFromContext(ctx)
+	docs := make([]interface{}, len(deliveries))
+	for i, d := range deliveries {
+		d.TenantID = tenant
+		docs[i] = d
+	}
+	opts := options.InsertMany().SetOrdered(false)
+	_, err := s.session.Collection(collectionDelivery).InsertMany(ctx, docs, opts)
+	if err != nil && isOnlyDuplicateKeyErr(err) {
+		return nil
+	}
+	return err
+}
+
+// ClaimDelivery returns the pending delivery of any tenant due the longest
+// at the given time and postpones its next attempt by the lease, so it is
+// not claimed again while being delivered. The deliveries to the webhooks
+// with the skipped IDs are not claimed. ErrDeliveryNotFound is returned
+// if no delivery is due.
+func (s *Storage) ClaimDelivery(ctx context.Context, now time.Time, lease time.Duration, skip []string) (*types.Delivery, error) {
+	filter := bson.M{"status": types.DeliveryPending, "next_attempt_at": bson.M{"$lte": now}}
+	if len(skip) > 0 {
+		filter["webhook_id"] = bson.M{"$nin": skip}
+	}
+	update := bson.M{"$set": bson.M{"next_attempt_at": now.Add(lease)}}
+	opts := options.FindOneAndUpdate().SetSort(bson.M{"next_attempt_at": 1})
+	var d *types.Delivery
+	err := s.session.Collection(collectionDelivery).FindOneAndUpdate(ctx, filter, update, opts).Decode(&d)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrDeliveryNotFound
+		}
+		return nil, err
+	}
+	return d, nil
+}
+
+// UpdateDelivery stores the outcome of a delivery attempt of any tenant.
+func (s *Storage) UpdateDelivery(ctx context.Context, d *types.Delivery) error {
+	update := bson.M{"$set": bson.M{
+		"status":          d.Status,
+		"attempts":        d.Attempts,
+		"next_attempt_at": d.NextAttemptAt,
+		"last_error":      d.LastError,
+		"delivered_at":    d.DeliveredAt,
+	}}
+	res, err := s.session.Collection(collectionDelivery).UpdateOne(ctx, bson.M{"id": d.ID}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrDeliveryNotFound
+	}
+	return nil
+}
+
+// ListDeliveries returns up to limit deliveries of the context tenant
+// with the given status, the most recent first.
+func (s *Storage) ListDeliveries(ctx context.Context, status types.DeliveryStatus, limit int) ([]*types.Delivery, error) {
+	filter := bson.M{"tenant_id": tenantFilter(ctx), "status": status}
+	opts := options.Find().SetSort(bson.M{"created_at": -1}).SetLimit(int64(limit))
+	cursor, err := s.session.Collection(collectionDelivery).Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	deliveries := []*types.Delivery{}
+	if err := cursor.All(ctx, &deliveries); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// RetryDelivery moves a dead delivery of the context tenant with the given
+// id back to the queue with a fresh set of attempts due at the given time.
+// ErrDeliveryNotDead is returned if the delivery is not dead.
+func (s *Storage) RetryDelivery(ctx context.Context, id string, now time.Time) (*types.Delivery, error) {
+	filter := bson.M{"id": id, "tenant_id": tenantFilter(ctx), "status": types.DeliveryDead}
+	update := bson.M{"$set": bson.M{
+		"status":          types.DeliveryPending,
+		"attempts":        0,
+		"next_attempt_at": now,
+	}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var d *types.Delivery
+	err := s.session.Collection(collectionDelivery).FindOneAndUpdate(ctx, filter, update, opts).Decode(&d)
+	if err == nil {
+		return d, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	delete(filter, "status")
+	n, err := s.session.Collection(collectionDelivery).CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, ErrDeliveryNotFound
+	}
+	return nil, ErrDeliveryNotDead
+}
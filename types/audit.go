@@ -0,0 +1,183 @@
+package types
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// AuditAction is a key operation recorded in the audit log.
+type AuditAction string
+
+// Audit actions.
+const (
+	AuditCreated  AuditAction = "created"
+	AuditIssued   AuditAction = "issued"
+	AuditRedeemed AuditAction = "redeemed"
+	AuditCanceled AuditAction = "canceled"
+	AuditExpired  AuditAction = "expired"
+	AuditRevoked  AuditAction = "revoked"
+	AuditVerified AuditAction = "verified"
+)
+
+// TransitionAction returns the audit action of moving a key to the status.
+// The actions of the transitions are named after the statuses.
+func TransitionAction(to KeyStatus) AuditAction {
+	if to == StatusAvailable {
+		return AuditCreated
+	}
+	return AuditAction(to)
+}
+
+// Audit actors of the operations performed without a request.
+const (
+	// ActorSystem performs the background operations,
+	// such as the expiry sweep and the pool replenishment.
+	ActorSystem = "system"
+	// ActorAnonymous performs the requests without credentials.
+	ActorAnonymous = "anonymous"
+)
+
+// AuditRecord is an append-only audit log entry of a key operation.
+// Before is the key state before the operation and After the state after
+// it. Before is nil for the created keys and the operations not changing
+// the key, such as verification.
+//
+// The records of every tenant pool form a chain: Seq numbers the records
+// from one and Hash covers the record and the hash of the previous one,
+// so editing or deleting a record breaks the chain. The records of the
+// verifications do not change the key and are left out of the chains with
+// a zero Seq. Fields added later must
+// be omitted when empty to keep the hashes of the older records.
+type AuditRecord struct {
+	KeyID     string      `json:"key_id"               bson:"key_id"`
+	TenantID  string      `json:"tenant_id,omitempty"  bson:"tenant_id,omitempty"`
+	PoolID    string      `json:"pool_id,omitempty"    bson:"pool_id,omitempty"`
+	Action    AuditAction `json:"action"               bson:"action"`
+	Actor     string      `json:"actor"                bson:"actor"`
+	RequestID string      `json:"request_id,omitempty" bson:"request_id,omitempty"`
+	ClientIP  string      `json:"client_ip,omitempty"  bson:"client_ip,omitempty"`
+	Before    *Key        `json:"before,omitempty"     bson:"before,omitempty"`
+	After     *Key        `json:"after,omitempty"      bson:"after,omitempty"`
+	At        time.Time   `json:"at"                   bson:"at"`
+
+	Seq      int64  `json:"seq"                 bson:"seq"`
+	PrevHash string `json:"prev_hash,omitempty" bson:"prev_hash,omitempty"`
+	Hash     string `json:"hash,omitempty"      bson:"hash,omitempty"`
+}
+
+// Link appends the record to a chain after the record
+// with the given sequence number and hash.
+func (r *AuditRecord) Link(prevSeq int64, prevHash string) {
+	r.Seq = prevSeq + 1
+	r.PrevHash = prevHash
+	r.Hash = r.ComputeHash()
+}
+
+// ComputeHash returns the hex-encoded SHA-256 hash of the record
+// without its Hash. The times are hashed in UTC at millisecond
+// precision, so the hash does not change when the record is stored.
+func (r *AuditRecord) ComputeHash() string {
+	c := *r
+	c.Hash = ""
+	c.At = canonicalTime(r.At)
+	c.Before = canonicalKey(r.Before)
+	c.After = canonicalKey(r.After)
+	b, _ := json.Marshal(&c)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// canonicalKey returns a copy of the key with the canonical times
+// and without the fields that are not stored.
+func canonicalKey(key *Key) *Key {
+	if key == nil {
+		return nil
+	}
+	k := *key
+	k.Validity = ""
+	for _, t := range []**time.Time{
+		&k.NotBefore, &k.ExpiresAt, &k.CreatedAt, &k.IssuedAt,
+		&k.RedeemedAt, &k.CanceledAt, &k.ExpiredAt, &k.RevokedAt,
+	} {
+		if *t != nil {
+			c := canonicalTime(**t)
+			*t = &c
+		}
+	}
+	return &k
+}
+
+func canonicalTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Millisecond)
+}
+
+// AuditChainBreak describes the first broken link of an audit chain.
+type AuditChainBreak struct {
+	TenantID string `json:"tenant_id,omitempty"`
+	PoolID   string `json:"pool_id,omitempty"`
+	// Seq is the sequence number of the first record
+	// which does not match the chain.
+	Seq    int64  `json:"seq"`
+	Reason string `json:"reason"`
+}
+
+// AuditVerification is the result of an audit chain verification.
+// Break is nil if all the chains are intact.
+type AuditVerification struct {
+	Chains  int              `json:"chains"`
+	Records int64            `json:"records"`
+	Break   *AuditChainBreak `json:"break,omitempty"`
+}
+
+// NewAuditRecord returns a record of the key operation performed with
+// the given context. The actor is the context principal, or ActorSystem
+// if there is none. The tenant and pool are those of the key.
+func NewAuditRecord(ctx context.Context, action AuditAction, before, after *Key, at time.Time) *AuditRecord {
+	rec := &AuditRecord{
+		Action: action,
+		Actor:  ActorSystem,
+		Before: before,
+		After:  after,
+		At:     at,
+	}
+	key := after
+	if key == nil {
+		key = before
+	}
+	rec.KeyID = key.ID
+	rec.TenantID = key.TenantID
+	rec.PoolID = key.PoolID
+	if p := PrincipalFromContext(ctx); p != nil {
+		rec.Actor = p.Subject
+		if rec.Actor == "" {
+			rec.Actor = ActorAnonymous
+		}
+	}
+	if req := RequestFromContext(ctx); req != nil {
+		rec.RequestID = req.ID
+		rec.ClientIP = req.ClientIP
+	}
+	return rec
+}
+
+// RequestInfo identifies the API request performing the operations.
+type RequestInfo struct {
+	ID       string
+	ClientIP string
+}
+
+type requestKey struct{}
+
+// WithRequest returns a copy of the context carrying the request info.
+func WithRequest(ctx context.Context, req *RequestInfo) context.Context {
+	return context.WithValue(ctx, requestKey{}, req)
+}
+
+// RequestFromContext returns the request info carried by the context or nil.
+func RequestFromContext(ctx context.Context) *RequestInfo {
+	req, _ := ctx.Value(requestKey{}).(*RequestInfo)
+	return req
+}
@@ -0,0 +1,72 @@
+package types
+
+import "time"
+
+// EventType is a key lifecycle event published to the event sinks.
+type EventType string
+
+// Key lifecycle events.
+const (
+	EventKeyCreated  EventType = "key.created"
+	EventKeyIssued   EventType = "key.issued"
+	EventKeyCanceled EventType = "key.canceled"
+	EventKeyRedeemed EventType = "key.redeemed"
+	EventKeyExpired  EventType = "key.expired"
+	EventKeyRevoked  EventType = "key.revoked"
+)
+
+// EventTypes returns all event types.
+func EventTypes() []EventType {
+	return []EventType{
+		EventKeyCreated,
+		EventKeyIssued,
+		EventKeyCanceled,
+		EventKeyRedeemed,
+		EventKeyExpired,
+		EventKeyRevoked,
+	}
+}
+
+// ValidEventType checks if the event type is known.
+func ValidEventType(t EventType) bool {
+	for _, e := range EventTypes() {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Event is a key lifecycle event. Key is the key state after the change.
+type Event struct {
+	ID       string    `json:"id"                  bson:"id"`
+	Type     EventType `json:"type"                bson:"type"`
+	TenantID string    `json:"tenant_id,omitempty" bson:"tenant_id,omitempty"`
+	Key      *Key      `json:"key"                 bson:"key"`
+	At       time.Time `json:"at"                  bson:"at"`
+}
+
+// Event returns the event of the key change recorded by the audit record
+// with the given event ID, or nil if the operation does not change the key.
+func (r *AuditRecord) Event(id string) *Event {
+	if r.Action == AuditVerified || r.After == nil {
+		return nil
+	}
+	return &Event{
+		ID:       id,
+		Type:     EventType("key." + r.Action),
+		TenantID: r.TenantID,
+		Key:      r.After,
+		At:       r.At,
+	}
+}
+
+// OutboxEntry is a key event waiting in the outbox to be relayed to the
+// event sinks. It is written together with the key change, so the event
+// is published even if the process dies right after the change.
+type OutboxEntry struct {
+	Event         *Event    `json:"event"                bson:"event"`
+	Attempts      int       `json:"attempts"             bson:"attempts"`
+	NextAttemptAt time.Time `json:"next_attempt_at"      bson:"next_attempt_at"`
+	LastError     string    `json:"last_error,omitempty" bson:"last_error,omitempty"`
+}
@@ -0,0 +1,23 @@
+package types
+
+import "time"
+
+// IdempotencyRecord is a stored response of a request carrying an
+// idempotency key. A record is created before the request is processed
+// and completed with the response, so retries of the request get the
+// same response instead of being processed again.
+type IdempotencyRecord struct {
+	Key      string `bson:"key"`
+	TenantID string `bson:"tenant_id,omitempty"`
+	// Fingerprint identifies the request, a key may not be reused
+	// for a different request.
+	Fingerprint string    `bson:"fingerprint"`
+	Completed   bool      `bson:"completed"`
+	StatusCode  int       `bson:"status_code,omitempty"`
+	ContentType string    `bson:"content_type,omitempty"`
+	Body        []byte    `bson:"body,omitempty"`
+	CreatedAt   time.Time `bson:"created_at"`
+	// ExpiresAt is the time the record is removed after. An uncompleted
+	// record expires shortly, so a request interrupted by a crash may be retried.
+	ExpiresAt time.Time `bson:"expires_at"`
+}
@@ -0,0 +1,42 @@
+package types
+
+import "time"
+
+// ImportKey is a key read from an import file.
+type ImportKey struct {
+	// Row is the number of the file row the key is read from
+	// starting at 1, not counting the CSV header.
+	Row       int               `json:"-"`
+	ID        string            `json:"id"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	NotBefore *time.Time        `json:"not_before,omitempty"`
+	ExpiresAt *time.Time        `json:"expires_at,omitempty"`
+	// Invalid is the reason the row could not be read, if any.
+	Invalid string `json:"-"`
+}
+
+// ImportStatus is the outcome of a key import row.
+type ImportStatus string
+
+// Key import row outcomes.
+const (
+	ImportAccepted ImportStatus = "accepted"
+	ImportRejected ImportStatus = "rejected"
+)
+
+// ImportRow reports the outcome of a key import row.
+type ImportRow struct {
+	Row    int          `json:"row"`
+	ID     string       `json:"id,omitempty"`
+	Status ImportStatus `json:"status"`
+	Reason string       `json:"reason,omitempty"`
+}
+
+// ImportReport reports the outcome of a key import.
+type ImportReport struct {
+	// BatchID is assigned to the imported keys.
+	BatchID  string       `json:"batch_id"`
+	Accepted int          `json:"accepted"`
+	Rejected int          `json:"rejected"`
+	Rows     []*ImportRow `json:"rows"`
+}
@@ -0,0 +1,176 @@
+package types
+
+import (
+	"strings"
+	"time"
+)
+
+// KeySort is a key listing order. The keys with equal sort
+// field values are ordered by ID, so the order is stable.
+type KeySort string
+
+// Key listing orders. The "-" prefix is the descending order.
+const (
+	SortByID          KeySort = "id"
+	SortByIDDesc      KeySort = "-id"
+	SortByCreated     KeySort = "created_at"
+	SortByCreatedDesc KeySort = "-created_at"
+	SortByIssued      KeySort = "issued_at"
+	SortByIssuedDesc  KeySort = "-issued_at"
+)
+
+// DefaultKeySort is the key listing order used if none is given.
+const DefaultKeySort = SortByID
+
+// ValidKeySort reports whether the sort order is known.
+func ValidKeySort(sort KeySort) bool {
+	switch sort {
+	case SortByID, SortByIDDesc, SortByCreated, SortByCreatedDesc, SortByIssued, SortByIssuedDesc:
+		return true
+	}
+	return false
+}
+
+// Field returns the key field the keys are sorted by.
+func (s KeySort) Field() string {
+	if s.Descending() {
+		return string(s[1:])
+	}
+	return string(s)
+}
+
+// Descending reports whether the keys are sorted in the descending order.
+func (s KeySort) Descending() bool {
+	return strings.HasPrefix(string(s), "-")
+}
+
+// KeyFilter selects keys by their fields. Zero fields match every key.
+// Time ranges include the start and exclude the end.
+type KeyFilter struct {
+	Statuses []KeyStatus `json:"statuses,omitempty"`
+	// PoolID selects the keys of the pool. An empty pool selects
+	// the keys out of any pool and nil the keys of all pools.
+	PoolID        *string    `json:"pool_id,omitempty"`
+	Recipient     string     `json:"recipient,omitempty"`
+	IDPrefix      string     `json:"id_prefix,omitempty"`
+	CreatedSince  *time.Time `json:"created_since,omitempty"`
+	CreatedBefore *time.Time `json:"created_before,omitempty"`
+	IssuedSince   *time.Time `json:"issued_since,omitempty"`
+	IssuedBefore  *time.Time `json:"issued_before,omitempty"`
+}
+
+// Match reports whether the key matches the filter.
+func (f *KeyFilter) Match(key *Key) bool {
+	if len(f.Statuses) > 0 {
+		found := false
+		for _, s := range f.Statuses {
+			if key.Status == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.PoolID != nil && key.PoolID != *f.PoolID {
+		return false
+	}
+	if f.Recipient != "" && key.Recipient != f.Recipient {
+		return false
+	}
+	if !strings.HasPrefix(key.ID, f.IDPrefix) {
+		return false
+	}
+	return inRange(key.CreatedAt, f.CreatedSince, f.CreatedBefore) &&
+		inRange(key.IssuedAt, f.IssuedSince, f.IssuedBefore)
+}
+
+// inRange reports whether the time is in the optional range.
+// A nil time is out of any range.
+func inRange(t, since, before *time.Time) bool {
+	if since == nil && before == nil {
+		return true
+	}
+	if t == nil {
+		return false
+	}
+	return (since == nil || !t.Before(*since)) && (before == nil || t.Before(*before))
+}
+
+// KeyListParams are the key listing parameters.
+type KeyListParams struct {
+	KeyFilter
+	Sort  KeySort `json:"sort,omitempty"`
+	Limit int     `json:"limit,omitempty"`
+	// Cursor is the NextCursor of the previous page.
+	// It must be used with the same filter and sort order.
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// KeyPage is a page of a key listing.
+type KeyPage struct {
+	Keys []*Key `json:"keys"`
+	// NextCursor selects the next page. It is empty on the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// FileFormat is a key export and import file format.
+type FileFormat string
+
+// Key file formats.
+const (
+	FormatCSV    FileFormat = "csv"
+	FormatNDJSON FileFormat = "ndjson"
+)
+
+// KeyExportParams are the key export parameters.
+type KeyExportParams struct {
+	KeyFilter
+	Sort   KeySort    `json:"sort,omitempty"`
+	Format FileFormat `json:"format,omitempty"`
+}
+
+// TimeOf returns the key time the keys are sorted by, or nil for the ID order.
+func (s KeySort) TimeOf(key *Key) *time.Time {
+	switch s.Field() {
+	case "created_at":
+		return key.CreatedAt
+	case "issued_at":
+		return key.IssuedAt
+	}
+	return nil
+}
+
+// Less reports whether key a goes before key b in the order.
+// Keys without the sort time go first in the ascending order.
+func (s KeySort) Less(a, b *Key) bool {
+	return s.less(s.TimeOf(a), a.ID, s.TimeOf(b), b.ID)
+}
+
+// After reports whether the key goes after the position
+// given by the sort time and the ID of another key.
+func (s KeySort) After(key *Key, t *time.Time, id string) bool {
+	return s.less(t, id, s.TimeOf(key), key.ID)
+}
+
+func (s KeySort) less(at *time.Time, aID string, bt *time.Time, bID string) bool {
+	c := 0
+	switch {
+	case at == nil && bt != nil:
+		c = -1
+	case at != nil && bt == nil:
+		c = 1
+	case at != nil && bt != nil && !at.Equal(*bt):
+		c = 1
+		if at.Before(*bt) {
+			c = -1
+		}
+	default:
+		c = strings.Compare(aID, bID)
+	}
+	if s.Descending() {
+		return c > 0
+	}
+	return c < 0
+}
@@ -0,0 +1,56 @@
+package types
+
+import "context"
+
+// Role is a set of API operations a caller is allowed to perform.
+type Role string
+
+// Roles.
+const (
+	// RoleAdmin may perform every operation.
+	RoleAdmin Role = "admin"
+	// RoleIssuer may hand out and cancel keys.
+	RoleIssuer Role = "issuer"
+	// RoleVerifier may verify and redeem keys.
+	RoleVerifier Role = "verifier"
+)
+
+// ValidRole reports whether the role is known.
+func ValidRole(role Role) bool {
+	switch role {
+	case RoleAdmin, RoleIssuer, RoleVerifier:
+		return true
+	}
+	return false
+}
+
+// Principal is an authenticated API caller.
+type Principal struct {
+	Subject string `json:"subject"`
+	Tenant  string `json:"tenant,omitempty"`
+	Roles   []Role `json:"roles"`
+}
+
+// HasRole reports whether the principal has the role.
+// Admins have every role.
+func (p *Principal) HasRole(role Role) bool {
+	for _, r := range p.Roles {
+		if r == role || r == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of the context carrying the principal.
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFromContext returns the principal carried by the context or nil.
+func PrincipalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
@@ -0,0 +1,23 @@
+package types
+
+import "time"
+
+// KeyStats are the key inventory statistics.
+type KeyStats struct {
+	// PoolID is the pool of the keys, or nil for all keys.
+	PoolID *string `json:"pool_id,omitempty"`
+	Total  int64   `json:"total"`
+	// Statuses counts the keys by the stored status. Keys past their
+	// expiry time count as expired once they are swept.
+	Statuses map[KeyStatus]int64 `json:"statuses"`
+	Issuance []*IssuanceRate     `json:"issuance"`
+	At       time.Time           `json:"at"`
+}
+
+// IssuanceRate is the number of keys issued in a recent time window.
+type IssuanceRate struct {
+	Window  string    `json:"window"`
+	Since   time.Time `json:"since"`
+	Issued  int64     `json:"issued"`
+	PerHour float64   `json:"per_hour"`
+}
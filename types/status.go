@@ -0,0 +1,92 @@
+package types
+
+import "time"
+
+// KeyStatus is a key lifecycle status.
+type KeyStatus string
+
+// Key statuses.
+const (
+	StatusAvailable KeyStatus = "available"
+	StatusIssued    KeyStatus = "issued"
+	StatusRedeemed  KeyStatus = "redeemed"
+	StatusCanceled  KeyStatus = "canceled"
+	StatusExpired   KeyStatus = "expired"
+	StatusRevoked   KeyStatus = "revoked"
+)
+
+// statuses lists all key statuses in the lifecycle order.
+var statuses = []KeyStatus{StatusAvailable, StatusIssued, StatusRedeemed, StatusExpired, StatusCanceled, StatusRevoked}
+
+// Statuses returns all key statuses.
+func Statuses() []KeyStatus {
+	return append([]KeyStatus(nil), statuses...)
+}
+
+// transitions lists the statuses a key may move to from each status.
+var transitions = map[KeyStatus][]KeyStatus{
+	StatusAvailable: {StatusIssued, StatusExpired, StatusRevoked},
+	StatusIssued:    {StatusRedeemed, StatusCanceled, StatusExpired, StatusRevoked},
+	StatusRedeemed:  {StatusRevoked},
+	StatusExpired:   {StatusRevoked},
+	StatusCanceled:  nil,
+	StatusRevoked:   nil,
+}
+
+// ValidStatus reports whether the status is known.
+func ValidStatus(status KeyStatus) bool {
+	_, ok := transitions[status]
+	return ok
+}
+
+// CanTransition reports whether a key may move from one status to another.
+func CanTransition(from, to KeyStatus) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// TransitionSources returns the statuses a key may move to the given status from.
+func TransitionSources(to KeyStatus) []KeyStatus {
+	var sources []KeyStatus
+	for _, from := range statuses {
+		if CanTransition(from, to) {
+			sources = append(sources, from)
+		}
+	}
+	return sources
+}
+
+// EffectiveStatus returns the key status at the given time. An available
+// or issued key past its expiry time is expired even if it is not marked yet.
+func (k *Key) EffectiveStatus(now time.Time) KeyStatus {
+	if (k.Status == StatusAvailable || k.Status == StatusIssued) &&
+		k.ExpiresAt != nil && !now.Before(*k.ExpiresAt) {
+		return StatusExpired
+	}
+	return k.Status
+}
+
+// SetStatus moves the key to the given status and records the transition time.
+// It does not check whether the transition is allowed.
+func (k *Key) SetStatus(to KeyStatus, now time.Time) {
+	k.Status = to
+	t := now
+	switch to {
+	case StatusAvailable:
+		k.CreatedAt = &t
+	case StatusIssued:
+		k.IssuedAt = &t
+	case StatusRedeemed:
+		k.RedeemedAt = &t
+	case StatusCanceled:
+		k.CanceledAt = &t
+	case StatusExpired:
+		k.ExpiredAt = &t
+	case StatusRevoked:
+		k.RevokedAt = &t
+	}
+}
@@ -0,0 +1,40 @@
+package types
+
+import (
+	"context"
+	"time"
+)
+
+// Tenant is a customer of the platform owning a separate set of keys and pools.
+type Tenant struct {
+	ID        string     `json:"id"   bson:"id"`
+	Name      string     `json:"name" bson:"name"`
+	CreatedAt *time.Time `json:"created_at,omitempty" bson:"created_at,omitempty"`
+}
+
+// APIKey is a tenant credential. Only the SHA-256 hash of the
+// secret is stored, the secret itself is returned once on creation.
+type APIKey struct {
+	ID        string     `json:"id"        bson:"id"`
+	TenantID  string     `json:"tenant_id" bson:"tenant_id"`
+	Hash      string     `json:"-"         bson:"hash"`
+	Secret    string     `json:"key,omitempty"        bson:"-"`
+	Roles     []Role     `json:"roles,omitempty"      bson:"roles,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty" bson:"created_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty" bson:"revoked_at,omitempty"`
+}
+
+type tenantKey struct{}
+
+// WithTenant returns a copy of the context carrying the tenant ID.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant ID carried by the context.
+// An empty ID is the default tenant owning the keys created
+// before tenants were introduced.
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
@@ -1,8 +1,181 @@
 package types
 
+import (
+	"strings"
+	"time"
+)
+
 // Key describes the keys
 type Key struct {
-	ID       string `json:"id"    bson:"id"`
-	Issued   bool   `json:"issued"   bson:"issued"`
-	Canceled bool   `json:"canceled" bson:"canceled"`
+	ID        string     `json:"id"     bson:"id"`
+	Status    KeyStatus  `json:"status" bson:"status"`
+	TenantID  string     `json:"tenant_id,omitempty"  bson:"tenant_id,omitempty"`
+	PoolID    string     `json:"pool_id,omitempty"    bson:"pool_id,omitempty"`
+	BatchID   string     `json:"batch_id,omitempty"   bson:"batch_id,omitempty"`
+	NotBefore *time.Time `json:"not_before,omitempty" bson:"not_before,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+
+	// Status transition times.
+	CreatedAt  *time.Time `json:"created_at,omitempty"  bson:"created_at,omitempty"`
+	IssuedAt   *time.Time `json:"issued_at,omitempty"   bson:"issued_at,omitempty"`
+	RedeemedAt *time.Time `json:"redeemed_at,omitempty" bson:"redeemed_at,omitempty"`
+	CanceledAt *time.Time `json:"canceled_at,omitempty" bson:"canceled_at,omitempty"`
+	ExpiredAt  *time.Time `json:"expired_at,omitempty"  bson:"expired_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"  bson:"revoked_at,omitempty"`
+
+	RedeemedBy string `json:"redeemed_by,omitempty" bson:"redeemed_by,omitempty"`
+
+	// Recipient and Metadata describe who the key is issued to.
+	Recipient string            `json:"recipient,omitempty" bson:"recipient,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"  bson:"metadata,omitempty"`
+
+	// Validity is the effective key status reported on verification.
+	Validity Validity `json:"validity,omitempty" bson:"-"`
+}
+
+// MaxKeyIDLen is the maximum length of a key ID in bytes.
+const MaxKeyIDLen = 128
+
+// KeyIDChars are the characters allowed in key IDs. These are the URL
+// unreserved characters, so a key ID needs no escaping in request paths.
+const KeyIDChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-._~"
+
+// ValidKeyIDChars reports whether s consists of the key ID characters only.
+func ValidKeyIDChars(s string) bool {
+	for _, r := range s {
+		if !strings.ContainsRune(KeyIDChars, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Validity is the effective key status.
+type Validity string
+
+// Key validity values.
+const (
+	ValidityValid       Validity = "valid"
+	ValidityExpired     Validity = "expired"
+	ValidityNotYetValid Validity = "not_yet_valid"
+	ValidityCanceled    Validity = "canceled"
+	ValidityRedeemed    Validity = "redeemed"
+	ValidityRevoked     Validity = "revoked"
+)
+
+// ValidityAt returns the effective key status at the given time.
+func (k *Key) ValidityAt(now time.Time) Validity {
+	switch k.EffectiveStatus(now) {
+	case StatusCanceled:
+		return ValidityCanceled
+	case StatusRedeemed:
+		return ValidityRedeemed
+	case StatusRevoked:
+		return ValidityRevoked
+	case StatusExpired:
+		return ValidityExpired
+	}
+	if k.NotBefore != nil && now.Before(*k.NotBefore) {
+		return ValidityNotYetValid
+	}
+	return ValidityValid
+}
+
+// KeyValidity is an optional key validity window.
+type KeyValidity struct {
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Issuance describes who a key is issued to.
+type Issuance struct {
+	// Recipient is a customer or order reference the key is looked up by.
+	Recipient string            `json:"recipient,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// KeyGenParams overrides the key generator settings.
+// Zero values keep the server defaults.
+type KeyGenParams struct {
+	Length     int    `json:"length,omitempty"      bson:"length,omitempty"`
+	Alphabet   string `json:"alphabet,omitempty"    bson:"alphabet,omitempty"`
+	GroupSize  int    `json:"group_size,omitempty"  bson:"group_size,omitempty"`
+	Separator  string `json:"separator,omitempty"   bson:"separator,omitempty"`
+	CheckDigit *bool  `json:"check_digit,omitempty" bson:"check_digit,omitempty"`
+}
+
+// Merge returns the parameters with non-zero fields of the
+// override replacing the fields of p. Both may be nil.
+func (p *KeyGenParams) Merge(override *KeyGenParams) *KeyGenParams {
+	if p == nil {
+		return override
+	}
+	merged := *p
+	if override == nil {
+		return &merged
+	}
+	if override.Length != 0 {
+		merged.Length = override.Length
+	}
+	if override.Alphabet != "" {
+		merged.Alphabet = override.Alphabet
+	}
+	if override.GroupSize != 0 {
+		merged.GroupSize = override.GroupSize
+	}
+	if override.Separator != "" {
+		merged.Separator = override.Separator
+	}
+	if override.CheckDigit != nil {
+		merged.CheckDigit = override.CheckDigit
+	}
+	return &merged
+}
+
+// Pool is a campaign owning a separate stock of keys.
+type Pool struct {
+	ID        string        `json:"id"   bson:"id"`
+	TenantID  string        `json:"tenant_id,omitempty" bson:"tenant_id,omitempty"`
+	Name      string        `json:"name" bson:"name"`
+	Generator *KeyGenParams `json:"generator,omitempty" bson:"generator,omitempty"`
+
+	// MaxKeys and MaxIssued limit the number of created
+	// and issued pool keys. Zero means no limit.
+	MaxKeys     int `json:"max_keys,omitempty"   bson:"max_keys"`
+	MaxIssued   int `json:"max_issued,omitempty" bson:"max_issued"`
+	KeyCount    int `json:"key_count"    bson:"key_count"`
+	IssuedCount int `json:"issued_count" bson:"issued_count"`
+
+	// Replenish sets the low-water mark of the available pool keys.
+	Replenish *ReplenishPolicy `json:"replenish,omitempty" bson:"replenish,omitempty"`
+
+	CreatedAt *time.Time `json:"created_at,omitempty" bson:"created_at,omitempty"`
+}
+
+// ReplenishPolicy raises a low stock alert when the number of available
+// keys drops below the low-water mark, and optionally creates a batch of
+// keys to bring it back up to the high-water mark.
+type ReplenishPolicy struct {
+	LowWater  int  `json:"low_water"            bson:"low_water"`
+	HighWater int  `json:"high_water,omitempty" bson:"high_water,omitempty"`
+	Auto      bool `json:"auto,omitempty"       bson:"auto,omitempty"`
+}
+
+// StockAlert reports that the available keys of a pool dropped
+// below the low-water mark. An empty pool is the keys out of any pool.
+type StockAlert struct {
+	TenantID  string    `json:"tenant_id,omitempty"`
+	PoolID    string    `json:"pool_id,omitempty"`
+	Available int64     `json:"available"`
+	LowWater  int       `json:"low_water"`
+	At        time.Time `json:"at"`
+}
+
+// BatchProgress describes the progress of a batch key creation.
+type BatchProgress struct {
+	BatchID string `json:"batch_id"`
+	Created int    `json:"created"`
+	Total   int    `json:"total"`
+	Done    bool   `json:"done"`
+	Error   string `json:"error,omitempty"`
 }
@@ -0,0 +1,139 @@
+package types
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidityAt(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+
+	testCases := []struct {
+		name string
+		key  *Key
+		want Validity
+	}{
+		{name: "no window", key: &Key{Status: StatusIssued}, want: ValidityValid},
+		{name: "inside window", key: &Key{Status: StatusIssued, NotBefore: &past, ExpiresAt: &future}, want: ValidityValid},
+		{name: "expired", key: &Key{Status: StatusIssued, ExpiresAt: &past}, want: ValidityExpired},
+		{name: "marked expired", key: &Key{Status: StatusExpired}, want: ValidityExpired},
+		{name: "not yet valid", key: &Key{Status: StatusAvailable, NotBefore: &future}, want: ValidityNotYetValid},
+		{name: "canceled", key: &Key{Status: StatusCanceled, ExpiresAt: &past}, want: ValidityCanceled},
+		{name: "redeemed", key: &Key{Status: StatusRedeemed, ExpiresAt: &past}, want: ValidityRedeemed},
+		{name: "revoked", key: &Key{Status: StatusRevoked}, want: ValidityRevoked},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.key.ValidityAt(now); got != tc.want {
+				t.Fatalf("got validity %q want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTransitionSources(t *testing.T) {
+	testCases := []struct {
+		to   KeyStatus
+		want []KeyStatus
+	}{
+		{to: StatusIssued, want: []KeyStatus{StatusAvailable}},
+		{to: StatusRedeemed, want: []KeyStatus{StatusIssued}},
+		{to: StatusCanceled, want: []KeyStatus{StatusIssued}},
+		{to: StatusExpired, want: []KeyStatus{StatusAvailable, StatusIssued}},
+		{to: StatusRevoked, want: []KeyStatus{StatusAvailable, StatusIssued, StatusRedeemed, StatusExpired}},
+		{to: StatusAvailable, want: nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(string(tc.to), func(t *testing.T) {
+			got := TransitionSources(tc.to)
+			if len(got) != len(tc.want) {
+				t.Fatalf("got sources %v want %v", got, tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Fatalf("got sources %v want %v", got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestKeyGenParamsMerge(t *testing.T) {
+	yes := true
+	base := &KeyGenParams{Length: 8, Alphabet: "ABC", GroupSize: 4}
+	override := &KeyGenParams{Length: 12, Separator: "_", CheckDigit: &yes}
+
+	got := base.Merge(override)
+	want := KeyGenParams{Length: 12, Alphabet: "ABC", GroupSize: 4, Separator: "_", CheckDigit: &yes}
+	if *got != want {
+		t.Fatalf("got params %#v want %#v", got, want)
+	}
+	if base.Length != 8 {
+		t.Fatal("merge changed the base params")
+	}
+
+	var none *KeyGenParams
+	if got := none.Merge(override); got != override {
+		t.Fatalf("got params %#v want the override", got)
+	}
+	if got := base.Merge(nil); got == base || *got != *base {
+		t.Fatalf("got params %#v want a copy of the base", got)
+	}
+}
+
+func TestAuditRecordHash(t *testing.T) {
+	at := time.Date(2030, 1, 1, 12, 0, 0, 123456789, time.FixedZone("UTC+3", 3*3600))
+	created := at.Add(-time.Hour)
+	rec := &AuditRecord{
+		KeyID:  "key",
+		Action: AuditIssued,
+		Actor:  "shop",
+		Before: &Key{ID: "key", Status: StatusAvailable, CreatedAt: &created},
+		After:  &Key{ID: "key", Status: StatusIssued, CreatedAt: &created, IssuedAt: &at, Validity: ValidityValid},
+		At:     at,
+	}
+	rec.Link(41, "prev")
+	if rec.Seq != 42 || rec.PrevHash != "prev" || rec.Hash == "" {
+		t.Fatalf("got seq %d, previous hash %q and hash %q want 42, prev and a hash", rec.Seq, rec.PrevHash, rec.Hash)
+	}
+
+	// The stored times are in UTC at millisecond precision.
+	stored := *rec
+	storedAt := at.UTC().Truncate(time.Millisecond)
+	storedCreated := created.UTC().Truncate(time.Millisecond)
+	stored.At = storedAt
+	stored.Before = &Key{ID: "key", Status: StatusAvailable, CreatedAt: &storedCreated}
+	stored.After = &Key{ID: "key", Status: StatusIssued, CreatedAt: &storedCreated, IssuedAt: &storedAt}
+	if got := stored.ComputeHash(); got != rec.Hash {
+		t.Fatalf("got stored record hash %q want %q", got, rec.Hash)
+	}
+
+	edited := stored
+	edited.Actor = "admin"
+	if edited.ComputeHash() == rec.Hash {
+		t.Fatal("edited record has the same hash")
+	}
+	relinked := stored
+	relinked.PrevHash = "other"
+	if relinked.ComputeHash() == rec.Hash {
+		t.Fatal("record linked to another one has the same hash")
+	}
+}
+
+func TestAuditRecordEvent(t *testing.T) {
+	for _, to := range []KeyStatus{StatusAvailable, StatusIssued, StatusRedeemed, StatusCanceled, StatusExpired, StatusRevoked} {
+		rec := &AuditRecord{KeyID: "key", TenantID: "t1", Action: TransitionAction(to), After: &Key{ID: "key", Status: to}}
+		event := rec.Event("e1")
+		if event == nil || !ValidEventType(event.Type) || event.ID != "e1" || event.TenantID != "t1" || event.Key != rec.After {
+			t.Fatalf("got event %+v of the %s record", event, rec.Action)
+		}
+	}
+	verified := &AuditRecord{KeyID: "key", Action: AuditVerified, After: &Key{ID: "key"}}
+	if event := verified.Event("e1"); event != nil {
+		t.Fatalf("got event %+v of the verified record want none", event)
+	}
+}
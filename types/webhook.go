@@ -0,0 +1,65 @@
+package types
+
+import "time"
+
+// Webhook is a subscription of a tenant to the key lifecycle events.
+// The events are signed with the secret, which is returned on creation
+// only. A webhook without event types receives all events.
+type Webhook struct {
+	ID        string      `json:"id"                   bson:"id"`
+	TenantID  string      `json:"tenant_id,omitempty"  bson:"tenant_id,omitempty"`
+	URL       string      `json:"url"                  bson:"url"`
+	Secret    string      `json:"secret,omitempty"     bson:"secret"`
+	Events    []EventType `json:"events,omitempty"     bson:"events,omitempty"`
+	CreatedAt *time.Time  `json:"created_at,omitempty" bson:"created_at,omitempty"`
+}
+
+// Subscribed reports whether the webhook receives the events of the type.
+func (w *Webhook) Subscribed(t EventType) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+// DeliveryStatus is a status of a webhook event delivery.
+type DeliveryStatus string
+
+// Delivery statuses.
+const (
+	// DeliveryPending deliveries are attempted at NextAttemptAt.
+	DeliveryPending DeliveryStatus = "pending"
+	// DeliveryDelivered deliveries are accepted by the receiver.
+	DeliveryDelivered DeliveryStatus = "delivered"
+	// DeliveryDead deliveries have run out of attempts
+	// and are kept until retried by hand.
+	DeliveryDead DeliveryStatus = "dead"
+)
+
+// ValidDeliveryStatus checks if the delivery status is known.
+func ValidDeliveryStatus(s DeliveryStatus) bool {
+	switch s {
+	case DeliveryPending, DeliveryDelivered, DeliveryDead:
+		return true
+	}
+	return false
+}
+
+// Delivery is an event queued for delivery to a webhook.
+type Delivery struct {
+	ID            string         `json:"id"                     bson:"id"`
+	TenantID      string         `json:"tenant_id,omitempty"    bson:"tenant_id,omitempty"`
+	WebhookID     string         `json:"webhook_id"             bson:"webhook_id"`
+	Event         *Event         `json:"event"                  bson:"event"`
+	Status        DeliveryStatus `json:"status"                 bson:"status"`
+	Attempts      int            `json:"attempts"               bson:"attempts"`
+	NextAttemptAt time.Time      `json:"next_attempt_at"        bson:"next_attempt_at"`
+	LastError     string         `json:"last_error,omitempty"   bson:"last_error,omitempty"`
+	CreatedAt     time.Time      `json:"created_at"             bson:"created_at"`
+	DeliveredAt   *time.Time     `json:"delivered_at,omitempty" bson:"delivered_at,omitempty"`
+}